@@ -58,10 +58,24 @@ type Room struct {
 	LastActive      string
 	Name            string
 	NumParticipants string
-	Owner           string
-	Privacy         string
-	RoomId          string
-	Topic           string
+	// Owner is the jid of the user who owns the room
+	Owner string
+	// Privacy is PrivacyPublic or PrivacyPrivate
+	Privacy string
+	RoomId  string
+	Topic   string
+}
+
+// The privacy settings a Room can have
+const (
+	PrivacyPublic  = "public"
+	PrivacyPrivate = "private"
+)
+
+// IsPrivate reports whether the room is private, open only to the users
+// invited to it
+func (r Room) IsPrivate() bool {
+	return r.Privacy == PrivacyPrivate
 }
 
 // NewClient creates a new Client connection from the user name, password and
@@ -173,28 +187,28 @@ func (c *Client) PrivSay(user, name, body string) {
 	c.connection.MUCSend("chat", user, c.Id+"/"+name, body)
 }
 
+// Disconnect leaves every room the client joined, announcing status as the
+// reason, and closes the connection to HipChat.
+func (c *Client) Disconnect(status string) error {
+	err := c.connection.GoOffline(status)
+	if cerr := c.connection.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 // KeepAlive is meant to run as a goroutine. It sends a single whitespace
 // character to HipChat every 60 seconds. This keeps the connection from
 // idling after 150 seconds.
 func (c *Client) KeepAlive() {
-	for range time.Tick(60 * time.Second) {
-		err := c.connection.KeepAlive()
-		if err != nil {
-			return
-		}
-	}
+	c.connection.KeepAliveEvery(60 * time.Second)
 }
 
 // KeepAliveBy is meant to run as a goroutine. It sends a single whitespace
 // character to HipChat every arbitrary seconds. This keeps the connection from
 // idling after 150 seconds.
 func (c *Client) KeepAliveBy(sec time.Duration) {
-	for range time.Tick(sec * time.Second) {
-		err := c.connection.KeepAlive()
-		if err != nil {
-			return
-		}
-	}
+	c.connection.KeepAliveEvery(sec * time.Second)
 }
 
 // RequestRooms will send an outgoing request to get
@@ -211,6 +225,9 @@ func (c *Client) RequestUsers() {
 
 func (c *Client) authenticate() error {
 	c.connection.Stream(c.Id, c.host)
+	if done, err := c.negotiate(); done {
+		return err
+	}
 	for {
 		element, err := c.connection.Next()
 		if err != nil {
@@ -218,20 +235,12 @@ func (c *Client) authenticate() error {
 		}
 
 		switch element.Name.Local + element.Name.Space {
-		case "stream" + xmpp.NsStream:
-			features := c.connection.Features()
-			if features.StartTLS != nil {
-				c.connection.StartTLS()
-			} else {
-				for _, m := range features.Mechanisms {
-					if m == "PLAIN" {
-						c.connection.Auth(c.Username, c.Password, c.Resource)
-					}
-				}
-			}
 		case "proceed" + xmpp.NsTLS:
 			c.connection.UseTLS(c.host)
 			c.connection.Stream(c.Id, c.host)
+			if done, err := c.negotiate(); done {
+				return err
+			}
 		case "iq" + xmpp.NsJabberClient:
 			for _, attr := range element.Attr {
 				if attr.Name.Local == "type" && attr.Value == "result" {
@@ -246,6 +255,23 @@ func (c *Client) authenticate() error {
 	return errors.New("unexpectedly ended auth loop")
 }
 
+// negotiate reads the features of a freshly opened stream, starting tls or
+// authenticating as they allow. It reports whether authentication was
+// attempted, and so whether authenticate is done.
+func (c *Client) negotiate() (bool, error) {
+	features := c.connection.Features()
+	if features.StartTLS != nil {
+		c.connection.StartTLS()
+		return false, nil
+	}
+	for _, m := range features.Mechanisms {
+		if m == "PLAIN" {
+			return true, c.connection.Auth(c.Username, c.Password, c.Resource)
+		}
+	}
+	return false, nil
+}
+
 func (c *Client) listen() {
 	for {
 		element, err := c.connection.Next()
@@ -0,0 +1,69 @@
+package hipchat
+
+import (
+	"encoding/xml"
+	"io"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestRoomsPrivacyAndOwner(t *testing.T) {
+	conn, server := xmpptest.Pipe()
+	defer server.Close()
+	c := &Client{
+		connection:     conn,
+		receivedRooms:  make(chan []*Room, 1),
+		unhandledEvent: make(chan *xml.StartElement, 1),
+	}
+	go c.listen()
+	go io.WriteString(server, "<iq xmlns='jabber:client' type='result' id='r1'>"+
+		"<query xmlns='"+xmpp.NsDisco+"'>"+
+		"<item jid='1_ops@conf.hipchat.com' name='Ops'><x xmlns='http://hipchat.com/protocol/muc#room'>"+
+		"<id>10</id><topic>Deploys</topic><privacy>private</privacy><owner>1_2@chat.hipchat.com</owner>"+
+		"<num_participants>3</num_participants></x></item>"+
+		"<item jid='1_lobby@conf.hipchat.com' name='Lobby'><x xmlns='http://hipchat.com/protocol/muc#room'>"+
+		"<id>11</id><privacy>public</privacy><owner>1_3@chat.hipchat.com</owner></x></item>"+
+		"</query></iq>")
+
+	rooms := <-c.Rooms()
+	if len(rooms) != 2 {
+		t.Fatalf("got %d rooms", len(rooms))
+	}
+	tests := []struct {
+		room    *Room
+		id      string
+		owner   string
+		privacy string
+		private bool
+	}{
+		{rooms[0], "1_ops@conf.hipchat.com", "1_2@chat.hipchat.com", PrivacyPrivate, true},
+		{rooms[1], "1_lobby@conf.hipchat.com", "1_3@chat.hipchat.com", PrivacyPublic, false},
+	}
+	for _, tt := range tests {
+		r := tt.room
+		if r.Id != tt.id || r.Owner != tt.owner || r.Privacy != tt.privacy || r.IsPrivate() != tt.private {
+			t.Errorf("room %+v, want %s owned by %s and %s", r, tt.id, tt.owner, tt.privacy)
+		}
+	}
+	if rooms[0].Topic != "Deploys" || rooms[0].NumParticipants != "3" || rooms[0].RoomId != "10" {
+		t.Errorf("room details %+v", rooms[0])
+	}
+}
+
+func TestRoomIsPrivate(t *testing.T) {
+	tests := []struct {
+		privacy string
+		want    bool
+	}{
+		{PrivacyPrivate, true},
+		{PrivacyPublic, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := (Room{Privacy: tt.privacy}).IsPrivate(); got != tt.want {
+			t.Errorf("IsPrivate with privacy %q = %v, want %v", tt.privacy, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package xmpp_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestLegacyAuth(t *testing.T) {
+	stanzaError := func(condition string) string {
+		return "<error type='auth'><" + condition + " xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error>"
+	}
+	tests := []struct {
+		name, reply string
+		want        error
+	}{
+		{"accepted", "", nil},
+		{"not authorized", stanzaError("not-authorized"), xmpp.ErrNotAuthorized},
+		{"conflict", stanzaError("conflict"), xmpp.ErrConflict},
+		{"not acceptable", stanzaError("not-acceptable"), xmpp.ErrNotAcceptable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			received := answer(c, server, func(s *xmpp.Stanza) string {
+				if tt.reply == "" {
+					return result(s)
+				}
+				return "<iq type='error' id='" + s.Attr["id"] + "'>" + tt.reply + "</iq>"
+			})
+			if err := c.Auth("bob", "p&ss", "bot"); err != tt.want {
+				t.Errorf("Auth returned %v, want %v", err, tt.want)
+			}
+			sent := received()
+			if len(sent) != 1 || !strings.Contains(string(sent[0].Inner), "<password>p&amp;ss</password>") {
+				t.Errorf("sent %v", sent)
+			}
+		})
+	}
+}
+
+func TestLegacyAuthOtherError(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		return "<iq type='error' id='" + s.Attr["id"] + "'><error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+	})
+	defer received()
+	var se *xmpp.StanzaError
+	if err := c.Auth("bob", "pw", "bot"); !errors.As(err, &se) || se.Condition != "service-unavailable" {
+		t.Errorf("Auth returned %v, want the stanza error", err)
+	}
+}
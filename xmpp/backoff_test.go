@@ -0,0 +1,41 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffJitter(t *testing.T) {
+	d := NewDialer(WithBackoff(100*time.Millisecond, time.Second))
+	tests := []struct {
+		failures int
+		ceiling  time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{70, time.Second},
+	}
+	for _, tt := range tests {
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			b := d.backoff(tt.failures)
+			if b < 0 || b >= tt.ceiling {
+				t.Fatalf("backoff after %d failures %v, want under %v", tt.failures, b, tt.ceiling)
+			}
+			seen[b] = true
+		}
+		// connections failing together must not all wait the same time
+		if len(seen) < 50 {
+			t.Errorf("backoff after %d failures took only %d values in 100 tries", tt.failures, len(seen))
+		}
+	}
+}
+
+func TestBackoffZero(t *testing.T) {
+	d := NewDialer(WithBackoff(0, 0))
+	if b := d.backoff(3); b != 0 {
+		t.Errorf("backoff %v with no delay set", b)
+	}
+}
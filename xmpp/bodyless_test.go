@@ -0,0 +1,51 @@
+package xmpp_test
+
+import (
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestBodylessMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		inner    string
+		bodyless bool
+		body     string
+	}{
+		{"body", "<body>deploy</body>", false, "deploy"},
+		{"empty body", "<body></body>", false, ""},
+		{"self-closed body", "<body/>", false, ""},
+		{"chat state", "<composing xmlns='http://jabber.org/protocol/chatstates'/>", true, ""},
+		{"receipt", "<received xmlns='urn:xmpp:receipts' id='m1'/>", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			var content, bodyless []xmpp.Message
+			c.HandleMessage(func(m *xmpp.Message) { content = append(content, *m) })
+			c.HandleBodyless(func(m *xmpp.Message) { bodyless = append(bodyless, *m) })
+			received := answer(c, server, func(s *xmpp.Stanza) string {
+				// the message arrives while EntityTime reads the stream
+				return "<message xmlns='jabber:client' from='a@b/c' type='chat'>" + tt.inner + "</message>" + result(s)
+			})
+			defer received()
+
+			if _, err := c.EntityTime("b"); err != nil {
+				t.Fatal(err)
+			}
+			got, other := content, bodyless
+			if tt.bodyless {
+				got, other = bodyless, content
+			}
+			if len(got) != 1 || len(other) != 0 {
+				t.Fatalf("%d content and %d bodyless messages", len(content), len(bodyless))
+			}
+			if m := got[0]; m.HasBody == tt.bodyless || m.Body != tt.body {
+				t.Errorf("got HasBody %v body %q", m.HasBody, m.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package xmpp
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// ellipsis marks a body cut short by WithMaxBodyBytes
+const ellipsis = "…"
+
+// ErrBodyTooLong is returned for a message whose body is over the limit set
+// by WithMaxBodyBytes in strict mode
+var ErrBodyTooLong = errors.New("message body too long")
+
+// fitBody prepares body to be sent: escaping emoticons as
+// WithEscapeEmoticons asks, then holding it to the connection's limit,
+// measured once escaped, by cutting it short with an ellipsis or failing in
+// strict mode
+func (c *Conn) fitBody(body string) (string, error) {
+	body = escapeEmoticons(body, c.escapeEmoticons)
+	if c.maxBodyBytes <= 0 || escapedLen(body) <= c.maxBodyBytes {
+		return body, nil
+	}
+	if c.strictBodyLimit {
+		return "", ErrBodyTooLong
+	}
+	return truncateEscaped(body, c.maxBodyBytes), nil
+}
+
+// SendChunked sends body to to as as many messages as it takes to keep
+// each under maxBytes once escaped, emoticons included, rather than cut it
+// short, and returns their ids. Bodies are split between lines where possible, keeping fenced
+// code blocks whole if they fit, and between runes otherwise. Messages to a
+// joined muc go as groupchat, anything else as chat. On failure the ids of
+// the messages already sent are returned with the error.
+func (c *Conn) SendChunked(to, from, body string, maxBytes int) ([]string, error) {
+	typ := c.messageType(to)
+	if typ == "chat" {
+		if err := c.presentTo(to); err != nil {
+			return nil, err
+		}
+	}
+	var ids []string
+	for _, chunk := range splitBody(body, maxBytes, c.escapeEmoticons) {
+		m := c.chat(to, from, typ, chunk)
+		if err := c.encode(m); err != nil {
+			return ids, err
+		}
+		ids = append(ids, m.ID)
+	}
+	return ids, nil
+}
+
+// splitBody splits body into chunks of at most max bytes once escaped,
+// with escapeEmoticons as escape asks and then as xml, packing as many
+// whole lines, or whole fenced code blocks, into each as fit. The newline a
+// chunk ends on is dropped.
+func splitBody(body string, max int, escape bool) []string {
+	width := func(s string) int {
+		return escapedLen(escapeEmoticons(s, escape))
+	}
+	if max <= 0 || width(body) <= max {
+		return []string{body}
+	}
+	var chunks []string
+	var cur strings.Builder
+	n := 0
+	flush := func() {
+		if cur.Len() > 0 {
+			chunks = append(chunks, strings.TrimSuffix(cur.String(), "\n"))
+			cur.Reset()
+			n = 0
+		}
+	}
+	add := func(s string, w int) {
+		if n+w > max {
+			flush()
+		}
+		cur.WriteString(s)
+		n += w
+	}
+	var pieces []string
+	for _, unit := range bodyUnits(body) {
+		if width(unit) <= max {
+			pieces = append(pieces, unit)
+			continue
+		}
+		// a code block too long to keep whole goes line by line
+		for _, line := range strings.SplitAfter(unit, "\n") {
+			if line != "" {
+				pieces = append(pieces, line)
+			}
+		}
+	}
+	for _, p := range pieces {
+		if w := width(p); w <= max {
+			add(p, w)
+			continue
+		}
+		// a line too long even alone is split between runes, keeping
+		// shortcodes whole so that each escapes as it was measured
+		for _, tok := range emoticonTokens(p) {
+			if w := width(tok); w <= max || utf8.RuneCountInString(tok) == 1 {
+				add(tok, w)
+				continue
+			}
+			// a shortcode too long to fit at all is broken up, its closing
+			// paren starting a chunk so that no part of it is escaped
+			for _, r := range strings.TrimSuffix(tok, ")") {
+				add(string(r), escapedRuneLen(r))
+			}
+			flush()
+			add(")", 1)
+		}
+	}
+	flush()
+	return chunks
+}
+
+// bodyUnits splits body into the pieces splitBody keeps together: lines,
+// each with its newline, and fenced code blocks
+func bodyUnits(body string) []string {
+	var units []string
+	var block strings.Builder
+	inBlock := false
+	for _, line := range strings.SplitAfter(body, "\n") {
+		if line == "" {
+			continue
+		}
+		fence := strings.HasPrefix(strings.TrimSpace(line), "```")
+		switch {
+		case inBlock:
+			block.WriteString(line)
+			if fence {
+				units = append(units, block.String())
+				block.Reset()
+				inBlock = false
+			}
+		case fence:
+			block.WriteString(line)
+			inBlock = true
+		default:
+			units = append(units, line)
+		}
+	}
+	if block.Len() > 0 {
+		units = append(units, block.String())
+	}
+	return units
+}
+
+// truncateEscaped cuts body to the longest prefix of whole runes that,
+// followed by an ellipsis, takes at most max bytes once escaped. Cutting
+// between runes means neither a rune nor the entity it escapes to is split.
+func truncateEscaped(body string, max int) string {
+	tail := ellipsis
+	budget := max - len(tail)
+	if budget < 0 {
+		tail, budget = "", max
+	}
+	n := 0
+	for i, r := range body {
+		w := escapedRuneLen(r)
+		if n+w > budget {
+			return body[:i] + tail
+		}
+		n += w
+	}
+	return body
+}
+
+// escapedLen is the number of bytes body takes once encoding/xml escapes it
+func escapedLen(body string) int {
+	n := 0
+	for _, r := range body {
+		n += escapedRuneLen(r)
+	}
+	return n
+}
+
+// escapedRuneLen is the number of bytes encoding/xml writes for r in text
+func escapedRuneLen(r rune) int {
+	switch r {
+	case '&', '\'', '"':
+		return 5
+	case '<', '>':
+		return 4
+	case '\t', '\n', '\r':
+		return 5
+	}
+	if r == utf8.RuneError {
+		return utf8.RuneLen(utf8.RuneError)
+	}
+	return utf8.RuneLen(r)
+}
@@ -0,0 +1,168 @@
+package xmpp_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// sentBody returns the escaped text of the first body in out
+func sentBody(t *testing.T, out string) string {
+	t.Helper()
+	i := strings.Index(out, "<body>")
+	j := strings.Index(out, "</body>")
+	if i < 0 || j < i {
+		t.Fatalf("no body sent: %q", out)
+	}
+	return out[i+len("<body>") : j]
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		body string
+		want string
+	}{
+		{"fits", 10, "short", "short"},
+		{"fits exactly with an entity", 10, "aaaa&b", "aaaa&amp;b"},
+		{"cut before a multibyte rune", 10, "aaaaaaébbbb", "aaaaaa…"},
+		{"cut after a multibyte rune", 10, "héllo wörld", "héllo …"},
+		{"cut before an entity", 10, "aaaa&bbbbb", "aaaa…"},
+		{"cut before a quote", 10, "aaa'bbbbbb", "aaa…"},
+		{"limit under the ellipsis", 2, "abcdef", "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe(xmpp.WithMaxBodyBytes(tt.max))
+			defer server.Close()
+			sent := capture(c, server)
+			if _, err := c.MUCSendWithID("chat", "a@b", "me@b", tt.body); err != nil {
+				t.Fatal(err)
+			}
+			if got := sentBody(t, sent()); got != tt.want {
+				t.Errorf("body %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// bodySenders are the ways of sending a message body, each sending body to
+// a@b or, for groupchat, room@conf.b
+var bodySenders = []struct {
+	name string
+	send func(c *xmpp.Conn, body string) error
+}{
+	{"MUCSendWithID", func(c *xmpp.Conn, body string) error {
+		_, err := c.MUCSendWithID("chat", "a@b", "me@b", body)
+		return err
+	}},
+	{"SendHeadline", func(c *xmpp.Conn, body string) error { return c.SendHeadline("a@b", "me@b", body) }},
+	{"SendHTML", func(c *xmpp.Conn, body string) error { return c.SendHTML("a@b", "me@b", body, "<b>hi</b>") }},
+	{"SendMultilingual", func(c *xmpp.Conn, body string) error {
+		return c.SendMultilingual("a@b", "me@b", map[string]string{"": body, "en": body})
+	}},
+	{"Correct", func(c *xmpp.Conn, body string) error { return c.Correct("a@b", "me@b", body, "m1") }},
+	{"Mention", func(c *xmpp.Conn, body string) error { return c.Mention("room@conf.b", "me@b", body, nil) }},
+	{"RoomMessage", func(c *xmpp.Conn, body string) error {
+		return c.NewRoomMessage("room@conf.b").From("me@b").Text(body).Send()
+	}},
+}
+
+func TestMaxBodyBytesEverySender(t *testing.T) {
+	for _, s := range bodySenders {
+		t.Run(s.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe(xmpp.WithMaxBodyBytes(8))
+			defer server.Close()
+			sent := capture(c, server)
+			if err := s.send(c, "0123456789"); err != nil {
+				t.Fatal(err)
+			}
+			out := sent()
+			if strings.Contains(out, "0123456789") {
+				t.Errorf("body not cut: %q", out)
+			}
+			if !strings.Contains(out, "01234…") {
+				t.Errorf("cut body missing: %q", out)
+			}
+		})
+	}
+}
+
+func TestStrictBodyLimit(t *testing.T) {
+	for _, s := range bodySenders {
+		t.Run(s.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe(xmpp.WithMaxBodyBytes(8), xmpp.WithStrictBodyLimit())
+			defer server.Close()
+			sent := capture(c, server)
+			if err := s.send(c, "0123456789"); !errors.Is(err, xmpp.ErrBodyTooLong) {
+				t.Errorf("send returned %v, want ErrBodyTooLong", err)
+			}
+			if out := sent(); strings.Contains(out, "<message") {
+				t.Errorf("message sent anyway: %q", out)
+			}
+		})
+	}
+}
+
+func TestSendChunked(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		max  int
+		opts []xmpp.Option
+		want []string
+	}{
+		{"fits", "short", 100, nil, []string{"short"}},
+		// a newline is five bytes once escaped
+		{"lines", "one\ntwo\nthree", 10, nil, []string{"one", "two", "three"}},
+		{"lines packed", "one\ntwo\nthree", 16, nil, []string{"one\ntwo", "three"}},
+		{"runes", "héllo wörld", 4, nil, []string{"hél", "lo w", "örl", "d"}},
+		{"escapes", "a&b", 5, nil, []string{"a", "&", "b"}},
+		{"code block kept whole", "intro\n```\na\nb\n```\nend", 30, nil, []string{"intro", "```\na\nb\n```", "end"}},
+		{"code block too long", "```\nabc\ndef\n```", 12, nil, []string{"```", "abc", "def\n```"}},
+		// an escaped shortcode is three bytes longer, for the zero width space
+		{"escaped emoticons", "(smile) (smile) (smile)", 20, []xmpp.Option{xmpp.WithEscapeEmoticons()},
+			[]string{"(\u200bsmile) ", "(\u200bsmile) ", "(\u200bsmile)"}},
+		{"escaped emoticon too long", "(smile)", 8, []xmpp.Option{xmpp.WithEscapeEmoticons()}, []string{"(smile", ")"}},
+		{"emoticons left alone", "(smile) (smile) (smile)", 20, nil, []string{"(smile) (smile) ", "(smile)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe(tt.opts...)
+			defer server.Close()
+			received := answer(c, server, func(*xmpp.Stanza) string { return "" })
+			ids, err := c.SendChunked("alice@b", "", tt.body, tt.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var bodies, sentIDs []string
+			for _, s := range received() {
+				var m struct {
+					Body string `xml:"body"`
+				}
+				if err := xml.Unmarshal([]byte("<m>"+string(s.Inner)+"</m>"), &m); err != nil {
+					t.Fatal(err)
+				}
+				var escaped bytes.Buffer
+				xml.EscapeText(&escaped, []byte(m.Body))
+				if escaped.Len() > tt.max {
+					t.Errorf("chunk %q is %d bytes escaped, over %d", m.Body, escaped.Len(), tt.max)
+				}
+				bodies = append(bodies, m.Body)
+				sentIDs = append(sentIDs, s.Attr["id"])
+			}
+			if strings.Join(bodies, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("sent %q, want %q", bodies, tt.want)
+			}
+			if strings.Join(ids, ",") != strings.Join(sentIDs, ",") || len(ids) != len(tt.want) {
+				t.Errorf("returned ids %q for messages %q", ids, sentIDs)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package xmpp_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// bounce answers each message c sends by returning it undelivered with
+// item-not-found, and iqs with an empty result
+func bounce(s *xmpp.Stanza) string {
+	if s.Name.Local != "message" {
+		return result(s)
+	}
+	return "<message xmlns='jabber:client' type='error' id='" + s.Attr["id"] + "' from='" + s.Attr["to"] + "'>" + string(s.Inner) +
+		"<error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>" +
+		"<text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'>no such room</text></error></message>"
+}
+
+func TestHandleMessageError(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var bounced []xmpp.MessageError
+	c.HandleMessageError(func(e *xmpp.MessageError) { bounced = append(bounced, *e) })
+	var handled int
+	c.HandleMessage(func(*xmpp.Message) { handled++ })
+	received := answer(c, server, bounce)
+	defer received()
+
+	msgID, err := c.MUCSendWithID("groupchat", "gone@conf.b", "", "alert: disk full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bounced) != 1 {
+		t.Fatalf("bounces %+v", bounced)
+	}
+	e := bounced[0]
+	if e.ID != msgID || e.To != "gone@conf.b" {
+		t.Errorf("bounce of %s to %s, want %s to gone@conf.b", e.ID, e.To, msgID)
+	}
+	if !errors.Is(&e, e.Err) || e.Err.Condition != "item-not-found" || e.Err.Type != "cancel" || e.Err.Text != "no such room" {
+		t.Errorf("bounced with %+v", e.Err)
+	}
+	if handled != 0 {
+		t.Errorf("the bounce went to the message handler too")
+	}
+}
+
+func TestMessageErrorWithoutHandler(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var types []string
+	c.HandleMessage(func(m *xmpp.Message) { types = append(types, m.Type) })
+	received := answer(c, server, bounce)
+	defer received()
+
+	if _, err := c.MUCSendWithID("groupchat", "gone@conf.b", "", "alert"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 1 || types[0] != "error" {
+		t.Errorf("message handler got types %q, want the bounce", types)
+	}
+}
@@ -0,0 +1,103 @@
+package xmpp
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"sort"
+	"strings"
+)
+
+// Identity is one of the identities an entity lists in its disco#info, such
+// as category "client" and type "pc"
+type Identity struct {
+	Category string `xml:"category,attr"`
+	Type     string `xml:"type,attr"`
+	Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Name     string `xml:"name,attr"`
+}
+
+// DiscoInfo is an entity's disco#info: who it is, what it supports and any
+// extended information forms. It decodes from the query element of a
+// disco#info result.
+type DiscoInfo struct {
+	Identities []Identity `xml:"identity"`
+	Features   []struct {
+		Var string `xml:"var,attr"`
+	} `xml:"feature"`
+	Forms []DataForm `xml:"jabber:x:data x"`
+}
+
+// HasFeature reports whether info lists the feature v
+func (info *DiscoInfo) HasFeature(v string) bool {
+	for _, f := range info.Features {
+		if f.Var == v {
+			return true
+		}
+	}
+	return false
+}
+
+// CapsVer returns the entity capabilities verification string for the
+// given identities and features, the sha-1 hash of them sorted and joined
+// as XEP-0115 lays out. Entities advertise it in their presence, so their
+// disco#info can be cached by it.
+func CapsVer(identities []Identity, features []string) string {
+	return capsVer(identities, features, nil)
+}
+
+// VerifyCaps reports whether ver is the verification string of info,
+// extended information forms included, so that info can be cached under
+// it
+func VerifyCaps(ver string, info *DiscoInfo) bool {
+	features := make([]string, len(info.Features))
+	for i, f := range info.Features {
+		features[i] = f.Var
+	}
+	return capsVer(info.Identities, features, info.Forms) == ver
+}
+
+func capsVer(identities []Identity, features []string, forms []DataForm) string {
+	ids := make([]string, len(identities))
+	for i, ident := range identities {
+		ids[i] = ident.Category + "/" + ident.Type + "/" + ident.Lang + "/" + ident.Name
+	}
+	sort.Strings(ids)
+	features = append([]string(nil), features...)
+	sort.Strings(features)
+
+	var b strings.Builder
+	for _, s := range ids {
+		b.WriteString(s + "<")
+	}
+	for _, s := range features {
+		b.WriteString(s + "<")
+	}
+
+	// forms go in the order of their FORM_TYPE, with their other fields
+	// sorted by name and each field's values sorted
+	rendered := make([]string, 0, len(forms))
+	for _, f := range forms {
+		formType := f.Field("FORM_TYPE")
+		if formType == nil {
+			continue
+		}
+		fields := make([]string, 0, len(f.Fields))
+		for _, field := range f.Fields {
+			if field.Var == "FORM_TYPE" {
+				continue
+			}
+			values := append([]string(nil), field.Values...)
+			sort.Strings(values)
+			fields = append(fields, field.Var+"<"+strings.Join(append(values, ""), "<"))
+		}
+		sort.Strings(fields)
+		rendered = append(rendered, formType.Value()+"<"+strings.Join(fields, ""))
+	}
+	sort.Strings(rendered)
+	for _, s := range rendered {
+		b.WriteString(s)
+	}
+
+	sum := sha1.Sum([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
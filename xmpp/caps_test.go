@@ -0,0 +1,69 @@
+package xmpp_test
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+)
+
+// the examples of XEP-0115 sections 5.2 and 5.3
+const (
+	simpleVer  = "QgayPKawpkPSDYmwT/WM94uAlu0="
+	complexVer = "q07IKJEyjvHSyhy//CH0CxmKi8w="
+
+	complexInfo = `<query xmlns='http://jabber.org/protocol/disco#info'>
+  <identity xml:lang='en' category='client' name='Psi 0.11' type='pc'/>
+  <identity xml:lang='el' category='client' name='Ψ 0.11' type='pc'/>
+  <feature var='http://jabber.org/protocol/caps'/>
+  <feature var='http://jabber.org/protocol/disco#info'/>
+  <feature var='http://jabber.org/protocol/disco#items'/>
+  <feature var='http://jabber.org/protocol/muc'/>
+  <x xmlns='jabber:x:data' type='result'>
+    <field var='FORM_TYPE' type='hidden'><value>urn:xmpp:dataforms:softwareinfo</value></field>
+    <field var='ip_version'><value>ipv4</value><value>ipv6</value></field>
+    <field var='os'><value>Mac</value></field>
+    <field var='os_version'><value>10.5.1</value></field>
+    <field var='software'><value>Psi</value></field>
+    <field var='software_version'><value>0.11</value></field>
+  </x>
+</query>`
+)
+
+func TestCapsVer(t *testing.T) {
+	identities := []xmpp.Identity{{Category: "client", Type: "pc", Name: "Exodus 0.9.1"}}
+	features := []string{
+		"http://jabber.org/protocol/disco#info",
+		"http://jabber.org/protocol/disco#items",
+		"http://jabber.org/protocol/muc",
+		"http://jabber.org/protocol/caps",
+	}
+	if got := xmpp.CapsVer(identities, features); got != simpleVer {
+		t.Errorf("CapsVer %q, want %q", got, simpleVer)
+	}
+	if features[0] != "http://jabber.org/protocol/disco#info" {
+		t.Errorf("CapsVer reordered the caller's features: %q", features)
+	}
+}
+
+func TestVerifyCaps(t *testing.T) {
+	var info xmpp.DiscoInfo
+	if err := xml.Unmarshal([]byte(complexInfo), &info); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ver  string
+		want bool
+	}{
+		{complexVer, true},
+		// the same leaving out its form
+		{"2ZC2Fe8xb+Ln321QG0/AaqNEfBU=", false},
+		{simpleVer, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := xmpp.VerifyCaps(tt.ver, &info); got != tt.want {
+			t.Errorf("VerifyCaps(%q) = %v, want %v", tt.ver, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package xmpp_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// latin1 transcodes ISO-8859-1, whose bytes are the first 256 code points
+func latin1(charset string, input io.Reader) (io.Reader, error) {
+	if !strings.EqualFold(charset, "iso-8859-1") {
+		return nil, errors.New("unsupported charset " + charset)
+	}
+	r, w := io.Pipe()
+	go func() {
+		br := bufio.NewReader(input)
+		buf := make([]byte, 0, utf8.UTFMax)
+		for {
+			b, err := br.ReadByte()
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			if _, err := w.Write(utf8.AppendRune(buf[:0], rune(b))); err != nil {
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+const latin1Stream = "<?xml version='1.0' encoding='ISO-8859-1'?>" + streamHeader +
+	"<message xmlns='jabber:client' from='a@b/c' type='chat'><body>caf\xe9 cr\xe8me</body></message></stream:stream>"
+
+func TestCharsetReader(t *testing.T) {
+	c, server := xmpptest.Pipe(xmpp.WithCharsetReader(latin1))
+	defer server.Close()
+	serve(server, latin1Stream)
+	var bodies []string
+	c.HandleMessage(func(m *xmpp.Message) { bodies = append(bodies, m.Body) })
+
+	if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v", err)
+	}
+	if len(bodies) != 1 || bodies[0] != "café crème" {
+		t.Errorf("got bodies %q", bodies)
+	}
+}
+
+func TestCharsetReaderUnset(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	serve(server, latin1Stream)
+
+	if err := runFor(t, c.Run); err == nil || errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v, want the decoder refusing the charset", err)
+	}
+}
@@ -0,0 +1,55 @@
+package xmpp_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// fakeClock ticks only when the test sends on tick
+type fakeClock struct {
+	now  time.Time
+	tick chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time                       { return c.now }
+func (c *fakeClock) After(time.Duration) <-chan time.Time { return nil }
+func (c *fakeClock) NewTicker(time.Duration) xmpp.Ticker  { return fakeTicker{c.tick} }
+
+type fakeTicker struct{ c chan time.Time }
+
+func (t fakeTicker) C() <-chan time.Time { return t.c }
+func (fakeTicker) Stop()                 {}
+
+func TestKeepAliveEveryFollowsClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1e9, 0), tick: make(chan time.Time)}
+	c, server := xmpptest.Pipe(xmpp.WithClock(clock), xmpp.WithKeepAlivePayload([]byte("\n")))
+	done := make(chan error, 1)
+	go func() { done <- c.KeepAliveEvery(time.Hour) }()
+
+	b := make([]byte, 8)
+	for i := 0; i < 3; i++ {
+		clock.tick <- clock.now.Add(time.Duration(i+1) * time.Hour)
+		n, err := io.ReadAtLeast(server, b, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b[:n]); got != "\n" {
+			t.Fatalf("tick %d wrote %q", i, got)
+		}
+	}
+
+	server.Close()
+	clock.tick <- clock.now.Add(4 * time.Hour)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("KeepAliveEvery returned nil after a failed write")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("KeepAliveEvery didn't return after a failed write")
+	}
+}
@@ -0,0 +1,64 @@
+package xmpp_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestCloneBindsNewResource(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	var mu sync.Mutex
+	var dialed []string
+	d := xmpp.NewDialer(xmpp.WithDialFunc(func(addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return srv.Pipe(), nil
+	}))
+	var buf bytes.Buffer
+	c, err := d.Connect("b", "bob", "pw", "bot1", xmpp.WithLogger(log.New(&buf, "", 0)), xmpp.WithLabel("fleet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sibling, err := c.Clone("bot2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sibling.Close()
+	if got := sibling.JID(); got != "bob@b/bot2" {
+		t.Errorf("clone bound %q, want bob@b/bot2", got)
+	}
+	if got := c.JID(); got != "bob@b/bot1" {
+		t.Errorf("original is now %q", got)
+	}
+	// the clone dials through the same dialer and logs under the same label
+	if len(dialed) != 2 || dialed[1] != dialed[0] {
+		t.Errorf("dialed %q, want the same address twice", dialed)
+	}
+	if n := strings.Count(buf.String(), "<resource>bot2</resource>"); n != 1 {
+		t.Errorf("logged the clone's bind %d times:\n%s", n, buf.String())
+	}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !strings.HasPrefix(line, "[fleet] ") {
+			t.Errorf("logged %q without the label", line)
+		}
+	}
+}
+
+func TestCloneWithoutSession(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	if _, err := c.Clone("bot2"); !errors.Is(err, xmpp.ErrNoSession) {
+		t.Errorf("Clone returned %v, want ErrNoSession", err)
+	}
+}
@@ -0,0 +1,119 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"html"
+	"sort"
+)
+
+const (
+	xmlCommand      = "<iq type='set' to='%s' id='%s'><command xmlns='%s' node='%s' action='%s'%s>%s</command></iq>"
+	commandExecute  = "execute"
+	commandCancel   = "cancel"
+	commandComplete = "completed"
+)
+
+// CommandNote is a note attached to an ad-hoc command response
+type CommandNote struct {
+	Type string
+	Text string
+}
+
+// CommandResult is the response to an ad-hoc command. While Status is
+// "executing" the command expects to be continued with ContinueCommand.
+type CommandResult struct {
+	To        string
+	Node      string
+	SessionID string
+	Status    string
+	// Fields holds the values of Form's fields by name
+	Fields map[string][]string
+	// Form is the data form the command returned, if any
+	Form  *DataForm
+	Notes []CommandNote
+}
+
+// Completed reports whether the command has finished
+func (r *CommandResult) Completed() bool {
+	return r.Status == commandComplete
+}
+
+type commandResponse struct {
+	Command struct {
+		Node      string    `xml:"node,attr"`
+		SessionID string    `xml:"sessionid,attr"`
+		Status    string    `xml:"status,attr"`
+		Form      *DataForm `xml:"jabber:x:data x"`
+		Notes     []struct {
+			Type string `xml:"type,attr"`
+			Text string `xml:",chardata"`
+		} `xml:"note"`
+	} `xml:"http://jabber.org/protocol/commands command"`
+}
+
+// ExecuteCommand runs the ad-hoc command node on to, submitting fields as
+// a data form if any are given.
+func (c *Conn) ExecuteCommand(to, node string, fields map[string]string) (*CommandResult, error) {
+	return c.command(to, node, "", commandExecute, fields)
+}
+
+// ContinueCommand submits fields to the next stage of a command that is
+// still executing
+func (c *Conn) ContinueCommand(r *CommandResult, fields map[string]string) (*CommandResult, error) {
+	return c.command(r.To, r.Node, r.SessionID, commandExecute, fields)
+}
+
+// CancelCommand cancels a command that is still executing
+func (c *Conn) CancelCommand(r *CommandResult) error {
+	_, err := c.command(r.To, r.Node, r.SessionID, commandCancel, nil)
+	return err
+}
+
+func (c *Conn) command(to, node, session, action string, fields map[string]string) (*CommandResult, error) {
+	var form string
+	if len(fields) > 0 {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		submit := &DataForm{Type: "submit"}
+		for _, k := range keys {
+			submit.Set(k, fields[k])
+		}
+		b, err := xml.Marshal(submit)
+		if err != nil {
+			return nil, err
+		}
+		form = string(b)
+	}
+
+	iqID := id()
+	s, err := c.sendIQ(iqID, xmlCommand, html.EscapeString(to), iqID, NsCommands, html.EscapeString(node), action, optAttr("sessionid", session), form)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp commandResponse
+	if err := s.decode(&resp); err != nil {
+		return nil, err
+	}
+	r := &CommandResult{
+		To:        to,
+		Node:      resp.Command.Node,
+		SessionID: resp.Command.SessionID,
+		Status:    resp.Command.Status,
+		Fields:    make(map[string][]string),
+		Form:      resp.Command.Form,
+	}
+	if r.Form != nil {
+		for _, f := range r.Form.Fields {
+			r.Fields[f.Var] = f.Values
+		}
+	}
+	for _, n := range resp.Command.Notes {
+		r.Notes = append(r.Notes, CommandNote{Type: n.Type, Text: n.Text})
+	}
+	return r, nil
+}
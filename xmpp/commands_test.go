@@ -0,0 +1,79 @@
+package xmpp_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestExecuteCommandStages(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	stage := 0
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		stage++
+		if stage == 1 {
+			return fmt.Sprintf("<iq type='result' id='%s' from='admin@b'><command xmlns='%s' node='restart' sessionid='s1' status='executing'>"+
+				"<x xmlns='jabber:x:data' type='form'><field var='mode' type='list-single'><value>fast</value></field></x></command></iq>",
+				s.Attr["id"], xmpp.NsCommands)
+		}
+		return fmt.Sprintf("<iq type='result' id='%s' from='admin@b'><command xmlns='%s' node='restart' sessionid='s1' status='completed'>"+
+			"<note type='info'>restarted</note></command></iq>", s.Attr["id"], xmpp.NsCommands)
+	})
+
+	r, err := c.ExecuteCommand("admin@b", "restart", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Completed() || r.SessionID != "s1" || r.Node != "restart" {
+		t.Fatalf("first stage %+v", r)
+	}
+	if got := r.Fields["mode"]; len(got) != 1 || got[0] != "fast" {
+		t.Errorf("form fields %v", r.Fields)
+	}
+
+	r, err = c.ContinueCommand(r, map[string]string{"mode": "slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Completed() {
+		t.Errorf("status %q, want completed", r.Status)
+	}
+	if len(r.Notes) != 1 || r.Notes[0] != (xmpp.CommandNote{Type: "info", Text: "restarted"}) {
+		t.Errorf("notes %+v", r.Notes)
+	}
+
+	sent := received()
+	if len(sent) < 2 {
+		t.Fatalf("sent %d stanzas, want 2", len(sent))
+	}
+	second := string(sent[1].Inner)
+	for _, want := range []string{"sessionid='s1'", "action='execute'", "type=\"submit\"", "<value>slow</value>"} {
+		if !strings.Contains(second, want) {
+			t.Errorf("continuation lacks %s: %s", want, second)
+		}
+	}
+}
+
+func TestExecuteCommandEscapes(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, result)
+
+	if _, err := c.ExecuteCommand("o'brien@b", "a<b>'c", nil); err != nil {
+		t.Fatal(err)
+	}
+	sent := received()
+	if len(sent) == 0 {
+		t.Fatal("nothing sent")
+	}
+	if to := sent[0].Attr["to"]; to != "o'brien@b" {
+		t.Errorf("to %q", to)
+	}
+	if !strings.Contains(string(sent[0].Inner), "a&lt;b&gt;&#39;c") {
+		t.Errorf("node not escaped: %s", sent[0].Inner)
+	}
+}
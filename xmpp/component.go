@@ -0,0 +1,82 @@
+package xmpp
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net"
+)
+
+const (
+	xmlComponentStream = "<stream:stream to='%s' xmlns='%s' xmlns:stream='%s'>"
+	xmlHandshake       = "<handshake>%s</handshake>"
+
+	// componentPort is the port DialComponent uses when host has none
+	componentPort = "5347"
+)
+
+// ErrHandshakeRefused is returned by DialComponent when the server rejects
+// the component's secret
+var ErrHandshakeRefused = errors.New("component handshake refused")
+
+// DialComponent connects to host as the external component for domain,
+// authenticating with the shared secret. host may include a port; without
+// one the usual component port is used. The component sends as any jid in
+// domain, so the from of messages and presence must always be given.
+func DialComponent(host, domain, secret string, opts ...Option) (*Conn, error) {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, componentPort)
+	}
+	c := newConn(opts)
+	outgoing, err := c.dial(addr)
+	if err != nil {
+		return nil, &ConnectError{Phase: PhaseDial, Err: err}
+	}
+
+	c.outgoing = outgoing
+	c.incoming = c.newDecoder(outgoing)
+	c.host, c.jid = host, domain
+	if err := c.componentHandshake(domain, secret); err != nil {
+		outgoing.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// componentHandshake opens a component stream and authenticates it
+func (c *Conn) componentHandshake(domain, secret string) error {
+	if err := c.send(xmlComponentStream, domain, NsComponentAccept, NsStream); err != nil {
+		return &ConnectError{Phase: PhaseStream, Err: err}
+	}
+	s, err := c.readStanza()
+	if err != nil {
+		return &ConnectError{Phase: PhaseStream, Err: err}
+	}
+	if s.Name.Local != "stream" || s.Name.Space != NsStream {
+		return &ConnectError{Phase: PhaseStream, Err: ErrInvalidXML}
+	}
+
+	if err := c.send(xmlHandshake, componentDigest(s.Attr["id"], secret)); err != nil {
+		return &ConnectError{Phase: PhaseAuth, Err: err}
+	}
+	for {
+		s, err := c.readStanza()
+		if isStreamError(err) {
+			return &ConnectError{Phase: PhaseAuth, Err: ErrHandshakeRefused}
+		}
+		if err != nil {
+			return &ConnectError{Phase: PhaseAuth, Err: err}
+		}
+		if s.Name.Local+s.Name.Space == "handshake"+NsComponentAccept {
+			return nil
+		}
+	}
+}
+
+// componentDigest is the handshake a component proves it knows secret with:
+// the hex sha1 of the stream id followed by the secret
+func componentDigest(streamID, secret string) string {
+	sum := sha1.Sum([]byte(streamID + secret))
+	return hex.EncodeToString(sum[:])
+}
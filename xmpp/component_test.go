@@ -0,0 +1,84 @@
+package xmpp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestComponentDigest(t *testing.T) {
+	tests := []struct {
+		id, secret, want string
+	}{
+		{"3BF96D32", "sesame", "7a98dc4c9e92493d7fd66a25364c862637789c45"},
+		{"sid12345", "secret", "19b91eb2233bed84e363734c2170d8309485dc3b"},
+	}
+	for _, tt := range tests {
+		if got := componentDigest(tt.id, tt.secret); got != tt.want {
+			t.Errorf("componentDigest(%q, %q) = %s, want %s", tt.id, tt.secret, got, tt.want)
+		}
+	}
+}
+
+// componentServer answers a component's stream open on the other end of a
+// pipe with stream id 3BF96D32, then replies to its handshake with reply and
+// reports the handshake it was sent
+func componentServer(server net.Conn, reply string) <-chan string {
+	sent := make(chan string, 1)
+	go func() {
+		defer close(sent)
+		r := bufio.NewReader(server)
+		if _, err := r.ReadString('>'); err != nil {
+			return
+		}
+		io.WriteString(server, "<stream:stream xmlns='"+NsComponentAccept+"' xmlns:stream='"+NsStream+"' from='bot.b' id='3BF96D32'>")
+		handshake, err := r.ReadString('/')
+		if err != nil {
+			return
+		}
+		r.ReadString('>')
+		sent <- strings.TrimSuffix(strings.TrimPrefix(handshake, "<handshake>"), "</")
+		io.WriteString(server, reply)
+		io.Copy(io.Discard, r)
+	}()
+	return sent
+}
+
+func TestDialComponent(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	var dialed string
+	d := NewDialer(WithDialFunc(func(addr string) (net.Conn, error) {
+		dialed = addr
+		return client, nil
+	}))
+	sent := componentServer(server, "<handshake/>")
+
+	c, err := DialComponent("b", "bot.b", "sesame", withDialer(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if dialed != "b:5347" {
+		t.Errorf("dialed %s, want the component port", dialed)
+	}
+	if got := <-sent; got != "7a98dc4c9e92493d7fd66a25364c862637789c45" {
+		t.Errorf("sent handshake %s", got)
+	}
+}
+
+func TestDialComponentRefused(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	d := NewDialer(WithDialFunc(func(string) (net.Conn, error) { return client, nil }))
+	componentServer(server, "<stream:error><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>")
+
+	_, err := DialComponent("b:5275", "bot.b", "wrong", withDialer(d))
+	var ce *ConnectError
+	if !errors.As(err, &ce) || ce.Phase != PhaseAuth || !errors.Is(err, ErrHandshakeRefused) {
+		t.Fatalf("DialComponent returned %v, want a refused handshake", err)
+	}
+}
@@ -0,0 +1,142 @@
+package xmpp
+
+import (
+	"compress/zlib"
+	"errors"
+	"io"
+	"time"
+)
+
+const xmlCompress = "<compress xmlns='%s'><method>zlib</method></compress>"
+
+// The stream features Connect negotiates, for WithStreamFeatures
+const (
+	FeatureStartTLS    = "starttls"
+	FeatureCompression = "compression"
+	FeatureSASL        = "sasl"
+)
+
+// defaultFeatureOrder is the order XEP-0170 recommends, less compression,
+// which is only negotiated when asked for
+var defaultFeatureOrder = []string{FeatureStartTLS, FeatureSASL}
+
+// ErrCompressionFailed is returned when the server offers zlib stream
+// compression but then fails to set it up
+var ErrCompressionFailed = errors.New("stream compression failed")
+
+// featureOrder splits the order features are negotiated in around sasl,
+// which is negotiated whether it is listed or not
+func (c *Conn) featureOrder() (before, after []string) {
+	order := c.streamFeatures
+	if order == nil {
+		order = defaultFeatureOrder
+	}
+	for i, f := range order {
+		if f == FeatureSASL {
+			return order[:i], order[i+1:]
+		}
+	}
+	return order, nil
+}
+
+// negotiate negotiates each of features in turn, skipping those the server
+// doesn't offer, and restarting the stream after each one that changes it.
+// Failures are returned as a *ConnectError.
+func (c *Conn) negotiate(features []string) error {
+	for _, name := range features {
+		c.mu.Lock()
+		f := c.features
+		c.mu.Unlock()
+		if f == nil {
+			return nil
+		}
+
+		phase := PhaseTLS
+		var err error
+		switch {
+		case name == FeatureStartTLS && f.StartTLS != nil:
+			err = c.upgradeTLS()
+		case name == FeatureCompression && f.offersCompression("zlib"):
+			phase, err = PhaseCompression, c.compress()
+		default:
+			continue
+		}
+		if err != nil {
+			return &ConnectError{Phase: phase, Err: err}
+		}
+		if err := c.openStream(); err != nil {
+			return &ConnectError{Phase: PhaseStream, Err: err}
+		}
+	}
+	return nil
+}
+
+// offersCompression reports whether the server offers the compression
+// method
+func (f *Features) offersCompression(method string) bool {
+	for _, m := range f.Compression {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// compress asks for zlib compression and compresses the stream from then on
+func (c *Conn) compress() error {
+	w := c.expect(func(s *Stanza) bool {
+		return s.Name.Space == NsCompress && (s.Name.Local == "compressed" || s.Name.Local == "failure")
+	})
+	if err := c.send(xmlCompress, NsCompress); err != nil {
+		c.forget(w)
+		return err
+	}
+	s, err := c.wait(w)
+	if err != nil {
+		return err
+	}
+	if s.Name.Local == "failure" {
+		return ErrCompressionFailed
+	}
+	c.outgoing = &zlibConn{ReadWriteCloser: c.outgoing, zw: zlib.NewWriter(c.outgoing)}
+	c.incoming = c.newDecoder(c.outgoing)
+	return nil
+}
+
+// zlibConn is a stream compressed with zlib. Each write is flushed, so that
+// stanzas aren't held back in the compressor.
+type zlibConn struct {
+	io.ReadWriteCloser
+	zw *zlib.Writer
+	// zr is created with the first read, since the server sends nothing
+	// compressed until the client has
+	zr io.ReadCloser
+}
+
+func (z *zlibConn) Read(p []byte) (int, error) {
+	if z.zr == nil {
+		zr, err := zlib.NewReader(z.ReadWriteCloser)
+		if err != nil {
+			return 0, err
+		}
+		z.zr = zr
+	}
+	return z.zr.Read(p)
+}
+
+func (z *zlibConn) Write(p []byte) (int, error) {
+	n, err := z.zw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, z.zw.Flush()
+}
+
+// SetReadDeadline sets the read deadline of the connection underneath, so
+// that Run can still interrupt reads
+func (z *zlibConn) SetReadDeadline(t time.Time) error {
+	if d, ok := z.ReadWriteCloser.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return errors.New("connection has no read deadline")
+}
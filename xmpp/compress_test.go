@@ -0,0 +1,56 @@
+package xmpp_test
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestStreamFeaturesOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []string
+		want  string
+	}{
+		{"default leaves compression out", nil, "starttls auth"},
+		{"compression after sasl", []string{xmpp.FeatureStartTLS, xmpp.FeatureSASL, xmpp.FeatureCompression}, "starttls auth compress"},
+		{"compression before sasl", []string{xmpp.FeatureStartTLS, xmpp.FeatureCompression, xmpp.FeatureSASL}, "starttls compress auth"},
+		// compression is only offered under tls, so asking for it first
+		// skips it
+		{"compression not yet offered", []string{xmpp.FeatureCompression, xmpp.FeatureStartTLS}, "starttls auth"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, pool := testCert(t, "b")
+			srv := xmpptest.NewServer("b")
+			srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			srv.Compression = true
+			opts := []xmpp.Option{xmpp.WithTLSConfig(&tls.Config{RootCAs: pool})}
+			if tt.order != nil {
+				opts = append(opts, xmpp.WithStreamFeatures(tt.order))
+			}
+			c, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", "pw", "bot", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			// the session works over whatever was negotiated
+			if _, err := c.GetRoster(); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range srv.Received() {
+				switch s.Name.Local {
+				case "starttls", "auth", "compress":
+					got = append(got, s.Name.Local)
+				}
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("negotiated %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"errors"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const proceedTLS = "proceed" + NsTLS
+
+// The phases of Connect a ConnectError can come from
+const (
+	PhaseDial        = "dial"
+	PhaseStream      = "stream"
+	PhaseTLS         = "tls"
+	PhaseCompression = "compression"
+	PhaseAuth        = "auth"
+	PhaseBind        = "bind"
+	PhasePresence    = "presence"
+)
+
+// ErrLegacyServer is returned by Connect when the server speaks a version of
+// xmpp older than 1.0, and so offers neither tls nor sasl, unless
+// WithAllowLegacy is set
+var ErrLegacyServer = errors.New("server predates xmpp 1.0")
+
+// legacyVersion reports whether a stream version, of the form major.minor,
+// is older than 1.0. A server that gives none is taken to be legacy.
+func legacyVersion(version string) bool {
+	major, _, _ := strings.Cut(version, ".")
+	n, err := strconv.Atoi(major)
+	return err != nil || n < 1
+}
+
+// ConnectError is returned when establishing a session fails, saying which
+// phase of it failed. Failures in the auth phase usually aren't worth
+// retrying; the others usually are.
+type ConnectError struct {
+	// Label is the label of the connection that failed, as set by
+	// WithLabel, or its jid
+	Label string
+	Phase string
+	Err   error
+}
+
+func (e *ConnectError) Error() string {
+	if e.Label != "" {
+		return e.Label + ": " + e.Phase + ": " + e.Err.Error()
+	}
+	return e.Phase + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// Connect dials host and sets up a session for user, upgrading to tls when
+// the server requires it, authenticating and sending initial presence. Any
+// failure is returned as a *ConnectError.
+func Connect(host, user, pass, resource string, opts ...Option) (*Conn, error) {
+	c := newConn(opts)
+	addr := host + ":5222"
+	for redirects := 0; ; redirects++ {
+		outgoing, err := c.dial(addr)
+		if err != nil {
+			return nil, c.labelled(&ConnectError{Phase: PhaseDial, Err: err})
+		}
+		c.outgoing = outgoing
+		c.incoming = c.newDecoder(outgoing)
+		c.host = host
+
+		err = c.establish(host, user, pass, resource)
+		var re *RedirectError
+		if err == nil {
+			return c, nil
+		}
+		if !errors.As(err, &re) || redirects >= c.maxRedirects {
+			return nil, err
+		}
+		addr = redirectAddr(re.Host)
+	}
+}
+
+// ConnectOver sets up a session like Connect does, but over an already open
+// stream rather than dialing host, such as a connection to an
+// xmpptest.Server.
+func ConnectOver(rwc io.ReadWriteCloser, host, user, pass, resource string, opts ...Option) (*Conn, error) {
+	c := NewConn(rwc, opts...)
+	c.host = host
+	if err := c.establish(host, user, pass, resource); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ErrNoSession is returned by Clone for a connection that has no user
+// session to copy, such as a component
+var ErrNoSession = errors.New("connection has no user session")
+
+// Clone connects another session for the same user, on the same host and
+// with the same options as c, but bound to a different resource, so a
+// supervisor can start sibling bots without repeating their configuration.
+// It dials afresh even if c was set up with ConnectOver. Options holding
+// state, such as WithOutbox's store, are shared with c, not copied.
+func (c *Conn) Clone(resource string) (*Conn, error) {
+	c.mu.Lock()
+	host, user, pass := c.host, c.user, c.pass
+	c.mu.Unlock()
+	if user == "" {
+		return nil, ErrNoSession
+	}
+	return Connect(host, user, pass, resource, c.opts...)
+}
+
+func (c *Conn) establish(host, user, pass, resource string) (err error) {
+	defer func() { err = c.labelled(err) }()
+	c.mu.Lock()
+	c.jid, c.host = user+"@"+host, host
+	c.user, c.pass, c.resource = user, pass, resource
+	c.mu.Unlock()
+
+	if err := c.handshake(); err != nil {
+		c.outgoing.Close()
+		return err
+	}
+	needBind, err := c.authenticate()
+	if err != nil {
+		c.outgoing.Close()
+		return err
+	}
+	if needBind {
+		if _, err := c.Bind(resource); err != nil {
+			c.outgoing.Close()
+			return &ConnectError{Phase: PhaseBind, Err: err}
+		}
+	}
+	if !c.directedOnly {
+		if err := c.encode(c.ownPresence("", "")); err != nil {
+			c.outgoing.Close()
+			return &ConnectError{Phase: PhasePresence, Err: err}
+		}
+	}
+	if _, err := c.GetRoster(); err != nil {
+		c.reportError(err)
+	} else if c.probeOnConnect {
+		if err := c.probeRoster(); err != nil {
+			c.reportError(err)
+		}
+	}
+	if err := c.ReplayOutbox(); err != nil {
+		c.reportError(err)
+	}
+	if c.MentionName() == "" {
+		if v, err := c.GetVCard(bare(c.JID())); err == nil {
+			c.mu.Lock()
+			c.mentionName = v.Nickname
+			c.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// JID returns the full jid of the session, as assigned by the server when
+// the resource was bound
+func (c *Conn) JID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.jid
+}
+
+// MentionName returns the hipchat mention name of the session's user, taken
+// from the roster or failing that the user's vcard during Connect
+func (c *Conn) MentionName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mentionName
+}
+
+// handshake opens a new stream and negotiates the stream features ordered
+// before sasl, which by default means upgrading to tls when the server
+// requires it. Failures are returned as a *ConnectError.
+func (c *Conn) handshake() error {
+	if err := c.openStream(); err != nil {
+		return &ConnectError{Phase: PhaseStream, Err: err}
+	}
+	before, _ := c.featureOrder()
+	return c.negotiate(before)
+}
+
+// openStream sends the stream header and reads the server's features
+func (c *Conn) openStream() error {
+	c.mu.Lock()
+	jid, host := c.jid, c.host
+	c.mu.Unlock()
+	if err := c.send(xmlStream, bare(jid), host, NsJabberClient, NsStream); err != nil {
+		return err
+	}
+	_, err := c.readFeatures()
+	return err
+}
+
+// upgradeTLS negotiates starttls and makes the tls handshake
+func (c *Conn) upgradeTLS() error {
+	c.mu.Lock()
+	host := c.host
+	c.mu.Unlock()
+
+	w := c.expect(func(s *Stanza) bool { return s.Name.Local+s.Name.Space == proceedTLS })
+	if err := c.send(xmlStartTLS, NsTLS); err != nil {
+		c.forget(w)
+		return err
+	}
+	if _, err := c.wait(w); err != nil {
+		return err
+	}
+	if err := c.startTLS(c.tlsConfigFor(host)); err != nil {
+		return err
+	}
+	if tc, ok := c.outgoing.(*tls.Conn); ok {
+		return tc.Handshake()
+	}
+	return nil
+}
+
+// authenticate logs in, then negotiates the stream features ordered after
+// sasl. It reports whether the resource still has to be bound. Failures
+// are returned as a *ConnectError.
+func (c *Conn) authenticate() (bool, error) {
+	needBind, err := c.login()
+	if err != nil {
+		return false, &ConnectError{Phase: PhaseAuth, Err: err}
+	}
+	_, after := c.featureOrder()
+	return needBind, c.negotiate(after)
+}
+
+// tlsConfigFor returns the configured tls config for host, falling back to
+// a default one. The server name presented is the one set by WithSNI, then
+// the config's own, then host.
+func (c *Conn) tlsConfigFor(host string) *tls.Config {
+	config := &tls.Config{}
+	if c.tlsConfig != nil {
+		config = c.tlsConfig.Clone()
+	}
+	switch {
+	case c.sni != "":
+		config.ServerName = c.sni
+	case config.ServerName == "":
+		config.ServerName = host
+	}
+	if len(c.alpn) > 0 && len(config.NextProtos) == 0 {
+		config.NextProtos = c.alpn
+	}
+	return config
+}
+
+// readFeatures reads up to and including the stream features. A server
+// older than xmpp 1.0 sends none, so for one the empty features are
+// returned with WithAllowLegacy, leaving legacy auth without tls, and
+// ErrLegacyServer without it.
+func (c *Conn) readFeatures() (*Features, error) {
+	var s *Stanza
+	for {
+		w := c.expect(func(s *Stanza) bool {
+			switch s.Name.Local {
+			case "stream", "features":
+				return s.Name.Space == NsStream
+			}
+			return false
+		})
+		var err error
+		if s, err = c.wait(w); err != nil {
+			return nil, err
+		}
+		if s.Name.Local != "stream" {
+			break
+		}
+		if !legacyVersion(s.Attr["version"]) {
+			continue
+		}
+		if !c.allowLegacy {
+			return nil, ErrLegacyServer
+		}
+		s = &Stanza{}
+		break
+	}
+	var f Features
+	if s.Name.Local == "features" {
+		if err := s.decode(&f); err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	c.features = &f
+	c.mu.Unlock()
+	return &f, nil
+}
+
+// login authenticates with the credentials last passed to Auth, using sasl
+// when the server offers SCRAM-SHA-1 or PLAIN and doesn't advertise legacy
+// auth. It reports whether the resource still has to be bound, which legacy
+// auth does itself.
+func (c *Conn) login() (bool, error) {
+	c.mu.Lock()
+	user, pass, resource := c.user, c.pass, c.resource
+	f := c.features
+	c.mu.Unlock()
+
+	if f != nil && f.IqAuth == nil {
+		switch {
+		case f.offers(scramSHA1):
+			return true, c.SCRAMAuth(user, pass)
+		case f.offers("PLAIN"):
+			return true, c.SASLAuth(user, pass)
+		}
+	}
+
+	if err := c.legacyAuth(user, pass, resource); err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.jid = bare(c.jid) + "/" + resource
+	c.mu.Unlock()
+	return false, nil
+}
+
+// legacyAuth authenticates with jabber:iq:auth, which binds the resource too
+func (c *Conn) legacyAuth(user, pass, resource string) error {
+	iqID := id()
+	if _, err := c.sendIQ(iqID, xmlIqSet, iqID, NsIqAuth,
+		html.EscapeString(user), html.EscapeString(pass), html.EscapeString(resource)); err != nil {
+		var se *StanzaError
+		if !errors.As(err, &se) {
+			return err
+		}
+		switch se.Condition {
+		case "not-authorized":
+			return ErrNotAuthorized
+		case "conflict":
+			return ErrConflict
+		case "not-acceptable":
+			return ErrNotAcceptable
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package xmpp_test
+
+import (
+	"encoding/xml"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+const awkwardPassword = "p&ss'<wd>&amp;"
+
+func TestConnectOverAwkwardPassword(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	srv.Users = map[string]string{"bob": awkwardPassword}
+	c, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", awkwardPassword, "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestAuthEscapes(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, result)
+	if err := c.Auth("o'bob", awkwardPassword, "res<1>"); err != nil {
+		t.Fatal(err)
+	}
+	sent := received()
+	if len(sent) == 0 {
+		t.Fatal("nothing sent")
+	}
+	var q struct {
+		Username string `xml:"query>username"`
+		Password string `xml:"query>password"`
+		Resource string `xml:"query>resource"`
+	}
+	if err := xml.Unmarshal([]byte("<iq>"+string(sent[0].Inner)+"</iq>"), &q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Username != "o'bob" || q.Password != awkwardPassword || q.Resource != "res<1>" {
+		t.Errorf("server got %+v", q)
+	}
+}
+
+func TestConnectAssignedJID(t *testing.T) {
+	tests := []struct{ resource, want string }{
+		{"bot", "bob@b/bot"},
+		{"", "bob@b/xmpptest"},
+	}
+	for _, tt := range tests {
+		c, err := xmpp.ConnectOver(xmpptest.NewServer("b").Pipe(), "b", "bob", "pw", tt.resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.JID(); got != tt.want {
+			t.Errorf("JID with resource %q is %q, want %q as bound", tt.resource, got, tt.want)
+		}
+		c.Close()
+	}
+}
+
+func TestConnectMentionName(t *testing.T) {
+	tests := []struct {
+		name, roster, vcard, want string
+	}{
+		{"from roster", "<item jid='1_1@chat.hipchat.com' mention_name='DeployBot'/>", "<NICKNAME>Other</NICKNAME>", "DeployBot"},
+		{"from vcard", "<item jid='1_2@chat.hipchat.com' mention_name='AliceJ'/>", "<NICKNAME>DeployBot</NICKNAME>", "DeployBot"},
+		{"neither", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			sasl := saslServer(plainFeatures)
+			// there is no Conn for negotiate to close until ConnectOver returns
+			negotiate(nil, server, func(s *xmpp.Stanza) string {
+				inner := string(s.Inner)
+				switch {
+				case s.Name.Local != "iq":
+					return sasl(s)
+				case strings.Contains(inner, xmpp.NsBind):
+					return "<iq type='result' id='" + s.Attr["id"] + "'><bind xmlns='" + xmpp.NsBind + "'><jid>1_1@chat.hipchat.com/bot</jid></bind></iq>"
+				case strings.Contains(inner, xmpp.NsIqRoster):
+					return rosterResult(tt.roster)(s)
+				case strings.Contains(inner, xmpp.NsVCard):
+					return "<iq type='result' id='" + s.Attr["id"] + "'><vCard xmlns='" + xmpp.NsVCard + "'>" + tt.vcard + "</vCard></iq>"
+				}
+				return result(s)
+			})
+			conn, err := xmpp.ConnectOver(client, "chat.hipchat.com", "1_1", "pw", "bot")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := conn.MentionName(); got != tt.want {
+				t.Errorf("MentionName %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// legacyHeader opens a stream the way a server older than xmpp 1.0 does,
+// without a version and without features to follow
+const legacyHeader = "<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' id='s1'>"
+
+func TestLegacyServer(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []xmpp.Option
+		err  error
+	}{
+		{"refused", nil, xmpp.ErrLegacyServer},
+		{"allowed", []xmpp.Option{xmpp.WithAllowLegacy()}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			auths := make(chan string, 8)
+			negotiate(nil, server, func(s *xmpp.Stanza) string {
+				switch s.Name.Local {
+				case "stream":
+					return legacyHeader
+				case "iq":
+					if strings.Contains(string(s.Inner), xmpp.NsIqAuth) {
+						auths <- string(s.Inner)
+					}
+					return "<iq type='result' id='" + s.Attr["id"] + "'/>"
+				}
+				return ""
+			})
+			c, err := xmpp.ConnectOver(client, "b", "bob", "pw", "bot", tt.opts...)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ConnectOver returned %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				client.Close()
+				if len(auths) != 0 {
+					t.Errorf("authenticated with a server that was refused: %s", <-auths)
+				}
+				return
+			}
+			defer c.Close()
+			if v := c.StreamVersion(); v != "" {
+				t.Errorf("StreamVersion %q", v)
+			}
+			if len(auths) != 1 {
+				t.Fatalf("authenticated %d times, want once with legacy auth", len(auths))
+			}
+			if auth := <-auths; !strings.Contains(auth, "<resource>bot</resource>") {
+				t.Errorf("legacy auth %s doesn't bind the resource", auth)
+			}
+		})
+	}
+}
+
+func TestStreamVersion(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	negotiate(nil, server, saslServer(plainFeatures))
+	c, err := xmpp.ConnectOver(client, "b", "bob", "pw", "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := c.StreamVersion(); v != "1.0" {
+		t.Errorf("StreamVersion %q, want 1.0", v)
+	}
+}
+
+func TestConnectErrorAuthPhase(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []xmpp.Option
+		label string
+	}{
+		{"jid", nil, "bob@b"},
+		{"label", []xmpp.Option{xmpp.WithLabel("bot1")}, "bot1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := xmpptest.NewServer("b")
+			srv.Users = map[string]string{"bob": "pw"}
+			_, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", "wrong", "bot", tt.opts...)
+			var ce *xmpp.ConnectError
+			if !errors.As(err, &ce) || ce.Phase != xmpp.PhaseAuth {
+				t.Fatalf("ConnectOver returned %v, want an auth phase ConnectError", err)
+			}
+			var sf *xmpp.SASLFailure
+			if !errors.As(err, &sf) || sf.Condition != "not-authorized" {
+				t.Errorf("ConnectError wraps %v, want the sasl failure", ce.Err)
+			}
+			if ce.Label != tt.label || !strings.HasPrefix(err.Error(), tt.label+": auth: ") {
+				t.Errorf("error %q labelled %q, want %q", err, ce.Label, tt.label)
+			}
+		})
+	}
+}
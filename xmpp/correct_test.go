@@ -0,0 +1,73 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestCorrectSends(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, joined)
+	if err := c.JoinRoom("ops@conf.b", "bot", xmpp.JoinOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Correct("ops@conf.b", "", "deploying 80%", "m1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Correct("alice@b", "", "done", "m'2"); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []*xmpp.Stanza
+	for _, s := range received() {
+		if s.Name.Local == "message" {
+			msgs = append(msgs, s)
+		}
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("sent %d messages, want 2", len(msgs))
+	}
+	tests := []struct {
+		typ, body, replace string
+	}{
+		{"groupchat", "<body>deploying 80%</body>", "<replace id='m1' xmlns='" + xmpp.NsCorrect + "'/>"},
+		{"chat", "<body>done</body>", "<replace id='m&#39;2' xmlns='" + xmpp.NsCorrect + "'/>"},
+	}
+	for i, tt := range tests {
+		inner := string(msgs[i].Inner)
+		if msgs[i].Attr["type"] != tt.typ || !strings.Contains(inner, tt.body) || !strings.Contains(inner, tt.replace) {
+			t.Errorf("correction %d sent as %s: %s", i, msgs[i].Attr["type"], inner)
+		}
+	}
+}
+
+func TestCorrectParsed(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var got []xmpp.Message
+	c.HandleMessage(func(m *xmpp.Message) { got = append(got, *m) })
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		// the messages arrive while EntityTime reads the stream
+		return "<message xmlns='jabber:client' from='ops@conf.b/alice' type='groupchat'><body>deploying 40%</body></message>" +
+			"<message xmlns='jabber:client' from='ops@conf.b/alice' type='groupchat'><body>deploying 80%</body>" +
+			"<replace xmlns='" + xmpp.NsCorrect + "' id='m1'/></message>" + result(s)
+	})
+	defer received()
+
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("handled %d messages", len(got))
+	}
+	if got[0].ReplaceID != "" {
+		t.Errorf("plain message has ReplaceID %q", got[0].ReplaceID)
+	}
+	if got[1].ReplaceID != "m1" || got[1].Body != "deploying 80%" {
+		t.Errorf("correction parsed as %q replacing %q", got[1].Body, got[1].ReplaceID)
+	}
+}
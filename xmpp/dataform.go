@@ -0,0 +1,150 @@
+package xmpp
+
+import "encoding/xml"
+
+// DataForm is a data form, the generic form that room configuration,
+// registration and ad-hoc commands are carried in. Type is "form" for a
+// form to be filled in, "submit" for one filled in, and "result" or
+// "cancel" otherwise. It marshals to and from an x element in the
+// jabber:x:data namespace.
+type DataForm struct {
+	Type         string
+	Title        string
+	Instructions string
+	Fields       []DataField
+}
+
+// DataField is a field of a data form. Type is one of the field types such
+// as "text-single", "boolean" or "list-multi", and may be empty in
+// submitted forms.
+type DataField struct {
+	Var      string
+	Type     string
+	Label    string
+	Required bool
+	Values   []string
+	// Options are the choices of list fields
+	Options []DataOption
+}
+
+// DataOption is a choice offered by a list field
+type DataOption struct {
+	Label string
+	Value string
+}
+
+// Value returns the field's first value, or "" if it has none
+func (f *DataField) Value() string {
+	if len(f.Values) == 0 {
+		return ""
+	}
+	return f.Values[0]
+}
+
+// Bool returns the value of a boolean field
+func (f *DataField) Bool() bool {
+	v := f.Value()
+	return v == "1" || v == "true"
+}
+
+// Field returns the field named name, or nil if the form has none
+func (f *DataForm) Field(name string) *DataField {
+	for i := range f.Fields {
+		if f.Fields[i].Var == name {
+			return &f.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Set sets the values of the field named name, adding it if the form
+// doesn't have it
+func (f *DataForm) Set(name string, values ...string) {
+	if field := f.Field(name); field != nil {
+		field.Values = values
+		return
+	}
+	f.Fields = append(f.Fields, DataField{Var: name, Values: values})
+}
+
+// SetBool sets a boolean field
+func (f *DataForm) SetBool(name string, v bool) {
+	if v {
+		f.Set(name, "1")
+	} else {
+		f.Set(name, "0")
+	}
+}
+
+// Submit returns the form filled in as it stands, ready to send back:
+// of type submit, with each field's name, type and values and nothing else.
+// Fixed fields, which only label the form, are left out.
+func (f *DataForm) Submit() *DataForm {
+	s := &DataForm{Type: "submit"}
+	for _, field := range f.Fields {
+		if field.Type == "fixed" || field.Var == "" {
+			continue
+		}
+		s.Fields = append(s.Fields, DataField{Var: field.Var, Type: field.Type, Values: field.Values})
+	}
+	return s
+}
+
+// dataForm is the wire form of DataForm
+type dataForm struct {
+	XMLName      xml.Name    `xml:"jabber:x:data x"`
+	Type         string      `xml:"type,attr"`
+	Title        string      `xml:"title,omitempty"`
+	Instructions string      `xml:"instructions,omitempty"`
+	Fields       []dataField `xml:"field"`
+}
+
+type dataField struct {
+	Var      string    `xml:"var,attr,omitempty"`
+	Type     string    `xml:"type,attr,omitempty"`
+	Label    string    `xml:"label,attr,omitempty"`
+	Required *struct{} `xml:"required"`
+	Values   []string  `xml:"value"`
+	Options  []struct {
+		Label string `xml:"label,attr,omitempty"`
+		Value string `xml:"value"`
+	} `xml:"option"`
+}
+
+// MarshalXML encodes the form as an x element in the jabber:x:data
+// namespace
+func (f DataForm) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	w := dataForm{Type: f.Type, Title: f.Title, Instructions: f.Instructions}
+	for _, field := range f.Fields {
+		df := dataField{Var: field.Var, Type: field.Type, Label: field.Label, Values: field.Values}
+		if field.Required {
+			df.Required = &struct{}{}
+		}
+		for _, o := range field.Options {
+			df.Options = append(df.Options, struct {
+				Label string `xml:"label,attr,omitempty"`
+				Value string `xml:"value"`
+			}{o.Label, o.Value})
+		}
+		w.Fields = append(w.Fields, df)
+	}
+	return e.Encode(w)
+}
+
+// UnmarshalXML decodes the form from an x element in the jabber:x:data
+// namespace
+func (f *DataForm) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var w dataForm
+	if err := d.DecodeElement(&w, &start); err != nil {
+		return err
+	}
+	*f = DataForm{Type: w.Type, Title: w.Title, Instructions: w.Instructions}
+	for _, df := range w.Fields {
+		field := DataField{Var: df.Var, Type: df.Type, Label: df.Label, Required: df.Required != nil, Values: df.Values}
+		for _, o := range df.Options {
+			field.Options = append(field.Options, DataOption{Label: o.Label, Value: o.Value})
+		}
+		f.Fields = append(f.Fields, field)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package xmpp_test
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+)
+
+func TestDataFormRoundTrip(t *testing.T) {
+	form := xmpp.DataForm{
+		Type:         "form",
+		Title:        "Room configuration",
+		Instructions: "Fill in & submit",
+		Fields: []xmpp.DataField{
+			{Var: "FORM_TYPE", Type: "hidden", Values: []string{"http://jabber.org/protocol/muc#roomconfig"}},
+			{Var: "muc#roomconfig_roomname", Type: "text-single", Label: "Name", Required: true, Values: []string{"Ops <alerts>"}},
+			{Var: "muc#roomconfig_persistentroom", Type: "boolean", Label: "Persistent", Values: []string{"1"}},
+			{Var: "muc#roomconfig_allowpm", Type: "list-multi", Label: "Who may message privately", Values: []string{"moderators", "participants"},
+				Options: []xmpp.DataOption{{Label: "Moderators", Value: "moderators"}, {Label: "Participants", Value: "participants"}, {Value: "none"}}},
+		},
+	}
+	b, err := xml.Marshal(form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), `<x xmlns="`+xmpp.NsDataForms+`" type="form">`) {
+		t.Errorf("marshalled to %s", b)
+	}
+	var got xmpp.DataForm
+	if err := xml.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, form) {
+		t.Errorf("round trip of %s gave\n%+v\nwant\n%+v", b, got, form)
+	}
+
+	if f := got.Field("muc#roomconfig_persistentroom"); f == nil || !f.Bool() {
+		t.Errorf("boolean field %+v", f)
+	}
+	if f := got.Field("muc#roomconfig_roomname"); f == nil || f.Value() != "Ops <alerts>" {
+		t.Errorf("text-single field %+v", f)
+	}
+	if got.Field("missing") != nil {
+		t.Error("found a field the form doesn't have")
+	}
+}
+
+func TestDataFormSubmit(t *testing.T) {
+	form := xmpp.DataForm{
+		Type: "form",
+		Fields: []xmpp.DataField{
+			{Type: "fixed", Values: []string{"Account details"}},
+			{Var: "username", Type: "text-single", Label: "User", Required: true},
+			{Var: "public", Type: "boolean", Label: "Listed", Values: []string{"0"}},
+			{Var: "rooms", Type: "list-multi", Options: []xmpp.DataOption{{Value: "ops"}, {Value: "dev"}}},
+		},
+	}
+	form.Set("username", "deploybot")
+	form.SetBool("public", true)
+	form.Set("rooms", "ops", "dev")
+	form.Set("extra", "x")
+
+	b, err := xml.Marshal(form.Submit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got xmpp.DataForm
+	if err := xml.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := xmpp.DataForm{
+		Type: "submit",
+		Fields: []xmpp.DataField{
+			{Var: "username", Type: "text-single", Values: []string{"deploybot"}},
+			{Var: "public", Type: "boolean", Values: []string{"1"}},
+			{Var: "rooms", Type: "list-multi", Values: []string{"ops", "dev"}},
+			{Var: "extra", Values: []string{"x"}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("submitted %s, want %+v", b, want)
+	}
+}
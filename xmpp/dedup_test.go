@@ -0,0 +1,109 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestSeenBefore(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var seen []bool
+	c.HandleMessage(func(m *xmpp.Message) { seen = append(seen, c.SeenBefore(m)) })
+	msg := func(from, ids string) string {
+		return "<message xmlns='jabber:client' from='" + from + "' type='groupchat'><body>hi</body>" + ids + "</message>"
+	}
+	stanzaID := "<stanza-id xmlns='" + xmpp.NsSID + "' id='s1' by='ops@conf.b'/>"
+	originID := "<origin-id xmlns='" + xmpp.NsSID + "' id='o1'/>"
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		// the replayed history arrives while EntityTime reads the stream
+		return msg("ops@conf.b/alice", stanzaID) +
+			msg("ops@conf.b/alice", stanzaID) +
+			msg("alice@b/phone", originID) +
+			msg("bob@b/phone", originID) +
+			msg("Alice@B/laptop", originID) +
+			msg("alice@b/phone", "") +
+			msg("alice@b/phone", "") + result(s)
+	})
+	defer received()
+
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	want := []bool{false, true, false, false, true, false, false}
+	if len(seen) != len(want) {
+		t.Fatalf("handled %d messages, want %d", len(seen), len(want))
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("message %d seen %v, want %v", i, seen[i], want[i])
+		}
+	}
+}
+
+func TestOutgoingOriginID(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	sent := capture(c, server)
+
+	msgID, err := c.MUCSendWithID("groupchat", "ops@conf.b", "", "deploying")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := sent(); !strings.Contains(out, "<origin-id xmlns='"+xmpp.NsSID+"' id='"+msgID+"'/>") {
+		t.Errorf("no origin id %q in %s", msgID, out)
+	}
+	if !c.Echoed(&xmpp.Message{OriginID: msgID}) {
+		t.Error("echo of our own message not recognised")
+	}
+	if c.Echoed(&xmpp.Message{OriginID: "someone-else"}) || c.Echoed(&xmpp.Message{}) {
+		t.Error("another message taken for an echo")
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	clock := &heldClock{now: time.Unix(1e9, 0)}
+	c, server := xmpptest.Pipe(xmpp.WithDedupWindow(2, time.Minute), xmpp.WithClock(clock))
+	defer server.Close()
+	var handled []string
+	c.HandleMessage(func(m *xmpp.Message) { handled = append(handled, m.StanzaID) })
+	var batches []string
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		var b strings.Builder
+		for _, id := range strings.Fields(batches[0]) {
+			b.WriteString("<message xmlns='jabber:client' from='ops@conf.b/alice' type='groupchat'><body>hi</body>" +
+				"<stanza-id xmlns='" + xmpp.NsSID + "' id='" + id + "' by='ops@conf.b'/></message>")
+		}
+		batches = batches[1:]
+		return b.String() + result(s)
+	})
+	defer received()
+
+	tests := []struct {
+		after   time.Duration
+		ids     string
+		handled string
+	}{
+		{0, "s1 s1", "s1"},
+		// s1 is still within the minute, s2 is new
+		{30 * time.Second, "s1 s2", "s2"},
+		// s1 has aged out, and s3 crowds s2 out of a window of two
+		{2 * time.Minute, "s1 s3 s2", "s1 s3 s2"},
+	}
+	start := clock.now
+	for _, tt := range tests {
+		clock.now = start.Add(tt.after)
+		batches = append(batches, tt.ids)
+		handled = nil
+		if _, err := c.EntityTime("b"); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(handled, " "); got != tt.handled {
+			t.Errorf("after %v handled %q of %q, want %q", tt.after, got, tt.ids, tt.handled)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package xmpp
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// The backoff ReconnectWithBackoff uses unless the Dialer says otherwise
+const (
+	defaultBackoffBase = time.Second
+	defaultBackoffMax  = 2 * time.Minute
+)
+
+// Dialer connects sessions with shared settings, pacing a fleet of
+// connections so that they don't all dial the server at once when it comes
+// back from a restart. A Dialer is safe for concurrent use.
+type Dialer struct {
+	sem         chan struct{}
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	dialFunc    func(addr string) (net.Conn, error)
+}
+
+// DialerOption configures a Dialer when it is created
+type DialerOption func(*Dialer)
+
+// WithMaxConcurrentDials limits the connections of the Dialer to n dialing
+// at once, counting reconnects; the rest wait their turn
+func WithMaxConcurrentDials(n int) DialerOption {
+	return func(d *Dialer) {
+		if n > 0 {
+			d.sem = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithBackoff sets the delays ReconnectWithBackoff waits between attempts:
+// a random time up to base doubled after each failure, capped at max
+func WithBackoff(base, max time.Duration) DialerOption {
+	return func(d *Dialer) {
+		d.backoffBase, d.backoffMax = base, max
+	}
+}
+
+// WithDialFunc replaces the tcp dial the Dialer makes to addr with dial,
+// such as to go through a proxy or, in tests, to an in-memory server. dial
+// bypasses the Dialer's own dialing entirely; only WithMaxConcurrentDials
+// still holds calls to it.
+func WithDialFunc(dial func(addr string) (net.Conn, error)) DialerOption {
+	return func(d *Dialer) {
+		d.dialFunc = dial
+	}
+}
+
+// NewDialer creates a Dialer
+func NewDialer(opts ...DialerOption) *Dialer {
+	d := &Dialer{backoffBase: defaultBackoffBase, backoffMax: defaultBackoffMax}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Connect sets up a session as the package's Connect does, dialing under
+// the Dialer's limits. Reconnects of the session are held to them too.
+func (d *Dialer) Connect(host, user, pass, resource string, opts ...Option) (*Conn, error) {
+	return Connect(host, user, pass, resource, append([]Option{withDialer(d)}, opts...)...)
+}
+
+// ImportState resumes an exported session as the package's ImportState
+// does, dialing under the Dialer's limits
+func (d *Dialer) ImportState(st SessionState, host string, opts ...Option) (*Conn, error) {
+	return ImportState(st, host, append([]Option{withDialer(d)}, opts...)...)
+}
+
+// withDialer makes the connection dial through d
+func withDialer(d *Dialer) Option {
+	return func(c *Conn) {
+		c.dialer = d
+	}
+}
+
+// dial connects to addr, waiting for a free slot when dials are limited
+func (d *Dialer) dial(addr string) (net.Conn, error) {
+	if d.sem != nil {
+		d.sem <- struct{}{}
+		defer func() { <-d.sem }()
+	}
+	if d.dialFunc != nil {
+		return d.dialFunc(addr)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// backoff returns how long to wait after the given number of failed
+// attempts: anywhere up to the exponential delay, so that connections that
+// dropped together spread out rather than retrying in step
+func (d *Dialer) backoff(failures int) time.Duration {
+	ceiling := d.backoffMax
+	if failures < 62 {
+		if exp := d.backoffBase << failures; exp > 0 && exp < ceiling {
+			ceiling = exp
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling)
+}
+
+// ReconnectWithBackoff calls Reconnect until it succeeds or ctx is done,
+// waiting a jittered, exponentially growing delay between attempts as set
+// by the Dialer the connection came from. It returns ctx.Err() if it gives
+// up; each failed attempt goes to the error channel.
+func (c *Conn) ReconnectWithBackoff(ctx context.Context) error {
+	d := c.dialer
+	if d == nil {
+		d = NewDialer()
+	}
+	for failures := 0; ; failures++ {
+		err := c.Reconnect()
+		if err == nil {
+			return nil
+		}
+		c.reportError(err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.clock.After(d.backoff(failures)):
+		}
+	}
+}
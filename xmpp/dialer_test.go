@@ -0,0 +1,73 @@
+package xmpp_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestDialerLimitsConcurrentDials(t *testing.T) {
+	const bots, limit = 12, 3
+	srv := xmpptest.NewServer("b")
+	var mu sync.Mutex
+	var inFlight, most, dials int
+	d := xmpp.NewDialer(xmpp.WithMaxConcurrentDials(limit), xmpp.WithDialFunc(func(string) (net.Conn, error) {
+		mu.Lock()
+		inFlight++
+		dials++
+		if inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		// long enough for the others to pile up behind the limit
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return srv.Pipe(), nil
+	}))
+
+	conns := make([]*xmpp.Conn, bots)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := d.Connect("b", "bob", "pw", "bot")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conns[i] = c
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+	// the server restarts and every bot reconnects at once
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *xmpp.Conn) {
+			defer wg.Done()
+			if err := c.Reconnect(); err != nil {
+				t.Error(err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	for _, c := range conns {
+		c.Close()
+	}
+
+	if dials != 2*bots {
+		t.Errorf("dialed %d times, want %d", dials, 2*bots)
+	}
+	if most != limit {
+		t.Errorf("at most %d dials at once, want %d", most, limit)
+	}
+}
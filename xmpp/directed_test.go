@@ -0,0 +1,81 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestDirectedPresenceOnly(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	c, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", "pw", "bot", xmpp.WithDirectedPresenceOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.JoinRoom("ops@conf.b", "bot", xmpp.JoinOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.MUCSendWithID("chat", "alice@b/phone", "", "hi"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Presence("", "away")
+	if err := c.GoOffline("bye"); err != nil {
+		t.Fatal(err)
+	}
+	// a round trip so the server has recorded everything sent before it
+	if _, err := c.GetRoster(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range srv.ReceivedNamed("presence") {
+		to := p.Attr["to"]
+		if to == "" {
+			t.Errorf("broadcast presence %s sent", p.Inner)
+			continue
+		}
+		desc := to
+		if typ := p.Attr["type"]; typ != "" {
+			desc += " " + typ
+		}
+		if strings.Contains(string(p.Inner), "<show>away</show>") {
+			desc += " away"
+		}
+		got = append(got, desc)
+	}
+	want := "ops@conf.b/bot,alice@b,ops@conf.b/bot away,alice@b away,ops@conf.b/bot unavailable,alice@b unavailable"
+	// the away and offline presences go to the room and alice in either order
+	if len(got) != 6 || got[0] != "ops@conf.b/bot" || got[1] != "alice@b" ||
+		!sameSet(got[2:4], []string{"ops@conf.b/bot away", "alice@b away"}) ||
+		!sameSet(got[4:], []string{"ops@conf.b/bot unavailable", "alice@b unavailable"}) {
+		t.Errorf("sent presences %q, want %s", got, want)
+	}
+}
+
+// sameSet reports whether a and b hold the same two strings in any order
+func sameSet(a, b []string) bool {
+	return len(a) == 2 && len(b) == 2 && (a[0] == b[0] && a[1] == b[1] || a[0] == b[1] && a[1] == b[0])
+}
+
+func TestBroadcastPresenceByDefault(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	c, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", "pw", "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	broadcast := 0
+	for _, p := range srv.ReceivedNamed("presence") {
+		if p.Attr["to"] == "" {
+			broadcast++
+		}
+	}
+	if broadcast != 1 {
+		t.Errorf("sent %d broadcast presences on connecting, want 1", broadcast)
+	}
+}
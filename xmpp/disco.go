@@ -0,0 +1,132 @@
+package xmpp
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"sort"
+)
+
+const (
+	xmlIqResultQuery  = "<iq type='result' id='%s' to='%s'><query xmlns='%s'%s>%s</query></iq>"
+	xmlDiscoItem      = "<item jid='%s'%s%s/>"
+	xmlDiscoIdentity  = "<identity category='%s' type='%s'%s%s/>"
+	xmlDiscoFeature   = "<feature var='%s'/>"
+	xmlCapsAdvertised = "<c xmlns='%s' hash='sha-1' node='%s' ver='%s'/>"
+
+	// capsNode is the node the connection advertises its capabilities under
+	capsNode = "https://github.com/lusis/hipchat"
+)
+
+// defaultIdentity is who the connection says it is in its disco#info until
+// SetDiscoInfo says otherwise
+var defaultIdentity = Identity{Category: "client", Type: "bot", Name: "hipchat"}
+
+// answeredFeatures are the features the connection answers itself, always
+// listed in its disco#info
+var answeredFeatures = []string{NsDiscoInfo, NsDisco, NsPing, NsCaps}
+
+// DiscoItem is an item the connection lists when queried for its
+// disco#items, such as an ad-hoc command node
+type DiscoItem struct {
+	Jid  string
+	Node string
+	Name string
+}
+
+type discoItemsQuery struct {
+	Query struct {
+		Node string `xml:"node,attr"`
+	} `xml:"query"`
+}
+
+// SetDiscoItems sets the items returned when another entity queries the
+// connection's disco#items. Until it is called an empty list is returned.
+func (c *Conn) SetDiscoItems(items []DiscoItem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.discoItems = append([]DiscoItem(nil), items...)
+}
+
+func (c *Conn) replyDiscoItems(s *Stanza) error {
+	var q discoItemsQuery
+	if err := s.decode(&q); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	items := c.discoItems
+	c.mu.Unlock()
+
+	var b bytes.Buffer
+	for _, i := range items {
+		fmt.Fprintf(&b, xmlDiscoItem, html.EscapeString(i.Jid), optAttr("node", i.Node), optAttr("name", i.Name))
+	}
+	return c.send(xmlIqResultQuery, html.EscapeString(s.Attr["id"]), html.EscapeString(s.Attr["from"]), NsDisco, optAttr("node", q.Query.Node), b.String())
+}
+
+// SetDiscoInfo sets the identities and extra features listed when another
+// entity queries the connection's disco#info, and so the capabilities its
+// presence advertises. The features the connection answers itself are
+// always listed; without identities it calls itself a client bot.
+func (c *Conn) SetDiscoInfo(identities []Identity, features []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.discoIdentities = append([]Identity(nil), identities...)
+	c.discoFeatures = append([]string(nil), features...)
+}
+
+// discoInfo returns the identities and the sorted, deduplicated features
+// of the connection's disco#info
+func (c *Conn) discoInfo() ([]Identity, []string) {
+	c.mu.Lock()
+	identities := c.discoIdentities
+	extra := c.discoFeatures
+	c.mu.Unlock()
+	if len(identities) == 0 {
+		identities = []Identity{defaultIdentity}
+	}
+
+	seen := make(map[string]bool)
+	var features []string
+	for _, f := range append(append([]string(nil), answeredFeatures...), extra...) {
+		if !seen[f] {
+			seen[f] = true
+			features = append(features, f)
+		}
+	}
+	sort.Strings(features)
+	return identities, features
+}
+
+// capsVer is the verification string of the connection's disco#info
+func (c *Conn) capsVer() string {
+	return CapsVer(c.discoInfo())
+}
+
+// capsElement renders the capabilities the connection advertises in its
+// presence
+func (c *Conn) capsElement() string {
+	return fmt.Sprintf(xmlCapsAdvertised, NsCaps, capsNode, c.capsVer())
+}
+
+func (c *Conn) replyDiscoInfo(s *Stanza) error {
+	var q discoItemsQuery
+	if err := s.decode(&q); err != nil {
+		return err
+	}
+	identities, features := c.discoInfo()
+	if node := q.Query.Node; node != "" && node != capsNode+"#"+CapsVer(identities, features) {
+		return c.SendRaw(newIQ(s).Reply("error", xmlItemNotFound))
+	}
+
+	var b bytes.Buffer
+	for _, i := range identities {
+		fmt.Fprintf(&b, xmlDiscoIdentity, html.EscapeString(i.Category), html.EscapeString(i.Type),
+			optAttr("xml:lang", i.Lang), optAttr("name", i.Name))
+	}
+	for _, f := range features {
+		fmt.Fprintf(&b, xmlDiscoFeature, html.EscapeString(f))
+	}
+	return c.send(xmlIqResultQuery, html.EscapeString(s.Attr["id"]), html.EscapeString(s.Attr["from"]), NsDiscoInfo, optAttr("node", q.Query.Node), b.String())
+}
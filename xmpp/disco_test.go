@@ -0,0 +1,156 @@
+package xmpp_test
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// query has c answer the iqs in requests under Run, returning its replies
+// in order
+func query(t *testing.T, c *xmpp.Conn, server io.ReadWriter, requests ...string) []*xmpp.Stanza {
+	t.Helper()
+	replies := make(chan *xmpp.Stanza, len(requests))
+	go io.WriteString(server, streamHeader+strings.Join(requests, ""))
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+	d := xml.NewDecoder(server)
+	go func() {
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			var raw struct {
+				Inner []byte `xml:",innerxml"`
+			}
+			if d.DecodeElement(&raw, &start) != nil {
+				return
+			}
+			if start.Name.Local == "iq" {
+				replies <- &xmpp.Stanza{Name: start.Name, Attr: xmpp.ToMap(start.Attr), Inner: raw.Inner}
+			}
+		}
+	}()
+
+	var got []*xmpp.Stanza
+	for range requests {
+		select {
+		case s := <-replies:
+			got = append(got, s)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d requests answered", len(got), len(requests))
+		}
+	}
+	io.WriteString(server, "</stream:stream>")
+	<-done
+	return got
+}
+
+func TestDiscoItems(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	c.SetDiscoItems([]xmpp.DiscoItem{{Jid: "bot@b/r", Node: xmpp.NsCommands, Name: "Commands"}})
+	got := query(t, c, server, "<iq type='get' id='q1' from='a@b/c'><query xmlns='"+xmpp.NsDisco+"' node='"+xmpp.NsCommands+"'/></iq>")
+
+	r := got[0]
+	if r.Attr["type"] != "result" || r.Attr["id"] != "q1" || r.Attr["to"] != "a@b/c" {
+		t.Fatalf("reply %v", r.Attr)
+	}
+	var q struct {
+		Node  string `xml:"node,attr"`
+		Items []struct {
+			Jid  string `xml:"jid,attr"`
+			Node string `xml:"node,attr"`
+			Name string `xml:"name,attr"`
+		} `xml:"item"`
+	}
+	if err := xml.Unmarshal(r.Inner, &q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Node != xmpp.NsCommands || len(q.Items) != 1 || q.Items[0].Jid != "bot@b/r" || q.Items[0].Name != "Commands" {
+		t.Errorf("items %+v", q)
+	}
+}
+
+func TestDiscoItemsUnset(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	got := query(t, c, server, "<iq type='get' id='q1' from='a@b/c'><query xmlns='"+xmpp.NsDisco+"'/></iq>")
+	if r := got[0]; r.Attr["type"] != "result" || strings.Contains(string(r.Inner), "<item") {
+		t.Errorf("reply %v %s", r.Attr, r.Inner)
+	}
+}
+
+func TestDiscoInfo(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	c.SetDiscoInfo([]xmpp.Identity{{Category: "client", Type: "bot", Name: "ops"}}, []string{xmpp.NsCommands})
+	got := query(t, c, server, "<iq type='get' id='q1' from='a@b/c'><query xmlns='"+xmpp.NsDiscoInfo+"'/></iq>")
+
+	var info xmpp.DiscoInfo
+	if err := xml.Unmarshal(got[0].Inner, &info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Identities) != 1 || info.Identities[0].Name != "ops" {
+		t.Errorf("identities %+v", info.Identities)
+	}
+	for _, f := range []string{xmpp.NsDiscoInfo, xmpp.NsDisco, xmpp.NsPing, xmpp.NsCommands} {
+		if !info.HasFeature(f) {
+			t.Errorf("feature %s not listed", f)
+		}
+	}
+}
+
+func TestDiscoInfoCapsNode(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	// the caps the connection advertises in its presence
+	var p struct {
+		Caps struct {
+			Node string `xml:"node,attr"`
+			Ver  string `xml:"ver,attr"`
+		} `xml:"http://jabber.org/protocol/caps c"`
+	}
+	sent := capture(c, server)
+	if err := c.UpdateStatus("here"); err != nil {
+		t.Fatal(err)
+	}
+	out := sent()
+	if err := xml.Unmarshal([]byte(out[:strings.Index(out, "</presence>")+len("</presence>")]), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Caps.Ver == "" {
+		t.Fatalf("no caps advertised: %s", out)
+	}
+
+	c, server = xmpptest.Pipe()
+	defer server.Close()
+	got := query(t, c, server,
+		"<iq type='get' id='q1' from='a@b/c'><query xmlns='"+xmpp.NsDiscoInfo+"' node='"+p.Caps.Node+"#"+p.Caps.Ver+"'/></iq>",
+		"<iq type='get' id='q2' from='a@b/c'><query xmlns='"+xmpp.NsDiscoInfo+"' node='"+p.Caps.Node+"#other'/></iq>")
+
+	if got[0].Attr["type"] != "result" {
+		t.Fatalf("caps node refused: %s", got[0].Inner)
+	}
+	var info xmpp.DiscoInfo
+	if err := xml.Unmarshal(got[0].Inner, &info); err != nil {
+		t.Fatal(err)
+	}
+	if !xmpp.VerifyCaps(p.Caps.Ver, &info) {
+		t.Errorf("advertised ver %s doesn't match the disco#info answered", p.Caps.Ver)
+	}
+	if got[1].Attr["type"] != "error" || !strings.Contains(string(got[1].Inner), "item-not-found") {
+		t.Errorf("unknown node answered %v %s", got[1].Attr, got[1].Inner)
+	}
+}
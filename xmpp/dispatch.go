@@ -0,0 +1,653 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrRunStopped is returned to callers waiting on a reply when Run returns
+// before the reply arrives
+var ErrRunStopped = errors.New("run loop stopped")
+
+// ErrTimeout is returned when the server doesn't answer in time
+var ErrTimeout = errors.New("timed out waiting for the server")
+
+// ErrIQTimeout is returned when an iq goes unanswered within the time set
+// by WithIQTimeout, retries included. It is also an ErrTimeout.
+var ErrIQTimeout = fmt.Errorf("iq: %w", ErrTimeout)
+
+// Stanza is a top level element read from the stream. Its children are kept
+// as raw xml until something decodes them.
+type Stanza struct {
+	Name  xml.Name
+	Attr  map[string]string
+	Inner []byte
+	// RawXML is the stanza exactly as received, with WithRawXML
+	RawXML []byte
+
+	start xml.StartElement
+	// lenient decodes the children leniently, as read with
+	// WithLenientParsing
+	lenient bool
+}
+
+// xml renders the stanza, exactly as received if WithRawXML kept it
+func (s *Stanza) xml() []byte {
+	if s.RawXML != nil {
+		return s.RawXML
+	}
+	keys := make([]string, 0, len(s.Attr))
+	for k := range s.Attr {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString("<" + s.Name.Local)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s='%s'", k, html.EscapeString(s.Attr[k]))
+	}
+	b.WriteByte('>')
+	b.Write(s.Inner)
+	b.WriteString("</" + s.Name.Local + ">")
+	return b.Bytes()
+}
+
+// stanzaDecoder is the state decode reuses from one stanza to the next: the
+// buffer the children are wrapped in and a decoder reading it
+type stanzaDecoder struct {
+	buf []byte
+	r   bytes.Reader
+	d   *xml.Decoder
+}
+
+// maxPooledDecode bounds the buffers decoderPool keeps, so that one huge
+// stanza doesn't pin its buffer for good
+const maxPooledDecode = 64 << 10
+
+var decoderPool = sync.Pool{New: func() interface{} { return new(stanzaDecoder) }}
+
+// decode unmarshals the stanza's children into v
+func (s *Stanza) decode(v interface{}) error {
+	sd := decoderPool.Get().(*stanzaDecoder)
+	b := append(sd.buf[:0], '<')
+	b = append(b, s.Name.Local...)
+	b = append(b, '>')
+	b = append(b, s.Inner...)
+	b = append(b, "</"...)
+	b = append(b, s.Name.Local...)
+	b = append(b, '>')
+	sd.buf = b
+	sd.r.Reset(b)
+	if sd.d == nil {
+		sd.d = xml.NewDecoder(&sd.r)
+	}
+	sd.d.Strict = !s.lenient
+	err := sd.d.Decode(v)
+	// a decoder that failed, or stopped short, is left mid-element and
+	// can't be trusted with the next stanza
+	if err != nil || sd.r.Len() != 0 {
+		sd.d = nil
+	}
+	if cap(sd.buf) <= maxPooledDecode {
+		decoderPool.Put(sd)
+	}
+	return err
+}
+
+// StanzaError is an error the server returned in reply to a stanza
+type StanzaError struct {
+	Type      string
+	Condition string
+	Text      string
+}
+
+func (e *StanzaError) Error() string {
+	if e.Text != "" {
+		return e.Condition + ": " + e.Text
+	}
+	return e.Condition
+}
+
+// stanzaError is the error child of a stanza with type='error'
+type stanzaError struct {
+	Type       string `xml:"type,attr"`
+	Text       string `xml:"text"`
+	Conditions []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// err converts the parsed error into a StanzaError
+func (e *stanzaError) err() *StanzaError {
+	if e == nil {
+		return &StanzaError{Condition: "undefined-condition"}
+	}
+	se := &StanzaError{Type: e.Type, Text: e.Text, Condition: "undefined-condition"}
+	for _, c := range e.Conditions {
+		if c.XMLName.Local != "text" {
+			se.Condition = c.XMLName.Local
+			break
+		}
+	}
+	return se
+}
+
+type waiter struct {
+	match func(*Stanza) bool
+	done  chan *Stanza
+}
+
+// shutdownGrace bounds how long Run waits for the server to close its side
+// of the stream once ctx is done
+const shutdownGrace = 5 * time.Second
+
+// readDeadliner is a connection whose reads can be interrupted
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Run reads stanzas from the connection and dispatches them until the
+// stream fails or ctx is done. While Run is going, methods that wait on a
+// reply from the server leave the reading to it.
+//
+// When ctx is done Run interrupts the read in progress, goes offline and
+// closes the stream, giving the server a few seconds to close its side
+// before the connection is closed, and returns ctx's error. Any other
+// error means the stream failed: a *StreamError, *RedirectError or
+// ErrHostUnknown if the server ended it with a stream error,
+// ErrStreamClosed if it closed it without one, or ErrConnectionLost if the
+// connection dropped. The server ending the stream is answered with the
+// connection's own closing tag before the connection is closed.
+func (c *Conn) Run(ctx context.Context) error {
+	c.mu.Lock()
+	c.running = true
+	c.mu.Unlock()
+	defer c.stopRunning()
+
+	stop := context.AfterFunc(ctx, func() {
+		if d, ok := c.outgoing.(readDeadliner); ok {
+			d.SetReadDeadline(time.Now())
+		}
+	})
+	defer stop()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return c.farewell(err)
+		}
+		s, err := c.readStanza()
+		if err != nil {
+			if ctx.Err() != nil {
+				return c.farewell(ctx.Err())
+			}
+			if errors.Is(err, ErrStreamClosed) || isStreamError(err) {
+				c.answerClose()
+			}
+			return err
+		}
+		c.dispatch(s)
+	}
+}
+
+// RunWithReconnect runs the dispatch loop like Run, reconnecting with
+// ReconnectWithBackoff each time the connection is lost or the server
+// closes the stream without a stream error, as servers do on idle timeouts
+// and restarts. It returns when ctx is done, when reconnecting fails or
+// when Run fails any other way, such as with a *StreamError.
+func (c *Conn) RunWithReconnect(ctx context.Context) error {
+	for {
+		err := c.Run(ctx)
+		if !errors.Is(err, ErrConnectionLost) && !errors.Is(err, ErrStreamClosed) {
+			return err
+		}
+		if err := c.ReconnectWithBackoff(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// farewell ends the session politely once Run has been cancelled, returning
+// reason. The decoder is unusable after an interrupted read, so the
+// server's closing tag is looked for in the raw stream, starting with what
+// the decoder has read ahead, since the tag may have arrived already.
+func (c *Conn) farewell(reason error) error {
+	d, ok := c.outgoing.(readDeadliner)
+	if ok {
+		d.SetReadDeadline(time.Time{})
+	}
+	c.GoOffline("")
+	if err := c.sendStreamClose(); err == nil {
+		c.flushQueue()
+		if ok {
+			d.SetReadDeadline(time.Now().Add(shutdownGrace))
+			awaitStreamClose(c.inbuf)
+		}
+	}
+	c.outgoing.Close()
+	return reason
+}
+
+// sendStreamClose ends the stream from the connection's side
+func (c *Conn) sendStreamClose() error {
+	c.mu.Lock()
+	c.closeSent = true
+	c.mu.Unlock()
+	return c.send(xmlStreamClose)
+}
+
+// answerClose answers the server closing the stream with the connection's
+// own closing tag, unless it has already sent one, and closes the
+// connection
+func (c *Conn) answerClose() {
+	c.mu.Lock()
+	sent := c.closeSent
+	c.mu.Unlock()
+	if !sent {
+		c.sendStreamClose()
+		c.flushQueue()
+	}
+	c.outgoing.Close()
+}
+
+// awaitStreamClose reads r until the closing stream tag or an error
+func awaitStreamClose(r io.Reader) {
+	tail := make([]byte, 0, 512)
+	buf := make([]byte, 256)
+	for {
+		n, err := r.Read(buf)
+		tail = append(tail, buf[:n]...)
+		if bytes.Contains(tail, []byte(xmlStreamClose)) || err != nil {
+			return
+		}
+		if len(tail) > len(xmlStreamClose) {
+			tail = append(tail[:0], tail[len(tail)-len(xmlStreamClose):]...)
+		}
+	}
+}
+
+// isRunning reports whether Run is reading the stream
+func (c *Conn) isRunning() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running
+}
+
+func (c *Conn) stopRunning() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = false
+	for _, w := range c.waiters {
+		close(w.done)
+	}
+	c.waiters = nil
+}
+
+// readStanza reads the next top level element in full. The opening stream
+// element is returned without children since it spans the whole session.
+func (c *Conn) readStanza() (*Stanza, error) {
+	element, err := c.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Stanza{Name: element.Name, Attr: ToMap(element.Attr), start: element, lenient: c.lenient}
+	if element.Name.Local == "stream" && element.Name.Space == NsStream {
+		c.streamOpened(s.Attr)
+		return s, nil
+	}
+
+	var raw struct {
+		Inner []byte `xml:",innerxml"`
+	}
+	if err := c.incoming.DecodeElement(&raw, &element); err != nil {
+		return nil, readError(err)
+	}
+	s.Inner = raw.Inner
+	if c.raw != nil {
+		s.RawXML = c.raw.span(c.rawStart, c.incoming.InputOffset())
+	}
+	if s.Name.Space == NsJabberClient {
+		c.handled()
+	}
+	c.countReceived(s)
+	if c.logger != nil {
+		c.logf("recv: %s", s.xml())
+	}
+	if s.Name.Local == "error" && s.Name.Space == NsStream {
+		return nil, parseStreamError(s)
+	}
+	return s, nil
+}
+
+// child returns the name of the stanza's first child element
+func (s *Stanza) child() xml.Name {
+	d := xml.NewDecoder(bytes.NewReader(s.Inner))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return xml.Name{}
+		}
+		if e, ok := t.(xml.StartElement); ok {
+			return e.Name
+		}
+	}
+}
+
+// dispatch hands s to the first waiter that wants it, or failing that to
+// whatever handles its kind of stanza
+func (c *Conn) dispatch(s *Stanza) {
+	defer c.recoverHandler(s)
+	c.mu.Lock()
+	for i, w := range c.waiters {
+		if w.match(s) {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			c.mu.Unlock()
+			w.done <- s
+			return
+		}
+	}
+	unknown := c.unknownHandler
+	middleware := c.middleware
+	c.mu.Unlock()
+
+	space := s.Name.Space
+	if space == NsComponentAccept {
+		space = NsJabberClient
+	}
+	if space == NsJabberClient && len(middleware) > 0 {
+		var ok bool
+		if s, ok = applyMiddleware(middleware, s); !ok {
+			return
+		}
+	}
+	switch s.Name.Local + space {
+	case "iq" + NsJabberClient:
+		c.handle(s, c.handleIQ)
+	case "message" + NsJabberClient:
+		if c.flooded(s.Attr["from"]) {
+			return
+		}
+		c.handle(s, c.handleMessage)
+	case "presence" + NsJabberClient:
+		c.handle(s, c.handlePresence)
+	case "stream" + NsStream:
+	case "r" + NsSM:
+		if err := c.ackRequested(); err != nil {
+			c.reportError(err)
+		}
+	case "a" + NsSM:
+		c.acked(s.Attr["h"])
+	default:
+		if unknown != nil {
+			unknown(s.start.Copy(), s.Inner)
+		}
+	}
+}
+
+// Use adds middleware to the chain the dispatch loop passes each message,
+// presence and iq through before handing it to the handlers. Middleware
+// runs in the order it was added, and each sees the stanza as the one
+// before it returned it; returning false drops the stanza. Replies the
+// connection is waiting on itself, such as iq results, bypass the chain.
+func (c *Conn) Use(middleware func(Stanza) (Stanza, bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.middleware = append(c.middleware, middleware)
+}
+
+// applyMiddleware runs s through the chain, reporting whether it survived
+func applyMiddleware(chain []func(Stanza) (Stanza, bool), s *Stanza) (*Stanza, bool) {
+	v := *s
+	for _, mw := range chain {
+		var ok bool
+		if v, ok = mw(v); !ok {
+			return nil, false
+		}
+	}
+	return &v, true
+}
+
+// OnHandlerPanic sets the function called when a handler panics while the
+// dispatch loop is handling a stanza, with the value the handler panicked
+// with and the stanza's xml. The loop carries on with the next stanza once
+// fn returns. fn runs before the panic unwinds, so runtime/debug.Stack
+// shows where it happened. Without fn the panic is logged with its stack.
+func (c *Conn) OnHandlerPanic(fn func(interface{}, []byte)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.panicHandler = fn
+}
+
+// recoverHandler stops a handler's panic from ending the dispatch loop
+func (c *Conn) recoverHandler(s *Stanza) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	c.mu.Lock()
+	fn := c.panicHandler
+	c.mu.Unlock()
+	if fn != nil {
+		fn(v, s.xml())
+		return
+	}
+	log.Printf("xmpp: handler panic: %v\nstanza: %s\n%s", v, s.xml(), debug.Stack())
+}
+
+// HandleUnknown sets a function to be called with each element read by the
+// dispatch loop that isn't a kind of stanza the package knows about, along
+// with the raw xml of its children. Such elements are dropped by default.
+func (c *Conn) HandleUnknown(fn func(xml.StartElement, []byte)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unknownHandler = fn
+}
+
+// handleIQ answers the requests the connection responds to on its own and
+// passes the rest to the iq handler. Requests nobody handles are refused
+// with service-unavailable.
+func (c *Conn) handleIQ(s *Stanza) {
+	typ := s.Attr["type"]
+	if typ == "get" && s.child() == (xml.Name{Space: NsPing, Local: "ping"}) {
+		// answered before any handler, as a server may drop a client
+		// that leaves its pings unanswered
+		if err := c.SendRaw(newIQ(s).Reply("result", "")); err != nil {
+			c.reportError(err)
+		}
+		return
+	}
+	if typ == "get" && s.child().Space == NsDisco {
+		if err := c.replyDiscoItems(s); err != nil {
+			c.reportError(err)
+		}
+		return
+	}
+	if typ == "get" && s.child().Space == NsDiscoInfo {
+		if err := c.replyDiscoInfo(s); err != nil {
+			c.reportError(err)
+		}
+		return
+	}
+	if s.child().Space == NsIqRoster {
+		switch typ {
+		case "set":
+			c.handleRosterPush(s)
+			return
+		case "result":
+			c.handleRosterResult(s)
+		}
+	}
+	if space := s.child().Space; typ == "set" && (space == NsSI || space == NsJingle) {
+		if c.handleFileOffer(s) {
+			return
+		}
+	}
+
+	c.mu.Lock()
+	fn := c.iqHandler
+	c.mu.Unlock()
+
+	iq := newIQ(s)
+	if fn != nil {
+		fn(iq)
+		return
+	}
+	if typ == "get" || typ == "set" {
+		if err := c.SendRaw(iq.Reply("error", xmlServiceUnavailable)); err != nil {
+			c.reportError(err)
+		}
+	}
+}
+
+// expect registers interest in the first stanza for which match returns
+// true. It must be called before sending the request the stanza answers.
+func (c *Conn) expect(match func(*Stanza) bool) *waiter {
+	w := &waiter{match: match, done: make(chan *Stanza, 1)}
+	c.mu.Lock()
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+	return w
+}
+
+// wait blocks until the stanza w expects has been read. Without Run going
+// the stream is read here instead, dispatching anything else that arrives.
+func (c *Conn) wait(w *waiter) (*Stanza, error) {
+	if c.isRunning() {
+		s, ok := <-w.done
+		if !ok {
+			return nil, ErrRunStopped
+		}
+		return s, nil
+	}
+
+	c.forget(w)
+	select {
+	case s := <-w.done:
+		return s, nil
+	default:
+	}
+	for {
+		s, err := c.readStanza()
+		if err != nil {
+			return nil, err
+		}
+		if w.match(s) {
+			return s, nil
+		}
+		c.dispatch(s)
+	}
+}
+
+// waitTimeout is wait giving up after d with ErrTimeout. Without Run going
+// the stream is read here under a read deadline, and as the decoder is
+// unusable after an interrupted read, timing out then leaves the stream
+// unreadable.
+func (c *Conn) waitTimeout(w *waiter, d time.Duration) (*Stanza, error) {
+	if !c.isRunning() {
+		rd, ok := c.outgoing.(readDeadliner)
+		if !ok {
+			return c.wait(w)
+		}
+		rd.SetReadDeadline(time.Now().Add(d))
+		defer rd.SetReadDeadline(time.Time{})
+		s, err := c.wait(w)
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return nil, ErrTimeout
+		}
+		return s, err
+	}
+
+	select {
+	case s, ok := <-w.done:
+		if !ok {
+			return nil, ErrRunStopped
+		}
+		return s, nil
+	case <-c.clock.After(d):
+		c.forget(w)
+		return nil, ErrTimeout
+	}
+}
+
+// sendIQ sends an iq built from format and waits for the result with the
+// given id. An error result is returned as a *StanzaError. With
+// WithIQTimeout an iq that goes unanswered is sent again, under a fresh id
+// so that a late answer to the first is ignored, as many times as allowed
+// before giving up with ErrIQTimeout.
+func (c *Conn) sendIQ(iqID, format string, a ...interface{}) (*Stanza, error) {
+	for attempt := 0; ; attempt++ {
+		s, err := c.tryIQ(iqID, format, a...)
+		if !errors.Is(err, ErrTimeout) || attempt >= c.iqRetries || !c.isRunning() {
+			return s, err
+		}
+		retryID := id()
+		retry := make([]interface{}, len(a))
+		for i, v := range a {
+			if v == iqID {
+				v = retryID
+			}
+			retry[i] = v
+		}
+		iqID, a = retryID, retry
+	}
+}
+
+// tryIQ makes a single attempt of sendIQ
+func (c *Conn) tryIQ(iqID, format string, a ...interface{}) (*Stanza, error) {
+	w := c.expect(func(s *Stanza) bool {
+		return s.Name.Local == "iq" && s.Attr["id"] == iqID &&
+			(s.Attr["type"] == "result" || s.Attr["type"] == "error")
+	})
+	if err := c.send(format, a...); err != nil {
+		c.forget(w)
+		return nil, err
+	}
+
+	var s *Stanza
+	var err error
+	if c.iqTimeout > 0 {
+		s, err = c.waitTimeout(w, c.iqTimeout)
+		if err == ErrTimeout {
+			err = ErrIQTimeout
+		}
+	} else {
+		s, err = c.wait(w)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Attr["type"] == "error" {
+		var e struct {
+			Error *stanzaError `xml:"error"`
+		}
+		if err := s.decode(&e); err != nil {
+			return nil, err
+		}
+		return nil, e.Error.err()
+	}
+	return s, nil
+}
+
+func (c *Conn) forget(w *waiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, o := range c.waiters {
+		if o == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
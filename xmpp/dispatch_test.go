@@ -0,0 +1,294 @@
+package xmpp_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+const streamHeader = "<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0' id='s1'>"
+
+// serve writes script to server, then reads and discards whatever the
+// client sends until the pipe is closed
+func serve(server net.Conn, script string) {
+	go func() {
+		io.WriteString(server, script)
+		io.Copy(io.Discard, server)
+	}()
+}
+
+// capture reads whatever c writes to server, returning a func that closes c
+// and gives back all it wrote
+func capture(c *xmpp.Conn, server net.Conn) func() string {
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(server)
+		done <- string(b)
+	}()
+	return func() string {
+		c.Close()
+		return <-done
+	}
+}
+
+// answer plays the server on server, passing each stanza c sends to reply
+// and writing back whatever it returns. Replies are written on their own
+// goroutine so that the server keeps reading while c writes. It returns a
+// func that closes c and gives back every stanza c sent.
+func answer(c *xmpp.Conn, server net.Conn, reply func(s *xmpp.Stanza) string) func() []*xmpp.Stanza {
+	done := make(chan []*xmpp.Stanza)
+	replies := make(chan string, 64)
+	go func() {
+		for r := range replies {
+			io.WriteString(server, r)
+		}
+	}()
+	go func() {
+		defer close(replies)
+		var got []*xmpp.Stanza
+		d := xml.NewDecoder(server)
+		for {
+			t, err := d.Token()
+			if err != nil {
+				break
+			}
+			start, ok := t.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			var raw struct {
+				Inner []byte `xml:",innerxml"`
+			}
+			if err := d.DecodeElement(&raw, &start); err != nil {
+				break
+			}
+			s := &xmpp.Stanza{Name: start.Name, Attr: xmpp.ToMap(start.Attr), Inner: raw.Inner}
+			got = append(got, s)
+			if r := reply(s); r != "" {
+				replies <- r
+			}
+		}
+		io.Copy(io.Discard, server)
+		done <- got
+	}()
+	return func() []*xmpp.Stanza {
+		c.Close()
+		return <-done
+	}
+}
+
+// result answers an iq with an empty result
+func result(s *xmpp.Stanza) string {
+	if s.Name.Local != "iq" {
+		return ""
+	}
+	return "<iq type='result' id='" + s.Attr["id"] + "'/>"
+}
+
+// startRun starts c's Run over server and waits until it is reading, so
+// that requests made afterwards wait on Run rather than read the stream
+// themselves. It returns a func that has the server close the stream and
+// waits for Run to return.
+func startRun(t *testing.T, c *xmpp.Conn, server net.Conn) func() error {
+	t.Helper()
+	ready := make(chan struct{})
+	c.HandleUnknown(func(start xml.StartElement, _ []byte) {
+		if start.Name.Local == "ready" {
+			close(ready)
+		}
+	})
+	go io.WriteString(server, streamHeader+"<ready xmlns='urn:test'/>")
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run not reading")
+	}
+	return func() error {
+		io.WriteString(server, "</stream:stream>")
+		return <-done
+	}
+}
+
+// rosterResult answers a roster get with items, and any other iq with an
+// empty result
+func rosterResult(items string) func(*xmpp.Stanza) string {
+	return func(s *xmpp.Stanza) string {
+		if s.Name.Local == "iq" && strings.Contains(string(s.Inner), xmpp.NsIqRoster) {
+			return "<iq type='result' id='" + s.Attr["id"] + "'><query xmlns='" + xmpp.NsIqRoster + "'>" + items + "</query></iq>"
+		}
+		return result(s)
+	}
+}
+
+func runFor(t *testing.T, run func(context.Context) error) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := run(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("run didn't return")
+	}
+	return err
+}
+
+func TestRunStreamError(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    string
+		condition string
+	}{
+		{"conflict", "<stream:error><conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>", "conflict"},
+		{"system-shutdown", "<stream:error><system-shutdown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/><text xmlns='urn:ietf:params:xml:ns:xmpp-streams'>bye</text></stream:error></stream:stream>", "system-shutdown"},
+		{"unqualified condition", "<stream:error><conflict/></stream:error></stream:stream>", "undefined-condition"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			serve(server, streamHeader+tt.script)
+
+			err := runFor(t, c.Run)
+			var se *xmpp.StreamError
+			if !errors.As(err, &se) {
+				t.Fatalf("Run returned %v, want a *StreamError", err)
+			}
+			if se.Condition != tt.condition {
+				t.Errorf("condition %q, want %q", se.Condition, tt.condition)
+			}
+			if errors.Is(err, xmpp.ErrStreamClosed) {
+				t.Error("stream error reported as a clean close")
+			}
+		})
+	}
+}
+
+func TestRunWithReconnectStopsOnStreamError(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	serve(server, streamHeader+"<stream:error><conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>")
+
+	err := runFor(t, c.RunWithReconnect)
+	var se *xmpp.StreamError
+	if !errors.As(err, &se) || se.Condition != "conflict" {
+		t.Fatalf("RunWithReconnect returned %v, want the conflict", err)
+	}
+	if n := c.Stats().Reconnects; n != 0 {
+		t.Errorf("reconnected %d times after a stream error", n)
+	}
+}
+
+func TestRunCleanClose(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	answered := make(chan string, 1)
+	go func() {
+		io.WriteString(server, streamHeader+"</stream:stream>")
+		b, _ := io.ReadAll(server)
+		answered <- string(b)
+	}()
+
+	if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v, want ErrStreamClosed", err)
+	}
+	select {
+	case got := <-answered:
+		if got != "</stream:stream>" {
+			t.Errorf("client answered %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't closed")
+	}
+}
+
+func TestRunConnectionLost(t *testing.T) {
+	tests := []struct {
+		name, script string
+		want, not    error
+	}{
+		{"mid stanza", streamHeader + "<message from='a@b/c' type='chat'><body>cut sh", xmpp.ErrConnectionLost, xmpp.ErrStreamClosed},
+		{"between stanzas", streamHeader + "<presence from='a@b/c'/>", xmpp.ErrConnectionLost, xmpp.ErrStreamClosed},
+		{"clean close", streamHeader + "</stream:stream>", xmpp.ErrStreamClosed, xmpp.ErrConnectionLost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			go func() {
+				io.WriteString(server, tt.script)
+				server.Close()
+			}()
+			err := runFor(t, c.Run)
+			if !errors.Is(err, tt.want) || errors.Is(err, tt.not) {
+				t.Errorf("Run returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunWithReconnectAfterCleanClose(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	serve(server, streamHeader+"</stream:stream>")
+	errs := make(chan error, 16)
+	c.SetErrorChannel(errs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.RunWithReconnect(ctx) }()
+
+	// the pipe has no host to redial, so the attempt fails at the dial
+	timeout := time.After(5 * time.Second)
+	for attempted := false; !attempted; {
+		select {
+		case err := <-errs:
+			var ce *xmpp.ConnectError
+			attempted = errors.As(err, &ce) && ce.Phase == xmpp.PhaseDial
+		case err := <-done:
+			t.Fatalf("RunWithReconnect returned %v without reconnecting", err)
+		case <-timeout:
+			t.Fatal("no reconnect attempted")
+		}
+	}
+	cancel()
+	go func() {
+		for range errs {
+		}
+	}()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("RunWithReconnect returned %v", err)
+	}
+}
+
+func TestHandleUnknown(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var names []string
+	var inner string
+	c.HandleUnknown(func(start xml.StartElement, children []byte) {
+		names = append(names, start.Name.Space+" "+start.Name.Local)
+		inner = string(children)
+	})
+	serve(server, streamHeader+
+		"<custom xmlns='urn:example' a='1'><child>x</child></custom>"+
+		"<message from='a@b' type='chat'><body>known</body></message>"+
+		"</stream:stream>")
+
+	if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v", err)
+	}
+	if len(names) != 1 || names[0] != "urn:example custom" {
+		t.Errorf("unknown handler got %v", names)
+	}
+	if inner != "<child>x</child>" {
+		t.Errorf("children %q", inner)
+	}
+}
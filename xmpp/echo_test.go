@@ -0,0 +1,61 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestIgnoreSelfEcho(t *testing.T) {
+	for _, ignore := range []bool{true, false} {
+		var opts []xmpp.Option
+		if ignore {
+			opts = append(opts, xmpp.WithIgnoreSelfEcho())
+		}
+		c, server := xmpptest.Pipe(opts...)
+		var bodies []string
+		c.HandleMessage(func(m *xmpp.Message) { bodies = append(bodies, m.Body) })
+		var originID string
+		received := answer(c, server, func(s *xmpp.Stanza) string {
+			if s.Name.Local == "message" {
+				i := strings.Index(string(s.Inner), "<origin-id")
+				originID = string(s.Inner[i:])
+				originID = originID[:strings.Index(originID, "/>")+2]
+				return ""
+			}
+			if s.Name.Local != "iq" {
+				return joined(s)
+			}
+			msg := func(from, body, extra string) string {
+				return "<message xmlns='jabber:client' from='" + from + "' type='groupchat'><body>" + body + "</body>" + extra + "</message>"
+			}
+			// the room's messages arrive while EntityTime reads the stream
+			return msg("ops@conf.b/bot", "own echo", "") +
+				msg("ops@conf.b/alice", "from alice", "") +
+				msg("ops@conf.b/renamed", "echo by origin id", originID) +
+				msg("dev@conf.b/bot", "bot in another room", "") + result(s)
+		})
+
+		if err := c.JoinRoom("ops@conf.b", "bot", xmpp.JoinOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.MUCSendWithID("groupchat", "ops@conf.b", "", "hello"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.EntityTime("b"); err != nil {
+			t.Fatal(err)
+		}
+		received()
+		server.Close()
+
+		want := "own echo,from alice,echo by origin id,bot in another room"
+		if ignore {
+			want = "from alice,bot in another room"
+		}
+		if got := strings.Join(bodies, ","); got != want {
+			t.Errorf("ignoring echoes %v, handled %q, want %q", ignore, got, want)
+		}
+	}
+}
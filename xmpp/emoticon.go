@@ -0,0 +1,108 @@
+package xmpp
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxEmoticonLen is the longest shortcode hipchat renders as an emoticon
+	maxEmoticonLen = 16
+	// emoticonMark prefixes shortcodes made with Emoticon so that
+	// WithEscapeEmoticons lets them through. It is a private use rune that
+	// never leaves the connection.
+	emoticonMark = "\uE000"
+	// emoticonBreak is put inside shortcodes to stop hipchat matching them,
+	// a zero width space so that the text reads the same
+	emoticonBreak = "\u200B"
+)
+
+// Emoticon returns the shortcode for the hipchat emoticon name, such as
+// "shrug", to be put in a body. Unlike shortcodes typed out literally it is
+// sent as it is under WithEscapeEmoticons.
+func Emoticon(name string) string {
+	return emoticonMark + "(" + name + ")"
+}
+
+// StripEmoticons removes the (shortcode) emoticons from s
+func StripEmoticons(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if n := emoticonAt(s[i:]); n > 0 {
+			i += n
+			continue
+		}
+		b.WriteByte(s[i])
+		i++
+	}
+	return b.String()
+}
+
+// escapeEmoticons breaks up the shortcodes in body that weren't made with
+// Emoticon, when escape is set, and drops the marks of those that were
+func escapeEmoticons(body string, escape bool) string {
+	if !escape && !strings.Contains(body, emoticonMark) {
+		return body
+	}
+	var b strings.Builder
+	for i := 0; i < len(body); {
+		if strings.HasPrefix(body[i:], emoticonMark) {
+			i += len(emoticonMark)
+			if n := emoticonAt(body[i:]); n > 0 {
+				b.WriteString(body[i : i+n])
+				i += n
+			}
+			continue
+		}
+		if n := emoticonAt(body[i:]); n > 0 && escape {
+			b.WriteString("(" + emoticonBreak + body[i+1:i+n])
+			i += n
+			continue
+		}
+		b.WriteByte(body[i])
+		i++
+	}
+	return b.String()
+}
+
+// emoticonTokens splits s into the pieces escapeEmoticons deals with one at
+// a time: shortcodes, with the mark Emoticon gave them if any, and single
+// runes. Joining whole tokens escapes to the same as escaping each.
+func emoticonTokens(s string) []string {
+	var toks []string
+	for i := 0; i < len(s); {
+		start := i
+		if strings.HasPrefix(s[i:], emoticonMark) {
+			i += len(emoticonMark)
+		}
+		if n := emoticonAt(s[i:]); n > 0 {
+			i += n
+		} else if i == start {
+			_, size := utf8.DecodeRuneInString(s[i:])
+			i += size
+		}
+		toks = append(toks, s[start:i])
+	}
+	return toks
+}
+
+// emoticonAt returns the length of the shortcode s starts with, or 0 if it
+// doesn't start with one
+func emoticonAt(s string) int {
+	if len(s) < 3 || s[0] != '(' {
+		return 0
+	}
+	for i := 1; i < len(s) && i <= maxEmoticonLen+1; i++ {
+		switch r := s[i]; {
+		case r == ')':
+			if i == 1 {
+				return 0
+			}
+			return i + 1
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		default:
+			return 0
+		}
+	}
+	return 0
+}
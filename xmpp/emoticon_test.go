@@ -0,0 +1,42 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestEmoticonMarkStripped(t *testing.T) {
+	body := "done " + xmpp.Emoticon("shrug") + " (yey)"
+	tests := []struct {
+		name string
+		send func(c *xmpp.Conn) error
+	}{
+		{"MUCSendWithID", func(c *xmpp.Conn) error { _, err := c.MUCSendWithID("chat", "a@b", "me@b", body); return err }},
+		{"SendHTML", func(c *xmpp.Conn) error { return c.SendHTML("a@b", "me@b", body, "<b>done</b>") }},
+		{"SendMultilingual", func(c *xmpp.Conn) error {
+			return c.SendMultilingual("a@b", "me@b", map[string]string{"": body, "en": body})
+		}},
+		{"Correct", func(c *xmpp.Conn) error { return c.Correct("a@b", "me@b", body, "m1") }},
+		{"Mention", func(c *xmpp.Conn) error { return c.Mention("room@conf.b", "me@b", body, nil) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe(xmpp.WithEscapeEmoticons())
+			defer server.Close()
+			sent := capture(c, server)
+			if err := tt.send(c); err != nil {
+				t.Fatal(err)
+			}
+			out := sent()
+			if strings.Contains(out, "\uE000") {
+				t.Errorf("emoticon mark sent: %q", out)
+			}
+			if !strings.Contains(out, "done (shrug) (\u200Byey)") {
+				t.Errorf("body not escaped as expected: %q", out)
+			}
+		})
+	}
+}
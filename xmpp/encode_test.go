@@ -0,0 +1,53 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStanzaRoundTrip(t *testing.T) {
+	body := `</body><evil/> & "quotes" 'n' café`
+	tests := []struct {
+		name    string
+		v       interface{}
+		payload string
+	}{
+		{"message", &outMessage{From: "o'brien@b/c", ID: "m1", To: "a&b@c", Type: "chat", Body: &body,
+			Thread: &outThread{ID: "t1", Parent: "t0"}, Payload: []byte("<active xmlns='http://jabber.org/protocol/chatstates'/>")}, "<active xmlns='http://jabber.org/protocol/chatstates'/>"},
+		{"message without body", &outMessage{ID: "m2", To: "a@b", Type: "normal"}, ""},
+		{"presence", &outPresence{ID: "p1", To: "ops@conf.b/<nick>", Type: "unavailable", Show: "away", Status: body,
+			Payload: []byte("<x xmlns='http://jabber.org/protocol/muc'/>")}, "<x xmlns='http://jabber.org/protocol/muc'/>"},
+		{"iq", &outIQ{From: "a@b/c", ID: `"q1"`, To: "b", Type: "get", Payload: []byte("<ping xmlns='urn:xmpp:ping'/>")}, "<ping xmlns='urn:xmpp:ping'/>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := xml.Marshal(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(b, []byte(tt.payload)) {
+				t.Errorf("%s lacks the payload %s", b, tt.payload)
+			}
+			if strings.Contains(string(b), "<evil/>") {
+				t.Errorf("%s isn't escaped", b)
+			}
+
+			got := reflect.New(reflect.TypeOf(tt.v).Elem())
+			if err := xml.Unmarshal(b, got.Interface()); err != nil {
+				t.Fatalf("unmarshalling %s: %v", b, err)
+			}
+			// unmarshalling keeps every child as inner xml, not just the payload
+			want := reflect.ValueOf(tt.v).Elem()
+			for _, v := range []reflect.Value{got.Elem(), want} {
+				v.FieldByName("XMLName").Set(reflect.ValueOf(xml.Name{}))
+				v.FieldByName("Payload").SetBytes(nil)
+			}
+			if !reflect.DeepEqual(got.Elem().Interface(), want.Interface()) {
+				t.Errorf("round trip of %s gave %+v, want %+v", b, got.Elem().Interface(), want.Interface())
+			}
+		})
+	}
+}
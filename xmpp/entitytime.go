@@ -0,0 +1,39 @@
+package xmpp
+
+import (
+	"html"
+	"time"
+)
+
+const xmlIqTimeGet = "<iq type='get' to='%s' id='%s'><time xmlns='%s'/></iq>"
+
+type timeResult struct {
+	Time struct {
+		UTC time.Time `xml:"utc"`
+	} `xml:"urn:xmpp:time time"`
+}
+
+// EntityTime asks to for its current time. The answer is given in the
+// location set by WithLocation, like every other time the package parses.
+func (c *Conn) EntityTime(to string) (time.Time, error) {
+	iqID := id()
+	s, err := c.sendIQ(iqID, xmlIqTimeGet, html.EscapeString(to), iqID, NsTime)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var r timeResult
+	if err := s.decode(&r); err != nil {
+		return time.Time{}, err
+	}
+	return c.Localize(r.Time.UTC), nil
+}
+
+// Localize returns t in the location set by WithLocation, or in UTC without
+// it. The zero time is left alone, so an unset Delay stays unset.
+func (c *Conn) Localize(t time.Time) time.Time {
+	if t.IsZero() || c.loc == nil {
+		return t
+	}
+	return t.In(c.loc)
+}
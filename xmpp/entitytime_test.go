@@ -0,0 +1,59 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestTimesLocalized(t *testing.T) {
+	sydney := time.FixedZone("AEDT", 11*60*60)
+	tests := []struct {
+		name string
+		opts []xmpp.Option
+		loc  *time.Location
+	}{
+		{"utc by default", nil, time.UTC},
+		{"WithLocation", []xmpp.Option{xmpp.WithLocation(sydney)}, sydney},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe(tt.opts...)
+			defer server.Close()
+			var delays []time.Time
+			c.HandleMessage(func(m *xmpp.Message) { delays = append(delays, m.Delay) })
+			received := answer(c, server, func(s *xmpp.Stanza) string {
+				if !strings.Contains(string(s.Inner), xmpp.NsTime) {
+					return result(s)
+				}
+				// the history arrives while EntityTime reads the stream
+				return "<message xmlns='jabber:client' from='ops@conf.b/alice' type='groupchat'><body>old</body>" +
+					"<delay xmlns='urn:xmpp:delay' stamp='2017-03-01T10:30:00.5+01:00'/></message>" +
+					"<message xmlns='jabber:client' from='ops@conf.b/alice' type='groupchat'><body>new</body></message>" +
+					"<iq type='result' id='" + s.Attr["id"] + "'><time xmlns='" + xmpp.NsTime + "'>" +
+					"<tzo>-06:00</tzo><utc>2017-03-01T09:45:00Z</utc></time></iq>"
+			})
+			defer received()
+
+			now, err := c.EntityTime("b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := time.Date(2017, 3, 1, 9, 45, 0, 0, time.UTC); !now.Equal(want) || now.Location() != tt.loc {
+				t.Errorf("EntityTime %v, want %v in %v", now, want, tt.loc)
+			}
+			if len(delays) != 2 {
+				t.Fatalf("handled %d messages", len(delays))
+			}
+			if want := time.Date(2017, 3, 1, 9, 30, 0, 5e8, time.UTC); !delays[0].Equal(want) || delays[0].Location() != tt.loc {
+				t.Errorf("Delay %v, want %v in %v", delays[0], want, tt.loc)
+			}
+			if !delays[1].IsZero() {
+				t.Errorf("Delay %v on a message that wasn't delayed", delays[1])
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package xmpp_test
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestFeaturesParsing(t *testing.T) {
+	tests := []struct {
+		name             string
+		features         string
+		mechanisms       string
+		saslRequired     bool
+		bindings         string
+		bindRequired     bool
+		bindOffered      bool
+		sm               bool
+		startTLSRequired bool
+	}{
+		{
+			name: "required sasl with channel binding",
+			features: "<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>SCRAM-SHA-1-PLUS</mechanism><mechanism>PLAIN</mechanism><required/></mechanisms>" +
+				"<sasl-channel-binding xmlns='urn:xmpp:sasl-cb:0'><channel-binding type='tls-exporter'/><channel-binding type='tls-server-end-point'/></sasl-channel-binding>",
+			mechanisms:   "SCRAM-SHA-1-PLUS PLAIN",
+			saslRequired: true,
+			bindings:     "tls-exporter tls-server-end-point",
+		},
+		{
+			name:       "optional sasl",
+			features:   "<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>EXTERNAL</mechanism></mechanisms>",
+			mechanisms: "EXTERNAL",
+		},
+		{
+			name:             "required starttls",
+			features:         "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls>",
+			startTLSRequired: true,
+		},
+		{
+			name:         "bind and sm",
+			features:     "<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><required/></bind><sm xmlns='urn:xmpp:sm:3'><optional/></sm>",
+			bindOffered:  true,
+			bindRequired: true,
+			sm:           true,
+		},
+		{
+			name:        "optional bind",
+			features:    "<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><optional/></bind>",
+			bindOffered: true,
+		},
+		{
+			name:         "unmarked bind",
+			features:     "<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>",
+			bindOffered:  true,
+			bindRequired: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			go io.WriteString(server, "<stream:features xmlns:stream='http://etherx.jabber.org/streams'>"+tt.features+"</stream:features>")
+
+			f := c.Features()
+			if got := strings.Join(f.Mechanisms, " "); got != tt.mechanisms {
+				t.Errorf("mechanisms %q, want %q", got, tt.mechanisms)
+			}
+			if f.SASLRequired() != tt.saslRequired {
+				t.Errorf("SASLRequired %v", f.SASLRequired())
+			}
+			if got := strings.Join(f.ChannelBindingTypes(), " "); got != tt.bindings {
+				t.Errorf("channel bindings %q, want %q", got, tt.bindings)
+			}
+			if (f.Bind != nil) != tt.bindOffered || f.BindRequired() != tt.bindRequired {
+				t.Errorf("bind offered %v required %v", f.Bind != nil, f.BindRequired())
+			}
+			if f.StreamManagement() != tt.sm {
+				t.Errorf("StreamManagement %v", f.StreamManagement())
+			}
+			if (f.StartTLS != nil) != tt.startTLSRequired {
+				t.Errorf("starttls required %v", f.StartTLS != nil)
+			}
+			if c.ServerFeatures() != f {
+				t.Error("ServerFeatures doesn't return the features read")
+			}
+		})
+	}
+}
+
+func TestFeaturesUnmarshal(t *testing.T) {
+	var f xmpp.Features
+	if err := xml.Unmarshal([]byte("<features><mechanisms><mechanism>PLAIN</mechanism></mechanisms></features>"), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.SASLRequired() || f.BindRequired() || f.StreamManagement() || len(f.ChannelBindingTypes()) != 0 {
+		t.Errorf("bare mechanisms parsed as %+v", f)
+	}
+}
+
+func TestServerFeaturesAfterRestart(t *testing.T) {
+	cert, _ := testCert(t, "b")
+	srv := xmpptest.NewServer("b")
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	c := xmpp.NewConn(srv.Pipe())
+	defer c.Close()
+	if c.ServerFeatures() != nil {
+		t.Error("features before any were read")
+	}
+
+	c.Stream("bob@b", "b")
+	c.Features()
+	if f := c.ServerFeatures(); f == nil || f.StartTLS == nil || len(f.Mechanisms) != 0 {
+		t.Fatalf("features before tls %+v, want just starttls", f)
+	}
+	c.StartTLS()
+	if start, err := c.Next(); err != nil || start.Name.Local != "proceed" {
+		t.Fatalf("starttls answered with %v, %v", start.Name, err)
+	}
+	c.UseTLSConfig(&tls.Config{ServerName: "b", InsecureSkipVerify: true})
+	c.Stream("bob@b", "b")
+	c.Features()
+	if f := c.ServerFeatures(); f == nil || f.StartTLS != nil || strings.Join(f.Mechanisms, " ") != "PLAIN" {
+		t.Fatalf("features after tls %+v, want the sasl mechanisms", f)
+	}
+	if err := c.SASLAuth("bob", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if f := c.ServerFeatures(); f == nil || len(f.Mechanisms) != 0 || f.Bind == nil {
+		t.Errorf("features after sasl %+v, want bind", f)
+	}
+}
+
+func TestServerFeaturesAfterConnect(t *testing.T) {
+	cert, _ := testCert(t, "b")
+	srv := xmpptest.NewServer("b")
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	c, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", "pw", "bot", xmpp.WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if f := c.ServerFeatures(); f == nil || f.StartTLS != nil || len(f.Mechanisms) != 0 || f.Bind == nil {
+		t.Errorf("features after connecting %+v, want those of the last stream", f)
+	}
+}
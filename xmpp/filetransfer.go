@@ -0,0 +1,112 @@
+package xmpp
+
+import "html"
+
+const (
+	xmlOfferDeclined = "<error type='cancel'><forbidden xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/><text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'>Offer Declined</text></error>"
+	xmlJingleDecline = "<iq type='set' id='%s' to='%s'><jingle xmlns='%s' action='session-terminate' sid='%s'><reason><decline/></reason></jingle></iq>"
+)
+
+// FileOffer is a user offering to send a file, by stream initiation or by
+// jingle
+type FileOffer struct {
+	From     string
+	Name     string
+	Size     int64
+	MimeType string
+	Desc     string
+	// SID identifies the transfer session
+	SID string
+	// Jingle is set for jingle offers, and unset for stream initiation
+	Jingle bool
+}
+
+type siOffer struct {
+	SI *struct {
+		ID       string `xml:"id,attr"`
+		Profile  string `xml:"profile,attr"`
+		MimeType string `xml:"mime-type,attr"`
+		File     *struct {
+			Name string `xml:"name,attr"`
+			Size int64  `xml:"size,attr"`
+			Desc string `xml:"desc"`
+		} `xml:"http://jabber.org/protocol/si/profile/file-transfer file"`
+	} `xml:"http://jabber.org/protocol/si si"`
+	Jingle *struct {
+		Action  string `xml:"action,attr"`
+		SID     string `xml:"sid,attr"`
+		Content []struct {
+			File *struct {
+				Name      string `xml:"name"`
+				Size      int64  `xml:"size"`
+				MediaType string `xml:"media-type"`
+				Desc      string `xml:"desc"`
+			} `xml:"urn:xmpp:jingle:apps:file-transfer:5 description>file"`
+		} `xml:"content"`
+	} `xml:"urn:xmpp:jingle:1 jingle"`
+}
+
+// HandleFileOffer sets the function the dispatch loop calls with each file
+// offered to the connection. Returning false declines the offer; returning
+// true passes the offer's iq on to the iq handler, which must then answer
+// it. Without a handler every offer is declined, so the sender isn't left
+// waiting.
+func (c *Conn) HandleFileOffer(fn func(FileOffer) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fileOfferHandler = fn
+}
+
+// parseFileOffer returns the file offered by an iq set, if it is an offer
+func parseFileOffer(s *Stanza) (FileOffer, bool) {
+	var o siOffer
+	if err := s.decode(&o); err != nil {
+		return FileOffer{}, false
+	}
+	offer := FileOffer{From: s.Attr["from"]}
+	switch {
+	case o.SI != nil && o.SI.File != nil:
+		offer.SID, offer.MimeType = o.SI.ID, o.SI.MimeType
+		offer.Name, offer.Size, offer.Desc = o.SI.File.Name, o.SI.File.Size, o.SI.File.Desc
+		return offer, true
+	case o.Jingle != nil && o.Jingle.Action == "session-initiate":
+		for _, content := range o.Jingle.Content {
+			if f := content.File; f != nil {
+				offer.SID, offer.Jingle = o.Jingle.SID, true
+				offer.Name, offer.Size, offer.MimeType, offer.Desc = f.Name, f.Size, f.MediaType, f.Desc
+				return offer, true
+			}
+		}
+	}
+	return FileOffer{}, false
+}
+
+// handleFileOffer offers a file to the handler, declining it unless the
+// handler takes it. It reports whether the iq has been dealt with.
+func (c *Conn) handleFileOffer(s *Stanza) bool {
+	offer, ok := parseFileOffer(s)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	fn := c.fileOfferHandler
+	c.mu.Unlock()
+	if fn != nil && fn(offer) {
+		return false
+	}
+
+	iq := newIQ(s)
+	var err error
+	if offer.Jingle {
+		// jingle wants the offer acked before the session is terminated
+		if err = c.SendRaw(iq.Reply("result", "")); err == nil {
+			err = c.send(xmlJingleDecline, id(), html.EscapeString(offer.From), NsJingle, html.EscapeString(offer.SID))
+		}
+	} else {
+		err = c.SendRaw(iq.Reply("error", xmlOfferDeclined))
+	}
+	if err != nil {
+		c.reportError(err)
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+const (
+	siOffer = "<iq xmlns='jabber:client' type='set' id='si1' from='alice@b/phone'>" +
+		"<si xmlns='" + xmpp.NsSI + "' id='s5b' profile='" + xmpp.NsSIFileTransfer + "' mime-type='text/plain'>" +
+		"<file xmlns='" + xmpp.NsSIFileTransfer + "' name='notes.txt' size='1022'><desc>meeting notes</desc></file></si></iq>"
+	jingleOffer = "<iq xmlns='jabber:client' type='set' id='j1' from='carol@b/laptop'>" +
+		"<jingle xmlns='" + xmpp.NsJingle + "' action='session-initiate' sid='851ba2'>" +
+		"<content creator='initiator' name='a-file-offer'><description xmlns='" + xmpp.NsJingleFileTransfer + "'>" +
+		"<file><name>photo.jpg</name><size>4096</size><media-type>image/jpeg</media-type></file></description></content></jingle></iq>"
+)
+
+func TestFileOfferDeclinedWithoutHandler(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Attr["id"] == "si1" || s.Attr["id"] == "j1" || s.Attr["type"] != "get" {
+			return ""
+		}
+		return siOffer + jingleOffer + result(s)
+	})
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	var siDeclined, jingleAcked, jingleTerminated bool
+	for _, s := range received() {
+		inner := string(s.Inner)
+		switch {
+		case s.Attr["id"] == "si1":
+			siDeclined = s.Attr["type"] == "error" && s.Attr["to"] == "alice@b/phone" && strings.Contains(inner, "<forbidden")
+		case s.Attr["id"] == "j1":
+			jingleAcked = s.Attr["type"] == "result"
+		case strings.Contains(inner, "session-terminate"):
+			jingleTerminated = s.Attr["to"] == "carol@b/laptop" && strings.Contains(inner, "sid='851ba2'") && strings.Contains(inner, "<decline/>")
+		}
+	}
+	if !siDeclined {
+		t.Error("stream initiation offer wasn't declined")
+	}
+	if !jingleAcked || !jingleTerminated {
+		t.Errorf("jingle offer acked %v, terminated %v", jingleAcked, jingleTerminated)
+	}
+}
+
+func TestHandleFileOffer(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var offers []xmpp.FileOffer
+	c.HandleFileOffer(func(o xmpp.FileOffer) bool {
+		offers = append(offers, o)
+		// take the stream initiation offer and decline the jingle one
+		return !o.Jingle
+	})
+	var taken []string
+	c.HandleIQ(func(iq *xmpp.IQ) { taken = append(taken, iq.ID) })
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Attr["type"] != "get" {
+			return ""
+		}
+		return siOffer + jingleOffer + result(s)
+	})
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []xmpp.FileOffer{
+		{From: "alice@b/phone", Name: "notes.txt", Size: 1022, MimeType: "text/plain", Desc: "meeting notes", SID: "s5b"},
+		{From: "carol@b/laptop", Name: "photo.jpg", Size: 4096, MimeType: "image/jpeg", SID: "851ba2", Jingle: true},
+	}
+	if len(offers) != len(want) {
+		t.Fatalf("offered %+v", offers)
+	}
+	for i := range want {
+		if offers[i] != want[i] {
+			t.Errorf("offer %d is %+v, want %+v", i, offers[i], want[i])
+		}
+	}
+	if len(taken) != 1 || taken[0] != "si1" {
+		t.Errorf("iq handler got %v, want the taken offer", taken)
+	}
+	for _, s := range received() {
+		if s.Attr["id"] == "si1" {
+			t.Errorf("answered the taken offer with %s", s.Attr["type"])
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package xmpp
+
+import (
+	"container/list"
+	"time"
+)
+
+// floodSenders is how many senders the inbound rate limit tracks before it
+// forgets the one it heard from longest ago
+const floodSenders = 1024
+
+// floodBucket is the token bucket of one sender under WithInboundRateLimit
+type floodBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+	// flooding is set from the first message dropped until the sender
+	// slows down, so that OnFlood fires once per flood
+	flooding bool
+	// elem is the bucket's place in the connection's floodOrder
+	elem *list.Element
+}
+
+// OnFlood sets the function the dispatch loop calls when a sender goes over
+// the rate set by WithInboundRateLimit, with the bare jid whose messages
+// are being dropped. It is called once per flood, not for every message
+// dropped.
+func (c *Conn) OnFlood(fn func(from string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.floodHandler = fn
+}
+
+// flooded reports whether a message from from is over the inbound rate
+// limit and should be dropped
+func (c *Conn) flooded(from string) bool {
+	if c.floodRate <= 0 {
+		return false
+	}
+	now := c.clock.Now()
+	key := foldBare(from)
+	c.mu.Lock()
+	if c.floodBuckets == nil {
+		c.floodBuckets = make(map[string]*floodBucket)
+		c.floodOrder = list.New()
+	}
+	b, ok := c.floodBuckets[key]
+	if ok {
+		c.floodOrder.MoveToFront(b.elem)
+	} else {
+		if len(c.floodBuckets) >= floodSenders {
+			c.forgetOldestSender()
+		}
+		b = &floodBucket{key: key, tokens: float64(c.floodBurst), last: now}
+		b.elem = c.floodOrder.PushFront(b)
+		c.floodBuckets[key] = b
+	}
+	b.refill(now, c.floodRate, c.floodBurst)
+	if b.tokens >= 1 {
+		b.tokens--
+		b.flooding = false
+		c.mu.Unlock()
+		return false
+	}
+	started := !b.flooding
+	b.flooding = true
+	fn := c.floodHandler
+	c.mu.Unlock()
+
+	if started && fn != nil {
+		fn(key)
+	}
+	return true
+}
+
+// forgetOldestSender drops the bucket of the sender heard from longest ago,
+// which has most likely refilled and so is no different from a new one.
+// c.mu must be held.
+func (c *Conn) forgetOldestSender() {
+	oldest := c.floodOrder.Back()
+	c.floodOrder.Remove(oldest)
+	delete(c.floodBuckets, oldest.Value.(*floodBucket).key)
+}
+
+// refill adds the tokens earned since the bucket was last used
+func (b *floodBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
@@ -0,0 +1,139 @@
+package xmpp_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// stoppedClock is a clock that never moves, so that rate limits don't
+// refill during a test
+type stoppedClock struct{ now time.Time }
+
+func (c stoppedClock) Now() time.Time                     { return c.now }
+func (stoppedClock) After(time.Duration) <-chan time.Time { return nil }
+func (stoppedClock) NewTicker(time.Duration) xmpp.Ticker  { return stoppedTicker{} }
+
+type stoppedTicker struct{}
+
+func (stoppedTicker) C() <-chan time.Time { return nil }
+func (stoppedTicker) Stop()               {}
+
+func TestInboundRateLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		perSecond float64
+		burst     int
+		handled   int
+		floods    int
+	}{
+		{"burst", 1, 2, 2, 1},
+		{"burst below 1", 1, 0, 1, 1},
+		{"off", 0, 2, 5, 0},
+		{"negative rate is off", -1, 2, 5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe(xmpp.WithInboundRateLimit(tt.perSecond, tt.burst),
+				xmpp.WithClock(stoppedClock{time.Unix(1e9, 0)}))
+			defer server.Close()
+			var handled, floods int
+			c.HandleMessage(func(*xmpp.Message) { handled++ })
+			c.OnFlood(func(from string) {
+				floods++
+				if from != "flood@b" {
+					t.Errorf("flood from %q", from)
+				}
+			})
+			msg := "<message xmlns='jabber:client' from='flood@b/r' type='chat'><body>hi</body></message>"
+			received := answer(c, server, func(s *xmpp.Stanza) string {
+				// the messages arrive while EntityTime reads the stream
+				return strings.Repeat(msg, 5) + result(s)
+			})
+			defer received()
+
+			if _, err := c.EntityTime("b"); err != nil {
+				t.Fatal(err)
+			}
+			if handled != tt.handled || floods != tt.floods {
+				t.Errorf("handled %d with %d floods, want %d with %d", handled, floods, tt.handled, tt.floods)
+			}
+		})
+	}
+}
+
+func TestInboundRateLimitRefills(t *testing.T) {
+	clock := &heldClock{now: time.Unix(1e9, 0)}
+	c, server := xmpptest.Pipe(xmpp.WithInboundRateLimit(1, 2), xmpp.WithClock(clock))
+	defer server.Close()
+	handled := make(map[string]int)
+	var floods []string
+	c.HandleMessage(func(m *xmpp.Message) { handled[m.Jid]++ })
+	c.OnFlood(func(from string) { floods = append(floods, from) })
+	msg := func(from string) string {
+		return "<message xmlns='jabber:client' from='" + from + "' type='chat'><body>hi</body></message>"
+	}
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		return strings.Repeat(msg("flood@b/r"), 3) + msg("calm@b/r") + result(s)
+	})
+	defer received()
+
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	// a second on, flood@b has one message's worth again, and going over
+	// once more is a new flood
+	clock.now = clock.now.Add(time.Second)
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	if handled["flood@b/r"] != 3 || handled["calm@b/r"] != 2 {
+		t.Errorf("handled %v, want 3 from flood@b and 2 from calm@b", handled)
+	}
+	if strings.Join(floods, ",") != "flood@b,flood@b" {
+		t.Errorf("floods %q, want two from flood@b", floods)
+	}
+}
+
+func TestInboundRateLimitForgetsOldestSender(t *testing.T) {
+	c, server := xmpptest.Pipe(xmpp.WithInboundRateLimit(1, 1),
+		xmpp.WithClock(stoppedClock{time.Unix(1e9, 0)}))
+	defer server.Close()
+	handled := make(map[string]int)
+	c.HandleMessage(func(m *xmpp.Message) { handled[m.Jid]++ })
+	msg := func(from string) string {
+		return "<message xmlns='jabber:client' from='" + from + "' type='chat'><body>hi</body></message>"
+	}
+	// more senders than are tracked use up their tokens, none refilling, and
+	// then the first and the last of them send again
+	var b strings.Builder
+	const senders = 1100
+	for i := 0; i < senders; i++ {
+		b.WriteString(msg(fmt.Sprintf("u%d@b/r", i)))
+	}
+	b.WriteString(msg("u0@b/r"))
+	b.WriteString(msg(fmt.Sprintf("u%d@b/r", senders-1)))
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		return b.String() + result(s)
+	})
+	defer received()
+
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	// u0 was heard from longest ago and forgotten, so it starts afresh,
+	// while the last sender is still held to its limit
+	if n := handled["u0@b/r"]; n != 2 {
+		t.Errorf("handled %d from the oldest sender, want 2 once it was forgotten", n)
+	}
+	if n := handled[fmt.Sprintf("u%d@b/r", senders-1)]; n != 1 {
+		t.Errorf("handled %d from the newest sender, want 1", n)
+	}
+	if len(handled) != senders {
+		t.Errorf("handled messages from %d senders, want %d", len(handled), senders)
+	}
+}
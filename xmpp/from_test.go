@@ -0,0 +1,48 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestFromPolicy(t *testing.T) {
+	senders := append(bodySenders[:len(bodySenders):len(bodySenders)], struct {
+		name string
+		send func(c *xmpp.Conn, body string) error
+	}{"MUCPresence", func(c *xmpp.Conn, _ string) error {
+		c.MUCPresence("room@conf.b/bot", "me@b")
+		return nil
+	}})
+	for _, s := range senders {
+		t.Run(s.name, func(t *testing.T) {
+			for _, managed := range []bool{false, true} {
+				var opts []xmpp.Option
+				if managed {
+					opts = append(opts, xmpp.WithServerManagedFrom())
+				}
+				c, server := xmpptest.Pipe(opts...)
+				received := answer(c, server, func(*xmpp.Stanza) string { return "" })
+				if err := s.send(c, "hi"); err != nil {
+					t.Fatal(err)
+				}
+				var from []string
+				for _, st := range received() {
+					if f, ok := st.Attr["from"]; ok {
+						from = append(from, f)
+					}
+				}
+				server.Close()
+
+				switch {
+				case managed && len(from) != 0:
+					t.Errorf("server-managed from still sent from=%q", from)
+				case !managed && (len(from) == 0 || strings.Join(from, "") != strings.Repeat("me@b", len(from))):
+					t.Errorf("explicit from sent from=%q, want me@b", from)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package xmpp_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestSendHeadline(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	sent := capture(c, server)
+	if err := c.SendHeadline("alice@b", "bot@b/bot", "maintenance at 22:00 & after"); err != nil {
+		t.Fatal(err)
+	}
+	out := sent()
+	for _, want := range []string{`type="headline"`, `to="alice@b"`, "<body>maintenance at 22:00 &amp; after</body>"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("sent %s, want %s", out, want)
+		}
+	}
+}
+
+func TestHeadlineType(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var types []string
+	c.HandleMessage(func(m *xmpp.Message) { types = append(types, m.Type) })
+	serve(server, streamHeader+
+		"<message from='b' type='headline'><body>server restarting</body></message>"+
+		"<message from='alice@b/phone' type='chat'><body>hi</body></message>"+
+		"</stream:stream>")
+	if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v", err)
+	}
+	if strings.Join(types, ",") != "headline,chat" {
+		t.Errorf("handled types %q", types)
+	}
+}
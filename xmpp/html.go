@@ -0,0 +1,58 @@
+package xmpp
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// SendHTML sends a message with an xhtml-im body alongside the plain one
+// clients without html support show. htmlBody must be well formed xhtml
+// and is sent as is. Messages to a joined muc go as groupchat.
+func (c *Conn) SendHTML(to, from, plain, htmlBody string) error {
+	msgID := id()
+	payload := fmt.Sprintf(xmlHTMLPart, NsXHTMLIM, NsXHTML, htmlBody) + c.stampOrigin(msgID)
+	return c.encode(&outMessage{From: c.fromJID(from), ID: msgID, To: to, Type: c.messageType(to), Body: &plain, Payload: []byte(payload)})
+}
+
+// SendHTMLOnly sends an html message like SendHTML, deriving the plain body
+// from htmlBody with StripHTML
+func (c *Conn) SendHTMLOnly(to, from, htmlBody string) error {
+	return c.SendHTML(to, from, StripHTML(htmlBody), htmlBody)
+}
+
+// lineBreakTags are the tags that end a line of text
+var lineBreakTags = map[string]bool{
+	"br": true, "/p": true, "/div": true, "/li": true, "/tr": true,
+	"/h1": true, "/h2": true, "/h3": true, "/h4": true, "/h5": true, "/h6": true,
+}
+
+// StripHTML reduces html to readable plain text. Tags are removed, line
+// breaks and the ends of block elements become newlines and entities are
+// unescaped.
+func StripHTML(s string) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(s, '<')
+		if start < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:start])
+		end := strings.IndexByte(s[start:], '>')
+		if end < 0 {
+			b.WriteString(s[start:])
+			break
+		}
+
+		tag := strings.ToLower(strings.TrimSpace(strings.TrimSuffix(s[start+1:start+end], "/")))
+		if i := strings.IndexAny(tag, " \t\r\n"); i >= 0 {
+			tag = tag[:i]
+		}
+		if lineBreakTags[tag] {
+			b.WriteByte('\n')
+		}
+		s = s[start+end+1:]
+	}
+	return strings.TrimRight(html.UnescapeString(b.String()), "\n")
+}
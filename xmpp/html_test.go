@@ -0,0 +1,45 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestStripHTML(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"plain", "plain"},
+		{"<b>bold <i>and italic</i></b> text", "bold and italic text"},
+		{"fish &amp; chips &lt;3 &#39;n&#39; &quot;peas&quot;", `fish & chips <3 'n' "peas"`},
+		{"one<br>two<br/>three<BR />four", "one\ntwo\nthree\nfour"},
+		{"<p>first</p><p>second</p>", "first\nsecond"},
+		{"<ul><li>a</li><li>b</li></ul>", "a\nb"},
+		{"<a href='https://example.com/?a=1&amp;b=2'>link</a>", "link"},
+		{"<span\nclass='x'>wrapped</span>", "wrapped"},
+		{"a < b", "a < b"},
+		{"&lt;b&gt;not a tag&lt;/b&gt;", "<b>not a tag</b>"},
+	}
+	for _, tt := range tests {
+		if got := xmpp.StripHTML(tt.in); got != tt.want {
+			t.Errorf("StripHTML(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSendHTMLOnly(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	sent := capture(c, server)
+	if err := c.SendHTMLOnly("a@b", "", "<p>deploy <b>done</b> &amp; verified</p>"); err != nil {
+		t.Fatal(err)
+	}
+	out := sent()
+	if got := sentBody(t, out); got != "deploy done &amp; verified" {
+		t.Errorf("plain body %q", got)
+	}
+	if !strings.Contains(out, "<body xmlns='"+xmpp.NsXHTML+"'><p>deploy <b>done</b> &amp; verified</p></body>") {
+		t.Errorf("html body not sent as is: %s", out)
+	}
+}
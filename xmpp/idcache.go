@@ -0,0 +1,52 @@
+package xmpp
+
+import (
+	"container/list"
+	"time"
+)
+
+const defaultIDCacheSize = 1000
+
+// idCache remembers the most recently added ids, forgetting the oldest once
+// it holds size of them, and with a ttl forgetting any added longer ago
+type idCache struct {
+	size  int
+	ttl   time.Duration
+	order *list.List
+	items map[string]*list.Element
+}
+
+// idEntry is an id in an idCache and when it was first added
+type idEntry struct {
+	id string
+	at time.Time
+}
+
+func newIDCache(size int) *idCache {
+	return &idCache{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// add records id as of now, reporting whether it was already there
+func (c *idCache) add(id string, now time.Time) bool {
+	if e, ok := c.items[id]; ok {
+		c.order.MoveToFront(e)
+		entry := e.Value.(*idEntry)
+		if c.ttl <= 0 || now.Sub(entry.at) <= c.ttl {
+			return true
+		}
+		entry.at = now
+		return false
+	}
+	c.items[id] = c.order.PushFront(&idEntry{id: id, at: now})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*idEntry).id)
+	}
+	return false
+}
+
+func (c *idCache) has(id string) bool {
+	_, ok := c.items[id]
+	return ok
+}
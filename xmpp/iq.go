@@ -0,0 +1,98 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+)
+
+const (
+	xmlIqReply            = "<iq type='%s' id='%s'%s>%s</iq>"
+	xmlServiceUnavailable = "<error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error>"
+	xmlItemNotFound       = "<error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error>"
+)
+
+// IQ is an info/query stanza received from the server. Query holds the raw
+// xml of its payload.
+type IQ struct {
+	Type  string
+	ID    string
+	From  string
+	To    string
+	Query []byte
+	// RawXML is the iq exactly as received, with WithRawXML
+	RawXML []byte
+}
+
+func newIQ(s *Stanza) *IQ {
+	return &IQ{
+		Type:   s.Attr["type"],
+		ID:     s.Attr["id"],
+		From:   s.Attr["from"],
+		To:     s.Attr["to"],
+		Query:  s.Inner,
+		RawXML: s.RawXML,
+	}
+}
+
+// Decode unmarshals the iq's payload into v
+func (iq *IQ) Decode(v interface{}) error {
+	return xml.Unmarshal(iq.Query, v)
+}
+
+// Reply builds a response to the iq of type typ, usually result or error,
+// addressed back to its sender and carrying payload as is
+func (iq *IQ) Reply(typ, payload string) string {
+	return fmt.Sprintf(xmlIqReply, typ, html.EscapeString(iq.ID), optAttr("to", iq.From), payload)
+}
+
+// HandleIQ sets the function the dispatch loop calls with each iq the
+// connection doesn't answer itself. The handler is responsible for replying
+// to gets and sets; without one they are refused with service-unavailable.
+func (c *Conn) HandleIQ(fn func(*IQ)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.iqHandler = fn
+}
+
+// SendRaw sends stanza as is after checking that it is well formed xml
+func (c *Conn) SendRaw(stanza string) error {
+	d := xml.NewDecoder(bytes.NewReader([]byte(stanza)))
+	depth := 0
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if depth != 0 {
+		return errors.New("unbalanced stanza")
+	}
+	return c.write([]byte(stanza))
+}
+
+// WriteStanza sends raw as is, without even the check SendRaw makes, for
+// callers that render their own stanzas. It takes the same path as every
+// other send, so it is serialized with them, queued by EnableSendQueue,
+// kept for resending under stream management and counted in Stats. The
+// caller owns its correctness: a malformed stanza will get the stream
+// closed by the server. raw is copied, so it may be reused once WriteStanza
+// returns.
+func (c *Conn) WriteStanza(raw []byte) (int, error) {
+	if err := c.write(append([]byte(nil), raw...)); err != nil {
+		return 0, err
+	}
+	return len(raw), nil
+}
@@ -0,0 +1,169 @@
+package xmpp_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestIQTimeoutWithoutRun(t *testing.T) {
+	c, server := xmpptest.Pipe(xmpp.WithIQTimeout(20*time.Millisecond, 2))
+	defer server.Close()
+	received := answer(c, server, func(*xmpp.Stanza) string { return "" })
+
+	start := time.Now()
+	_, err := c.GetVCard("a@b")
+	if !errors.Is(err, xmpp.ErrIQTimeout) {
+		t.Fatalf("GetVCard returned %v, want ErrIQTimeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("took %v to time out", d)
+	}
+	if sent := received(); len(sent) != 1 {
+		t.Errorf("sent %d iqs, want 1 as a timed out stream can't be retried on", len(sent))
+	}
+}
+
+func TestIQTimeoutRetries(t *testing.T) {
+	c, server := xmpptest.Pipe(xmpp.WithIQTimeout(20*time.Millisecond, 2))
+	defer server.Close()
+	attempts := 0
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local != "iq" {
+			return ""
+		}
+		// only the second attempt is answered
+		if attempts++; attempts < 2 {
+			return ""
+		}
+		return result(s)
+	})
+	stop := startRun(t, c, server)
+
+	if _, err := c.GetVCard("a@b"); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	sent := received()
+	var iqs []*xmpp.Stanza
+	for _, s := range sent {
+		if s.Name.Local == "iq" {
+			iqs = append(iqs, s)
+		}
+	}
+	if len(iqs) != 2 || iqs[0].Attr["id"] == iqs[1].Attr["id"] {
+		t.Errorf("sent %d iqs, want the request and one retry under a fresh id", len(iqs))
+	}
+}
+
+func TestIQDecodeAndReply(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var iqs []xmpp.IQ
+	c.HandleIQ(func(iq *xmpp.IQ) {
+		iqs = append(iqs, *iq)
+		if iq.Type == "get" {
+			c.SendRaw(iq.Reply("result", "<query xmlns='urn:test'/>"))
+		}
+	})
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Attr["type"] != "get" {
+			return ""
+		}
+		// the iqs arrive while EntityTime reads the stream
+		return "<iq xmlns='jabber:client' type='result' id='r1' from='b' to='bob@b/bot'><query xmlns='" + xmpp.NsIqRoster + "'>" +
+			"<item jid='1_2@chat.hipchat.com' name='Alice Jones' subscription='both'/>" +
+			"<item jid='1_3@chat.hipchat.com' name='Bob' subscription='to'/></query></iq>" +
+			"<iq xmlns='jabber:client' type='get' id='q&amp;1' from='alice@b/phone'><query xmlns='urn:test'/></iq>" + result(s)
+	})
+
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(iqs) != 2 {
+		t.Fatalf("handled %d iqs, want 2", len(iqs))
+	}
+	if iq := iqs[0]; iq.Type != "result" || iq.ID != "r1" || iq.From != "b" || iq.To != "bob@b/bot" {
+		t.Errorf("got iq %+v", iq)
+	}
+	var roster struct {
+		Items []struct {
+			Jid  string `xml:"jid,attr"`
+			Name string `xml:"name,attr"`
+		} `xml:"item"`
+	}
+	if err := iqs[0].Decode(&roster); err != nil {
+		t.Fatal(err)
+	}
+	if len(roster.Items) != 2 || roster.Items[0].Jid != "1_2@chat.hipchat.com" || roster.Items[1].Name != "Bob" {
+		t.Errorf("decoded %+v", roster)
+	}
+
+	sent := received()
+	reply := sent[len(sent)-1]
+	if reply.Attr["type"] != "result" || reply.Attr["id"] != "q&1" || reply.Attr["to"] != "alice@b/phone" {
+		t.Errorf("replied %v", reply.Attr)
+	}
+}
+
+func TestWriteStanza(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	c, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", "pw", "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	before := c.Stats().StanzasSent
+	buf := []byte("<message to='alice@b' type='chat'><body>first</body></message>")
+	if n, err := c.WriteStanza(buf); err != nil || n != len(buf) {
+		t.Fatalf("WriteStanza returned %d, %v", n, err)
+	}
+	// the caller may reuse its buffer as soon as WriteStanza returns
+	copy(buf, "<message to='alice@b' type='chat'><body>xxxxx</body></message>")
+	if sent := c.Stats().StanzasSent - before; sent != 1 {
+		t.Errorf("counted %d stanzas sent", sent)
+	}
+	if _, err := c.GetRoster(); err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.ReceivedNamed("message")
+	if len(msgs) != 1 || msgs[0].Attr["to"] != "alice@b" || string(msgs[0].Inner) != "<body>first</body>" {
+		t.Errorf("server received %v", msgs)
+	}
+}
+
+func TestServerPingAnswered(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var handled []string
+	c.HandleIQ(func(iq *xmpp.IQ) { handled = append(handled, iq.ID) })
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Attr["type"] != "get" {
+			return ""
+		}
+		// the ping arrives while EntityTime reads the stream
+		return "<iq xmlns='jabber:client' type='get' id='ping1' from='b'><ping xmlns='" + xmpp.NsPing + "'/></iq>" + result(s)
+	})
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 0 {
+		t.Errorf("iq handler got %q, want the ping answered before it", handled)
+	}
+	var pongs int
+	for _, s := range received() {
+		if s.Name.Local != "iq" || s.Attr["id"] != "ping1" {
+			continue
+		}
+		pongs++
+		if s.Attr["type"] != "result" || s.Attr["to"] != "b" || len(s.Inner) != 0 {
+			t.Errorf("ping answered with %v %s", s.Attr, s.Inner)
+		}
+	}
+	if pongs != 1 {
+		t.Errorf("ping answered %d times", pongs)
+	}
+}
@@ -0,0 +1,60 @@
+package xmpp
+
+import "strings"
+
+// JID is an xmpp address of the form local@domain/resource, where only the
+// domain is required
+type JID string
+
+// Local returns the part of j before the @, if any
+func (j JID) Local() string {
+	b := bare(string(j))
+	if i := strings.IndexByte(b, '@'); i >= 0 {
+		return b[:i]
+	}
+	return ""
+}
+
+// Domain returns the domain of j
+func (j JID) Domain() string {
+	b := bare(string(j))
+	if i := strings.IndexByte(b, '@'); i >= 0 {
+		return b[i+1:]
+	}
+	return b
+}
+
+// Resource returns the part of j after the /, if any
+func (j JID) Resource() string {
+	return resource(string(j))
+}
+
+// Bare returns j without its resource
+func (j JID) Bare() JID {
+	return JID(bare(string(j)))
+}
+
+// Normalized returns j with its local part and domain case folded, and any
+// trailing dot removed from the domain, so that jids naming the same entity
+// compare equal. The resource is case sensitive and kept as is.
+func (j JID) Normalized() JID {
+	n := strings.TrimSuffix(strings.ToLower(j.Domain()), ".")
+	if local := j.Local(); local != "" {
+		n = strings.ToLower(local) + "@" + n
+	}
+	if i := strings.IndexByte(string(j), '/'); i >= 0 {
+		n += string(j[i:])
+	}
+	return JID(n)
+}
+
+// Equal reports whether j and other are the same jid once normalized
+func (j JID) Equal(other JID) bool {
+	return j.Normalized() == other.Normalized()
+}
+
+// foldBare returns the normalized bare form of jid, which is what rooms and
+// roster entries are keyed by
+func foldBare(jid string) string {
+	return string(JID(jid).Bare().Normalized())
+}
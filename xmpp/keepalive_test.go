@@ -0,0 +1,61 @@
+package xmpp_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestKeepAlivePayload(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []xmpp.Option
+		want string
+	}{
+		{"default", nil, " "},
+		{"newline", []xmpp.Option{xmpp.WithKeepAlivePayload([]byte("\n"))}, "\n"},
+		{"mixed whitespace", []xmpp.Option{xmpp.WithKeepAlivePayload([]byte("\r\n\t "))}, "\r\n\t "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe(tt.opts...)
+			defer server.Close()
+			sent := capture(c, server)
+			if err := c.KeepAlive(); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSuffix(sent(), "</stream:stream>"); got != tt.want {
+				t.Errorf("wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepAlivePayloadNotWhitespace(t *testing.T) {
+	c, server := xmpptest.Pipe(xmpp.WithKeepAlivePayload([]byte(" <x/>")))
+	defer server.Close()
+	sent := capture(c, server)
+	if err := c.KeepAlive(); !errors.Is(err, xmpp.ErrKeepAlivePayload) {
+		t.Errorf("KeepAlive returned %v, want ErrKeepAlivePayload", err)
+	}
+	if got := sent(); strings.Contains(got, "<x/>") {
+		t.Errorf("wrote %q", got)
+	}
+}
+
+func TestKeepAlivePing(t *testing.T) {
+	c, server := xmpptest.Pipe(xmpp.WithKeepAlivePing(true), xmpp.WithKeepAlivePayload([]byte("\n")))
+	defer server.Close()
+	received := answer(c, server, func(*xmpp.Stanza) string { return "" })
+	if err := c.KeepAlive(); err != nil {
+		t.Fatal(err)
+	}
+	sent := received()
+	if len(sent) != 1 || sent[0].Name.Local != "iq" || sent[0].Attr["type"] != "get" ||
+		!strings.Contains(string(sent[0].Inner), "<ping xmlns='"+xmpp.NsPing+"'") {
+		t.Fatalf("sent %v, want a ping iq", sent)
+	}
+}
@@ -0,0 +1,42 @@
+package xmpp_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestMessageKind(t *testing.T) {
+	const mucUser = "<x xmlns='http://jabber.org/protocol/muc#user'/>"
+	tests := []struct {
+		name, stanza                         string
+		group, private, mucPrivate, headline bool
+	}{
+		{"groupchat", "<message from='ops@conf.b/alice' type='groupchat'><body>x</body></message>", true, false, false, false},
+		{"chat to bare", "<message from='alice@b/phone' to='bot@b' type='chat'><body>x</body></message>", false, true, false, false},
+		{"no type", "<message from='alice@b/phone'><body>x</body></message>", false, true, false, false},
+		{"muc private", "<message from='ops@conf.b/alice' type='chat'><body>x</body>" + mucUser + "</message>", false, false, true, false},
+		{"headline", "<message from='b' type='headline'><body>x</body></message>", false, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			var m *xmpp.Message
+			c.HandleMessage(func(msg *xmpp.Message) { m = msg.Copy() })
+			serve(server, streamHeader+tt.stanza+"</stream:stream>")
+			if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+				t.Fatalf("Run returned %v", err)
+			}
+			if m == nil {
+				t.Fatal("message wasn't handled")
+			}
+			if m.IsGroupChat() != tt.group || m.IsPrivate() != tt.private || m.IsMUCPrivate() != tt.mucPrivate || m.IsHeadline() != tt.headline {
+				t.Errorf("type %q: group %v, private %v, muc private %v, headline %v", m.Type,
+					m.IsGroupChat(), m.IsPrivate(), m.IsMUCPrivate(), m.IsHeadline())
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package xmpp
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+)
+
+const xmlLangBody = "<body xml:lang='%s'>%s</body>"
+
+type langBody struct {
+	Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Text string `xml:",chardata"`
+}
+
+// SendMultilingual sends one message carrying a body in each language of
+// bodies, keyed by xml:lang such as "en" or "pt-BR", for the recipient's
+// client to choose from. A body keyed "" has no language. Each body is held
+// to WithMaxBodyBytes on its own.
+func (c *Conn) SendMultilingual(to, from string, bodies map[string]string) error {
+	var b strings.Builder
+	for _, lang := range sortedLangs(bodies) {
+		body, err := c.fitBody(bodies[lang])
+		if err != nil {
+			return err
+		}
+		if lang == "" {
+			b.WriteString("<body>" + html.EscapeString(body) + "</body>")
+			continue
+		}
+		fmt.Fprintf(&b, xmlLangBody, html.EscapeString(lang), html.EscapeString(body))
+	}
+	msgID := id()
+	b.WriteString(c.stampOrigin(msgID))
+	return c.encode(&outMessage{From: c.fromJID(from), ID: msgID, To: to, Type: c.messageType(to), Payload: []byte(b.String())})
+}
+
+// BodyFor returns the body best suited to lang: the body in exactly that
+// language, or failing that one sharing its primary language, so "en-GB"
+// matches "en" and the reverse. Otherwise it falls back to Body.
+func (m *Message) BodyFor(lang string) string {
+	for l, body := range m.Bodies {
+		if strings.EqualFold(l, lang) {
+			return body
+		}
+	}
+	primary := primaryLang(lang)
+	for _, l := range sortedLangs(m.Bodies) {
+		if strings.EqualFold(primaryLang(l), primary) {
+			return m.Bodies[l]
+		}
+	}
+	return m.Body
+}
+
+// primaryLang returns the primary subtag of a language tag
+func primaryLang(lang string) string {
+	if i := strings.IndexByte(lang, '-'); i >= 0 {
+		return lang[:i]
+	}
+	return lang
+}
+
+func sortedLangs(bodies map[string]string) []string {
+	langs := make([]string, 0, len(bodies))
+	for l := range bodies {
+		langs = append(langs, l)
+	}
+	sort.Strings(langs)
+	return langs
+}
@@ -0,0 +1,63 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestSendMultilingual(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	sent := capture(c, server)
+	err := c.SendMultilingual("alice@b", "", map[string]string{
+		"":   "hi",
+		"en": "fish & chips",
+		"de": "<Hallo>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := sent()
+	want := "<body>hi</body><body xml:lang='de'>&lt;Hallo&gt;</body><body xml:lang='en'>fish &amp; chips</body>"
+	if !strings.Contains(out, want) {
+		t.Errorf("sent %s, want bodies %s", out, want)
+	}
+}
+
+func TestBodyFor(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var m *xmpp.Message
+	c.HandleMessage(func(msg *xmpp.Message) { m = msg.Copy() })
+	serve(server, streamHeader+"<message type='chat' from='a@b/c' xml:lang='en'>"+
+		"<body>Hello</body><body xml:lang='de'>Hallo</body><body xml:lang='pt-BR'>Olá</body></message></stream:stream>")
+	runFor(t, c.Run)
+
+	if m == nil {
+		t.Fatal("message wasn't handled")
+	}
+	if m.Body != "Hello" || len(m.Bodies) != 3 || m.Bodies["en"] != "Hello" {
+		t.Fatalf("Body %q, Bodies %v", m.Body, m.Bodies)
+	}
+	tests := []struct {
+		lang, want string
+	}{
+		{"de", "Hallo"},
+		{"DE", "Hallo"},
+		{"de-AT", "Hallo"},
+		{"pt", "Olá"},
+		{"pt-BR", "Olá"},
+		{"en-GB", "Hello"},
+		// no body in French, so the default
+		{"fr", "Hello"},
+		{"", "Hello"},
+	}
+	for _, tt := range tests {
+		if got := m.BodyFor(tt.lang); got != tt.want {
+			t.Errorf("BodyFor(%q) = %q, want %q", tt.lang, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package xmpp
+
+import (
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type lastResult struct {
+	Query struct {
+		Seconds string `xml:"seconds,attr"`
+		Status  string `xml:",chardata"`
+	} `xml:"jabber:iq:last query"`
+}
+
+// LastActivity asks to for its last activity. For a bare jid this is the
+// time since the user logged out, for a full jid how long the resource has
+// been idle and for a server how long it has been up. Any status text the
+// user left is returned along with it.
+func (c *Conn) LastActivity(to string) (time.Duration, string, error) {
+	iqID := id()
+	s, err := c.sendIQ(iqID, xmlIqQueryGet, html.EscapeString(to), iqID, NsIqLast)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var r lastResult
+	if err := s.decode(&r); err != nil {
+		return 0, "", err
+	}
+	secs, err := strconv.ParseUint(r.Query.Seconds, 10, 63)
+	if err != nil {
+		return 0, "", err
+	}
+	return time.Duration(secs) * time.Second, strings.TrimSpace(r.Query.Status), nil
+}
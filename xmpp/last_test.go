@@ -0,0 +1,50 @@
+package xmpp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestLastActivity(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		idle   time.Duration
+		status string
+		fails  bool
+	}{
+		{"idle", "<query xmlns='" + xmpp.NsIqLast + "' seconds='903'/>", 903 * time.Second, "", false},
+		{"status", "<query xmlns='" + xmpp.NsIqLast + "' seconds='0'>\n  Heading home\n</query>", 0, "Heading home", false},
+		{"negative", "<query xmlns='" + xmpp.NsIqLast + "' seconds='-1'/>", 0, "", true},
+		{"missing", "<query xmlns='" + xmpp.NsIqLast + "'/>", 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			received := answer(c, server, func(s *xmpp.Stanza) string {
+				return "<iq type='result' id='" + s.Attr["id"] + "'>" + tt.query + "</iq>"
+			})
+
+			idle, status, err := c.LastActivity("1_2@chat.hipchat.com/bot")
+			if tt.fails {
+				if err == nil {
+					t.Errorf("accepted %s", tt.query)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if idle != tt.idle || status != tt.status {
+				t.Errorf("got %v %q, want %v %q", idle, status, tt.idle, tt.status)
+			}
+			if sent := received(); sent[0].Attr["to"] != "1_2@chat.hipchat.com/bot" {
+				t.Errorf("sent to %q", sent[0].Attr["to"])
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package xmpp_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// lenientStream has a stanza with an unknown entity and one with a
+// mismatched end tag between two good ones
+const lenientStream = streamHeader +
+	"<message from='a@b/c' type='chat'><body>first</body></message>" +
+	"<message from='a@b/c' type='chat'><body>caf&eacute;</body></message>" +
+	"<message from='a@b/c' type='chat'><body>bold<b>text</body></message>" +
+	"<message from='a@b/c' type='chat'><body>last</body></message></stream:stream>"
+
+func TestLenientParsing(t *testing.T) {
+	c, server := xmpptest.Pipe(xmpp.WithLenientParsing())
+	defer server.Close()
+	serve(server, lenientStream)
+	var bodies []string
+	c.HandleMessage(func(m *xmpp.Message) { bodies = append(bodies, m.Body) })
+
+	if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v, want the stream to survive to its close", err)
+	}
+	// the entity is kept as written and the stray tag closed with the body
+	if got, want := strings.Join(bodies, "|"), "first|caf&eacute;|bold|last"; got != want {
+		t.Errorf("handled %q, want %q", got, want)
+	}
+}
+
+func TestStrictParsing(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	serve(server, lenientStream)
+	var bodies []string
+	c.HandleMessage(func(m *xmpp.Message) { bodies = append(bodies, m.Body) })
+
+	err := runFor(t, c.Run)
+	if err == nil || errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v, want the bad stanza to end the stream", err)
+	}
+	if got := strings.Join(bodies, "|"); got != "first" {
+		t.Errorf("handled %q, want only the stanza before the bad one", got)
+	}
+}
@@ -0,0 +1,32 @@
+package xmpp
+
+import "errors"
+
+// Label returns the label the connection's log lines and errors carry: the
+// one set with WithLabel, or else the session's jid
+func (c *Conn) Label() string {
+	if c.label != "" {
+		return c.label
+	}
+	return c.JID()
+}
+
+// logf logs a line to the logger set with WithLogger, prefixed with the
+// connection's label. Callers on the hot path check c.logger themselves
+// first, so that arguments that are costly to build aren't built for
+// nothing.
+func (c *Conn) logf(format string, a ...interface{}) {
+	if c.logger == nil {
+		return
+	}
+	c.logger.Printf("[%s] "+format, append([]interface{}{c.Label()}, a...)...)
+}
+
+// labelled sets the connection's label on err if it is a *ConnectError
+func (c *Conn) labelled(err error) error {
+	var ce *ConnectError
+	if errors.As(err, &ce) && ce.Label == "" {
+		ce.Label = c.Label()
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package xmpp_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestLoggerLabelsTraffic(t *testing.T) {
+	var buf bytes.Buffer
+	c, server := xmpptest.Pipe(xmpp.WithLogger(log.New(&buf, "", 0)), xmpp.WithLabel("bot1"))
+	defer server.Close()
+	go func() {
+		b := make([]byte, 512)
+		server.Read(b)
+		io.WriteString(server, streamHeader+"<message from='a@b/c' type='chat'><body>hi</body></message></stream:stream>")
+		io.Copy(io.Discard, server)
+	}()
+	if err := c.SendRaw("<presence/>"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{"[bot1] send: <presence/>", "[bot1] recv: <message from='a@b/c' type='chat'><body>hi</body></message>"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package xmpp
+
+import (
+	"fmt"
+	"html"
+)
+
+const (
+	xmlMarkable = "<markable xmlns='%s'/>"
+	xmlMarker   = "<%s xmlns='%s' id='%s'/>"
+)
+
+type chatMarker struct {
+	ID string `xml:"id,attr"`
+}
+
+// MarkReceived tells to that the message with id has been received
+func (c *Conn) MarkReceived(to, id string) error {
+	return c.mark(to, "received", id)
+}
+
+// MarkDisplayed tells to that the message with id has been displayed. Chat
+// markers should only be sent for messages that were Markable.
+func (c *Conn) MarkDisplayed(to, id string) error {
+	return c.mark(to, "displayed", id)
+}
+
+// MarkAcknowledged tells to that the message with id has been acted upon
+func (c *Conn) MarkAcknowledged(to, id string) error {
+	return c.mark(to, "acknowledged", id)
+}
+
+func (c *Conn) mark(to, marker, markedID string) error {
+	typ := c.messageType(to)
+	if typ == "groupchat" {
+		to = bare(to)
+	}
+	payload := fmt.Sprintf(xmlMarker, marker, NsChatMarkers, html.EscapeString(markedID))
+	return c.encode(&outMessage{To: to, Type: typ, ID: id(), Payload: []byte(payload)})
+}
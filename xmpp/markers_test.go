@@ -0,0 +1,93 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestMarkableSent(t *testing.T) {
+	for _, markable := range []bool{true, false} {
+		var opts []xmpp.Option
+		if markable {
+			opts = append(opts, xmpp.WithMarkable())
+		}
+		c, server := xmpptest.Pipe(opts...)
+		sent := capture(c, server)
+		if _, err := c.MUCSendWithID("groupchat", "ops@conf.b", "", "please confirm"); err != nil {
+			t.Fatal(err)
+		}
+		out := sent()
+		server.Close()
+		if got := strings.Contains(out, "<markable xmlns='"+xmpp.NsChatMarkers+"'/>"); got != markable {
+			t.Errorf("WithMarkable %v sent %s", markable, out)
+		}
+	}
+}
+
+func TestMarkDisplayed(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, joined)
+	if err := c.JoinRoom("ops@conf.b", "bot", xmpp.JoinOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MarkDisplayed("alice@b/phone", "m1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MarkDisplayed("ops@conf.b/alice", "m'2"); err != nil {
+		t.Fatal(err)
+	}
+
+	var marks []*xmpp.Stanza
+	for _, s := range received() {
+		if s.Name.Local == "message" {
+			marks = append(marks, s)
+		}
+	}
+	tests := []struct{ to, typ, marker string }{
+		{"alice@b/phone", "chat", "<displayed xmlns='" + xmpp.NsChatMarkers + "' id='m1'/>"},
+		{"ops@conf.b", "groupchat", "<displayed xmlns='" + xmpp.NsChatMarkers + "' id='m&#39;2'/>"},
+	}
+	if len(marks) != len(tests) {
+		t.Fatalf("sent %d markers, want %d", len(marks), len(tests))
+	}
+	for i, tt := range tests {
+		if m := marks[i]; m.Attr["to"] != tt.to || m.Attr["type"] != tt.typ || string(m.Inner) != tt.marker {
+			t.Errorf("marker %d sent to %s as %s: %s", i, m.Attr["to"], m.Attr["type"], m.Inner)
+		}
+	}
+}
+
+func TestMarkersParsed(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var got []xmpp.Message
+	c.HandleMessage(func(m *xmpp.Message) { got = append(got, *m) })
+	c.HandleBodyless(func(m *xmpp.Message) { got = append(got, *m) })
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		// the messages arrive while EntityTime reads the stream
+		return "<message xmlns='jabber:client' from='alice@b/phone' type='chat' id='a1'><body>read this</body><markable xmlns='" + xmpp.NsChatMarkers + "'/></message>" +
+			"<message xmlns='jabber:client' from='alice@b/phone' type='chat'><displayed xmlns='" + xmpp.NsChatMarkers + "' id='m1'/></message>" +
+			"<message xmlns='jabber:client' from='alice@b/phone' type='chat'><acknowledged xmlns='" + xmpp.NsChatMarkers + "' id='m2'/></message>" +
+			result(s)
+	})
+	defer received()
+
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("handled %d messages", len(got))
+	}
+	if !got[0].Markable || got[0].Marker != "" {
+		t.Errorf("markable message parsed as %+v", got[0])
+	}
+	for i, want := range []string{"displayed:m1", "acknowledged:m2"} {
+		if m := got[i+1]; m.Marker+":"+m.MarkerID != want || m.Markable {
+			t.Errorf("marker %d parsed as %s:%s", i, m.Marker, m.MarkerID)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package xmpp_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestMention(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, rosterResult("<item jid='1_2@chat.hipchat.com' name='Alice Jones' mention_name='AliceJ'/>"))
+	if _, err := c.GetRoster(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mention("1_ops@conf.hipchat.com", "1_1@chat.hipchat.com", "deploy done", []string{"alicej", "@1_2@chat.hipchat.com/bot", "@all"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := received()
+	m := sent[len(sent)-1]
+	if m.Name.Local != "message" || m.Attr["type"] != "groupchat" || m.Attr["to"] != "1_ops@conf.hipchat.com" {
+		t.Fatalf("sent %s %v", m.Name.Local, m.Attr)
+	}
+	inner := string(m.Inner)
+	if !strings.Contains(inner, "<body>@AliceJ @AliceJ @all deploy done</body>") {
+		t.Errorf("mentions not resolved: %s", inner)
+	}
+	if !strings.Contains(inner, "<x xmlns='"+xmpp.NsHipChat+"'><notify>1</notify></x>") {
+		t.Errorf("not flagged to notify: %s", inner)
+	}
+}
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		body string
+		want []string
+	}{
+		{"@AliceJ, @bob: deploy done.", []string{"AliceJ", "bob"}},
+		{"ping @all!", []string{"all"}},
+		{"ask @here... or @jane.doe.", []string{"here", "jane.doe"}},
+		{"mail alice@example.com", nil},
+		{"(@carol) and @dave-", []string{"carol", "dave"}},
+		{"@ alone and @@twice", []string{"twice"}},
+		{"no mentions", nil},
+	}
+	for _, tt := range tests {
+		m := &xmpp.Message{Body: tt.body}
+		if got := m.Mentions(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Mentions of %q = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestMentionsMe(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	msg := func(body string) string {
+		return "<message xmlns='jabber:client' from='1_ops@conf.hipchat.com/alice' type='groupchat'><body>" + body + "</body></message>"
+	}
+	received := negotiate(c, server, func(s *xmpp.Stanza) string {
+		switch {
+		case s.Name.Local == "stream":
+			return streamHeader
+		case strings.Contains(string(s.Inner), xmpp.NsIqRoster):
+			return rosterResult("<item jid='1_1@chat.hipchat.com' name='Deploy Bot' mention_name='DeployBot'/>")(s)
+		}
+		// the messages arrive while EntityTime reads the stream
+		return msg("@deploybot, ship it") + msg("@here anyone?") + msg("@alicej ship it") + result(s)
+	})
+	defer received()
+	var mine []bool
+	c.HandleMessage(func(m *xmpp.Message) { mine = append(mine, m.MentionsMe("")) })
+
+	c.Stream("1_1@chat.hipchat.com", "chat.hipchat.com")
+	if _, err := c.GetRoster(); err != nil {
+		t.Fatal(err)
+	}
+	if name := c.MentionName(); name != "DeployBot" {
+		t.Fatalf("mention name %q, want DeployBot from the roster", name)
+	}
+	if _, err := c.EntityTime("chat.hipchat.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(mine); got != "[true true false]" {
+		t.Errorf("MentionsMe gave %s, want [true true false]", got)
+	}
+	if m := (&xmpp.Message{Body: "@alicej"}); !m.MentionsMe("AliceJ") || m.MentionsMe("bob") {
+		t.Error("MentionsMe ignored the name it was given")
+	}
+}
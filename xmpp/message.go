@@ -0,0 +1,494 @@
+package xmpp
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	xmlOriginID = "<origin-id xmlns='%s' id='%s'/>"
+	xmlReplace  = "<replace id='%s' xmlns='%s'/>"
+)
+
+type messageStanza struct {
+	Bodies   []langBody `xml:"body"`
+	OriginID *struct {
+		ID string `xml:"id,attr"`
+	} `xml:"urn:xmpp:sid:0 origin-id"`
+	StanzaID *struct {
+		ID string `xml:"id,attr"`
+		By string `xml:"by,attr"`
+	} `xml:"urn:xmpp:sid:0 stanza-id"`
+	Replace *struct {
+		ID string `xml:"id,attr"`
+	} `xml:"urn:xmpp:message-correct:0 replace"`
+	Thread *struct {
+		ID     string `xml:",chardata"`
+		Parent string `xml:"parent,attr"`
+	} `xml:"thread"`
+	Subject      *string     `xml:"subject"`
+	Nick         string      `xml:"http://jabber.org/protocol/nick nick"`
+	Delay        *delay      `xml:"urn:xmpp:delay delay"`
+	Markable     *struct{}   `xml:"urn:xmpp:chat-markers:0 markable"`
+	Received     *chatMarker `xml:"urn:xmpp:chat-markers:0 received"`
+	Displayed    *chatMarker `xml:"urn:xmpp:chat-markers:0 displayed"`
+	Acknowledged *chatMarker `xml:"urn:xmpp:chat-markers:0 acknowledged"`
+	Receipt      *struct {
+		ID string `xml:"id,attr"`
+	} `xml:"urn:xmpp:receipts received"`
+	MUCUser   *struct{}        `xml:"http://jabber.org/protocol/muc#user x"`
+	Reactions *reactionsStanza `xml:"urn:xmpp:reactions:0 reactions"`
+	Form      *DataForm        `xml:"jabber:x:data x"`
+}
+
+// HandleMessage sets the function the dispatch loop calls with each message
+// that has a body.
+//
+// The messages passed to handlers are reused once the handler returns, so a
+// handler must not keep m, or hand it to another goroutine, without taking
+// m.Copy() first.
+func (c *Conn) HandleMessage(fn func(*Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messageHandler = fn
+}
+
+// HandleRoom sets the function the dispatch loop calls, in place of the
+// HandleMessage one, with each message that has a body from the room
+// roomJID, including private messages from its occupants. A nil fn removes
+// the room's handler. As with HandleMessage, m must be copied to be kept.
+func (c *Conn) HandleRoom(roomJID string, fn func(*Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := foldBare(roomJID)
+	if fn == nil {
+		delete(c.roomHandlers, key)
+		return
+	}
+	if c.roomHandlers == nil {
+		c.roomHandlers = make(map[string]func(*Message))
+	}
+	c.roomHandlers[key] = fn
+}
+
+// MessageError is a message the server bounced back undelivered, such as
+// one to a room that doesn't exist
+type MessageError struct {
+	// ID is the id the message was sent with
+	ID string
+	// To is where the message was sent
+	To  string
+	Err *StanzaError
+}
+
+func (e *MessageError) Error() string {
+	return "message to " + e.To + ": " + e.Err.Error()
+}
+
+// Unwrap returns the StanzaError the message bounced with
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// HandleMessageError sets the function the dispatch loop calls with each
+// message that bounces, in place of passing the bounce to the message
+// handlers
+func (c *Conn) HandleMessageError(fn func(*MessageError)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messageErrorHandler = fn
+}
+
+// handleMessageError passes a bounce to the handler, reporting whether
+// there was one
+func (c *Conn) handleMessageError(s *Stanza, m *Message) bool {
+	c.mu.Lock()
+	fn := c.messageErrorHandler
+	c.mu.Unlock()
+	if fn == nil {
+		return false
+	}
+	var e struct {
+		Error *stanzaError `xml:"error"`
+	}
+	if err := s.decode(&e); err != nil {
+		c.reportError(err)
+		return true
+	}
+	fn(&MessageError{ID: m.ID, To: m.Jid, Err: e.Error.err()})
+	return true
+}
+
+// HandleBodyless sets the function the dispatch loop calls with each message
+// that has no body, such as chat state notifications and receipts. As with
+// HandleMessage, m must be copied to be kept.
+func (c *Conn) HandleBodyless(fn func(*Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bodylessHandler = fn
+}
+
+// messagePool recycles the messages passed to handlers, which is why they
+// must not be kept past the handler's return. Together with decoderPool and
+// messageStanzaPool it cuts the garbage each inbound message leaves; see
+// BenchmarkDispatchMessage.
+var messagePool = sync.Pool{New: func() interface{} { return new(Message) }}
+
+func (c *Conn) handleMessage(s *Stanza) {
+	m := messagePool.Get().(*Message)
+	defer func() {
+		*m = Message{}
+		messagePool.Put(m)
+	}()
+	if err := parseMessage(s, m); err != nil {
+		c.reportError(err)
+		return
+	}
+	m.Delay = c.Localize(m.Delay)
+	if m.Type == "error" && c.handleMessageError(s, m) {
+		return
+	}
+
+	if m.ReceiptID != "" {
+		c.confirm(m.ReceiptID)
+	}
+	if c.ignoreSelfEcho && c.isSelfEcho(m) {
+		return
+	}
+	if c.dedup && c.SeenBefore(m) {
+		return
+	}
+
+	c.mu.Lock()
+	fn := c.messageHandler
+	if rfn, ok := c.roomHandlers[foldBare(m.Jid)]; ok {
+		fn = rfn
+	}
+	if !m.HasBody {
+		fn = c.bodylessHandler
+	}
+	subjectFn := c.subjectHandler
+	reactionFn := c.reactionHandler
+	// granting waits on the room's answer, which only Run can read for it
+	voiceFn, autoVoice := c.voiceRequestHandler, c.autoVoice && c.running
+	m.me = c.mentionName
+	if _, ok := c.rooms[foldBare(m.Jid)]; ok {
+		m.fromRoom = true
+	}
+	c.mu.Unlock()
+
+	if subjectFn != nil && m.Type == "groupchat" && !m.HasBody && m.Subject != "" {
+		subjectFn(SubjectChange{
+			Room:    bare(m.Jid),
+			Subject: m.Subject,
+			ByNick:  resource(m.Jid),
+			Delay:   m.Delay,
+		})
+		return
+	}
+	if reactionFn != nil && m.reaction != nil {
+		reactionFn(*m.reaction)
+		return
+	}
+	if r := m.voiceRequest; r != nil && (voiceFn != nil || autoVoice) {
+		if autoVoice {
+			go c.grantRequested(*r)
+		}
+		if voiceFn != nil {
+			voiceFn(*r)
+		}
+		return
+	}
+	if fn != nil {
+		fn(m)
+	}
+}
+
+// SubjectChange is a room's subject being changed
+type SubjectChange struct {
+	Room    string
+	Subject string
+	// ByNick is who changed it, or "" when the room itself set it
+	ByNick string
+	// Delay is when the subject was set if the room sent it as history,
+	// such as on joining
+	Delay time.Time
+}
+
+// HandleSubjectChange sets the function the dispatch loop calls when a
+// room's subject changes. Without one, subject changes are passed to the
+// bodyless handler. The empty subjects sent while a room is being
+// configured are not reported.
+func (c *Conn) HandleSubjectChange(fn func(SubjectChange)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subjectHandler = fn
+}
+
+// messageStanzaPool recycles what parseMessage decodes into, which nothing
+// keeps once m has been filled
+var messageStanzaPool = sync.Pool{New: func() interface{} { return new(messageStanza) }}
+
+// parseMessage fills m from a message stanza
+func parseMessage(s *Stanza, m *Message) error {
+	ms := messageStanzaPool.Get().(*messageStanza)
+	defer func() {
+		*ms = messageStanza{Bodies: ms.Bodies[:0]}
+		messageStanzaPool.Put(ms)
+	}()
+	if err := s.decode(ms); err != nil {
+		return err
+	}
+	m.Jid = s.Attr["from"]
+	m.To = s.Attr["to"]
+	m.Type = s.Attr["type"]
+	m.ID = s.Attr["id"]
+	m.RawXML = s.RawXML
+	for i, b := range ms.Bodies {
+		lang := b.Lang
+		if lang == "" {
+			lang = s.Attr["lang"]
+		}
+		if len(ms.Bodies) > 1 {
+			if m.Bodies == nil {
+				m.Bodies = make(map[string]string, len(ms.Bodies))
+			}
+			m.Bodies[lang] = b.Text
+		}
+		if i == 0 || b.Lang == "" {
+			m.Body, m.HasBody = b.Text, true
+		}
+	}
+	if ms.OriginID != nil {
+		m.OriginID = ms.OriginID.ID
+	}
+	if ms.StanzaID != nil {
+		m.StanzaID = ms.StanzaID.ID
+	}
+	if ms.Replace != nil {
+		m.ReplaceID = ms.Replace.ID
+	}
+	if ms.Thread != nil {
+		m.Thread, m.ThreadParent = strings.TrimSpace(ms.Thread.ID), ms.Thread.Parent
+	}
+	if ms.Subject != nil {
+		m.Subject = *ms.Subject
+	}
+	m.Nick = ms.Nick
+	if ms.Reactions != nil {
+		m.reaction = parseReaction(m.Jid, ms.Reactions)
+	}
+	if ms.Form != nil && !strings.Contains(m.Jid, "/") {
+		m.voiceRequest = parseVoiceRequest(m.Jid, ms.Form)
+	}
+	if ms.Delay != nil {
+		m.Delay = ms.Delay.Stamp
+	}
+	m.Markable = ms.Markable != nil
+	switch {
+	case ms.Acknowledged != nil:
+		m.Marker, m.MarkerID = "acknowledged", ms.Acknowledged.ID
+	case ms.Displayed != nil:
+		m.Marker, m.MarkerID = "displayed", ms.Displayed.ID
+	case ms.Received != nil:
+		m.Marker, m.MarkerID = "received", ms.Received.ID
+	}
+	if ms.Receipt != nil {
+		m.ReceiptID = ms.Receipt.ID
+	}
+	m.fromRoom = ms.MUCUser != nil
+	return nil
+}
+
+// IsGroupChat reports whether m was sent to a whole room
+func (m *Message) IsGroupChat() bool {
+	return m.Type == "groupchat"
+}
+
+// IsHeadline reports whether m is a headline, which should not be answered
+func (m *Message) IsHeadline() bool {
+	return m.Type == "headline"
+}
+
+// IsPrivate reports whether m is a one to one message from a user, rather
+// than one sent through a room
+func (m *Message) IsPrivate() bool {
+	return m.isDirect() && !m.fromRoom
+}
+
+// IsMUCPrivate reports whether m is a private message from an occupant of
+// a room, which comes from the occupant's room jid rather than their own
+func (m *Message) IsMUCPrivate() bool {
+	return m.isDirect() && m.fromRoom && resource(m.Jid) != ""
+}
+
+// isDirect reports whether m's type is one for messages between two parties
+func (m *Message) isDirect() bool {
+	return m.Type == "chat" || m.Type == "normal" || m.Type == ""
+}
+
+// Copy returns a copy of m that is safe to keep after the handler m was
+// passed to returns
+func (m *Message) Copy() *Message {
+	cp := *m
+	return &cp
+}
+
+// Correct replaces the body of the message with id replaceID that was sent
+// to to. Corrections to a joined muc go as groupchat, anything else as chat.
+func (c *Conn) Correct(to, from, newBody, replaceID string) error {
+	msgID := id()
+	payload := fmt.Sprintf(xmlReplace, html.EscapeString(replaceID), NsCorrect) + c.stampOrigin(msgID)
+	return c.encode(&outMessage{From: c.fromJID(from), ID: msgID, To: to, Type: c.messageType(to), Body: &newBody, Payload: []byte(payload)})
+}
+
+// ReplyTo answers original where it came from, in its thread: a room
+// message in the room, and anything else privately to its sender, including
+// an occupant who wrote from a room. A message that isn't in a thread has
+// one started for it, keyed by its id, so replies to it all land together.
+func (c *Conn) ReplyTo(original *Message, from, body string) error {
+	to, typ := original.Jid, "chat"
+	if original.IsGroupChat() {
+		to, typ = bare(original.Jid), "groupchat"
+	} else if err := c.presentTo(to); err != nil {
+		return err
+	}
+	thread := original.Thread
+	if thread == "" {
+		thread = original.ID
+	}
+	if thread == "" {
+		thread = original.StanzaID
+	}
+	m := c.chat(to, from, typ, body)
+	if thread != "" {
+		m.Thread = &outThread{ID: thread, Parent: original.ThreadParent}
+	}
+	return c.encode(m)
+}
+
+// messageType returns groupchat for a joined muc and chat for anything else
+func (c *Conn) messageType(to string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.rooms[foldBare(to)]; ok {
+		return "groupchat"
+	}
+	return "chat"
+}
+
+// SeenBefore reports whether a message with the same stanza id, or failing
+// that the same origin id from the same sender, has already been passed to
+// it. Messages with neither are never reported as seen. Only the most
+// recent ids are remembered, within the window set by WithDedupWindow.
+func (c *Conn) SeenBefore(m *Message) bool {
+	var key string
+	switch {
+	case m.StanzaID != "":
+		key = "stanza:" + m.StanzaID
+	case m.OriginID != "":
+		key = "origin:" + foldBare(m.Jid) + ":" + m.OriginID
+	default:
+		return false
+	}
+
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seen.add(key, now)
+}
+
+// Echoed reports whether m carries an origin id the connection stamped on a
+// message it sent, as when a muc echoes the connection's own messages
+func (c *Conn) Echoed(m *Message) bool {
+	if m.OriginID == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stamped.has(m.OriginID)
+}
+
+// stampOrigin renders an origin id for an outgoing message, remembering it
+// so that the message can be recognised when it comes back. With
+// WithMarkable the message is also marked as wanting chat markers.
+func (c *Conn) stampOrigin(msgID string) string {
+	now := c.clock.Now()
+	c.mu.Lock()
+	c.stamped.add(msgID, now)
+	c.mu.Unlock()
+	origin := fmt.Sprintf(xmlOriginID, NsSID, html.EscapeString(msgID))
+	if c.markable {
+		origin += fmt.Sprintf(xmlMarkable, NsChatMarkers)
+	}
+	return origin
+}
+
+// isSelfEcho reports whether m is a muc's echo of a message the connection
+// sent, either because it comes from our nick in the room or because it
+// carries an origin id we stamped
+func (c *Conn) isSelfEcho(m *Message) bool {
+	if c.Echoed(m) {
+		return true
+	}
+	if m.Type != "groupchat" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.rooms[foldBare(m.Jid)]
+	return ok && r.nick == resource(m.Jid)
+}
+
+// Mentions returns the names @mentioned in the body, without the @ and
+// with any trailing punctuation removed. @all and @here are included as
+// "all" and "here".
+func (m *Message) Mentions() []string {
+	var names []string
+	body := []rune(m.Body)
+	for i := 0; i < len(body); i++ {
+		if body[i] != '@' || (i > 0 && !isMentionBoundary(body[i-1])) {
+			continue
+		}
+		j := i + 1
+		for j < len(body) && isMentionRune(body[j]) {
+			j++
+		}
+		name := strings.TrimRight(string(body[i+1:j]), ".-")
+		if name != "" {
+			names = append(names, name)
+		}
+		i = j - 1
+	}
+	return names
+}
+
+// MentionsMe reports whether the body @mentions myMentionName, or @all or
+// @here. An empty myMentionName means the mention name the receiving
+// connection found for itself in the roster during Connect.
+func (m *Message) MentionsMe(myMentionName string) bool {
+	if myMentionName == "" {
+		myMentionName = m.me
+	}
+	for _, name := range m.Mentions() {
+		if name == "all" || name == "here" ||
+			(myMentionName != "" && strings.EqualFold(name, myMentionName)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isMentionRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+// isMentionBoundary reports whether r can come before an @mention, which
+// rules out the @ in an email address
+func isMentionBoundary(r rune) bool {
+	return !isMentionRune(r)
+}
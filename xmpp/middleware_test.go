@@ -0,0 +1,74 @@
+package xmpp_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestMiddleware(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var bodies []string
+	c.HandleMessage(func(m *xmpp.Message) { bodies = append(bodies, m.Jid+":"+m.Body) })
+
+	// drop everything from a blocked user
+	c.Use(func(s xmpp.Stanza) (xmpp.Stanza, bool) {
+		return s, !strings.HasPrefix(s.Attr["from"], "troll@b")
+	})
+	// redact passwords, copying rather than changing what it was given
+	c.Use(func(s xmpp.Stanza) (xmpp.Stanza, bool) {
+		s.Inner = bytes.ReplaceAll(s.Inner, []byte("hunter2"), []byte("*******"))
+		return s, true
+	})
+	// the chain runs in order, so this sees neither the dropped stanza nor
+	// the password
+	var seen []string
+	c.Use(func(s xmpp.Stanza) (xmpp.Stanza, bool) {
+		seen = append(seen, string(s.Inner))
+		return s, true
+	})
+
+	serve(server, streamHeader+
+		"<message from='alice@b/phone' type='chat'><body>my password is hunter2</body></message>"+
+		"<message from='troll@b/x' type='chat'><body>spam</body></message>"+
+		"<message from='bob@b/laptop' type='chat'><body>hi</body></message>"+
+		"</stream:stream>")
+	if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v", err)
+	}
+
+	if got := strings.Join(bodies, ","); got != "alice@b/phone:my password is *******,bob@b/laptop:hi" {
+		t.Errorf("handled %s", got)
+	}
+	if len(seen) != 2 || strings.Contains(strings.Join(seen, ""), "hunter2") {
+		t.Errorf("last middleware saw %q", seen)
+	}
+}
+
+func TestMiddlewareSkipsAwaitedReplies(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	dropped := 0
+	c.Use(func(s xmpp.Stanza) (xmpp.Stanza, bool) {
+		dropped++
+		return s, false
+	})
+	var handled int
+	c.HandleMessage(func(*xmpp.Message) { handled++ })
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		return "<message xmlns='jabber:client' from='alice@b/phone' type='chat'><body>hi</body></message>" + result(s)
+	})
+	defer received()
+
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatalf("EntityTime returned %v with its reply dropped", err)
+	}
+	if handled != 0 || dropped != 1 {
+		t.Errorf("handled %d messages, middleware dropped %d stanzas", handled, dropped)
+	}
+}
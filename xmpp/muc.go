@@ -0,0 +1,406 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"time"
+)
+
+const (
+	xmlMUCJoin         = "<presence id='%s' to='%s/%s'><x xmlns='%s'>%s</x></presence>"
+	xmlMUCJoinPassword = "<password>%s</password>"
+)
+
+// Errors returned when a muc refuses a join
+var (
+	// ErrRoomPasswordRequired means the room is password protected and no
+	// or the wrong password was given in JoinOptions
+	ErrRoomPasswordRequired = errors.New("room password required")
+	// ErrRegistrationRequired means the room is members only
+	ErrRegistrationRequired = errors.New("room registration required")
+	// ErrRoomForbidden means the user is banned from the room
+	ErrRoomForbidden = errors.New("room forbidden")
+)
+
+type joinedRoom struct {
+	nick string
+	opts JoinOptions
+	// settled is set once the server has sent the occupants already in the
+	// room, after which presences mean people entering and leaving
+	settled bool
+}
+
+// JoinOptions holds the optional settings for joining a muc
+type JoinOptions struct {
+	Password string
+}
+
+// Occupant is a member of a muc as seen in its presence
+type Occupant struct {
+	Nick        string
+	Jid         string
+	Role        string
+	Affiliation string
+}
+
+type mucItem struct {
+	Jid         string `xml:"jid,attr"`
+	Affiliation string `xml:"affiliation,attr"`
+	Role        string `xml:"role,attr"`
+}
+
+type mucStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+type mucUser struct {
+	Item   mucItem     `xml:"item"`
+	Status []mucStatus `xml:"status"`
+}
+
+type delay struct {
+	Stamp time.Time `xml:"stamp,attr"`
+}
+
+type mucPresence struct {
+	Users  []mucUser    `xml:"http://jabber.org/protocol/muc#user x"`
+	Error  *stanzaError `xml:"error"`
+	Delay  *delay       `xml:"urn:xmpp:delay delay"`
+	Show   string       `xml:"show"`
+	Status string       `xml:"status"`
+	Nick   string       `xml:"http://jabber.org/protocol/nick nick"`
+}
+
+func (u *mucUser) hasStatus(code int) bool {
+	for _, s := range u.Status {
+		if s.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// JoinRoomWithOccupants joins a muc as nick and returns the occupants the
+// server reports before it confirms the join with our own presence.
+func (c *Conn) JoinRoomWithOccupants(roomJID, nick string, opts JoinOptions) ([]Occupant, error) {
+	j := c.expectJoin(roomJID)
+	if err := c.sendJoin(roomJID, nick, opts); err != nil {
+		c.forget(j.w)
+		return nil, err
+	}
+	if _, err := c.wait(j.w); err != nil {
+		return nil, err
+	}
+	if j.err != nil {
+		return nil, j.err
+	}
+	c.joined(roomJID, nick, opts)
+	c.settle(roomJID)
+	return j.occupants, nil
+}
+
+// pendingJoin collects the server's answer to a join
+type pendingJoin struct {
+	w         *waiter
+	occupants []Occupant
+	err       error
+}
+
+// expectJoin waits for the presence confirming or refusing a join of
+// roomJID, gathering the occupants reported before it
+func (c *Conn) expectJoin(roomJID string) *pendingJoin {
+	j := &pendingJoin{}
+	j.w = c.expect(func(s *Stanza) bool {
+		if s.Name.Local != "presence" || foldBare(s.Attr["from"]) != foldBare(roomJID) {
+			return false
+		}
+		var p mucPresence
+		if err := s.decode(&p); err != nil {
+			return false
+		}
+		if s.Attr["type"] == "error" {
+			j.err = joinError(p.Error)
+			return true
+		}
+		if s.Attr["type"] == "unavailable" || len(p.Users) == 0 {
+			return false
+		}
+		u := p.Users[0]
+		if u.hasStatus(110) {
+			return true
+		}
+		j.occupants = append(j.occupants, Occupant{
+			Nick:        resource(s.Attr["from"]),
+			Jid:         u.Item.Jid,
+			Role:        u.Item.Role,
+			Affiliation: u.Item.Affiliation,
+		})
+		return false
+	})
+	return j
+}
+
+// RoomJoin is one of the rooms to join with JoinRooms
+type RoomJoin struct {
+	RoomJID string
+	Nick    string
+	Options JoinOptions
+	// Timeout is how long to wait for the server to confirm the join. When
+	// zero the join is sent without waiting and assumed to succeed.
+	Timeout time.Duration
+}
+
+// JoinRooms joins many rooms at once, sending every join before waiting for
+// any of them, and returns the outcome for each room by jid. Without Run
+// going a timeout is a read deadline, as with WithIQTimeout, and timing out
+// leaves the stream unreadable.
+func (c *Conn) JoinRooms(joins []RoomJoin) map[string]error {
+	results := make(map[string]error, len(joins))
+	pending := make([]*pendingJoin, len(joins))
+	for i, rj := range joins {
+		if rj.Timeout > 0 {
+			pending[i] = c.expectJoin(rj.RoomJID)
+		}
+		if err := c.sendJoin(rj.RoomJID, rj.Nick, rj.Options); err != nil {
+			results[rj.RoomJID] = err
+			if pending[i] != nil {
+				c.forget(pending[i].w)
+				pending[i] = nil
+			}
+		}
+	}
+
+	for i, rj := range joins {
+		if _, failed := results[rj.RoomJID]; failed {
+			continue
+		}
+		if j := pending[i]; j != nil {
+			if _, err := c.waitTimeout(j.w, rj.Timeout); err != nil {
+				results[rj.RoomJID] = err
+				continue
+			}
+			if j.err != nil {
+				results[rj.RoomJID] = j.err
+				continue
+			}
+		}
+		c.joined(rj.RoomJID, rj.Nick, rj.Options)
+		if pending[i] != nil {
+			c.settle(rj.RoomJID)
+		}
+		results[rj.RoomJID] = nil
+	}
+	return results
+}
+
+// JoinRoom joins a muc as nick, waiting for the server to confirm it
+func (c *Conn) JoinRoom(roomJID, nick string, opts JoinOptions) error {
+	_, err := c.JoinRoomWithOccupants(roomJID, nick, opts)
+	return err
+}
+
+// joinError maps the ways a join can be refused to their errors
+func joinError(e *stanzaError) error {
+	err := e.err()
+	switch err.Condition {
+	case "not-authorized":
+		return ErrRoomPasswordRequired
+	case "registration-required":
+		return ErrRegistrationRequired
+	case "forbidden":
+		return ErrRoomForbidden
+	}
+	return err
+}
+
+// joined records a room the connection is in so that it can be rejoined
+func (c *Conn) joined(roomJID, nick string, opts JoinOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rooms == nil {
+		c.rooms = make(map[string]joinedRoom)
+	}
+	key := foldBare(roomJID)
+	c.rooms[key] = joinedRoom{nick: nick, opts: opts, settled: c.rooms[key].settled}
+}
+
+// settle marks the end of a room's initial occupant list
+func (c *Conn) settle(roomJID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := foldBare(roomJID)
+	if r, ok := c.rooms[key]; ok {
+		r.settled = true
+		c.rooms[key] = r
+	}
+}
+
+func (c *Conn) sendJoin(roomJID, nick string, opts JoinOptions) error {
+	var password string
+	if opts.Password != "" {
+		password = fmt.Sprintf(xmlMUCJoinPassword, html.EscapeString(opts.Password))
+	}
+	return c.send(xmlMUCJoin, id(), html.EscapeString(roomJID), html.EscapeString(nick), NsMuc, password)
+}
+
+// RoomPresenceKind says whether an occupant entered or left a room
+type RoomPresenceKind int
+
+// The kinds of RoomPresenceEvent
+const (
+	Joined RoomPresenceKind = iota + 1
+	Left
+)
+
+// RoomPresenceEvent is someone entering or leaving a room, the system lines
+// hipchat shows in the room's history
+type RoomPresenceEvent struct {
+	Kind RoomPresenceKind
+	Nick string
+	// Time is when it happened, which is when the presence arrived unless
+	// the server said otherwise
+	Time time.Time
+}
+
+// RoomEvent is a change to an occupant of a muc: a change of role or
+// affiliation, such as a promotion to moderator or the loss of membership,
+// or their entering or leaving the room
+type RoomEvent struct {
+	// Presence is set when the occupant entered or left the room
+	Presence *RoomPresenceEvent
+
+	Room           string
+	Nick           string
+	OldRole        string
+	NewRole        string
+	OldAffiliation string
+	NewAffiliation string
+	// StatusCodes are the muc#user status codes sent with the change
+	StatusCodes []int
+}
+
+// HandleRoomEvent sets the function the dispatch loop calls when an
+// occupant's role or affiliation changes in a room, or when someone enters
+// or leaves it. The occupants already in a room when it is joined are not
+// reported as entering, nor is the connection's own presence.
+func (c *Conn) HandleRoomEvent(fn func(RoomEvent)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roomEventHandler = fn
+}
+
+// handleMUCPresence tracks muc occupants and reports changes to them
+func (c *Conn) handleMUCPresence(s *Stanza, p *mucPresence) {
+	u := p.Users[0]
+	// the room is reported as it was written, and only folded for lookups
+	room, nick := bare(s.Attr["from"]), resource(s.Attr["from"])
+	key := foldBare(room)
+	occupant := Occupant{Nick: nick, Jid: u.Item.Jid, Role: u.Item.Role, Affiliation: u.Item.Affiliation}
+
+	self := u.hasStatus(110)
+	unavailable := s.Attr["type"] == "unavailable"
+	switch {
+	case self && unavailable && (u.hasStatus(307) || u.hasStatus(321)):
+		c.removed(room, u.Item.Affiliation != "outcast")
+	case self && unavailable:
+		c.removed(room, false)
+	case self:
+		c.settle(room)
+	}
+
+	c.mu.Lock()
+	if c.occupants == nil {
+		c.occupants = make(map[string]map[string]Occupant)
+	}
+	if c.occupants[key] == nil {
+		c.occupants[key] = make(map[string]Occupant)
+	}
+	old, known := c.occupants[key][nick]
+	if unavailable {
+		delete(c.occupants[key], nick)
+	} else {
+		c.occupants[key][nick] = occupant
+	}
+	settled := c.rooms[key].settled
+	fn := c.roomEventHandler
+	c.mu.Unlock()
+
+	if fn == nil {
+		return
+	}
+	ev := RoomEvent{
+		Room:           room,
+		Nick:           nick,
+		OldRole:        old.Role,
+		NewRole:        occupant.Role,
+		OldAffiliation: old.Affiliation,
+		NewAffiliation: occupant.Affiliation,
+	}
+	if settled && !self && known == unavailable {
+		when := c.clock.Now()
+		if p.Delay != nil {
+			when = p.Delay.Stamp
+		}
+		when = c.Localize(when)
+		kind := Joined
+		if unavailable {
+			kind = Left
+		}
+		ev.Presence = &RoomPresenceEvent{Kind: kind, Nick: nick, Time: when}
+	}
+	if ev.Presence == nil && (!known || (old.Role == occupant.Role && old.Affiliation == occupant.Affiliation)) {
+		return
+	}
+	for _, st := range u.Status {
+		ev.StatusCodes = append(ev.StatusCodes, st.Code)
+	}
+	fn(ev)
+}
+
+// RejoinError is sent to the error channel when WithAutoRejoin has tried
+// every delay without getting back into a room
+type RejoinError struct {
+	Room string
+	Err  error
+}
+
+func (e *RejoinError) Error() string {
+	return "rejoin " + e.Room + ": " + e.Err.Error()
+}
+
+func (e *RejoinError) Unwrap() error {
+	return e.Err
+}
+
+// removed forgets a room the connection has been put out of, rejoining it
+// if auto rejoin is on, rejoin is set and Run is going to read the answer
+func (c *Conn) removed(roomJID string, rejoin bool) {
+	c.mu.Lock()
+	r, ok := c.rooms[foldBare(roomJID)]
+	delete(c.rooms, foldBare(roomJID))
+	running := c.running
+	c.mu.Unlock()
+	if !ok || !rejoin || !running || len(c.rejoinDelays) == 0 {
+		return
+	}
+	go c.autoRejoin(roomJID, r)
+}
+
+// autoRejoin tries to rejoin a room for WithAutoRejoin, giving up quietly
+// if Run has stopped by the time an attempt is due
+func (c *Conn) autoRejoin(roomJID string, r joinedRoom) {
+	var err error
+	for _, d := range c.rejoinDelays {
+		<-c.clock.After(d)
+		if !c.isRunning() {
+			return
+		}
+		if err = c.JoinRoom(roomJID, r.nick, r.opts); err == nil || err == ErrRoomForbidden {
+			break
+		}
+	}
+	if err != nil {
+		c.reportError(&RejoinError{Room: roomJID, Err: err})
+	}
+}
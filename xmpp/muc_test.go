@@ -0,0 +1,284 @@
+package xmpp_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func occupantPresence(from, typ, role string) string {
+	var t string
+	if typ != "" {
+		t = " type='" + typ + "'"
+	}
+	return "<presence xmlns='jabber:client' from='" + from + "'" + t + "><x xmlns='" + xmpp.NsMucUser +
+		"'><item affiliation='member' role='" + role + "'/></x></presence>"
+}
+
+func TestRoomEvents(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var events []xmpp.RoomEvent
+	c.HandleRoomEvent(func(ev xmpp.RoomEvent) { events = append(events, ev) })
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local == "iq" {
+			// the occupant's presence arrives while EntityTime reads the stream
+			return occupantPresence("Ops@Conf.B/alice", "", "participant") +
+				occupantPresence("ops@conf.b/alice", "", "moderator") +
+				occupantPresence("Ops@Conf.B/alice", "unavailable", "none") + result(s)
+		}
+		return joined(s)
+	})
+	defer received()
+
+	if err := c.JoinRoom("Ops@Conf.B", "bot", xmpp.JoinOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3: %+v", len(events), events)
+	}
+	if p := events[0].Presence; p == nil || p.Kind != xmpp.Joined || p.Nick != "alice" {
+		t.Errorf("first event %+v, want alice joining", events[0])
+	}
+	if ev := events[1]; ev.Presence != nil || ev.OldRole != "participant" || ev.NewRole != "moderator" {
+		t.Errorf("second event %+v, want a promotion", ev)
+	}
+	if p := events[2].Presence; p == nil || p.Kind != xmpp.Left {
+		t.Errorf("third event %+v, want alice leaving", events[2])
+	}
+	for i, want := range []string{"Ops@Conf.B", "ops@conf.b", "Ops@Conf.B"} {
+		if events[i].Room != want {
+			t.Errorf("event %d room %q, want %q as written", i, events[i].Room, want)
+		}
+	}
+}
+
+func TestJoinRoomWithOccupants(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local != "presence" {
+			return ""
+		}
+		room := s.Attr["to"][:strings.Index(s.Attr["to"], "/")]
+		return occupantPresence(room+"/alice", "", "moderator") + joined(s)
+	})
+	defer received()
+
+	occupants, err := c.JoinRoomWithOccupants("ops@conf.b", "bot", xmpp.JoinOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var alice bool
+	for _, o := range occupants {
+		if o.Nick == "alice" && o.Role == "moderator" {
+			alice = true
+		}
+	}
+	if !alice {
+		t.Errorf("occupants %+v lack alice", occupants)
+	}
+}
+
+func TestJoinRoomRefused(t *testing.T) {
+	tests := []struct {
+		condition string
+		want      error
+	}{
+		{"not-authorized", xmpp.ErrRoomPasswordRequired},
+		{"registration-required", xmpp.ErrRegistrationRequired},
+		{"forbidden", xmpp.ErrRoomForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			received := answer(c, server, func(s *xmpp.Stanza) string {
+				return "<presence xmlns='jabber:client' from='" + s.Attr["to"] + "' type='error'><x xmlns='" + xmpp.NsMuc +
+					"'/><error type='auth'><" + tt.condition + " xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>"
+			})
+			defer received()
+			if _, err := c.JoinRoomWithOccupants("ops@conf.b", "bot", xmpp.JoinOptions{}); !errors.Is(err, tt.want) {
+				t.Errorf("join returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoinRoomWithPassword(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	const password = "s3cr&t<>"
+	var joins []string
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local != "presence" {
+			return ""
+		}
+		inner := string(s.Inner)
+		joins = append(joins, inner)
+		if !strings.Contains(inner, "<password>s3cr&amp;t&lt;&gt;</password>") {
+			return "<presence xmlns='jabber:client' from='" + s.Attr["to"] + "' type='error'><x xmlns='" + xmpp.NsMuc +
+				"'/><error type='auth'><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>"
+		}
+		return joined(s)
+	})
+	defer received()
+
+	if err := c.JoinRoom("ops@conf.b", "bot", xmpp.JoinOptions{}); !errors.Is(err, xmpp.ErrRoomPasswordRequired) {
+		t.Fatalf("join without password returned %v, want ErrRoomPasswordRequired", err)
+	}
+	if err := c.JoinRoom("ops@conf.b", "bot", xmpp.JoinOptions{Password: password}); err != nil {
+		t.Fatalf("join with password returned %v", err)
+	}
+	if len(joins) != 2 || strings.Contains(joins[0], "<password>") {
+		t.Errorf("joins sent %q", joins)
+	}
+}
+
+func TestRoomAffiliationEvents(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var events []xmpp.RoomEvent
+	c.HandleRoomEvent(func(ev xmpp.RoomEvent) { events = append(events, ev) })
+	occupant := func(nick, typ, affiliation, role, status string) string {
+		if typ != "" {
+			typ = " type='" + typ + "'"
+		}
+		if status != "" {
+			status = "<status code='" + status + "'/>"
+		}
+		return "<presence xmlns='jabber:client' from='ops@conf.b/" + nick + "'" + typ + "><x xmlns='" + xmpp.NsMucUser +
+			"'><item affiliation='" + affiliation + "' role='" + role + "'/>" + status + "</x></presence>"
+	}
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local == "presence" {
+			return occupant("bob", "", "member", "participant", "") + joined(s)
+		}
+		// the changes arrive while EntityTime reads the stream
+		return occupant("bob", "", "admin", "moderator", "") +
+			occupant("bob", "", "admin", "moderator", "") +
+			occupant("carol", "", "member", "participant", "") +
+			occupant("carol", "unavailable", "none", "none", "321") + result(s)
+	})
+	defer received()
+
+	if err := c.JoinRoom("ops@conf.b", "bot", xmpp.JoinOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3: %+v", len(events), events)
+	}
+	if ev := events[0]; ev.Nick != "bob" || ev.Presence != nil || ev.OldAffiliation != "member" || ev.NewAffiliation != "admin" ||
+		ev.OldRole != "participant" || ev.NewRole != "moderator" {
+		t.Errorf("promotion reported as %+v", ev)
+	}
+	if ev := events[1]; ev.Nick != "carol" || ev.Presence == nil || ev.Presence.Kind != xmpp.Joined {
+		t.Errorf("carol entering reported as %+v", ev)
+	}
+	ev := events[2]
+	if ev.Nick != "carol" || ev.Presence == nil || ev.Presence.Kind != xmpp.Left ||
+		ev.OldAffiliation != "member" || ev.NewAffiliation != "none" ||
+		len(ev.StatusCodes) != 1 || ev.StatusCodes[0] != 321 {
+		t.Errorf("revoked membership reported as %+v", ev)
+	}
+}
+
+func TestRoomPresenceEvents(t *testing.T) {
+	now := time.Date(2017, 3, 1, 9, 30, 0, 0, time.UTC)
+	c, server := xmpptest.Pipe(xmpp.WithClock(stoppedClock{now}))
+	defer server.Close()
+	var events []xmpp.RoomPresenceEvent
+	c.HandleRoomEvent(func(ev xmpp.RoomEvent) {
+		if ev.Presence != nil {
+			events = append(events, *ev.Presence)
+		}
+	})
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local == "presence" {
+			// bob was in the room before the bot joined
+			return occupantPresence("ops@conf.b/bob", "", "participant") + joined(s)
+		}
+		// the presences arrive while EntityTime reads the stream
+		return occupantPresence("ops@conf.b/alice", "", "participant") +
+			"<presence xmlns='jabber:client' from='ops@conf.b/bob' type='unavailable'><x xmlns='" + xmpp.NsMucUser +
+			"'><item affiliation='member' role='none'/></x><delay xmlns='urn:xmpp:delay' stamp='2017-03-01T09:29:00Z'/></presence>" +
+			result(s)
+	})
+	defer received()
+
+	if err := c.JoinRoom("ops@conf.b", "bot", xmpp.JoinOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []xmpp.RoomPresenceEvent{
+		{Kind: xmpp.Joined, Nick: "alice", Time: now},
+		{Kind: xmpp.Left, Nick: "bob", Time: now.Add(-time.Minute)},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %+v, want %+v", events, want)
+	}
+	for i := range want {
+		if ev := events[i]; ev.Kind != want[i].Kind || ev.Nick != want[i].Nick || !ev.Time.Equal(want[i].Time) {
+			t.Errorf("event %d is %+v, want %+v", i, ev, want[i])
+		}
+	}
+}
+
+func TestJoinRooms(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var joins []string
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local != "presence" {
+			return ""
+		}
+		joins = append(joins, s.Attr["to"])
+		if len(joins) < 3 {
+			return ""
+		}
+		// answer only once every join is in, so none waited on another
+		refused := "<presence xmlns='jabber:client' from='secret@conf.b/bot' type='error'><x xmlns='" + xmpp.NsMuc +
+			"'/><error type='auth'><forbidden xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>"
+		confirmed := "<presence from='ops@conf.b/bot'><x xmlns='" + xmpp.NsMucUser +
+			"'><item affiliation='member' role='participant'/><status code='110'/></x></presence>"
+		return refused + confirmed
+	})
+	defer received()
+
+	results := c.JoinRooms([]xmpp.RoomJoin{
+		{RoomJID: "ops@conf.b", Nick: "bot", Timeout: 5 * time.Second},
+		{RoomJID: "secret@conf.b", Nick: "bot", Timeout: 5 * time.Second},
+		{RoomJID: "lobby@conf.b", Nick: "bot"},
+	})
+
+	if got := strings.Join(joins, ","); got != "ops@conf.b/bot,secret@conf.b/bot,lobby@conf.b/bot" {
+		t.Errorf("joins sent to %s", got)
+	}
+	if len(results) != 3 {
+		t.Fatalf("results %v, want one per room", results)
+	}
+	if err := results["ops@conf.b"]; err != nil {
+		t.Errorf("ops: %v", err)
+	}
+	if err := results["secret@conf.b"]; !errors.Is(err, xmpp.ErrRoomForbidden) {
+		t.Errorf("secret: %v, want ErrRoomForbidden", err)
+	}
+	if err := results["lobby@conf.b"]; err != nil {
+		t.Errorf("lobby, which isn't waited on: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package xmpp
+
+import (
+	"errors"
+	"html"
+)
+
+const xmlMUCAdminList = "<iq type='get' to='%s' id='%s'><query xmlns='%s'><item affiliation='%s'/></query></iq>"
+
+// ErrNotPrivileged is returned when the room won't let the connection do
+// something that needs its owner, an admin or a moderator
+var ErrNotPrivileged = errors.New("room privileges required")
+
+type mucAdminResult struct {
+	Items []struct {
+		mucItem
+		Nick string `xml:"nick,attr"`
+	} `xml:"http://jabber.org/protocol/muc#admin query>item"`
+}
+
+// RoomMembers lists the users of the room roomJID with the given
+// affiliation: owner, admin, member or outcast for those banned. Only a
+// room's owners and admins may ask, so others get ErrNotPrivileged. The
+// occupants returned have no role, as a list says nothing of who is in the
+// room.
+func (c *Conn) RoomMembers(roomJID, affiliation string) ([]Occupant, error) {
+	iqID := id()
+	s, err := c.sendIQ(iqID, xmlMUCAdminList, html.EscapeString(bare(roomJID)), iqID, NsMucAdmin, html.EscapeString(affiliation))
+	if err != nil {
+		var se *StanzaError
+		if errors.As(err, &se) && se.Condition == "forbidden" {
+			return nil, ErrNotPrivileged
+		}
+		return nil, err
+	}
+
+	var r mucAdminResult
+	if err := s.decode(&r); err != nil {
+		return nil, err
+	}
+	members := make([]Occupant, 0, len(r.Items))
+	for _, item := range r.Items {
+		members = append(members, Occupant{Nick: item.Nick, Jid: item.Jid, Affiliation: item.Affiliation})
+	}
+	return members, nil
+}
@@ -0,0 +1,58 @@
+package xmpp_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestRoomMembers(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		return "<iq type='result' id='" + s.Attr["id"] + "' from='ops@conf.b'><query xmlns='" + xmpp.NsMucAdmin + "'>" +
+			"<item affiliation='member' jid='alice@b' nick='alice'/>" +
+			"<item affiliation='member' jid='bob@b'/>" +
+			"</query></iq>"
+	})
+
+	members, err := c.RoomMembers("ops@conf.b/bot", "member")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []xmpp.Occupant{
+		{Nick: "alice", Jid: "alice@b", Affiliation: "member"},
+		{Jid: "bob@b", Affiliation: "member"},
+	}
+	if len(members) != len(want) {
+		t.Fatalf("members %+v", members)
+	}
+	for i := range want {
+		if members[i] != want[i] {
+			t.Errorf("member %d is %+v, want %+v", i, members[i], want[i])
+		}
+	}
+
+	sent := received()
+	if len(sent) != 1 {
+		t.Fatalf("sent %v", sent)
+	}
+	if q := sent[0]; q.Attr["type"] != "get" || q.Attr["to"] != "ops@conf.b" || !strings.Contains(string(q.Inner), "<item affiliation='member'/>") {
+		t.Errorf("sent %s to %s", q.Inner, q.Attr["to"])
+	}
+}
+
+func TestRoomMembersForbidden(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		return "<iq type='error' id='" + s.Attr["id"] + "'><error type='auth'><forbidden xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+	})
+	defer received()
+	if _, err := c.RoomMembers("ops@conf.b", "outcast"); !errors.Is(err, xmpp.ErrNotPrivileged) {
+		t.Errorf("RoomMembers returned %v, want ErrNotPrivileged", err)
+	}
+}
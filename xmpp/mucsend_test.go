@@ -0,0 +1,49 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestMUCSendWithID(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, result)
+	first, err := c.MUCSendWithID("groupchat", "ops@conf.b", "", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.MUCSendWithID("groupchat", "ops@conf.b", "", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MUCSendID("mine-1", "groupchat", "ops@conf.b", "", "three"); err != nil {
+		t.Fatal(err)
+	}
+	if first == "" || first == second {
+		t.Fatalf("ids %q and %q", first, second)
+	}
+
+	var ids []string
+	for _, s := range received() {
+		if s.Name.Local != "message" {
+			continue
+		}
+		ids = append(ids, s.Attr["id"])
+		if origin := "<origin-id xmlns='" + xmpp.NsSID + "' id='" + s.Attr["id"] + "'/>"; !strings.Contains(string(s.Inner), origin) {
+			t.Errorf("message %s doesn't carry its id as origin id: %s", s.Attr["id"], s.Inner)
+		}
+	}
+	want := []string{first, second, "mine-1"}
+	if len(ids) != len(want) {
+		t.Fatalf("sent messages with ids %q, want %q", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Errorf("message %d sent with id %q, want %q", i, ids[i], want[i])
+		}
+	}
+}
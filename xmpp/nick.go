@@ -0,0 +1,16 @@
+package xmpp
+
+import (
+	"fmt"
+	"html"
+)
+
+const xmlNick = "<nick xmlns='%s'>%s</nick>"
+
+// nickElement renders the nick set with WithNick, or "" without one
+func (c *Conn) nickElement() string {
+	if c.nick == "" {
+		return ""
+	}
+	return fmt.Sprintf(xmlNick, NsNick, html.EscapeString(c.nick))
+}
@@ -0,0 +1,62 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestWithNickSent(t *testing.T) {
+	const nick = "<nick xmlns='" + xmpp.NsNick + "'>Deploy &lt;Bot&gt;</nick>"
+	c, server := xmpptest.Pipe(xmpp.WithNick("Deploy <Bot>"), xmpp.WithDirectedPresenceOnly())
+	defer server.Close()
+	received := answer(c, server, func(*xmpp.Stanza) string { return "" })
+	if _, err := c.MUCSendWithID("chat", "alice@b/phone", "", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MUCSendWithID("groupchat", "ops@conf.b", "", "hi all"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, s := range received() {
+		desc := s.Name.Local + " " + s.Attr["to"]
+		if strings.Contains(string(s.Inner), nick) {
+			desc += " with nick"
+		}
+		got = append(got, desc)
+	}
+	// the presence sent ahead of the first chat carries the nick too
+	want := "presence alice@b with nick,message alice@b/phone with nick,message ops@conf.b"
+	if strings.Join(got, ",") != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestNickParsed(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var nicks []string
+	c.HandleMessage(func(m *xmpp.Message) { nicks = append(nicks, m.Nick) })
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		nick := "<nick xmlns='" + xmpp.NsNick + "'>Alice J</nick>"
+		// these arrive while EntityTime reads the stream
+		return "<presence xmlns='jabber:client' from='alice@b/phone'>" + nick + "</presence>" +
+			"<message xmlns='jabber:client' from='alice@b/phone' type='chat'><body>hi</body>" + nick + "</message>" +
+			"<message xmlns='jabber:client' from='bob@b/phone' type='chat'><body>hi</body></message>" +
+			result(s)
+	})
+	defer received()
+
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(nicks, ",") != "Alice J," {
+		t.Errorf("message nicks %q, want alice's and none for bob", nicks)
+	}
+	if p, ok := c.PresenceOf("alice@b"); !ok || p.Nick != "Alice J" {
+		t.Errorf("alice's presence %+v, %v", p, ok)
+	}
+}
@@ -0,0 +1,81 @@
+//go:build unix
+
+package xmpp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// noDelay reports whether TCP_NODELAY is set on conn
+func noDelay(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v != 0
+}
+
+func TestWithNoDelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name string
+		opts []Option
+		want bool
+	}{
+		{"default", nil, true},
+		{"on", []Option{WithNoDelay(true)}, true},
+		{"off", []Option{WithNoDelay(false)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := newConn(tt.opts).dial(l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := noDelay(t, conn); got != tt.want {
+				t.Errorf("TCP_NODELAY %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithNoDelayNotTCP(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	d := NewDialer(WithDialFunc(func(string) (net.Conn, error) { return client, nil }))
+	conn, err := newConn([]Option{withDialer(d), WithNoDelay(false)}).dial("b:5222")
+	if err != nil {
+		t.Fatalf("dialing a pipe returned %v", err)
+	}
+	if conn != client {
+		t.Error("dial didn't return the pipe")
+	}
+}
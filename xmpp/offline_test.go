@@ -0,0 +1,45 @@
+package xmpp_test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestGoOfflineLeavesEveryRoom(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local == "presence" && s.Attr["type"] == "" {
+			return joined(s)
+		}
+		return ""
+	})
+	for _, room := range []string{"ops@conf.b", "dev@conf.b"} {
+		if err := c.JoinRoom(room, "bot", xmpp.JoinOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.GoOffline("restarting <deploy> & co"); err != nil {
+		t.Fatal(err)
+	}
+
+	var to []string
+	for _, s := range received() {
+		if s.Name.Local != "presence" || s.Attr["type"] != "unavailable" {
+			continue
+		}
+		to = append(to, s.Attr["to"])
+		if inner := string(s.Inner); !strings.Contains(inner, "<status>restarting &lt;deploy&gt; &amp; co</status>") {
+			t.Errorf("presence to %q has %s", s.Attr["to"], inner)
+		}
+	}
+	sort.Strings(to)
+	if want := []string{"", "dev@conf.b/bot", "ops@conf.b/bot"}; strings.Join(to, ",") != strings.Join(want, ",") {
+		t.Errorf("unavailable presence sent to %q, want %q", to, want)
+	}
+}
@@ -0,0 +1,348 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"time"
+)
+
+// Option configures a Conn when it is created
+type Option func(*Conn)
+
+// WithClock sets the clock the connection uses for anything timed, in
+// place of the system clock. It is meant for tests.
+func WithClock(clock Clock) Option {
+	return func(c *Conn) {
+		c.clock = clock
+	}
+}
+
+// WithCharsetReader sets the function used to decode a stream declared in a
+// charset other than UTF-8, which is all the decoder understands by itself.
+// It is assigned to the CharsetReader of each decoder the connection creates.
+func WithCharsetReader(fn func(charset string, input io.Reader) (io.Reader, error)) Option {
+	return func(c *Conn) {
+		c.charsetReader = fn
+	}
+}
+
+// WithTLSConfig sets the tls config used when the stream is upgraded during
+// Connect and Reconnect. ServerName defaults to the host dialed.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Conn) {
+		c.tlsConfig = config
+	}
+}
+
+// WithSNI sets the server name presented during the tls handshake and
+// checked against the server's certificate, for frontends that route by
+// SNI when the host dialed is an address or a proxy. It takes precedence
+// over the ServerName of WithTLSConfig.
+func WithSNI(serverName string) Option {
+	return func(c *Conn) {
+		c.sni = serverName
+	}
+}
+
+// WithALPN sets the application protocols offered during the tls
+// handshake, usually "xmpp-client", for frontends that route by ALPN. A
+// config given to WithTLSConfig with NextProtos of its own keeps them.
+func WithALPN(protos ...string) Option {
+	return func(c *Conn) {
+		c.alpn = append([]string(nil), protos...)
+	}
+}
+
+// WithServerManagedFrom leaves the from attribute off outgoing messages and
+// presence so that the server stamps it, ignoring whatever from the caller
+// passes. Most client bots should use it: strict servers reject stanzas
+// whose from doesn't match the session with invalid-from. Components, which
+// must say who they are sending as, should not.
+func WithServerManagedFrom() Option {
+	return func(c *Conn) {
+		c.serverFrom = true
+	}
+}
+
+// WithIgnoreSelfEcho drops the copies of the connection's own groupchat
+// messages that mucs send back, so that the message handler doesn't reply
+// to itself
+func WithIgnoreSelfEcho() Option {
+	return func(c *Conn) {
+		c.ignoreSelfEcho = true
+	}
+}
+
+// WithKeepAlivePayload sets what KeepAlive writes in place of a single
+// space, such as a newline for proxies that ignore spaces. The payload must
+// be whitespace, or KeepAlive returns ErrKeepAlivePayload.
+func WithKeepAlivePayload(payload []byte) Option {
+	return func(c *Conn) {
+		c.keepAlivePayload = append([]byte(nil), payload...)
+	}
+}
+
+// WithKeepAlivePing makes KeepAlive send an xmpp ping iq instead of
+// whitespace, for middleboxes that strip whitespace
+func WithKeepAlivePing(enabled bool) Option {
+	return func(c *Conn) {
+		c.keepAlivePing = enabled
+	}
+}
+
+// WithLenientParsing tolerates the mistakes of non-compliant peers instead
+// of ending the stream: missing or mismatched end tags are closed for them,
+// unknown entities are taken literally and elements that make no sense are
+// skipped, with ErrInvalidXML sent to the error channel. Stanzas mangled
+// this way may still fail to decode, which is reported for that stanza
+// alone. Errors that leave the stream unreadable still end it.
+func WithLenientParsing() Option {
+	return func(c *Conn) {
+		c.lenient = true
+	}
+}
+
+// WithAutoRejoin makes the connection rejoin a room it is kicked from, or
+// put out of by losing its membership, trying again after each of delays in
+// turn. Once they run out a RejoinError is sent to the error channel. Bans
+// are never retried. Rooms are only rejoined while Run is going, as joining
+// waits on the room's answer, which only Run reads for it.
+func WithAutoRejoin(delays []time.Duration) Option {
+	return func(c *Conn) {
+		c.rejoinDelays = append([]time.Duration(nil), delays...)
+	}
+}
+
+// WithMarkable asks recipients for chat markers on every message sent, so
+// that their clients report when the message is displayed
+func WithMarkable() Option {
+	return func(c *Conn) {
+		c.markable = true
+	}
+}
+
+// WithRawXML keeps the bytes of each stanza exactly as they came off the
+// wire in the RawXML fields of Stanza, Message and IQ, for audit logs that
+// must match the stream byte for byte. It costs a copy of every stanza, and
+// only suits connections read through Run, since elements read with Next
+// alone are never released.
+func WithRawXML() Option {
+	return func(c *Conn) {
+		c.captureRaw = true
+	}
+}
+
+// WithPresenceProbe makes Connect probe the presence of everyone on the
+// roster once it has been fetched, so that PresenceOf knows who is online
+// straight away rather than as contacts next change presence
+func WithPresenceProbe() Option {
+	return func(c *Conn) {
+		c.probeOnConnect = true
+	}
+}
+
+// WithNoDelay sets whether connections the package dials send small writes
+// straight away (TCP_NODELAY) rather than letting Nagle's algorithm gather
+// them, which can hold each stanza back by up to 40ms. It is on by default,
+// which suits interactive bots; batch senders pushing many stanzas may get
+// better throughput with it off. It has no effect on connections handed to
+// NewConn.
+func WithNoDelay(enabled bool) Option {
+	return func(c *Conn) {
+		c.nagle = !enabled
+	}
+}
+
+// WithDirectedPresenceOnly never broadcasts presence, so the connection
+// stays offline to the roster at large. Presence goes only to the rooms it
+// joins and to the users it sends chat messages to, and Presence and
+// GoOffline update just those.
+func WithDirectedPresenceOnly() Option {
+	return func(c *Conn) {
+		c.directedOnly = true
+	}
+}
+
+// WithFollowRedirects makes Connect follow a server's see-other-host stream
+// error to the host it names, up to max times, for clustered servers that
+// hand clients off to another node. Without it, or once max redirects have
+// been followed, Connect returns the *RedirectError.
+func WithFollowRedirects(max int) Option {
+	return func(c *Conn) {
+		c.maxRedirects = max
+	}
+}
+
+// WithMaxBodyBytes limits the bodies of messages sent to max bytes once
+// escaped, as servers reject or cut short bodies that are too long. Longer
+// bodies are cut at a rune boundary and end with an ellipsis. It holds for
+// every method sending a body, each body of SendMultilingual on its own;
+// html bodies are sent as they are.
+func WithMaxBodyBytes(max int) Option {
+	return func(c *Conn) {
+		c.maxBodyBytes = max
+	}
+}
+
+// WithStrictBodyLimit makes sending a body over the WithMaxBodyBytes limit
+// fail with ErrBodyTooLong rather than cutting it short
+func WithStrictBodyLimit() Option {
+	return func(c *Conn) {
+		c.strictBodyLimit = true
+	}
+}
+
+// WithEscapeEmoticons stops text in bodies sent, such as relayed logs, that
+// happens to look like a (shortcode) from being shown as an emoticon, by
+// putting a zero width space inside it. Shortcodes made with Emoticon are
+// sent as they are.
+func WithEscapeEmoticons() Option {
+	return func(c *Conn) {
+		c.escapeEmoticons = true
+	}
+}
+
+// WithIQTimeout bounds how long requests made with an iq, such as GetRoster
+// or GetVCard, wait for the server's answer. An unanswered request is sent
+// again up to retries times before failing with ErrIQTimeout. Without Run
+// going the request reads the stream itself under a read deadline instead,
+// and isn't retried: timing out then leaves the stream unreadable, so the
+// connection has to be dropped.
+func WithIQTimeout(timeout time.Duration, retries int) Option {
+	return func(c *Conn) {
+		c.iqTimeout, c.iqRetries = timeout, retries
+	}
+}
+
+// WithLocation sets the location the times the package hands out are given
+// in, such as message delays and EntityTime's answer. They are in UTC by
+// default, whatever zone the server stamped them in.
+func WithLocation(loc *time.Location) Option {
+	return func(c *Conn) {
+		c.loc = loc
+	}
+}
+
+// WithAllowLegacy lets Connect go on with a server older than xmpp 1.0,
+// which offers no stream features, using legacy auth over a plain stream.
+// Without it Connect fails with ErrLegacyServer rather than wait for
+// features that never come.
+func WithAllowLegacy() Option {
+	return func(c *Conn) {
+		c.allowLegacy = true
+	}
+}
+
+// WithLogger logs every stanza the connection sends and receives to l. Each
+// line is prefixed with the connection's label, so that the lines of
+// several connections sharing a logger can be told apart. Stanzas are
+// logged as they are, credentials included, so it is meant for debugging.
+func WithLogger(l *log.Logger) Option {
+	return func(c *Conn) {
+		c.logger = l
+	}
+}
+
+// WithLabel sets the label the connection's log lines and errors carry, in
+// place of the session's jid
+func WithLabel(label string) Option {
+	return func(c *Conn) {
+		c.label = label
+	}
+}
+
+// WithTLSHandshakeTimeout bounds the tls handshake, so that a server that
+// accepts the connection but never finishes the handshake fails Connect,
+// or UseTLS, rather than hang it. The handshake is then made as soon as
+// tls is started instead of with the first write.
+func WithTLSHandshakeTimeout(timeout time.Duration) Option {
+	return func(c *Conn) {
+		c.tlsHandshakeTimeout = timeout
+	}
+}
+
+// WithInboundRateLimit limits every sender to perSecond messages a second,
+// in bursts of up to burst, so that a flooding user or room can't starve
+// the handlers. Senders are told apart by bare jid, which makes a room one
+// sender. Messages over the limit are dropped, and OnFlood is told. A
+// perSecond of 0 or less turns the limit off, and a burst below 1 allows
+// bursts of 1.
+func WithInboundRateLimit(perSecond float64, burst int) Option {
+	return func(c *Conn) {
+		if perSecond <= 0 {
+			c.floodRate, c.floodBurst = 0, 0
+			return
+		}
+		c.floodRate, c.floodBurst = perSecond, burst
+		if burst < 1 {
+			c.floodBurst = 1
+		}
+	}
+}
+
+// WithStreamFeatures sets which stream features Connect negotiates, and in
+// what order, from FeatureStartTLS, FeatureCompression and FeatureSASL.
+// Features the server doesn't offer are skipped, and sasl, or legacy auth,
+// is always negotiated, last if it isn't listed. The default is starttls
+// then sasl; XEP-0170 puts compression, when wanted, after sasl.
+func WithStreamFeatures(order []string) Option {
+	return func(c *Conn) {
+		c.streamFeatures = append([]string(nil), order...)
+	}
+}
+
+// WithDedupWindow drops messages SeenBefore reports as duplicates, such as
+// those replayed as room history after a reconnect, before they reach any
+// handler. Up to size ids are remembered, each for ttl after it was first
+// seen; a size below 1 keeps the default of 1000, and a ttl of 0 remembers
+// ids until they are crowded out.
+func WithDedupWindow(size int, ttl time.Duration) Option {
+	return func(c *Conn) {
+		if size < 1 {
+			size = defaultIDCacheSize
+		}
+		c.dedup = true
+		c.seen = newIDCache(size)
+		c.seen.ttl = ttl
+	}
+}
+
+// WithNick sets a friendly name sent along with chat messages, and the
+// presence sent ahead of them with WithDirectedPresenceOnly, so that users
+// who haven't added the connection's user can see who is writing to them.
+// It isn't sent to rooms, where the occupant nick is what shows.
+func WithNick(nick string) Option {
+	return func(c *Conn) {
+		c.nick = nick
+	}
+}
+
+// WithConcurrentHandlers runs the handlers for messages, presence and iqs
+// off the dispatch loop on max workers, so that a slow handler doesn't hold
+// up reading the stream, and with it keepalives and acks. Senders are
+// spread over the workers by bare jid, so stanzas from the same one are
+// still handled one at a time in the order they arrived; only those from
+// senders on different workers are handled in parallel, so handlers must
+// then be safe for concurrent use. Reading the stream never waits on the
+// workers, so handlers may make requests that wait on a reply, such as an
+// iq; stanzas for a busy worker queue up in memory until it gets to them. A
+// max below 1 leaves the handlers running on the dispatch loop.
+func WithConcurrentHandlers(max int) Option {
+	return func(c *Conn) {
+		if max > 0 {
+			c.handlers = newHandlerPool(max)
+		}
+	}
+}
+
+// WithAutoGrantVoice grants voice to everyone who asks for it in a room the
+// connection moderates, before passing the request to HandleVoiceRequest's
+// handler, if any. Failures to grant go to the error channel. Requests are
+// only granted while Run is going, as the grant waits on an answer only Run
+// reads; without it they are passed on ungranted.
+func WithAutoGrantVoice() Option {
+	return func(c *Conn) {
+		c.autoVoice = true
+	}
+}
@@ -0,0 +1,174 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"sync"
+)
+
+// PendingStanza is a message an OutboxStore holds until its delivery is
+// confirmed
+type PendingStanza struct {
+	ID     string
+	Stanza []byte
+}
+
+// OutboxStore persists outgoing messages so that none are lost if the
+// process dies between accepting a message and its delivery. Put is called
+// before a message is written, Ack once its delivery is confirmed, and
+// Pending returns what is still awaiting confirmation, oldest first, for
+// ReplayOutbox to send again. A message may be Put again with the same id
+// when it is resent. Stores must be safe for concurrent use.
+type OutboxStore interface {
+	Put(id string, stanza []byte) error
+	Ack(id string) error
+	Pending() ([]PendingStanza, error)
+}
+
+// WithOutbox persists every outgoing message with an id in store until its
+// delivery is confirmed: by the server's ack when stream management is
+// enabled, by a delivery receipt when the message asks for one, and
+// otherwise once it has been written in full. Connect replays whatever the
+// store still holds once the session is up, so messages are delivered at
+// least once and recipients may see duplicates.
+func WithOutbox(store OutboxStore) Option {
+	return func(c *Conn) {
+		c.outbox = store
+	}
+}
+
+// ReplayOutbox sends again every message the outbox still holds, such as
+// those left over from a previous process. Connect calls it itself.
+func (c *Conn) ReplayOutbox() error {
+	if c.outbox == nil {
+		return nil
+	}
+	pending, err := c.outbox.Pending()
+	if err != nil {
+		return err
+	}
+	// a message the queue turns away stays stored for the next replay
+	for _, p := range pending {
+		if _, err := c.persist(p.Stanza); err != nil {
+			return err
+		}
+		if err := c.enqueue(p.Stanza); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// persist stores b in the outbox if it is a message that can be confirmed,
+// returning the id it is stored under
+func (c *Conn) persist(b []byte) (string, error) {
+	if c.outbox == nil {
+		return "", nil
+	}
+	msgID := outboxID(b)
+	if msgID == "" {
+		return "", nil
+	}
+	return msgID, c.outbox.Put(msgID, b)
+}
+
+// written confirms b once the server has it, unless b waits on a receipt
+func (c *Conn) written(b []byte) {
+	if c.outbox == nil || wantsReceipt(b) {
+		return
+	}
+	if msgID := outboxID(b); msgID != "" {
+		c.confirm(msgID)
+	}
+}
+
+// confirm drops a delivered message from the outbox
+func (c *Conn) confirm(msgID string) {
+	if c.outbox == nil {
+		return
+	}
+	if err := c.outbox.Ack(msgID); err != nil {
+		c.reportError(err)
+	}
+}
+
+// outboxID returns the id of the message b, or "" if b isn't a message or
+// has no id
+func outboxID(b []byte) string {
+	if !bytes.HasPrefix(b, []byte("<message")) {
+		return ""
+	}
+	t, err := xml.NewDecoder(bytes.NewReader(b)).Token()
+	if err != nil {
+		return ""
+	}
+	start, ok := t.(xml.StartElement)
+	if !ok {
+		return ""
+	}
+	for _, a := range start.Attr {
+		if a.Name.Local == "id" {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// wantsReceipt reports whether the message b requests a delivery receipt
+func wantsReceipt(b []byte) bool {
+	return bytes.Contains(b, []byte("<request xmlns='"+NsReceipts+"'")) ||
+		bytes.Contains(b, []byte(`<request xmlns="`+NsReceipts+`"`))
+}
+
+// MemoryOutbox is an OutboxStore that keeps messages in memory. It carries
+// messages across Reconnect but not across restarts, for which a store
+// backed by disk or a database is needed.
+type MemoryOutbox struct {
+	mu      sync.Mutex
+	order   []string
+	stanzas map[string][]byte
+}
+
+// NewMemoryOutbox returns an empty MemoryOutbox
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{stanzas: make(map[string][]byte)}
+}
+
+// Put stores stanza under id, replacing any stanza already stored with it
+func (o *MemoryOutbox) Put(id string, stanza []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.stanzas[id]; !ok {
+		o.order = append(o.order, id)
+	}
+	o.stanzas[id] = append([]byte(nil), stanza...)
+	return nil
+}
+
+// Ack drops the stanza stored under id
+func (o *MemoryOutbox) Ack(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.stanzas[id]; !ok {
+		return nil
+	}
+	delete(o.stanzas, id)
+	for i, v := range o.order {
+		if v == id {
+			o.order = append(o.order[:i], o.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Pending returns the stored stanzas, oldest first
+func (o *MemoryOutbox) Pending() ([]PendingStanza, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pending := make([]PendingStanza, 0, len(o.order))
+	for _, id := range o.order {
+		pending = append(pending, PendingStanza{ID: id, Stanza: append([]byte(nil), o.stanzas[id]...)})
+	}
+	return pending, nil
+}
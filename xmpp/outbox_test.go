@@ -0,0 +1,138 @@
+package xmpp_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// loggedOutbox is a MemoryOutbox that logs what is put and acked, standing
+// in for a store that outlives the process
+type loggedOutbox struct {
+	*xmpp.MemoryOutbox
+	mu  sync.Mutex
+	log []string
+}
+
+func (o *loggedOutbox) Put(id string, stanza []byte) error {
+	o.record("put " + id)
+	return o.MemoryOutbox.Put(id, stanza)
+}
+
+func (o *loggedOutbox) Ack(id string) error {
+	o.record("ack " + id)
+	return o.MemoryOutbox.Ack(id)
+}
+
+func (o *loggedOutbox) record(op string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.log = append(o.log, op)
+}
+
+// pendingIDs returns the ids the store still holds
+func pendingIDs(t *testing.T, store xmpp.OutboxStore) string {
+	t.Helper()
+	pending, err := store.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(pending))
+	for i, p := range pending {
+		ids[i] = p.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestOutboxCrashAndReplay(t *testing.T) {
+	store := &loggedOutbox{MemoryOutbox: xmpp.NewMemoryOutbox()}
+
+	// the first process sends a message awaiting a receipt and one that is
+	// confirmed once written, then dies before sending a third
+	c, server := xmpptest.Pipe(xmpp.WithOutbox(store))
+	sent := capture(c, server)
+	if err := c.SendRaw("<message id='r1' to='alice@b/phone' type='chat'><body>page</body><request xmlns='" + xmpp.NsReceipts + "'/></message>"); err != nil {
+		t.Fatal(err)
+	}
+	written, err := c.MUCSendWithID("groupchat", "ops@conf.b", "", "deployed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent()
+	lost, err := c.MUCSendWithID("groupchat", "ops@conf.b", "", "rolled back")
+	if err == nil {
+		t.Fatal("sending over the dead connection succeeded")
+	}
+	if got := pendingIDs(t, store); got != "r1,"+lost {
+		t.Fatalf("pending after the crash %s, want r1 and %s", got, lost)
+	}
+
+	// the next process replays both, and the receipt confirms the first
+	c, server = xmpptest.Pipe(xmpp.WithOutbox(store))
+	defer server.Close()
+	var replayed []string
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local == "message" {
+			replayed = append(replayed, s.Attr["id"])
+			if s.Attr["id"] == "r1" {
+				return "<message xmlns='jabber:client' from='alice@b/phone'><received xmlns='" + xmpp.NsReceipts + "' id='r1'/></message>"
+			}
+			return ""
+		}
+		return result(s)
+	})
+	if err := c.ReplayOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	// reading the answer to an iq dispatches the receipt ahead of it
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	received()
+
+	if strings.Join(replayed, ",") != "r1,"+lost {
+		t.Errorf("replayed %v, want r1 and %s", replayed, lost)
+	}
+	if got := pendingIDs(t, store); got != "" {
+		t.Errorf("still pending after the replay: %s", got)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	want := []string{"put r1", "put " + written, "ack " + written, "put " + lost, "put r1", "put " + lost, "ack " + lost, "ack r1"}
+	if strings.Join(store.log, ",") != strings.Join(want, ",") {
+		t.Errorf("store saw %q, want %q", store.log, want)
+	}
+}
+
+func TestOutboxQueueFull(t *testing.T) {
+	store := xmpp.NewMemoryOutbox()
+	c, server := xmpptest.Pipe(xmpp.WithOutbox(store))
+	defer server.Close()
+	c.EnableSendQueue(1)
+
+	// nothing reads the server, so the queue overflows and the message it
+	// turns away must not be kept for replay
+	var accepted []string
+	for i := 0; i < 10; i++ {
+		msgID := fmt.Sprintf("m%d", i)
+		err := c.SendRaw("<message id='" + msgID + "' to='alice@b' type='chat'><body>hi</body></message>")
+		if errors.Is(err, xmpp.ErrQueueFull) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted = append(accepted, msgID)
+	}
+	if len(accepted) == 10 {
+		t.Fatal("queue never filled")
+	}
+	if got, want := pendingIDs(t, store), strings.Join(accepted, ","); got != want {
+		t.Errorf("outbox holds %q, want only the accepted %q", got, want)
+	}
+}
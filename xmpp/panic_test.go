@@ -0,0 +1,93 @@
+package xmpp_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+const panicScript = streamHeader +
+	"<message from='alice@b/phone' type='chat'><body>boom</body></message>" +
+	"<message from='alice@b/phone' type='chat'><body>still here</body></message>" +
+	"</stream:stream>"
+
+// panicky is a message handler that panics on "boom"
+func panicky(mu *sync.Mutex, bodies *[]string) func(*xmpp.Message) {
+	return func(m *xmpp.Message) {
+		if m.Body == "boom" {
+			panic("handler bug")
+		}
+		mu.Lock()
+		*bodies = append(*bodies, m.Body)
+		mu.Unlock()
+	}
+}
+
+func TestOnHandlerPanic(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []xmpp.Option
+	}{
+		{"in the read loop", nil},
+		{"on the handler pool", []xmpp.Option{xmpp.WithConcurrentHandlers(2)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe(tt.opts...)
+			defer server.Close()
+			var mu sync.Mutex
+			var bodies []string
+			c.HandleMessage(panicky(&mu, &bodies))
+			panicked := make(chan string, 2)
+			c.OnHandlerPanic(func(v interface{}, stanza []byte) {
+				panicked <- v.(string) + " " + string(stanza)
+			})
+			serve(server, panicScript)
+			if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+				t.Fatalf("Run returned %v after the panic", err)
+			}
+			c.Close()
+
+			p := <-panicked
+			if !strings.HasPrefix(p, "handler bug <message") || !strings.Contains(p, "boom") {
+				t.Errorf("OnHandlerPanic got %s", p)
+			}
+			// the pool may still be handling the second message
+			if !eventually(func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(bodies) == 1 && bodies[0] == "still here"
+			}) {
+				t.Errorf("handled %q after the panic", bodies)
+			}
+		})
+	}
+}
+
+func TestHandlerPanicLogged(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var mu sync.Mutex
+	var bodies []string
+	c.HandleMessage(panicky(&mu, &bodies))
+	serve(server, panicScript)
+	if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v after the panic", err)
+	}
+	if out := buf.String(); !strings.Contains(out, "handler panic: handler bug") || !strings.Contains(out, "boom") || !strings.Contains(out, "panic_test.go") {
+		t.Errorf("logged %s, want the panic, the stanza and the stack", out)
+	}
+	if len(bodies) != 1 {
+		t.Errorf("handled %q after the panic", bodies)
+	}
+}
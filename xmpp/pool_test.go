@@ -0,0 +1,85 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+// repeatReader plays a stream header and then the same stanza forever
+type repeatReader struct {
+	header, stanza []byte
+	pos            int
+	started        bool
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if !r.started {
+		r.started = true
+		return copy(p, r.header), nil
+	}
+	n := copy(p, r.stanza[r.pos:])
+	r.pos = (r.pos + n) % len(r.stanza)
+	return n, nil
+}
+
+func (r *repeatReader) Write(p []byte) (int, error) { return len(p), nil }
+func (r *repeatReader) Close() error                { return nil }
+
+func BenchmarkDispatchMessage(b *testing.B) {
+	rw := &repeatReader{
+		header: []byte("<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>"),
+		stanza: []byte("<message from='1_room@conf.hipchat.com/Ann' to='1_2@chat.hipchat.com/bot' type='groupchat' id='m1'>" +
+			"<body>deploy finished on web-3 in 42s</body>" +
+			"<stanza-id xmlns='urn:xmpp:sid:0' id='s1' by='1_room@conf.hipchat.com'/>" +
+			"<delay xmlns='urn:xmpp:delay' stamp='2024-01-02T03:04:05Z'/></message>"),
+	}
+	c := NewConn(rw)
+	if _, err := c.readStanza(); err != nil {
+		b.Fatal(err)
+	}
+	var n int
+	c.HandleMessage(func(m *Message) { n += len(m.Body) })
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, err := c.readStanza()
+		if err != nil {
+			b.Fatal(err)
+		}
+		c.dispatch(s)
+	}
+	if n == 0 {
+		b.Fatal("handler not called")
+	}
+}
+
+// TestDecodeReusesSafely checks that a pooled decoder left broken by one
+// stanza doesn't spoil the next
+func TestDecodeReusesSafely(t *testing.T) {
+	var body struct {
+		Body string `xml:"body"`
+	}
+	stanzas := []struct {
+		inner   string
+		want    string
+		wantErr bool
+	}{
+		{"<body>one</body>", "one", false},
+		{"<body>two", "", true},
+		{"<body>three</body><x xmlns='urn:a'><y/></x>", "three", false},
+		{"</body>", "", true},
+		{"<body>four &amp; more</body>", "four & more", false},
+	}
+	for _, tt := range stanzas {
+		body.Body = ""
+		s := &Stanza{Name: xml.Name{Local: "message"}, Inner: []byte(tt.inner)}
+		err := s.decode(&body)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("decode %q: %v", tt.inner, err)
+		}
+		if !tt.wantErr && body.Body != tt.want {
+			t.Errorf("decode %q: body %q, want %q", tt.inner, body.Body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package xmpp
+
+import "time"
+
+// statusInterval is the least time UpdateStatus leaves between presences
+const statusInterval = time.Second
+
+// ContactPresence is the last presence a contact sent
+type ContactPresence struct {
+	Available bool
+	// Show is away, chat, dnd or xa, or "" for plain available
+	Show   string
+	Status string
+	// Nick is the friendly name the contact gave for themselves
+	Nick string
+}
+
+// handlePresence passes muc presence on to handleMUCPresence and records
+// everyone else's
+func (c *Conn) handlePresence(s *Stanza) {
+	typ := s.Attr["type"]
+	if typ != "" && typ != "unavailable" {
+		return
+	}
+	var p mucPresence
+	if err := s.decode(&p); err != nil {
+		c.reportError(err)
+		return
+	}
+	if len(p.Users) > 0 {
+		c.handleMUCPresence(s, &p)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.presences == nil {
+		c.presences = make(map[string]ContactPresence)
+	}
+	c.presences[foldBare(s.Attr["from"])] = ContactPresence{
+		Available: typ == "",
+		Show:      p.Show,
+		Status:    p.Status,
+		Nick:      p.Nick,
+	}
+}
+
+// PresenceOf returns the last presence received from jid, and false if
+// none has been
+func (c *Conn) PresenceOf(jid string) (ContactPresence, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.presences[foldBare(jid)]
+	return p, ok
+}
+
+// ProbePresence asks the server for jid's current presence, which arrives
+// as an ordinary presence and is recorded for PresenceOf. Servers only
+// answer for contacts the user is subscribed to.
+func (c *Conn) ProbePresence(jid string) error {
+	return c.encode(&outPresence{To: bare(jid), Type: "probe"})
+}
+
+// probeRoster probes the presence of everyone on the roster
+func (c *Conn) probeRoster() error {
+	for _, e := range c.Contacts() {
+		if err := c.ProbePresence(e.Jid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// directedPresence sets the availability shown to the rooms the connection
+// is in and the users it has talked to, in place of a broadcast
+func (c *Conn) directedPresence(jid, show string) error {
+	c.mu.Lock()
+	c.show = show
+	to := make([]string, 0, len(c.rooms)+len(c.directed))
+	for room, r := range c.rooms {
+		to = append(to, room+"/"+r.nick)
+	}
+	for user := range c.directed {
+		to = append(to, user)
+	}
+	c.mu.Unlock()
+	for _, t := range to {
+		if err := c.encode(c.ownPresence(jid, t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// presentTo sends directed presence to a user the first time the connection
+// talks to them, so that under WithDirectedPresenceOnly they alone see it
+// online. Rooms already have the connection's presence from joining.
+func (c *Conn) presentTo(jid string) error {
+	if !c.directedOnly {
+		return nil
+	}
+	key := foldBare(jid)
+	c.mu.Lock()
+	_, inRoom := c.rooms[key]
+	known := inRoom || c.directed[key]
+	if !known {
+		if c.directed == nil {
+			c.directed = make(map[string]bool)
+		}
+		c.directed[key] = true
+	}
+	c.mu.Unlock()
+	if known {
+		return nil
+	}
+	p := c.ownPresence("", key)
+	p.Payload = append(p.Payload, c.nickElement()...)
+	return c.encode(p)
+}
+
+// ownPresence returns the connection's own presence as last set, from jid
+// and to to if they are given
+func (c *Conn) ownPresence(jid, to string) *outPresence {
+	c.mu.Lock()
+	show, status := c.show, c.status
+	c.mu.Unlock()
+	return &outPresence{From: c.fromJID(jid), To: to, Show: show, Status: status, Payload: c.presenceExtras()}
+}
+
+// UpdateStatus resends the connection's presence with a new status text,
+// keeping the show last set with Presence. Updates are sent a second apart
+// at most: one made sooner is held back until then, and only the latest of
+// those held back is sent, so a status showing a changing count can be set
+// as often as the count changes.
+func (c *Conn) UpdateStatus(status string) error {
+	now := c.clock.Now()
+	c.mu.Lock()
+	c.status = status
+	if wait := c.statusSent.Add(statusInterval).Sub(now); wait > 0 {
+		if !c.statusPending {
+			c.statusPending = true
+			go c.flushStatus(wait)
+		}
+		c.mu.Unlock()
+		return nil
+	}
+	c.statusSent = now
+	c.mu.Unlock()
+	return c.sendStatus()
+}
+
+// flushStatus sends the status held back by UpdateStatus once wait is up
+func (c *Conn) flushStatus(wait time.Duration) {
+	<-c.clock.After(wait)
+	c.mu.Lock()
+	c.statusPending, c.statusSent = false, c.clock.Now()
+	c.mu.Unlock()
+	if err := c.sendStatus(); err != nil {
+		c.reportError(err)
+	}
+}
+
+// sendStatus sends the connection's presence wherever it goes
+func (c *Conn) sendStatus() error {
+	if c.directedOnly {
+		c.mu.Lock()
+		show := c.show
+		c.mu.Unlock()
+		return c.directedPresence("", show)
+	}
+	return c.encode(c.ownPresence("", ""))
+}
@@ -0,0 +1,64 @@
+package xmpp_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestProbePresence(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	sent := capture(c, server)
+	if err := c.ProbePresence("alice@b/phone"); err != nil {
+		t.Fatal(err)
+	}
+	out := sent()
+	if !strings.Contains(out, `to="alice@b"`) || !strings.Contains(out, `type="probe"`) {
+		t.Errorf("sent %s, want a probe of alice's bare jid", out)
+	}
+}
+
+func TestConnectProbesRoster(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	probed := make(chan string, 8)
+	sasl := saslServer(plainFeatures)
+	roster := rosterResult("<item jid='alice@b' subscription='both'/><item jid='carol@b' subscription='both'/>")
+	negotiate(nil, server, func(s *xmpp.Stanza) string {
+		switch {
+		case s.Name.Local == "presence" && s.Attr["type"] == "probe":
+			probed <- s.Attr["to"]
+			if s.Attr["to"] == "alice@b" {
+				return "<presence xmlns='jabber:client' from='alice@b/phone'><show>away</show></presence>"
+			}
+			return ""
+		case s.Name.Local == "iq" && strings.Contains(string(s.Inner), xmpp.NsBind):
+			return sasl(s)
+		case s.Name.Local == "iq":
+			return roster(s)
+		}
+		return sasl(s)
+	})
+	c, err := xmpp.ConnectOver(client, "b", "bob", "pw", "bot", xmpp.WithPresenceProbe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the vcard fetch that follows the probes reads alice's answer
+	if p, ok := c.PresenceOf("alice@b"); !ok || !p.Available || p.Show != "away" {
+		t.Errorf("alice's presence %+v, %v", p, ok)
+	}
+	if _, ok := c.PresenceOf("carol@b"); ok {
+		t.Error("carol has a presence without answering the probe")
+	}
+	for _, want := range []string{"alice@b", "carol@b"} {
+		if got := <-probed; got != want {
+			t.Errorf("probed %s, want %s", got, want)
+		}
+	}
+}
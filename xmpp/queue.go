@@ -0,0 +1,69 @@
+package xmpp
+
+import (
+	"errors"
+	"time"
+)
+
+// queueFlushTimeout bounds how long Close waits for queued stanzas to be
+// written
+const queueFlushTimeout = 5 * time.Second
+
+// ErrQueueFull is returned by sends when the send queue has no room left
+var ErrQueueFull = errors.New("send queue full")
+
+type sendQueue struct {
+	ch   chan []byte
+	done chan struct{}
+}
+
+// EnableSendQueue makes sends queue their stanzas, up to size of them, for
+// a single goroutine to write in order, so that callers don't block on a
+// slow connection. A send that finds the queue full fails at once with
+// ErrQueueFull, and errors writing queued stanzas go to the error channel.
+// Close writes out what is left in the queue, waiting a few seconds at most.
+func (c *Conn) EnableSendQueue(size int) {
+	q := &sendQueue{ch: make(chan []byte, size), done: make(chan struct{})}
+	c.qmu.Lock()
+	c.queue = q
+	c.qmu.Unlock()
+	go c.drain(q)
+}
+
+// QueueLen returns the number of stanzas waiting in the send queue
+func (c *Conn) QueueLen() int {
+	c.qmu.RLock()
+	defer c.qmu.RUnlock()
+	if c.queue == nil {
+		return 0
+	}
+	return len(c.queue.ch)
+}
+
+func (c *Conn) drain(q *sendQueue) {
+	defer close(q.done)
+	for b := range q.ch {
+		if err := c.writeNow(b); err != nil {
+			c.reportError(err)
+		}
+	}
+}
+
+// flushQueue stops queueing and waits for the writer to empty the queue
+func (c *Conn) flushQueue() {
+	c.qmu.Lock()
+	q := c.queue
+	c.queue = nil
+	if q != nil {
+		close(q.ch)
+	}
+	c.qmu.Unlock()
+	if q == nil {
+		return
+	}
+
+	select {
+	case <-q.done:
+	case <-c.clock.After(queueFlushTimeout):
+	}
+}
@@ -0,0 +1,49 @@
+package xmpp_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestSendQueueFull(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	c.EnableSendQueue(2)
+
+	// nothing reads the server yet, so the writer blocks on the first
+	// stanza and the rest wait in the queue until it overflows
+	accepted := 0
+	var err error
+	for ; accepted < 10; accepted++ {
+		if err = c.SendRaw(fmt.Sprintf("<message id='m%d'/>", accepted)); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, xmpp.ErrQueueFull) {
+		t.Fatalf("send %d returned %v, want ErrQueueFull", accepted, err)
+	}
+	if accepted < 2 || accepted > 3 {
+		t.Errorf("accepted %d sends into a queue of 2", accepted)
+	}
+	if n := c.QueueLen(); n != 2 {
+		t.Errorf("QueueLen %d, want 2", n)
+	}
+
+	received := answer(c, server, func(*xmpp.Stanza) string { return "" })
+	sent := received()
+	if len(sent) != accepted {
+		t.Fatalf("server got %d stanzas, want the %d accepted", len(sent), accepted)
+	}
+	for i, s := range sent {
+		if want := fmt.Sprintf("m%d", i); s.Attr["id"] != want {
+			t.Errorf("stanza %d is %s, want %s", i, s.Attr["id"], want)
+		}
+	}
+	if n := c.QueueLen(); n != 0 {
+		t.Errorf("QueueLen %d after Close flushed the queue", n)
+	}
+}
@@ -0,0 +1,33 @@
+package xmpp
+
+import (
+	"bytes"
+	"io"
+)
+
+// rawReader keeps what the decoder reads so that the exact bytes of each
+// stanza can be handed out with WithRawXML
+type rawReader struct {
+	r    io.Reader
+	buf  []byte
+	base int64 // the decoder offset of buf[0]
+}
+
+func (rr *rawReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	return n, err
+}
+
+// span returns a copy of the bytes between the decoder offsets start and
+// end, less leading whitespace, and forgets everything before end
+func (rr *rawReader) span(start, end int64) []byte {
+	if start < rr.base || end-rr.base > int64(len(rr.buf)) || start > end {
+		return nil
+	}
+	raw := bytes.TrimLeft(rr.buf[start-rr.base:end-rr.base], " \t\r\n")
+	raw = append([]byte(nil), raw...)
+	rr.buf = append(rr.buf[:0], rr.buf[end-rr.base:]...)
+	rr.base = end
+	return raw
+}
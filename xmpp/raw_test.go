@@ -0,0 +1,50 @@
+package xmpp_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestRawXML(t *testing.T) {
+	// quoting, spacing, entities and empty elements a re-serialization
+	// would all change
+	msg := "<message type=\"chat\"   from='a@b/c'><body>caf&#233; &amp; &quot;tea&quot;</body><active xmlns='http://jabber.org/protocol/chatstates'></active></message>"
+	iq := "<iq type='get' id='v1' from='a@b/c'>\n  <query xmlns='jabber:iq:version'/>\n</iq>"
+
+	c, server := xmpptest.Pipe(xmpp.WithRawXML())
+	defer server.Close()
+	var gotMsg, gotIQ string
+	c.HandleMessage(func(m *xmpp.Message) { gotMsg = string(m.RawXML) })
+	c.HandleIQ(func(q *xmpp.IQ) { gotIQ = string(q.RawXML) })
+	serve(server, streamHeader+msg+"\n"+iq+"</stream:stream>")
+	if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v", err)
+	}
+
+	if gotMsg != msg {
+		t.Errorf("message RawXML is\n%s\nwant\n%s", gotMsg, msg)
+	}
+	if gotIQ != iq {
+		t.Errorf("iq RawXML is\n%s\nwant\n%s", gotIQ, iq)
+	}
+}
+
+func TestRawXMLUnset(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var raw []byte
+	handled := false
+	c.HandleMessage(func(m *xmpp.Message) { raw, handled = m.RawXML, true })
+	serve(server, streamHeader+"<message type='chat' from='a@b/c'><body>hi</body></message></stream:stream>")
+	runFor(t, c.Run)
+
+	if !handled {
+		t.Fatal("message wasn't handled")
+	}
+	if raw != nil {
+		t.Errorf("RawXML is %q without WithRawXML", raw)
+	}
+}
@@ -0,0 +1,63 @@
+package xmpp
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+const (
+	xmlReactions = "<reactions xmlns='%s' id='%s'>%s</reactions>"
+	xmlReaction  = "<reaction>%s</reaction>"
+)
+
+// Reaction is a user reacting to a message with emojis
+type Reaction struct {
+	// From is who reacted, an occupant's room jid for a room
+	From string
+	// ID is the id of the message reacted to
+	ID string
+	// Emojis is the sender's full set of reactions to the message, replacing
+	// any sent before. It is empty when the reactions are cleared.
+	Emojis []string
+}
+
+type reactionsStanza struct {
+	ID        string   `xml:"id,attr"`
+	Reactions []string `xml:"reaction"`
+}
+
+// React reacts to the message with targetID sent by or to to, replacing the
+// connection's earlier reactions to it. Passing no emojis clears them. In a
+// room targetID must be the message's stanza id as given by the room.
+func (c *Conn) React(to, targetID string, emojis []string) error {
+	typ := c.messageType(to)
+	if typ == "groupchat" {
+		to = bare(to)
+	}
+	var b strings.Builder
+	for _, e := range emojis {
+		fmt.Fprintf(&b, xmlReaction, html.EscapeString(e))
+	}
+	payload := fmt.Sprintf(xmlReactions, NsReactions, html.EscapeString(targetID), b.String())
+	return c.encode(&outMessage{To: to, Type: typ, ID: id(), Payload: []byte(payload)})
+}
+
+// HandleReaction sets the function the dispatch loop calls with each
+// reaction. Without one, reactions are passed to the bodyless handler.
+func (c *Conn) HandleReaction(fn func(Reaction)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reactionHandler = fn
+}
+
+// parseReaction returns the reaction carried by a message's reactions
+func parseReaction(from string, r *reactionsStanza) *Reaction {
+	emojis := make([]string, 0, len(r.Reactions))
+	for _, e := range r.Reactions {
+		if e = strings.TrimSpace(e); e != "" {
+			emojis = append(emojis, e)
+		}
+	}
+	return &Reaction{From: from, ID: r.ID, Emojis: emojis}
+}
@@ -0,0 +1,75 @@
+package xmpp_test
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestReact(t *testing.T) {
+	tests := []struct {
+		name   string
+		emojis []string
+	}{
+		{"emojis", []string{"✅", "<3"}},
+		{"cleared", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			received := answer(c, server, func(*xmpp.Stanza) string { return "" })
+			if err := c.React("alice@b/phone", "m'1", tt.emojis); err != nil {
+				t.Fatal(err)
+			}
+			sent := received()
+			if len(sent) != 1 || sent[0].Attr["to"] != "alice@b/phone" || sent[0].Attr["type"] != "chat" {
+				t.Fatalf("sent %v", sent)
+			}
+			var m struct {
+				Reactions struct {
+					ID        string   `xml:"id,attr"`
+					Reactions []string `xml:"reaction"`
+				} `xml:"urn:xmpp:reactions:0 reactions"`
+			}
+			if err := xml.Unmarshal([]byte("<m>"+string(sent[0].Inner)+"</m>"), &m); err != nil {
+				t.Fatal(err)
+			}
+			if m.Reactions.ID != "m'1" || strings.Join(m.Reactions.Reactions, " ") != strings.Join(tt.emojis, " ") {
+				t.Errorf("sent reactions %+v, want %q to m'1", m.Reactions, tt.emojis)
+			}
+		})
+	}
+}
+
+func TestHandleReaction(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var got []xmpp.Reaction
+	c.HandleReaction(func(r xmpp.Reaction) { got = append(got, r) })
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		reactions := func(emojis string) string {
+			return "<message xmlns='jabber:client' from='ops@conf.b/alice' type='groupchat'>" +
+				"<reactions xmlns='" + xmpp.NsReactions + "' id='s1'>" + emojis + "</reactions></message>"
+		}
+		// the reactions arrive while EntityTime reads the stream
+		return reactions("<reaction>👍</reaction><reaction> 🎉 </reaction>") + reactions("") + result(s)
+	})
+	defer received()
+
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("handled %d reactions", len(got))
+	}
+	if r := got[0]; r.From != "ops@conf.b/alice" || r.ID != "s1" || strings.Join(r.Emojis, " ") != "👍 🎉" {
+		t.Errorf("reaction %+v", r)
+	}
+	if r := got[1]; r.ID != "s1" || r.Emojis == nil || len(r.Emojis) != 0 {
+		t.Errorf("cleared reactions %+v, want an empty set", r)
+	}
+}
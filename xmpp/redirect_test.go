@@ -0,0 +1,105 @@
+package xmpp_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// refusing returns a connection to a server that answers the stream with
+// the stream error condition
+func refusing(condition string) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		go io.Copy(io.Discard, server)
+		io.WriteString(server, streamHeader+"<stream:error>"+condition+"</stream:error></stream:stream>")
+	}()
+	return client
+}
+
+func seeOtherHost(host string) string {
+	return "<see-other-host xmlns='urn:ietf:params:xml:ns:xmpp-streams'>" + host + "</see-other-host>"
+}
+
+// nodes returns a Dialer that dials by address through the dial funcs in
+// nodes, recording each address dialed
+func nodes(dialed *[]string, nodes map[string]func() net.Conn) *xmpp.Dialer {
+	var mu sync.Mutex
+	return xmpp.NewDialer(xmpp.WithDialFunc(func(addr string) (net.Conn, error) {
+		mu.Lock()
+		*dialed = append(*dialed, addr)
+		mu.Unlock()
+		if dial, ok := nodes[addr]; ok {
+			return dial(), nil
+		}
+		return nil, errors.New("no route to " + addr)
+	}))
+}
+
+func TestConnectFollowsRedirects(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	var dialed []string
+	d := nodes(&dialed, map[string]func() net.Conn{
+		"node1:5222": func() net.Conn { return refusing(seeOtherHost("node2:5333")) },
+		"node2:5333": func() net.Conn { return refusing(seeOtherHost("[::1]")) },
+		"[::1]:5222": srv.Pipe,
+	})
+	c, err := d.Connect("node1", "bob", "pw", "bot", xmpp.WithFollowRedirects(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := strings.Join(dialed, ","); got != "node1:5222,node2:5333,[::1]:5222" {
+		t.Errorf("dialed %s", got)
+	}
+}
+
+func TestConnectRedirectCap(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []xmpp.Option
+		dialed int
+	}{
+		{"not following", nil, 1},
+		{"loop", []xmpp.Option{xmpp.WithFollowRedirects(3)}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dialed []string
+			// the two nodes send clients to each other
+			d := nodes(&dialed, map[string]func() net.Conn{
+				"node1:5222": func() net.Conn { return refusing(seeOtherHost("node2")) },
+				"node2:5222": func() net.Conn { return refusing(seeOtherHost("node1")) },
+			})
+			_, err := d.Connect("node1", "bob", "pw", "bot", tt.opts...)
+			var re *xmpp.RedirectError
+			if !errors.As(err, &re) {
+				t.Fatalf("Connect returned %v, want a *RedirectError", err)
+			}
+			if len(dialed) != tt.dialed {
+				t.Errorf("dialed %q, want %d dials", dialed, tt.dialed)
+			}
+		})
+	}
+}
+
+func TestConnectHostUnknown(t *testing.T) {
+	var dialed []string
+	d := nodes(&dialed, map[string]func() net.Conn{
+		"b:5222": func() net.Conn { return refusing("<host-unknown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>") },
+	})
+	_, err := d.Connect("b", "bob", "pw", "bot", xmpp.WithFollowRedirects(3))
+	var ce *xmpp.ConnectError
+	if !errors.Is(err, xmpp.ErrHostUnknown) || !errors.As(err, &ce) {
+		t.Fatalf("Connect returned %v, want ErrHostUnknown", err)
+	}
+	if len(dialed) != 1 {
+		t.Errorf("dialed %q after the host was unknown", dialed)
+	}
+}
@@ -0,0 +1,86 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+)
+
+const (
+	xmlRegisterGet = "<iq type='get' id='%s'><query xmlns='%s'/></iq>"
+	xmlRegisterSet = "<iq type='set' id='%s'><query xmlns='%s'>%s</query></iq>"
+)
+
+// Errors returned by Register when the server turns the registration down.
+// Other failures are returned as a *StanzaError.
+var (
+	// ErrUsernameTaken means the username is already registered
+	ErrUsernameTaken = errors.New("register: username taken")
+	// ErrRegistrationNotAcceptable means required fields were missing or
+	// held values the server won't take
+	ErrRegistrationNotAcceptable = errors.New("register: fields not acceptable")
+)
+
+type registerQuery struct {
+	Query struct {
+		Form *DataForm `xml:"jabber:x:data x"`
+	} `xml:"jabber:iq:register query"`
+}
+
+// Register creates an account with in-band registration, filling the
+// server's registration form with fields such as username, password and
+// email. It must be called on a stream that is open but not yet
+// authenticated. Servers that answer with a data form have it filled in
+// and returned; the rest are sent the fields as plain elements.
+func (c *Conn) Register(fields map[string]string) error {
+	iqID := id()
+	s, err := c.sendIQ(iqID, xmlRegisterGet, iqID, NsRegister)
+	if err != nil {
+		return err
+	}
+	var q registerQuery
+	if err := s.decode(&q); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var payload bytes.Buffer
+	if form := q.Query.Form; form != nil {
+		submit := form.Submit()
+		for _, k := range keys {
+			submit.Set(k, fields[k])
+		}
+		b, err := xml.Marshal(submit)
+		if err != nil {
+			return err
+		}
+		payload.Write(b)
+	} else {
+		for _, k := range keys {
+			fmt.Fprintf(&payload, "<%s>%s</%s>", k, html.EscapeString(fields[k]), k)
+		}
+	}
+
+	iqID = id()
+	if _, err := c.sendIQ(iqID, xmlRegisterSet, iqID, NsRegister, payload.String()); err != nil {
+		var se *StanzaError
+		if errors.As(err, &se) {
+			switch se.Condition {
+			case "conflict":
+				return ErrUsernameTaken
+			case "not-acceptable":
+				return ErrRegistrationNotAcceptable
+			}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package xmpp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestRegister(t *testing.T) {
+	const (
+		plainQuery = "<username/><password/><email/>"
+		formQuery  = "<x xmlns='jabber:x:data' type='form'><field type='fixed'><value>Sign up</value></field>" +
+			"<field var='FORM_TYPE' type='hidden'><value>jabber:iq:register</value></field>" +
+			"<field var='username' type='text-single' label='User'><required/></field>" +
+			"<field var='password' type='text-private' label='Password'><required/></field></x>"
+	)
+	conflict := "<error type='cancel'><conflict xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error>"
+	notAcceptable := "<error type='modify'><not-acceptable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error>"
+	tests := []struct {
+		name, query, refusal string
+		want                 error
+		submitted            []string
+	}{
+		{"plain fields", plainQuery, "", nil, []string{"<password>s3cr&amp;t</password><username>deploybot</username>"}},
+		{"data form", formQuery, "", nil, []string{
+			`<x xmlns="jabber:x:data" type="submit">`,
+			`<field var="FORM_TYPE" type="hidden"><value>jabber:iq:register</value></field>`,
+			`<field var="username" type="text-single"><value>deploybot</value></field>`,
+			`<field var="password" type="text-private"><value>s3cr&amp;t</value></field>`,
+		}},
+		{"username taken", plainQuery, conflict, xmpp.ErrUsernameTaken, nil},
+		{"not acceptable", formQuery, notAcceptable, xmpp.ErrRegistrationNotAcceptable, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			var submitted string
+			received := answer(c, server, func(s *xmpp.Stanza) string {
+				reply := "<iq type='result' id='" + s.Attr["id"] + "'>"
+				switch {
+				case s.Attr["type"] == "get":
+					reply += "<query xmlns='" + xmpp.NsRegister + "'>" + tt.query + "</query>"
+				case tt.refusal != "":
+					submitted = string(s.Inner)
+					reply = "<iq type='error' id='" + s.Attr["id"] + "'>" + tt.refusal
+				default:
+					submitted = string(s.Inner)
+				}
+				return reply + "</iq>"
+			})
+			err := c.Register(map[string]string{"username": "deploybot", "password": "s3cr&t"})
+			received()
+			if err != tt.want {
+				t.Fatalf("Register returned %v, want %v", err, tt.want)
+			}
+			if !strings.Contains(submitted, "<query xmlns='"+xmpp.NsRegister+"'>") {
+				t.Errorf("submitted %s", submitted)
+			}
+			for _, part := range tt.submitted {
+				if !strings.Contains(submitted, part) {
+					t.Errorf("submitted %s, want %s", submitted, part)
+				}
+			}
+			if strings.Contains(submitted, "Sign up") {
+				t.Errorf("submitted the form's fixed field: %s", submitted)
+			}
+		})
+	}
+}
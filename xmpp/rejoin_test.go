@@ -0,0 +1,73 @@
+package xmpp_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+const kicked = "<presence xmlns='jabber:client' from='room@conf.b/bot' type='unavailable'><x xmlns='" + xmpp.NsMucUser +
+	"'><item affiliation='member' role='none'/><status code='307'/><status code='110'/></x></presence>"
+
+func TestAutoRejoin(t *testing.T) {
+	c, server := xmpptest.Pipe(xmpp.WithAutoRejoin([]time.Duration{time.Millisecond}))
+	defer server.Close()
+	joins := make(chan *xmpp.Stanza, 2)
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local == "presence" {
+			joins <- s
+		}
+		return joined(s)
+	})
+	if err := c.JoinRoom("room@conf.b", "bot", xmpp.JoinOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	<-joins
+
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+	io.WriteString(server, streamHeader+kicked)
+	select {
+	case s := <-joins:
+		if s.Attr["to"] != "room@conf.b/bot" {
+			t.Errorf("rejoined %q", s.Attr["to"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("room not rejoined")
+	}
+	io.WriteString(server, "</stream:stream>")
+	<-done
+	received()
+}
+
+func TestAutoRejoinWithoutRun(t *testing.T) {
+	c, server := xmpptest.Pipe(xmpp.WithAutoRejoin([]time.Duration{time.Millisecond}))
+	defer server.Close()
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local == "iq" {
+			// the kick arrives while EntityTime reads the stream itself
+			return kicked + result(s)
+		}
+		return joined(s)
+	})
+	if err := c.JoinRoom("room@conf.b", "bot", xmpp.JoinOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	var presences int
+	for _, s := range received() {
+		if s.Name.Local == "presence" {
+			presences++
+		}
+	}
+	if presences != 1 {
+		t.Errorf("sent %d presences, want only the first join", presences)
+	}
+}
@@ -0,0 +1,41 @@
+package xmpp_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestHandleRoom(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var got []string
+	handler := func(name string) func(*xmpp.Message) {
+		return func(m *xmpp.Message) { got = append(got, name+":"+m.Body) }
+	}
+	c.HandleMessage(handler("fallback"))
+	c.HandleRoom("ops@conf.b", handler("ops"))
+	c.HandleRoom("Dev@Conf.B", handler("dev"))
+	c.HandleRoom("gone@conf.b", handler("gone"))
+	c.HandleRoom("gone@conf.b", nil)
+	serve(server, streamHeader+
+		"<message from='ops@conf.b/alice' type='groupchat'><body>1</body></message>"+
+		"<message from='dev@conf.b/bob' type='groupchat'><body>2</body></message>"+
+		"<message from='qa@conf.b/carol' type='groupchat'><body>3</body></message>"+
+		// a private message from an occupant of ops goes to ops too
+		"<message from='ops@conf.b/alice' type='chat'><body>4</body></message>"+
+		"<message from='gone@conf.b/dave' type='groupchat'><body>5</body></message>"+
+		"<message from='alice@b/phone' type='chat'><body>6</body></message>"+
+		"</stream:stream>")
+	if err := runFor(t, c.Run); !errors.Is(err, xmpp.ErrStreamClosed) {
+		t.Fatalf("Run returned %v", err)
+	}
+
+	want := "ops:1,dev:2,fallback:3,ops:4,fallback:5,fallback:6"
+	if strings.Join(got, ",") != want {
+		t.Errorf("handled %q, want %s", got, want)
+	}
+}
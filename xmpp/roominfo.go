@@ -0,0 +1,84 @@
+package xmpp
+
+import (
+	"html"
+	"strconv"
+)
+
+// RoomInfo is what a muc says about itself in its disco#info, which anyone
+// may ask for without joining
+type RoomInfo struct {
+	Name              string
+	Description       string
+	Subject           string
+	Persistent        bool
+	Public            bool
+	PasswordProtected bool
+	MembersOnly       bool
+	Moderated         bool
+	// NonAnonymous is set when every occupant can see the others' real jids
+	NonAnonymous bool
+	// Occupants is the number of people in the room, or -1 if the room
+	// doesn't say
+	Occupants int
+	// Info is the disco#info as received, for the features and form
+	// fields RoomInfo doesn't pick out
+	Info *DiscoInfo
+}
+
+// RoomInfo asks the room roomJID what kind of room it is, so that a bot can
+// tell whether it can, or should, join before trying to. A room that
+// doesn't exist is reported as a *StanzaError with the condition
+// item-not-found.
+func (c *Conn) RoomInfo(roomJID string) (*RoomInfo, error) {
+	iqID := id()
+	s, err := c.sendIQ(iqID, xmlIqQueryGet, html.EscapeString(bare(roomJID)), iqID, NsDiscoInfo)
+	if err != nil {
+		return nil, err
+	}
+	var r struct {
+		Query DiscoInfo `xml:"http://jabber.org/protocol/disco#info query"`
+	}
+	if err := s.decode(&r); err != nil {
+		return nil, err
+	}
+	return parseRoomInfo(&r.Query), nil
+}
+
+// parseRoomInfo picks a room's traits out of its disco#info
+func parseRoomInfo(info *DiscoInfo) *RoomInfo {
+	ri := &RoomInfo{
+		Persistent:        info.HasFeature("muc_persistent"),
+		Public:            info.HasFeature("muc_public"),
+		PasswordProtected: info.HasFeature("muc_passwordprotected"),
+		MembersOnly:       info.HasFeature("muc_membersonly"),
+		Moderated:         info.HasFeature("muc_moderated"),
+		NonAnonymous:      info.HasFeature("muc_nonanonymous"),
+		Occupants:         -1,
+		Info:              info,
+	}
+	for _, ident := range info.Identities {
+		if ident.Category == "conference" {
+			ri.Name = ident.Name
+			break
+		}
+	}
+	for i := range info.Forms {
+		form := &info.Forms[i]
+		if t := form.Field("FORM_TYPE"); t == nil || t.Value() != NsMuc+"#roominfo" {
+			continue
+		}
+		if f := form.Field("muc#roominfo_description"); f != nil {
+			ri.Description = f.Value()
+		}
+		if f := form.Field("muc#roominfo_subject"); f != nil {
+			ri.Subject = f.Value()
+		}
+		if f := form.Field("muc#roominfo_occupants"); f != nil {
+			if n, err := strconv.Atoi(f.Value()); err == nil {
+				ri.Occupants = n
+			}
+		}
+	}
+	return ri
+}
@@ -0,0 +1,86 @@
+package xmpp_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// the room of XEP-0045 example 10
+const roomInfoResult = "<query xmlns='http://jabber.org/protocol/disco#info'>" +
+	"<identity category='conference' name='A Dark Cave' type='text'/>" +
+	"<feature var='http://jabber.org/protocol/muc'/>" +
+	"<feature var='muc_passwordprotected'/>" +
+	"<feature var='muc_hidden'/>" +
+	"<feature var='muc_temporary'/>" +
+	"<feature var='muc_open'/>" +
+	"<feature var='muc_unmoderated'/>" +
+	"<feature var='muc_nonanonymous'/>" +
+	"<x xmlns='jabber:x:data' type='result'>" +
+	"<field var='FORM_TYPE' type='hidden'><value>http://jabber.org/protocol/muc#roominfo</value></field>" +
+	"<field var='muc#roominfo_description' label='Description'><value>The place for all good witches!</value></field>" +
+	"<field var='muc#roominfo_subject' label='Current Discussion Topic'><value>Spells</value></field>" +
+	"<field var='muc#roominfo_occupants' label='Number of occupants'><value>3</value></field>" +
+	"</x></query>"
+
+func TestRoomInfo(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  xmpp.RoomInfo
+	}{
+		{"example", roomInfoResult, xmpp.RoomInfo{
+			Name:              "A Dark Cave",
+			Description:       "The place for all good witches!",
+			Subject:           "Spells",
+			PasswordProtected: true,
+			NonAnonymous:      true,
+			Occupants:         3,
+		}},
+		{"no form", "<query xmlns='http://jabber.org/protocol/disco#info'>" +
+			"<identity category='conference' name='ops' type='text'/>" +
+			"<feature var='muc_persistent'/><feature var='muc_public'/>" +
+			"<feature var='muc_membersonly'/><feature var='muc_moderated'/></query>",
+			xmpp.RoomInfo{Name: "ops", Persistent: true, Public: true, MembersOnly: true, Moderated: true, Occupants: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			received := answer(c, server, func(s *xmpp.Stanza) string {
+				return "<iq type='result' id='" + s.Attr["id"] + "' from='" + s.Attr["to"] + "'>" + tt.reply + "</iq>"
+			})
+			info, err := c.RoomInfo("coven@chat.shakespeare.lit/thirdwitch")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Info == nil {
+				t.Fatal("no disco#info kept")
+			}
+			got := *info
+			got.Info = nil
+			if got != tt.want {
+				t.Errorf("RoomInfo %+v, want %+v", got, tt.want)
+			}
+			if sent := received(); len(sent) != 1 || sent[0].Attr["to"] != "coven@chat.shakespeare.lit" {
+				t.Errorf("asked %v, want the room's bare jid", sent)
+			}
+		})
+	}
+}
+
+func TestRoomInfoNoRoom(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		return "<iq type='error' id='" + s.Attr["id"] + "'><error type='cancel'>" +
+			"<item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+	})
+	defer received()
+	var se *xmpp.StanzaError
+	if _, err := c.RoomInfo("nowhere@conf.b"); !errors.As(err, &se) || se.Condition != "item-not-found" {
+		t.Errorf("RoomInfo returned %v, want item-not-found", err)
+	}
+}
@@ -0,0 +1,124 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	xmlHTMLPart = "<html xmlns='%s'><body xmlns='%s'>%s</body></html>"
+	xmlHipChatX = "<x xmlns='%s'>%s%s</x>"
+)
+
+// Errors returned by RoomMessage.Send for messages that can't be sent
+var (
+	// ErrEmptyMessage means neither text nor html was given
+	ErrEmptyMessage = errors.New("message has no text or html")
+	// ErrInvalidColor means the color isn't one hipchat knows
+	ErrInvalidColor = errors.New("invalid message color")
+	// ErrMentionWithoutNotify means mentions were asked for on a message
+	// explicitly set not to notify, which hipchat can't do
+	ErrMentionWithoutNotify = errors.New("mentions always notify")
+)
+
+// roomColors are the colors hipchat can show a message in
+var roomColors = map[string]bool{
+	"yellow": true, "green": true, "red": true, "purple": true, "gray": true, "random": true,
+}
+
+// RoomMessage builds a groupchat message combining hipchat's extensions:
+// plain and html bodies, a color, notification and @mentions.
+type RoomMessage struct {
+	c        *Conn
+	room     string
+	from     string
+	text     string
+	html     string
+	color    string
+	notify   *bool
+	mentions []string
+}
+
+// NewRoomMessage starts a message to the room roomJID
+func (c *Conn) NewRoomMessage(roomJID string) *RoomMessage {
+	return &RoomMessage{c: c, room: roomJID}
+}
+
+// From sets who the message is from
+func (m *RoomMessage) From(jid string) *RoomMessage {
+	m.from = jid
+	return m
+}
+
+// Text sets the plain body
+func (m *RoomMessage) Text(body string) *RoomMessage {
+	m.text = body
+	return m
+}
+
+// HTML sets the html body. Without Text the plain body is derived from it
+// with StripHTML.
+func (m *RoomMessage) HTML(body string) *RoomMessage {
+	m.html = body
+	return m
+}
+
+// Color sets the color hipchat shows the message in: yellow, green, red,
+// purple, gray or random
+func (m *RoomMessage) Color(color string) *RoomMessage {
+	m.color = color
+	return m
+}
+
+// Notify sets whether the message notifies the room's occupants
+func (m *RoomMessage) Notify(notify bool) *RoomMessage {
+	m.notify = &notify
+	return m
+}
+
+// Mention adds @mentions of users, by mention name or jid, ahead of the
+// body. Mentions notify, so they can't be combined with Notify(false).
+func (m *RoomMessage) Mention(users ...string) *RoomMessage {
+	m.mentions = append(m.mentions, users...)
+	return m
+}
+
+// Send validates the message and sends it as a single stanza
+func (m *RoomMessage) Send() error {
+	if m.text == "" && m.html == "" {
+		return ErrEmptyMessage
+	}
+	if m.color != "" && !roomColors[m.color] {
+		return ErrInvalidColor
+	}
+	if len(m.mentions) > 0 && m.notify != nil && !*m.notify {
+		return ErrMentionWithoutNotify
+	}
+
+	text := m.text
+	if text == "" {
+		text = StripHTML(m.html)
+	}
+	tokens := make([]string, 0, len(m.mentions)+1)
+	for _, u := range m.mentions {
+		tokens = append(tokens, "@"+m.c.resolveMention(u))
+	}
+	text = strings.Join(append(tokens, text), " ")
+
+	var htmlPart, x string
+	if m.html != "" {
+		htmlPart = fmt.Sprintf(xmlHTMLPart, NsXHTMLIM, NsXHTML, m.html)
+	}
+	var notify string
+	if len(m.mentions) > 0 || (m.notify != nil && *m.notify) {
+		notify = "<notify>1</notify>"
+	}
+	if notify != "" || m.color != "" {
+		x = fmt.Sprintf(xmlHipChatX, NsHipChat, notify, optElement("color", m.color))
+	}
+
+	msgID := id()
+	payload := htmlPart + x + m.c.stampOrigin(msgID)
+	return m.c.encode(&outMessage{From: m.c.fromJID(m.from), ID: msgID, To: m.room, Type: "groupchat", Body: &text, Payload: []byte(payload)})
+}
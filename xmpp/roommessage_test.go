@@ -0,0 +1,87 @@
+package xmpp_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestRoomMessageComposes(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	sent := capture(c, server)
+	err := c.NewRoomMessage("ops@conf.b").
+		Text("disk full on db1").
+		HTML("<b>disk full</b> on db1").
+		Color("red").
+		Notify(true).
+		Mention("oncall").
+		Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := sent()
+
+	for _, part := range []string{
+		`type="groupchat"`,
+		"<body>@oncall disk full on db1</body>",
+		"<html xmlns='" + xmpp.NsXHTMLIM + "'><body xmlns='" + xmpp.NsXHTML + "'><b>disk full</b> on db1</body></html>",
+		"<x xmlns='" + xmpp.NsHipChat + "'>",
+		"<notify>1</notify>",
+		"<color>red</color>",
+		"@oncall",
+	} {
+		if n := strings.Count(out, part); n != 1 {
+			t.Errorf("%s appears %d times in %s", part, n, out)
+		}
+	}
+	if n := strings.Count(out, "<message"); n != 1 {
+		t.Errorf("sent %d messages", n)
+	}
+}
+
+func TestRoomMessageFromHTML(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	sent := capture(c, server)
+	if err := c.NewRoomMessage("ops@conf.b").HTML("<i>deployed</i> v2").Send(); err != nil {
+		t.Fatal(err)
+	}
+	out := sent()
+	if !strings.Contains(out, "<body>deployed v2</body>") {
+		t.Errorf("sent %s, want the plain body taken from the html", out)
+	}
+	if strings.Contains(out, xmpp.NsHipChat) {
+		t.Errorf("sent %s, with hipchat extensions no one asked for", out)
+	}
+}
+
+func TestRoomMessageInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(*xmpp.RoomMessage) *xmpp.RoomMessage
+		want  error
+	}{
+		{"empty", func(m *xmpp.RoomMessage) *xmpp.RoomMessage { return m.Color("red") }, xmpp.ErrEmptyMessage},
+		{"bad color", func(m *xmpp.RoomMessage) *xmpp.RoomMessage { return m.Text("hi").Color("blue") }, xmpp.ErrInvalidColor},
+		{"mention without notify", func(m *xmpp.RoomMessage) *xmpp.RoomMessage {
+			return m.Text("hi").Notify(false).Mention("oncall")
+		}, xmpp.ErrMentionWithoutNotify},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			sent := capture(c, server)
+			if err := tt.build(c.NewRoomMessage("ops@conf.b")).Send(); !errors.Is(err, tt.want) {
+				t.Errorf("Send returned %v, want %v", err, tt.want)
+			}
+			if out := sent(); strings.Contains(out, "<message") {
+				t.Errorf("sent %s for an invalid message", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package xmpp
+
+import (
+	"html"
+	"sort"
+	"strings"
+)
+
+// RosterEntry is a contact on the roster
+type RosterEntry struct {
+	Jid          string
+	Name         string
+	MentionName  string
+	Email        string
+	Subscription string
+}
+
+// ChangeKind says how a roster push changed an entry
+type ChangeKind int
+
+// The kinds of roster change
+const (
+	RosterAdded ChangeKind = iota + 1
+	RosterUpdated
+	RosterRemoved
+)
+
+func rosterEntry(i *item) RosterEntry {
+	return RosterEntry{
+		Jid:          bare(i.Jid),
+		Name:         i.Name,
+		MentionName:  i.MentionName,
+		Email:        i.Email,
+		Subscription: i.Subscription,
+	}
+}
+
+// GetRoster fetches the roster from the server, replacing the cached one
+func (c *Conn) GetRoster() ([]RosterEntry, error) {
+	c.mu.Lock()
+	jid, host := c.jid, c.host
+	c.mu.Unlock()
+
+	iqID := id()
+	s, err := c.sendIQ(iqID, xmlIqGet, html.EscapeString(jid), html.EscapeString(host), iqID, NsIqRoster)
+	if err != nil {
+		return nil, err
+	}
+	var r struct {
+		Query query `xml:"query"`
+	}
+	if err := s.decode(&r); err != nil {
+		return nil, err
+	}
+	c.setRoster(r.Query.Items)
+	return c.Contacts(), nil
+}
+
+// Contacts returns the cached roster, sorted by jid. It is empty until the
+// roster has been fetched, which Connect does.
+func (c *Conn) Contacts() []RosterEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	contacts := make([]RosterEntry, 0, len(c.roster))
+	for _, e := range c.roster {
+		contacts = append(contacts, e)
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].Jid < contacts[j].Jid })
+	return contacts
+}
+
+// OnRosterChange sets the function the dispatch loop calls with each entry
+// a roster push adds, updates or removes, once the cache reflects it
+func (c *Conn) OnRosterChange(fn func(RosterEntry, ChangeKind)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rosterHandler = fn
+}
+
+// setRoster replaces the cached roster with items
+func (c *Conn) setRoster(items []*item) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roster = make(map[string]RosterEntry, len(items))
+	for _, i := range items {
+		c.roster[foldBare(i.Jid)] = rosterEntry(i)
+	}
+	c.cacheMentions()
+}
+
+// cacheMentions indexes the roster's mention names by mention name and jid.
+// c.mu must be held.
+func (c *Conn) cacheMentions() {
+	c.mentions = make(map[string]string, 2*len(c.roster))
+	for _, e := range c.roster {
+		if e.MentionName == "" {
+			continue
+		}
+		c.mentions[strings.ToLower(e.MentionName)] = e.MentionName
+		c.mentions[foldBare(e.Jid)] = e.MentionName
+		if foldBare(e.Jid) == foldBare(c.jid) {
+			c.mentionName = e.MentionName
+		}
+	}
+}
+
+// handleRosterResult caches a roster that came back to a request nobody
+// waits on, such as the one Roster sends. The iq handler still gets it.
+func (c *Conn) handleRosterResult(s *Stanza) {
+	var r struct {
+		Query query `xml:"query"`
+	}
+	if err := s.decode(&r); err != nil {
+		c.reportError(err)
+		return
+	}
+	c.setRoster(r.Query.Items)
+}
+
+// handleRosterPush applies a roster push to the cache and acknowledges it.
+// Only the server may push the roster, so a push from anyone else, which
+// would let them rewrite the cache, is refused with service-unavailable as
+// RFC 6121 2.1.6 asks.
+func (c *Conn) handleRosterPush(s *Stanza) {
+	if from := s.Attr["from"]; from != "" && foldBare(from) != foldBare(c.JID()) {
+		if err := c.SendRaw(newIQ(s).Reply("error", xmlServiceUnavailable)); err != nil {
+			c.reportError(err)
+		}
+		return
+	}
+	var r struct {
+		Query query `xml:"query"`
+	}
+	if err := s.decode(&r); err != nil {
+		c.reportError(err)
+		return
+	}
+
+	type change struct {
+		entry RosterEntry
+		kind  ChangeKind
+	}
+	var changes []change
+	c.mu.Lock()
+	if c.roster == nil {
+		c.roster = make(map[string]RosterEntry)
+	}
+	for _, i := range r.Query.Items {
+		e := rosterEntry(i)
+		key := foldBare(e.Jid)
+		_, known := c.roster[key]
+		switch {
+		case e.Subscription == "remove":
+			delete(c.roster, key)
+			changes = append(changes, change{e, RosterRemoved})
+		case known:
+			c.roster[key] = e
+			changes = append(changes, change{e, RosterUpdated})
+		default:
+			c.roster[key] = e
+			changes = append(changes, change{e, RosterAdded})
+		}
+	}
+	c.cacheMentions()
+	fn := c.rosterHandler
+	c.mu.Unlock()
+
+	if err := c.SendRaw(newIQ(s).Reply("result", "")); err != nil {
+		c.reportError(err)
+	}
+	if fn == nil {
+		return
+	}
+	for _, ch := range changes {
+		fn(ch.entry, ch.kind)
+	}
+}
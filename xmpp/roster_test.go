@@ -0,0 +1,111 @@
+package xmpp_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// rosterPush is a push of item with the given id, from from if it is set
+func rosterPush(id, from, item string) string {
+	if from != "" {
+		from = " from='" + from + "'"
+	}
+	return "<iq xmlns='jabber:client' type='set' id='" + id + "'" + from + "><query xmlns='" + xmpp.NsIqRoster + "'>" + item + "</query></iq>"
+}
+
+func TestRosterPushUpdatesContacts(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var changes []string
+	c.OnRosterChange(func(e xmpp.RosterEntry, kind xmpp.ChangeKind) {
+		changes = append(changes, fmt.Sprintf("%s:%d", e.Jid, kind))
+	})
+	roster := rosterResult("<item jid='alice@b' name='Alice' subscription='both'/><item jid='bob@b' name='Bob' subscription='both'/>")
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if strings.Contains(string(s.Inner), xmpp.NsIqRoster) {
+			return roster(s)
+		}
+		if s.Attr["type"] != "get" {
+			return ""
+		}
+		// the pushes arrive while EntityTime reads the stream
+		return rosterPush("p1", "", "<item jid='carol@b' name='Carol' subscription='none'/>") +
+			rosterPush("p2", "", "<item jid='Alice@B/phone' name='Alice Jones' subscription='both'/>") +
+			rosterPush("p3", "", "<item jid='bob@b' subscription='remove'/>") +
+			rosterPush("p4", "mallory@evil", "<item jid='mallory@evil' subscription='both'/>") + result(s)
+	})
+
+	if _, err := c.GetRoster(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the update replaces alice as the push wrote her jid, without the resource
+	var contacts []string
+	for _, e := range c.Contacts() {
+		contacts = append(contacts, e.Jid+"="+e.Name)
+	}
+	if got, want := strings.Join(contacts, ","), "Alice@B=Alice Jones,carol@b=Carol"; got != want {
+		t.Errorf("contacts %q, want %q", got, want)
+	}
+	want := fmt.Sprintf("carol@b:%d,Alice@B:%d,bob@b:%d", xmpp.RosterAdded, xmpp.RosterUpdated, xmpp.RosterRemoved)
+	if got := strings.Join(changes, ","); got != want {
+		t.Errorf("changes %q, want %q", got, want)
+	}
+
+	acked := make(map[string]bool)
+	refused := false
+	for _, s := range received() {
+		if s.Name.Local == "iq" && s.Attr["type"] == "result" {
+			acked[s.Attr["id"]] = true
+		}
+		if s.Attr["id"] == "p4" {
+			refused = s.Attr["type"] == "error" && s.Attr["to"] == "mallory@evil" &&
+				strings.Contains(string(s.Inner), "<service-unavailable")
+		}
+	}
+	for _, id := range []string{"p1", "p2", "p3"} {
+		if !acked[id] {
+			t.Errorf("push %s not acknowledged", id)
+		}
+	}
+	if !refused {
+		t.Error("push from mallory@evil not refused with service-unavailable")
+	}
+}
+
+func TestRosterResultCached(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var handled []string
+	c.HandleIQ(func(iq *xmpp.IQ) { handled = append(handled, iq.Type+" "+iq.ID) })
+	rosterID := ""
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if !strings.Contains(string(s.Inner), xmpp.NsIqRoster) {
+			return result(s)
+		}
+		rosterID = s.Attr["id"]
+		return "<iq xmlns='jabber:client' type='result' id='" + rosterID + "'><query xmlns='" + xmpp.NsIqRoster + "'>" +
+			"<item jid='alice@b' name='Alice' subscription='both'/></query></iq>"
+	})
+	defer received()
+
+	// Roster doesn't wait for its answer, which the EntityTime after it
+	// reads off the stream
+	c.Roster("", "")
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	if contacts := c.Contacts(); len(contacts) != 1 || contacts[0].Jid != "alice@b" || contacts[0].Name != "Alice" {
+		t.Errorf("contacts %+v, want alice from the roster result", contacts)
+	}
+	if len(handled) != 1 || handled[0] != "result "+rosterID {
+		t.Errorf("iq handler got %q, want the roster result %s", handled, rosterID)
+	}
+}
@@ -0,0 +1,85 @@
+package xmpp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestRunCancelSaysFarewell(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	c, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", "pw", "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.JoinRoom("ops@conf.b", "bot", xmpp.JoinOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	// give Run time to block in a read for the cancel to interrupt
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return")
+	}
+	// the server answered the stream close, so there was no waiting out the
+	// grace period
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("Run took %v to return", d)
+	}
+
+	var leftRoom, offline bool
+	for _, p := range srv.ReceivedNamed("presence") {
+		if p.Attr["type"] != "unavailable" {
+			continue
+		}
+		switch p.Attr["to"] {
+		case "ops@conf.b/bot":
+			leftRoom = true
+		case "":
+			offline = true
+		}
+	}
+	if !leftRoom || !offline {
+		t.Errorf("left the room %v, went offline %v", leftRoom, offline)
+	}
+}
+
+func TestRunCancelAfterServerClosed(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.HandleMessage(func(*xmpp.Message) { cancel() })
+	// the server closes the stream at once, so its closing tag has already
+	// been read ahead when the message cancels Run
+	serve(server, streamHeader+"<message xmlns='jabber:client' from='alice@b/r' type='chat'><body>bye</body></message></stream:stream>")
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return")
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("Run took %v to return, waiting out the grace period", d)
+	}
+}
@@ -0,0 +1,179 @@
+package xmpp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"strings"
+)
+
+const (
+	xmlSASLAuth     = "<auth xmlns='%s' mechanism='%s'>%s</auth>"
+	xmlSASLResponse = "<response xmlns='%s'>%s</response>"
+	xmlBind         = "<iq type='set' id='%s'><bind xmlns='%s'>%s</bind></iq>"
+)
+
+var (
+	// ErrMechanismUnavailable is returned when the server doesn't offer the
+	// sasl mechanism asked for
+	ErrMechanismUnavailable = errors.New("sasl mechanism not offered")
+	// ErrBindBeforeAuth is returned by Bind until sasl has completed and the
+	// stream has been restarted
+	ErrBindBeforeAuth = errors.New("bind before sasl authentication")
+)
+
+// SASLFailure is returned when the server rejects sasl authentication
+type SASLFailure struct {
+	Condition string
+	Text      string
+}
+
+func (e *SASLFailure) Error() string {
+	if e.Text != "" {
+		return "sasl failure: " + e.Condition + ": " + e.Text
+	}
+	return "sasl failure: " + e.Condition
+}
+
+type saslFailure struct {
+	Text       string `xml:"text"`
+	Conditions []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// SASLAuth authenticates with the PLAIN mechanism. On success the stream is
+// restarted and its new features read, as the server requires, leaving the
+// connection ready for Bind.
+func (c *Conn) SASLAuth(user, pass string) error {
+	if !c.mechanismOffered("PLAIN") {
+		return ErrMechanismUnavailable
+	}
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + pass))
+	if _, err := c.saslExchange("PLAIN", creds); err != nil {
+		return err
+	}
+	return c.restartStream()
+}
+
+// ExternalAuth authenticates with the EXTERNAL mechanism, relying on the
+// client certificate presented during tls (see WithTLSConfig). The authzid
+// may be empty to authorize as the identity in the certificate.
+func (c *Conn) ExternalAuth(authzid string) error {
+	if !c.mechanismOffered("EXTERNAL") {
+		return ErrMechanismUnavailable
+	}
+	initial := "="
+	if authzid != "" {
+		initial = base64.StdEncoding.EncodeToString([]byte(authzid))
+	}
+	if _, err := c.saslExchange("EXTERNAL", initial); err != nil {
+		return err
+	}
+	return c.restartStream()
+}
+
+func (c *Conn) mechanismOffered(mechanism string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.features != nil && c.features.offers(mechanism)
+}
+
+// saslExchange sends the auth element and waits for the server's challenge
+// or outcome
+func (c *Conn) saslExchange(mechanism, initial string) (*Stanza, error) {
+	return c.saslStep(xmlSASLAuth, NsSASL, mechanism, initial)
+}
+
+// saslRespond answers a challenge and waits for the next challenge or the
+// outcome
+func (c *Conn) saslRespond(data string) (*Stanza, error) {
+	return c.saslStep(xmlSASLResponse, NsSASL, data)
+}
+
+func (c *Conn) saslStep(format string, a ...interface{}) (*Stanza, error) {
+	w := c.expect(isSASLReply)
+	if err := c.send(format, a...); err != nil {
+		c.forget(w)
+		return nil, err
+	}
+	s, err := c.wait(w)
+	if err != nil {
+		return nil, err
+	}
+	if s.Name.Local == "failure" {
+		return nil, parseSASLFailure(s)
+	}
+	return s, nil
+}
+
+func isSASLReply(s *Stanza) bool {
+	return s.Name.Space == NsSASL &&
+		(s.Name.Local == "success" || s.Name.Local == "failure" || s.Name.Local == "challenge")
+}
+
+// saslData decodes the base64 payload of a challenge or success
+func saslData(s *Stanza) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(s.Inner)))
+}
+
+func parseSASLFailure(s *Stanza) error {
+	var f saslFailure
+	if err := s.decode(&f); err != nil {
+		return err
+	}
+	e := &SASLFailure{Condition: "not-authorized", Text: f.Text}
+	for _, cond := range f.Conditions {
+		if cond.XMLName.Local != "text" {
+			e.Condition = cond.XMLName.Local
+			break
+		}
+	}
+	return e
+}
+
+// restartStream opens the new stream the server expects after sasl and
+// reads the features offered on it
+func (c *Conn) restartStream() error {
+	if err := c.openStream(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.restarted = true
+	c.mu.Unlock()
+	return nil
+}
+
+type bindResult struct {
+	Bind struct {
+		Jid string `xml:"jid"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+}
+
+// Bind binds resource to the session, returning the full jid the server
+// assigned. It can only be called once sasl has completed. An empty
+// resource lets the server choose one.
+func (c *Conn) Bind(resource string) (string, error) {
+	c.mu.Lock()
+	restarted := c.restarted
+	c.mu.Unlock()
+	if !restarted {
+		return "", ErrBindBeforeAuth
+	}
+
+	iqID := id()
+	s, err := c.sendIQ(iqID, xmlBind, iqID, NsBind, optElement("resource", resource))
+	if err != nil {
+		return "", err
+	}
+	var r bindResult
+	if err := s.decode(&r); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.jid = r.Bind.Jid
+	c.restarted = false
+	c.mu.Unlock()
+	return r.Bind.Jid, nil
+}
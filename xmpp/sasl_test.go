@@ -0,0 +1,115 @@
+package xmpp_test
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+const (
+	plainFeatures = "<stream:features><mechanisms xmlns='" + xmpp.NsSASL + "'><mechanism>PLAIN</mechanism></mechanisms></stream:features>"
+	bindFeatures  = "<stream:features><bind xmlns='" + xmpp.NsBind + "'/></stream:features>"
+)
+
+// negotiate plays the server's side of stream negotiation on server, like
+// answer but passing stream headers to reply too, without their content as
+// that is the rest of the stream. It returns a func that closes c and gives
+// back the names of everything c sent.
+func negotiate(c *xmpp.Conn, server net.Conn, reply func(s *xmpp.Stanza) string) func() []string {
+	done := make(chan []string)
+	replies := make(chan string, 16)
+	go func() {
+		for r := range replies {
+			io.WriteString(server, r)
+		}
+	}()
+	go func() {
+		defer close(replies)
+		var got []string
+		d := xml.NewDecoder(server)
+		for {
+			t, err := d.Token()
+			if err != nil {
+				break
+			}
+			start, ok := t.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			var raw struct {
+				Inner []byte `xml:",innerxml"`
+			}
+			if start.Name.Local != "stream" {
+				if err := d.DecodeElement(&raw, &start); err != nil {
+					break
+				}
+			}
+			got = append(got, start.Name.Local)
+			s := &xmpp.Stanza{Name: start.Name, Attr: xmpp.ToMap(start.Attr), Inner: raw.Inner}
+			if r := reply(s); r != "" {
+				replies <- r
+			}
+		}
+		io.Copy(io.Discard, server)
+		done <- got
+	}()
+	return func() []string {
+		c.Close()
+		return <-done
+	}
+}
+
+// saslServer answers a client that authenticates with features before
+// sasl and bindFeatures after the restart
+func saslServer(features string) func(s *xmpp.Stanza) string {
+	authed := false
+	return func(s *xmpp.Stanza) string {
+		switch s.Name.Local {
+		case "stream":
+			if authed {
+				return streamHeader + bindFeatures
+			}
+			return streamHeader + features
+		case "auth":
+			authed = true
+			return "<success xmlns='" + xmpp.NsSASL + "'/>"
+		case "iq":
+			return "<iq type='result' id='" + s.Attr["id"] + "'><bind xmlns='" + xmpp.NsBind + "'><jid>bob@b/bot</jid></bind></iq>"
+		}
+		return ""
+	}
+}
+
+func TestSASLAuthRestartsStream(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := negotiate(c, server, saslServer(plainFeatures))
+
+	c.Stream("bob@b", "b")
+	c.Features()
+	if _, err := c.Bind("bot"); !errors.Is(err, xmpp.ErrBindBeforeAuth) {
+		t.Fatalf("Bind before auth returned %v", err)
+	}
+	if err := c.SASLAuth("bob", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if f := c.ServerFeatures(); f == nil || f.Bind == nil || len(f.Mechanisms) != 0 {
+		t.Fatalf("features after auth %+v, want those of the restarted stream", f)
+	}
+	if _, err := c.Bind("bot"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Bind("bot"); !errors.Is(err, xmpp.ErrBindBeforeAuth) {
+		t.Errorf("second Bind returned %v", err)
+	}
+
+	if got, want := strings.Join(received(), " "), "stream auth stream iq"; !strings.HasPrefix(got, want) {
+		t.Errorf("client sent %q, want %q", got, want)
+	}
+}
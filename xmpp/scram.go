@@ -0,0 +1,171 @@
+package xmpp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const scramSHA1 = "SCRAM-SHA-1"
+
+// scramGS2Header is the gs2 header for a client without channel binding
+const scramGS2Header = "n,,"
+
+// ErrServerSignature is returned when the server fails to prove during SCRAM
+// that it knows the password
+var ErrServerSignature = errors.New("scram: server signature mismatch")
+
+// SCRAMAuth authenticates with the SCRAM-SHA-1 mechanism, which unlike PLAIN
+// never sends the password, and checks the server's signature in turn. On
+// success the stream is restarted as with SASLAuth.
+func (c *Conn) SCRAMAuth(user, pass string) error {
+	if !c.mechanismOffered(scramSHA1) {
+		return ErrMechanismUnavailable
+	}
+
+	sc := newSCRAM(user, pass, scramNonce())
+	s, err := c.saslExchange(scramSHA1, base64.StdEncoding.EncodeToString([]byte(sc.clientFirst())))
+	if err != nil {
+		return err
+	}
+	if s.Name.Local != "challenge" {
+		return errors.New("scram: expected challenge")
+	}
+	serverFirst, err := saslData(s)
+	if err != nil {
+		return err
+	}
+	final, err := sc.clientFinal(string(serverFirst))
+	if err != nil {
+		return err
+	}
+
+	if s, err = c.saslRespond(base64.StdEncoding.EncodeToString([]byte(final))); err != nil {
+		return err
+	}
+	serverFinal, err := saslData(s)
+	if err != nil {
+		return err
+	}
+	if err := sc.verify(string(serverFinal)); err != nil {
+		return err
+	}
+	if s.Name.Local == "challenge" {
+		// the signature came as a last challenge rather than with success
+		if _, err := c.saslRespond(""); err != nil {
+			return err
+		}
+	}
+	return c.restartStream()
+}
+
+// scram holds the client side of a SCRAM-SHA-1 exchange
+type scram struct {
+	user            string
+	pass            string
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newSCRAM(user, pass, nonce string) *scram {
+	return &scram{user: user, pass: pass, nonce: nonce}
+}
+
+func scramNonce() string {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return id() + id()
+	}
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+// clientFirst returns the client-first-message
+func (sc *scram) clientFirst() string {
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(sc.user)
+	sc.clientFirstBare = "n=" + name + ",r=" + sc.nonce
+	return scramGS2Header + sc.clientFirstBare
+}
+
+// clientFinal computes the client-final-message from the server-first-message
+func (sc *scram) clientFinal(serverFirst string) (string, error) {
+	attrs := scramAttrs(serverFirst)
+	nonce, salt64, iter := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, sc.nonce) || len(nonce) == len(sc.nonce) {
+		return "", errors.New("scram: bad server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return "", err
+	}
+	iterations, err := strconv.Atoi(iter)
+	if err != nil || iterations < 1 {
+		return "", errors.New("scram: bad iteration count")
+	}
+
+	salted := pbkdf2SHA1([]byte(sc.pass), salt, iterations)
+	clientKey := hmacSHA1(salted, []byte("Client Key"))
+	storedKey := sha1.Sum(clientKey)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(scramGS2Header)) + ",r=" + nonce
+	authMessage := []byte(sc.clientFirstBare + "," + serverFirst + "," + withoutProof)
+
+	signature := hmacSHA1(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	sc.serverSignature = hmacSHA1(hmacSHA1(salted, []byte("Server Key")), authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server-final-message against the expected signature
+func (sc *scram) verify(serverFinal string) error {
+	attrs := scramAttrs(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return errors.New("scram: " + e)
+	}
+	v, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || subtle.ConstantTimeCompare(v, sc.serverSignature) != 1 {
+		return ErrServerSignature
+	}
+	return nil
+}
+
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(msg, ",") {
+		if len(kv) > 2 && kv[1] == '=' {
+			attrs[kv[:1]] = kv[2:]
+		}
+	}
+	return attrs
+}
+
+func hmacSHA1(key, data []byte) []byte {
+	h := hmac.New(sha1.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA1 derives a single block key, which is all SCRAM-SHA-1 needs
+func pbkdf2SHA1(pass, salt []byte, iterations int) []byte {
+	block := make([]byte, len(salt)+4)
+	copy(block, salt)
+	binary.BigEndian.PutUint32(block[len(salt):], 1)
+
+	u := hmacSHA1(pass, block)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		u = hmacSHA1(pass, u)
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
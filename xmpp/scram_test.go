@@ -0,0 +1,110 @@
+package xmpp
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// the worked example of RFC 5802 section 5
+const (
+	rfcUser        = "user"
+	rfcPass        = "pencil"
+	rfcNonce       = "fyko+d2lbbFgONRv9qkxdawL"
+	rfcClientFirst = "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL"
+	rfcServerFirst = "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"
+	rfcClientFinal = "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts="
+	rfcServerFinal = "v=rmF9pqV8S7suAoZWja4dJRkFsKQ="
+)
+
+func TestSCRAMVectors(t *testing.T) {
+	sc := newSCRAM(rfcUser, rfcPass, rfcNonce)
+	if got := sc.clientFirst(); got != rfcClientFirst {
+		t.Errorf("client-first %q, want %q", got, rfcClientFirst)
+	}
+	final, err := sc.clientFinal(rfcServerFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final != rfcClientFinal {
+		t.Errorf("client-final %q, want %q", final, rfcClientFinal)
+	}
+	if err := sc.verify(rfcServerFinal); err != nil {
+		t.Errorf("server-final rejected: %v", err)
+	}
+}
+
+func TestSCRAMClientFirstEscapes(t *testing.T) {
+	tests := []struct{ user, want string }{
+		{"user", "n,,n=user,r=abc"},
+		{"a=b", "n,,n=a=3Db,r=abc"},
+		{"a,b", "n,,n=a=2Cb,r=abc"},
+		{"=,", "n,,n==3D=2C,r=abc"},
+	}
+	for _, tt := range tests {
+		if got := newSCRAM(tt.user, "", "abc").clientFirst(); got != tt.want {
+			t.Errorf("client-first for %q is %q, want %q", tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestSCRAMBadServerFirst(t *testing.T) {
+	tests := []struct{ name, serverFirst string }{
+		{"foreign nonce", "r=someoneelse3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"},
+		{"nonce not extended", "r=" + rfcNonce + ",s=QSXCR+Q6sek8bf92,i=4096"},
+		{"bad salt", "r=" + rfcNonce + "x,s=not base64!,i=4096"},
+		{"zero iterations", "r=" + rfcNonce + "x,s=QSXCR+Q6sek8bf92,i=0"},
+		{"missing iterations", "r=" + rfcNonce + "x,s=QSXCR+Q6sek8bf92"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := newSCRAM(rfcUser, rfcPass, rfcNonce)
+			sc.clientFirst()
+			if _, err := sc.clientFinal(tt.serverFirst); err == nil {
+				t.Errorf("accepted %q", tt.serverFirst)
+			}
+		})
+	}
+}
+
+func TestSCRAMBadServerFinal(t *testing.T) {
+	tests := []struct {
+		name, serverFinal string
+		want              error
+	}{
+		{"wrong signature", "v=AAAAAAAAAAAAAAAAAAAAAAAAAAA=", ErrServerSignature},
+		{"no signature", "", ErrServerSignature},
+		{"server error", "e=invalid-proof", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := newSCRAM(rfcUser, rfcPass, rfcNonce)
+			sc.clientFirst()
+			if _, err := sc.clientFinal(rfcServerFirst); err != nil {
+				t.Fatal(err)
+			}
+			err := sc.verify(tt.serverFinal)
+			if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+				t.Errorf("verify returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// the PBKDF2-HMAC-SHA1 vectors of RFC 6070 that fit in a single block
+func TestPBKDF2SHA1(t *testing.T) {
+	tests := []struct {
+		pass, salt string
+		iterations int
+		want       string
+	}{
+		{"password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(pbkdf2SHA1([]byte(tt.pass), []byte(tt.salt), tt.iterations)); got != tt.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", tt.pass, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package xmpp_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestShutdownWaitsForServerClose(t *testing.T) {
+	c, err := xmpp.ConnectOver(xmpptest.NewServer("b").Pipe(), "b", "bob", "pw", "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
+
+func TestShutdownReadsWhatServerHadQueued(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var bodies []string
+	c.HandleMessage(func(m *xmpp.Message) { bodies = append(bodies, m.Body) })
+	go func() {
+		b := make([]byte, len("</stream:stream>"))
+		io.ReadFull(server, b)
+		// the server still had a message to send when the client closed
+		io.WriteString(server, streamHeader+"<message xmlns='jabber:client' from='a@b/c' type='chat'><body>last words</body></message></stream:stream>")
+		io.Copy(io.Discard, server)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+	if strings.Join(bodies, ",") != "last words" {
+		t.Errorf("handled %q before the server closed", bodies)
+	}
+}
+
+func TestShutdownTimesOut(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	closed := make(chan error, 1)
+	go func() {
+		// never close the stream in reply, only read until the client hangs up
+		_, err := io.Copy(io.Discard, server)
+		closed <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown returned %v, want the deadline", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection left open after the deadline")
+	}
+}
+
+func TestLeaveAll(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	c, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", "pw", "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	rooms := []string{"ops@conf.b", "dev@conf.b", "random@conf.b"}
+	for _, room := range rooms {
+		if err := c.JoinRoom(room, "bot", xmpp.JoinOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.LeaveAll("deploying"); err != nil {
+		t.Fatal(err)
+	}
+	// the rooms are forgotten, so this goes as a chat to the room's jid
+	if _, err := c.SendChunked("ops@conf.b", "", "gone", 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetRoster(); err != nil {
+		t.Fatal(err)
+	}
+
+	left := make(map[string]bool)
+	var last *xmpp.Stanza
+	for _, p := range srv.ReceivedNamed("presence") {
+		if p.Attr["type"] != "unavailable" {
+			continue
+		}
+		if !strings.Contains(string(p.Inner), "<status>deploying</status>") {
+			t.Errorf("unavailable presence %v without the reason: %s", p.Attr, p.Inner)
+		}
+		left[p.Attr["to"]] = true
+		last = p
+	}
+	for _, room := range rooms {
+		if !left[room+"/bot"] {
+			t.Errorf("%s not left", room)
+		}
+	}
+	if len(left) != len(rooms)+1 || last == nil || last.Attr["to"] != "" {
+		t.Errorf("left %v, want the rooms and then a broadcast", left)
+	}
+	if msgs := srv.ReceivedNamed("message"); len(msgs) != 1 || msgs[0].Attr["type"] != "chat" {
+		t.Errorf("message after leaving sent as %v", msgs)
+	}
+}
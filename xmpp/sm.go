@@ -0,0 +1,243 @@
+package xmpp
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+const (
+	xmlSMEnable = "<enable xmlns='%s' resume='true'/>"
+	xmlSMAck    = "<a xmlns='%s' h='%d'/>"
+	xmlSMResume = "<resume xmlns='%s' previd='%s' h='%d'/>"
+)
+
+// ErrStreamManagement is returned when the server refuses to enable stream
+// management
+var ErrStreamManagement = errors.New("stream management unavailable")
+
+// streamManagement counts the stanzas handled in each direction and holds
+// on to the ones sent until the server acks them
+type streamManagement struct {
+	id       string
+	inbound  uint32
+	outbound uint32
+	unacked  [][]byte
+}
+
+func (sm *streamManagement) sent(b []byte) {
+	sm.unacked = append(sm.unacked, append([]byte(nil), b...))
+	sm.outbound++
+}
+
+func isStanza(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("<message")) ||
+		bytes.HasPrefix(b, []byte("<presence")) ||
+		bytes.HasPrefix(b, []byte("<iq"))
+}
+
+// EnableStreamManagement asks the server to track the stanzas exchanged on
+// the stream, so that unacked stanzas survive a Reconnect. The session is
+// resumable if the server allows it.
+func (c *Conn) EnableStreamManagement() error {
+	w := c.expect(func(s *Stanza) bool {
+		return s.Name.Space == NsSM && (s.Name.Local == "enabled" || s.Name.Local == "failed")
+	})
+	if err := c.send(xmlSMEnable, NsSM); err != nil {
+		c.forget(w)
+		return err
+	}
+
+	s, err := c.wait(w)
+	if err != nil {
+		return err
+	}
+	if s.Name.Local == "failed" {
+		return ErrStreamManagement
+	}
+
+	sm := new(streamManagement)
+	if r := s.Attr["resume"]; r == "true" || r == "1" {
+		sm.id = s.Attr["id"]
+	}
+	c.smu.Lock()
+	c.sm = sm
+	c.smu.Unlock()
+	return nil
+}
+
+func (c *Conn) handled() {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	if c.sm != nil {
+		c.sm.inbound++
+	}
+}
+
+func (c *Conn) ackRequested() error {
+	c.smu.Lock()
+	sm := c.sm
+	var h uint32
+	if sm != nil {
+		h = sm.inbound
+	}
+	c.smu.Unlock()
+	if sm == nil {
+		return nil
+	}
+	return c.send(xmlSMAck, NsSM, h)
+}
+
+// acked drops the stanzas the server has confirmed handling
+func (c *Conn) acked(h string) {
+	n, err := strconv.ParseUint(h, 10, 32)
+	if err != nil {
+		return
+	}
+
+	c.smu.Lock()
+	if c.sm == nil {
+		c.smu.Unlock()
+		return
+	}
+	done := int(uint32(n) - (c.sm.outbound - uint32(len(c.sm.unacked))))
+	if done > len(c.sm.unacked) {
+		done = len(c.sm.unacked)
+	}
+	var handled [][]byte
+	if done > 0 {
+		handled = c.sm.unacked[:done]
+		c.sm.unacked = c.sm.unacked[done:]
+	}
+	c.smu.Unlock()
+	for _, b := range handled {
+		c.written(b)
+	}
+}
+
+// Reconnect dials the server again after the connection has dropped. If
+// stream management was enabled the previous session is resumed and the
+// stanzas the server hadn't acked are sent again. Otherwise, or if the server
+// can no longer resume it, Reconnect logs in afresh, rejoins the rooms the
+// connection was in, refreshes the roster and resends any unacked messages.
+// Reconnect reads from the stream itself, so Run must not be going while it
+// does.
+func (c *Conn) Reconnect() error {
+	c.mu.Lock()
+	host := c.host
+	c.mu.Unlock()
+
+	c.outgoing.Close()
+	outgoing, err := c.dial(host + ":5222")
+	if err != nil {
+		return &ConnectError{Phase: PhaseDial, Err: err}
+	}
+	c.wmu.Lock()
+	c.outgoing = outgoing
+	c.wmu.Unlock()
+	c.mu.Lock()
+	c.peerClosed, c.closeSent = make(chan struct{}), false
+	c.mu.Unlock()
+	c.smu.Lock()
+	sm := c.sm
+	c.sm = nil
+	c.smu.Unlock()
+	c.incoming = c.newDecoder(outgoing)
+	c.countReconnect()
+
+	if err := c.handshake(); err != nil {
+		return err
+	}
+	needBind, err := c.authenticate()
+	if err != nil {
+		return err
+	}
+
+	if sm != nil && sm.id != "" {
+		resumed, err := c.resume(sm)
+		if err != nil || resumed {
+			return err
+		}
+	}
+
+	if needBind {
+		c.mu.Lock()
+		resource := c.resource
+		c.mu.Unlock()
+		if _, err := c.Bind(resource); err != nil {
+			return &ConnectError{Phase: PhaseBind, Err: err}
+		}
+	}
+	if sm != nil {
+		if err := c.EnableStreamManagement(); err != nil {
+			return err
+		}
+	}
+	if err := c.rejoin(); err != nil {
+		return err
+	}
+	if _, err := c.GetRoster(); err != nil {
+		return err
+	}
+	if sm != nil {
+		for _, b := range sm.unacked {
+			if !bytes.HasPrefix(b, []byte("<message")) {
+				continue
+			}
+			if err := c.write(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resume asks the server to resume the stream management session sm,
+// resending whatever it hadn't handled when the connection dropped
+func (c *Conn) resume(sm *streamManagement) (bool, error) {
+	w := c.expect(func(s *Stanza) bool {
+		return s.Name.Space == NsSM && (s.Name.Local == "resumed" || s.Name.Local == "failed")
+	})
+	if err := c.send(xmlSMResume, NsSM, sm.id, sm.inbound); err != nil {
+		c.forget(w)
+		return false, err
+	}
+
+	s, err := c.wait(w)
+	if err != nil || s.Name.Local == "failed" {
+		return false, err
+	}
+
+	c.smu.Lock()
+	c.sm = sm
+	c.smu.Unlock()
+	c.acked(s.Attr["h"])
+	c.smu.Lock()
+	pending := c.sm.unacked
+	c.sm.unacked = nil
+	c.sm.outbound -= uint32(len(pending))
+	c.smu.Unlock()
+	for _, b := range pending {
+		if err := c.write(b); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// rejoin joins the rooms the connection was in again
+func (c *Conn) rejoin() error {
+	c.mu.Lock()
+	rooms := make(map[string]joinedRoom, len(c.rooms))
+	for jid, r := range c.rooms {
+		rooms[jid] = r
+	}
+	c.mu.Unlock()
+
+	for jid, r := range rooms {
+		if err := c.sendJoin(jid, r.nick, r.opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
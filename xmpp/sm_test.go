@@ -0,0 +1,123 @@
+package xmpp_test
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// dialServer returns a Dialer connecting to srv, and a func returning the
+// client ends of the connections it has made
+func dialServer(srv *xmpptest.Server) (*xmpp.Dialer, func() []net.Conn) {
+	var mu sync.Mutex
+	var conns []net.Conn
+	d := xmpp.NewDialer(xmpp.WithDialFunc(func(string) (net.Conn, error) {
+		conn := srv.Pipe()
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+		return conn, nil
+	}))
+	return d, func() []net.Conn {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]net.Conn(nil), conns...)
+	}
+}
+
+// dropWithUnacked connects to srv with stream management, then drops the
+// connection and sends a message that so never reaches the server
+func dropWithUnacked(t *testing.T, srv *xmpptest.Server) *xmpp.Conn {
+	t.Helper()
+	d, conns := dialServer(srv)
+	c, err := d.Connect("b", "bob", "secret", "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EnableStreamManagement(); err != nil {
+		t.Fatal(err)
+	}
+	conns()[0].Close()
+	if _, err := c.MUCSendWithID("chat", "alice@b", "", "while away"); err == nil {
+		t.Fatal("send over a dropped connection succeeded")
+	}
+	return c
+}
+
+func countBodies(srv *xmpptest.Server, body string) int {
+	n := 0
+	for _, m := range srv.ReceivedNamed("message") {
+		if strings.Contains(string(m.Inner), "<body>"+body+"</body>") {
+			n++
+		}
+	}
+	return n
+}
+
+// eventually waits up to a few seconds for ok to hold, as the server
+// handles what it reads after the client's write returns
+func eventually(ok func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if ok() {
+			return true
+		}
+	}
+	return ok()
+}
+
+func countBinds(srv *xmpptest.Server) int {
+	n := 0
+	for _, s := range srv.ReceivedNamed("iq") {
+		if strings.Contains(string(s.Inner), xmpp.NsBind) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestReconnectResumes(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	c := dropWithUnacked(t, srv)
+	defer c.Close()
+	if err := c.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(func() bool { return countBodies(srv, "while away") > 0 })
+	if n := countBodies(srv, "while away"); n != 1 {
+		t.Errorf("unacked message received %d times, want once", n)
+	}
+	if n := countBinds(srv); n != 1 {
+		t.Errorf("bound %d times, want only on connecting as the session resumed", n)
+	}
+}
+
+func TestReconnectResumeFailed(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	srv.NoResume = true
+	c := dropWithUnacked(t, srv)
+	defer c.Close()
+	if err := c.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(func() bool { return countBodies(srv, "while away") > 0 })
+	if n := countBodies(srv, "while away"); n != 1 {
+		t.Errorf("unacked message received %d times, want once", n)
+	}
+	if n := countBinds(srv); n != 2 {
+		t.Errorf("bound %d times, want again after resumption failed", n)
+	}
+	var enables int
+	for _, s := range srv.Received() {
+		if s.Name.Space == xmpp.NsSM && s.Name.Local == "enable" {
+			enables++
+		}
+	}
+	if enables != 2 {
+		t.Errorf("stream management enabled %d times, want again on the fresh session", enables)
+	}
+}
@@ -0,0 +1,62 @@
+package xmpp_test
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestSNIAndALPN(t *testing.T) {
+	const frontend = "chat.example.com"
+	tests := []struct {
+		name       string
+		serverName string
+		opts       []xmpp.Option
+		wantName   string
+		wantProtos int
+	}{
+		{"dial host", "", nil, "xmpp.internal", 0},
+		{"sni", "", []xmpp.Option{xmpp.WithSNI(frontend)}, frontend, 0},
+		{"sni over config", "other", []xmpp.Option{xmpp.WithSNI(frontend)}, frontend, 0},
+		{"config", frontend, nil, frontend, 0},
+		{"alpn", "", []xmpp.Option{xmpp.WithSNI(frontend), xmpp.WithALPN("xmpp-client")}, frontend, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, _ := testCert(t, frontend)
+			var hello *tls.ClientHelloInfo
+			srv := xmpptest.NewServer("b")
+			srv.TLSConfig = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{"xmpp-client"},
+				GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+					hello = h
+					return nil, nil
+				},
+			}
+			// only what the client asks the frontend for matters here, not
+			// whether the certificate matches it
+			config := &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true}
+			opts := append([]xmpp.Option{xmpp.WithTLSConfig(config)}, tt.opts...)
+			c, err := xmpp.ConnectOver(srv.Pipe(), "xmpp.internal", "bob", "pw", "bot", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if hello == nil {
+				t.Fatal("no tls handshake")
+			}
+			if hello.ServerName != tt.wantName {
+				t.Errorf("presented server name %q, want %q", hello.ServerName, tt.wantName)
+			}
+			if len(hello.SupportedProtos) != tt.wantProtos || tt.wantProtos > 0 && hello.SupportedProtos[0] != "xmpp-client" {
+				t.Errorf("offered protocols %q", hello.SupportedProtos)
+			}
+			if config.ServerName != tt.serverName {
+				t.Errorf("the caller's config was changed to %q", config.ServerName)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package xmpp
+
+import "encoding/xml"
+
+// outMessage, outPresence and outIQ are the stanzas the connection sends,
+// marshalled by encode so that encoding/xml does the escaping. Payload
+// carries extension elements that are already rendered.
+type outMessage struct {
+	XMLName xml.Name   `xml:"message"`
+	From    string     `xml:"from,attr,omitempty"`
+	ID      string     `xml:"id,attr,omitempty"`
+	To      string     `xml:"to,attr,omitempty"`
+	Type    string     `xml:"type,attr,omitempty"`
+	Body    *string    `xml:"body"`
+	Thread  *outThread `xml:"thread"`
+	Payload []byte     `xml:",innerxml"`
+}
+
+type outThread struct {
+	ID     string `xml:",chardata"`
+	Parent string `xml:"parent,attr,omitempty"`
+}
+
+type outPresence struct {
+	XMLName xml.Name `xml:"presence"`
+	From    string   `xml:"from,attr,omitempty"`
+	ID      string   `xml:"id,attr,omitempty"`
+	To      string   `xml:"to,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Show    string   `xml:"show,omitempty"`
+	Status  string   `xml:"status,omitempty"`
+	Payload []byte   `xml:",innerxml"`
+}
+
+type outIQ struct {
+	XMLName xml.Name `xml:"iq"`
+	From    string   `xml:"from,attr,omitempty"`
+	ID      string   `xml:"id,attr"`
+	To      string   `xml:"to,attr,omitempty"`
+	Type    string   `xml:"type,attr"`
+	Payload []byte   `xml:",innerxml"`
+}
+
+// encode marshals v and writes it, holding message bodies to
+// WithMaxBodyBytes
+func (c *Conn) encode(v interface{}) error {
+	if m, ok := v.(*outMessage); ok && m.Body != nil {
+		body, err := c.fitBody(*m.Body)
+		if err != nil {
+			return err
+		}
+		m.Body = &body
+	}
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.write(b)
+}
+
+// fromJID returns what the from attribute of an outgoing stanza should be,
+// which is nothing when the server stamps it
+func (c *Conn) fromJID(jid string) string {
+	if c.serverFrom {
+		return ""
+	}
+	return jid
+}
+
+// chat builds a message stanza with a body, stamped with an origin id and,
+// for chat, the nick set with WithNick
+func (c *Conn) chat(to, from, typ, body string) *outMessage {
+	return c.chatWithID(id(), to, from, typ, body)
+}
+
+// chatWithID builds a message like chat does, with the given id
+func (c *Conn) chatWithID(msgID, to, from, typ, body string) *outMessage {
+	payload := c.stampOrigin(msgID)
+	if typ == "chat" {
+		payload += c.nickElement()
+	}
+	return &outMessage{
+		From:    c.fromJID(from),
+		ID:      msgID,
+		To:      to,
+		Type:    typ,
+		Body:    &body,
+		Payload: []byte(payload),
+	}
+}
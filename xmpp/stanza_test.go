@@ -0,0 +1,52 @@
+package xmpp_test
+
+import (
+	"html"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// joined answers iqs with an empty result and muc joins with the room's
+// self presence
+func joined(s *xmpp.Stanza) string {
+	if s.Name.Local == "presence" {
+		return "<presence from='" + html.EscapeString(s.Attr["to"]) + "'><x xmlns='" + xmpp.NsMucUser +
+			"'><item affiliation='member' role='participant'/><status code='110'/></x></presence>"
+	}
+	return result(s)
+}
+
+func TestAddressesEscaped(t *testing.T) {
+	const jid = "o'brien&co@b"
+	tests := []struct {
+		name string
+		send func(c *xmpp.Conn)
+		to   string
+	}{
+		{"SendHTML", func(c *xmpp.Conn) { c.SendHTML(jid, "me@b", "hi", "<b>hi</b>") }, jid},
+		{"Mention", func(c *xmpp.Conn) { c.Mention(jid, "me@b", "hi", nil) }, jid},
+		{"RoomMessage", func(c *xmpp.Conn) { c.NewRoomMessage(jid).Text("hi").Send() }, jid},
+		{"Correct", func(c *xmpp.Conn) { c.Correct(jid, "me@b", "hi", "m'1") }, jid},
+		{"JoinRoom", func(c *xmpp.Conn) { c.JoinRoom(jid, "o'nick", xmpp.JoinOptions{}) }, jid + "/o'nick"},
+		{"EntityTime", func(c *xmpp.Conn) { c.EntityTime(jid) }, jid},
+		{"LastActivity", func(c *xmpp.Conn) { c.LastActivity(jid) }, jid},
+		{"GetVCard", func(c *xmpp.Conn) { c.GetVCard(jid) }, jid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			received := answer(c, server, joined)
+			tt.send(c)
+			sent := received()
+			if len(sent) == 0 {
+				t.Fatal("nothing sent")
+			}
+			if to := sent[0].Attr["to"]; to != tt.to {
+				t.Errorf("to %q, want %q", to, tt.to)
+			}
+		})
+	}
+}
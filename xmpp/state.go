@@ -0,0 +1,118 @@
+package xmpp
+
+import "errors"
+
+// ErrNotResumable is returned by ImportState when the server won't resume
+// the exported session, which then has to be connected afresh
+var ErrNotResumable = errors.New("session not resumable")
+
+// SessionState is what a new process needs to take over a session from
+// ExportState: the credentials, the stream management session to resume,
+// the rooms joined and the cached roster. It holds the password, so it must
+// be handed over as carefully as the password itself.
+type SessionState struct {
+	User     string
+	Password string
+	Resource string
+	JID      string
+	// SMID is the id of the resumable stream management session, and
+	// Inbound and Outbound its stanza counts. Unacked holds the stanzas
+	// the server had yet to ack.
+	SMID     string
+	Inbound  uint32
+	Outbound uint32
+	Unacked  [][]byte
+	Rooms    []RoomState
+	Roster   []RosterEntry
+}
+
+// RoomState is a room a session is in
+type RoomState struct {
+	Room    string
+	Nick    string
+	Options JoinOptions
+}
+
+// ExportState captures the session so that another process can resume it
+// with ImportState, as in a deploy that hands over without leaving rooms.
+// It should be called once Run has returned, so that the counts are final,
+// and the connection then dropped without Close: closing the stream ends
+// the session on the server. The session is only resumable if stream
+// management was enabled and the server allows resumption.
+func (c *Conn) ExportState() (SessionState, error) {
+	c.mu.Lock()
+	st := SessionState{
+		User:     c.user,
+		Password: c.pass,
+		Resource: c.resource,
+		JID:      c.jid,
+	}
+	for room, r := range c.rooms {
+		st.Rooms = append(st.Rooms, RoomState{Room: room, Nick: r.nick, Options: r.opts})
+	}
+	c.mu.Unlock()
+	if st.User == "" {
+		return SessionState{}, ErrNoSession
+	}
+	st.Roster = c.Contacts()
+
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	if c.sm == nil || c.sm.id == "" {
+		return SessionState{}, ErrNotResumable
+	}
+	st.SMID, st.Inbound, st.Outbound = c.sm.id, c.sm.inbound, c.sm.outbound
+	for _, b := range c.sm.unacked {
+		st.Unacked = append(st.Unacked, append([]byte(nil), b...))
+	}
+	return st, nil
+}
+
+// ImportState connects to host and resumes the session st was exported
+// from, sending again whatever the server hadn't acked. The rooms and
+// roster carry over without being fetched again. If the server can no
+// longer resume the session, ErrNotResumable is returned and nothing is
+// left connected.
+func ImportState(st SessionState, host string, opts ...Option) (*Conn, error) {
+	c := newConn(opts)
+	c.host, c.jid = host, st.JID
+	c.user, c.pass, c.resource = st.User, st.Password, st.Resource
+	c.rooms = make(map[string]joinedRoom, len(st.Rooms))
+	for _, r := range st.Rooms {
+		c.rooms[foldBare(r.Room)] = joinedRoom{nick: r.Nick, opts: r.Options, settled: true}
+	}
+	c.roster = make(map[string]RosterEntry, len(st.Roster))
+	for _, e := range st.Roster {
+		c.roster[foldBare(e.Jid)] = e
+	}
+	c.cacheMentions()
+
+	sm := &streamManagement{id: st.SMID, inbound: st.Inbound, outbound: st.Outbound}
+	for _, b := range st.Unacked {
+		sm.unacked = append(sm.unacked, append([]byte(nil), b...))
+	}
+
+	outgoing, err := c.dial(host + ":5222")
+	if err != nil {
+		return nil, c.labelled(&ConnectError{Phase: PhaseDial, Err: err})
+	}
+	c.outgoing = outgoing
+	c.incoming = c.newDecoder(outgoing)
+	if err := c.handshake(); err != nil {
+		outgoing.Close()
+		return nil, c.labelled(err)
+	}
+	if _, err := c.authenticate(); err != nil {
+		outgoing.Close()
+		return nil, c.labelled(err)
+	}
+	resumed, err := c.resume(sm)
+	if err == nil && !resumed {
+		err = ErrNotResumable
+	}
+	if err != nil {
+		outgoing.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,109 @@
+package xmpp_test
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// exportDropped connects through d with stream management and joins a
+// room, then drops the connection with a message unacked and exports the
+// session
+func exportDropped(t *testing.T, d *xmpp.Dialer, conns func() []net.Conn) xmpp.SessionState {
+	t.Helper()
+	c, err := d.Connect("b", "bob", "secret", "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EnableStreamManagement(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.JoinRoom("ops@conf.b", "bot", xmpp.JoinOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	conns()[0].Close()
+	if _, err := c.MUCSendWithID("chat", "alice@b", "", "while away"); err == nil {
+		t.Fatal("send over a dropped connection succeeded")
+	}
+	st, err := c.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestImportStateResumes(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	d, conns := dialServer(srv)
+	st := exportDropped(t, d, conns)
+	if st.SMID == "" || len(st.Unacked) == 0 || len(st.Rooms) != 1 || st.Rooms[0].Nick != "bot" {
+		t.Fatalf("exported %+v", st)
+	}
+
+	c, err := d.ImportState(st, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.JID(); got != "bob@b/bot" {
+		t.Errorf("resumed as %q", got)
+	}
+	eventually(func() bool { return countBodies(srv, "while away") > 0 })
+	if n := countBodies(srv, "while away"); n != 1 {
+		t.Errorf("unacked message received %d times, want once", n)
+	}
+	if n := countBinds(srv); n != 1 {
+		t.Errorf("bound %d times, want only on first connecting", n)
+	}
+	// the room carries over without being joined again
+	if _, err := c.SendChunked("ops@conf.b", "", "back", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetRoster(); err != nil {
+		t.Fatal(err)
+	}
+	joins := 0
+	for _, p := range srv.ReceivedNamed("presence") {
+		if p.Attr["to"] == "ops@conf.b/bot" {
+			joins++
+		}
+	}
+	if joins != 1 {
+		t.Errorf("joined the room %d times", joins)
+	}
+	var back *xmpp.Stanza
+	for _, m := range srv.ReceivedNamed("message") {
+		if strings.Contains(string(m.Inner), "<body>back</body>") {
+			back = m
+		}
+	}
+	if back == nil || back.Attr["type"] != "groupchat" {
+		t.Errorf("message to the room sent as %v", back)
+	}
+}
+
+func TestImportStateNotResumable(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	d, conns := dialServer(srv)
+	st := exportDropped(t, d, conns)
+	st.SMID = "gone"
+	if _, err := d.ImportState(st, "b"); !errors.Is(err, xmpp.ErrNotResumable) {
+		t.Errorf("ImportState returned %v, want ErrNotResumable", err)
+	}
+}
+
+func TestExportStateWithoutStreamManagement(t *testing.T) {
+	srv := xmpptest.NewServer("b")
+	c, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", "pw", "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.ExportState(); !errors.Is(err, xmpp.ErrNotResumable) {
+		t.Errorf("ExportState returned %v, want ErrNotResumable", err)
+	}
+}
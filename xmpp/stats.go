@@ -0,0 +1,73 @@
+package xmpp
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnStats is a snapshot of a connection's activity, for health checks. A
+// LastReceived that stops advancing is the surest sign of a dead stream.
+type ConnStats struct {
+	LastSent     time.Time
+	LastReceived time.Time
+	// LastPingRTT is the round trip of the last answered keepalive ping. It
+	// stays zero unless WithKeepAlivePing is set.
+	LastPingRTT     time.Duration
+	StanzasSent     uint64
+	StanzasReceived uint64
+	Reconnects      uint64
+}
+
+// connStats is the state behind Stats
+type connStats struct {
+	mu    sync.Mutex
+	stats ConnStats
+	// pingID and pingSent track the keepalive ping awaiting an answer
+	pingID   string
+	pingSent time.Time
+}
+
+// Stats returns the connection's activity so far
+func (c *Conn) Stats() ConnStats {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	return c.stats.stats
+}
+
+func (c *Conn) countSent(b []byte) {
+	now := c.clock.Now()
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	c.stats.stats.LastSent = now
+	if isStanza(b) {
+		c.stats.stats.StanzasSent++
+	}
+}
+
+func (c *Conn) countReceived(s *Stanza) {
+	now := c.clock.Now()
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	c.stats.stats.LastReceived = now
+	if s.Name.Space != NsJabberClient && s.Name.Space != NsComponentAccept {
+		return
+	}
+	c.stats.stats.StanzasReceived++
+	if s.Name.Local == "iq" && c.stats.pingID != "" && s.Attr["id"] == c.stats.pingID {
+		c.stats.stats.LastPingRTT = now.Sub(c.stats.pingSent)
+		c.stats.pingID = ""
+	}
+}
+
+func (c *Conn) countPing(pingID string) {
+	now := c.clock.Now()
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	c.stats.pingID, c.stats.pingSent = pingID, now
+}
+
+func (c *Conn) countReconnect() {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	c.stats.stats.Reconnects++
+}
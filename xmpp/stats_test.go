@@ -0,0 +1,57 @@
+package xmpp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestStatsAdvance(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	c, server := xmpptest.Pipe(xmpp.WithClock(clock), xmpp.WithKeepAlivePing(true))
+	defer server.Close()
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local != "iq" {
+			return ""
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.Attr["id"] + "'/>"
+	})
+	defer received()
+
+	if st := c.Stats(); st != (xmpp.ConnStats{}) {
+		t.Fatalf("fresh connection has stats %+v", st)
+	}
+
+	sentAt := clock.now
+	if err := c.SendRaw("<message to='a@b'><body>hi</body></message>"); err != nil {
+		t.Fatal(err)
+	}
+	st := c.Stats()
+	if st.StanzasSent != 1 || !st.LastSent.Equal(sentAt) || st.StanzasReceived != 0 {
+		t.Errorf("after a send %+v", st)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	if err := c.KeepAlive(); err != nil {
+		t.Fatal(err)
+	}
+	pingAt := clock.now
+	clock.now = clock.now.Add(40 * time.Millisecond)
+	// GetRoster reads the ping's answer from the stream before its own
+	if _, err := c.GetRoster(); err != nil {
+		t.Fatal(err)
+	}
+
+	st = c.Stats()
+	if st.StanzasSent != 3 || !st.LastSent.Equal(pingAt.Add(40*time.Millisecond)) {
+		t.Errorf("after the ping %+v", st)
+	}
+	if st.StanzasReceived != 2 || !st.LastReceived.Equal(clock.now) {
+		t.Errorf("after two answers %+v", st)
+	}
+	if st.LastPingRTT != 40*time.Millisecond {
+		t.Errorf("ping round trip %v, want 40ms", st.LastPingRTT)
+	}
+}
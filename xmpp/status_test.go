@@ -0,0 +1,69 @@
+package xmpp_test
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// heldClock stands still, firing whatever waits on After only when the
+// test sends on after
+type heldClock struct {
+	now   time.Time
+	after chan time.Time
+}
+
+func (c *heldClock) Now() time.Time                       { return c.now }
+func (c *heldClock) After(time.Duration) <-chan time.Time { return c.after }
+func (c *heldClock) NewTicker(time.Duration) xmpp.Ticker  { return fakeTicker{} }
+
+func TestUpdateStatus(t *testing.T) {
+	clock := &heldClock{now: time.Unix(1e9, 0), after: make(chan time.Time)}
+	srv := xmpptest.NewServer("b")
+	c, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", "pw", "bot", xmpp.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Presence("", "away")
+	for _, status := range []string{"queue: 1", "queue: 2", "queue <3 & rising"} {
+		if err := c.UpdateStatus(status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the last two came within a second of the first, so only the latest
+	// of them goes once that second is up
+	clock.after <- clock.now.Add(time.Second)
+
+	type presence struct {
+		Show   string `xml:"show"`
+		Status string `xml:"status"`
+	}
+	var got []presence
+	if !eventually(func() bool {
+		got = got[:0]
+		for _, s := range srv.ReceivedNamed("presence") {
+			var p presence
+			if err := xml.Unmarshal([]byte("<p>"+string(s.Inner)+"</p>"), &p); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, p)
+		}
+		return len(got) >= 4
+	}) {
+		t.Fatalf("server received presences %+v", got)
+	}
+	// the first is the one sent on connecting
+	want := []presence{{"", ""}, {"away", ""}, {"away", "queue: 1"}, {"away", "queue <3 & rising"}}
+	if len(got) != len(want) {
+		t.Fatalf("server received presences %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("presence %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
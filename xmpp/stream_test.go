@@ -0,0 +1,60 @@
+package xmpp_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestStreamReadsOpeningTag(t *testing.T) {
+	tests := []struct {
+		name, prefix string
+	}{
+		{"header alone", ""},
+		{"declaration first", "<?xml version='1.0' encoding='UTF-8'?>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			go io.Copy(io.Discard, server)
+			// the header and features arrive in a single read
+			go io.WriteString(server, tt.prefix+streamHeader+plainFeatures)
+
+			c.Stream("bob@b", "b")
+			if c.StreamID() != "s1" || c.StreamVersion() != "1.0" {
+				t.Errorf("stream id %q, version %q", c.StreamID(), c.StreamVersion())
+			}
+			f := c.Features()
+			if strings.Join(f.Mechanisms, " ") != "PLAIN" {
+				t.Errorf("features %+v", f)
+			}
+		})
+	}
+}
+
+func TestStreamInvalidOpening(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	errs := make(chan error, 4)
+	c.SetErrorChannel(errs)
+	go io.Copy(io.Discard, server)
+	go io.WriteString(server, "<html><body>502 Bad Gateway</body></html>")
+
+	c.Stream("bob@b", "b")
+	select {
+	case err := <-errs:
+		if !errors.Is(err, xmpp.ErrInvalidXML) {
+			t.Errorf("reported %v, want ErrInvalidXML", err)
+		}
+	default:
+		t.Error("nothing reported for a reply that isn't a stream")
+	}
+	if c.StreamID() != "" {
+		t.Errorf("stream id %q from a reply that isn't a stream", c.StreamID())
+	}
+}
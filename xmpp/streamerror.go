@@ -0,0 +1,118 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// ErrHostUnknown is returned when the server doesn't serve the domain the
+// stream was opened for, which usually means the host given is wrong
+var ErrHostUnknown = errors.New("stream error: host unknown")
+
+// Errors reading the stream once it has ended. ErrStreamClosed is also an
+// io.EOF.
+var (
+	// ErrConnectionLost means the connection dropped without the stream
+	// being closed, possibly in the middle of a stanza, and is worth
+	// reconnecting after
+	ErrConnectionLost = errors.New("connection lost")
+	// ErrStreamClosed means the server closed the stream without a stream
+	// error, as on an idle timeout or a restart
+	ErrStreamClosed = fmt.Errorf("stream closed: %w", io.EOF)
+)
+
+// readError classifies an error reading the stream, making the connection
+// dropping an ErrConnectionLost that still wraps err. A read that times out
+// or is of a connection closed on this side is left alone.
+func readError(err error) error {
+	var se *xml.SyntaxError
+	var oe *net.OpError
+	switch {
+	case errors.Is(err, ErrStreamClosed), errors.Is(err, net.ErrClosed):
+		return err
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, &se) && se.Msg == "unexpected EOF",
+		errors.As(err, &oe) && !oe.Timeout():
+		return fmt.Errorf("%w: %w", ErrConnectionLost, err)
+	}
+	return err
+}
+
+// StreamError is an error the server ended the stream with
+type StreamError struct {
+	Condition string
+	Text      string
+}
+
+func (e *StreamError) Error() string {
+	if e.Text != "" {
+		return "stream error: " + e.Condition + ": " + e.Text
+	}
+	return "stream error: " + e.Condition
+}
+
+// RedirectError is returned when the server sends the client to another
+// host with see-other-host. Connect follows it itself with
+// WithFollowRedirects.
+type RedirectError struct {
+	// Host is the address to connect to instead, which may carry a port
+	Host string
+}
+
+func (e *RedirectError) Error() string {
+	return "stream error: see other host " + e.Host
+}
+
+// streamError is the stream:error element
+type streamError struct {
+	Text       string `xml:"urn:ietf:params:xml:ns:xmpp-streams text"`
+	Conditions []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+// parseStreamError converts a stream:error into a *RedirectError,
+// ErrHostUnknown or a *StreamError
+func parseStreamError(s *Stanza) error {
+	var e streamError
+	if err := s.decode(&e); err != nil {
+		return err
+	}
+	se := &StreamError{Condition: "undefined-condition", Text: e.Text}
+	for _, c := range e.Conditions {
+		if c.XMLName.Space != NsStreams || c.XMLName.Local == "text" {
+			continue
+		}
+		switch c.XMLName.Local {
+		case "see-other-host":
+			return &RedirectError{Host: strings.TrimSpace(c.Value)}
+		case "host-unknown":
+			return ErrHostUnknown
+		}
+		se.Condition = c.XMLName.Local
+		break
+	}
+	return se
+}
+
+// isStreamError reports whether err is the server ending the stream with a
+// stream error
+func isStreamError(err error) bool {
+	var se *StreamError
+	var re *RedirectError
+	return errors.As(err, &se) || errors.As(err, &re) || errors.Is(err, ErrHostUnknown)
+}
+
+// redirectAddr returns the address to dial for a see-other-host host,
+// which may leave the port off
+func redirectAddr(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), "5222")
+}
@@ -0,0 +1,50 @@
+package xmpp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestSubjectChange(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var changes []xmpp.SubjectChange
+	c.HandleSubjectChange(func(sc xmpp.SubjectChange) { changes = append(changes, sc) })
+	var other int
+	c.HandleMessage(func(*xmpp.Message) { other++ })
+	c.HandleBodyless(func(*xmpp.Message) { other++ })
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		// the messages arrive while EntityTime reads the stream
+		return "<message xmlns='jabber:client' from='ops@conf.b' type='groupchat'><subject>Deploys &amp; incidents</subject>" +
+			"<delay xmlns='urn:xmpp:delay' stamp='2017-03-01T09:00:00Z'/></message>" +
+			"<message xmlns='jabber:client' from='ops@conf.b/alice' type='groupchat'><subject>Freeze until Monday</subject></message>" +
+			// an empty subject, as rooms send while being configured
+			"<message xmlns='jabber:client' from='ops@conf.b' type='groupchat'><subject/></message>" +
+			// a subject with a body is a message that happens to set one
+			"<message xmlns='jabber:client' from='ops@conf.b/alice' type='groupchat'><subject>x</subject><body>hi</body></message>" +
+			result(s)
+	})
+	defer received()
+
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	want := []xmpp.SubjectChange{
+		{Room: "ops@conf.b", Subject: "Deploys & incidents", Delay: time.Date(2017, 3, 1, 9, 0, 0, 0, time.UTC)},
+		{Room: "ops@conf.b", Subject: "Freeze until Monday", ByNick: "alice"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("got %+v, want %+v", changes, want)
+	}
+	for i := range want {
+		if sc := changes[i]; sc.Room != want[i].Room || sc.Subject != want[i].Subject || sc.ByNick != want[i].ByNick || !sc.Delay.Equal(want[i].Delay) {
+			t.Errorf("change %d is %+v, want %+v", i, sc, want[i])
+		}
+	}
+	if other != 2 {
+		t.Errorf("%d messages went to the other handlers, want the empty subject and the message with a body", other)
+	}
+}
@@ -0,0 +1,79 @@
+package xmpp_test
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestReplyToKeepsThread(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	var got []*xmpp.Message
+	c.HandleMessage(func(m *xmpp.Message) { got = append(got, m.Copy()) })
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local != "iq" {
+			return ""
+		}
+		// the messages arrive while EntityTime reads the stream
+		return "<message xmlns='jabber:client' from='alice@b/phone' id='m1' type='chat'><body>one</body>" +
+			"<thread parent='root'> t1 </thread></message>" +
+			"<message xmlns='jabber:client' from='ops@conf.b/alice' id='m2' type='groupchat'><body>two</body></message>" +
+			"<message xmlns='jabber:client' from='ops@conf.b/carol' type='chat'><body>three</body></message>" +
+			result(s)
+	})
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("handled %d messages", len(got))
+	}
+	if got[0].Thread != "t1" || got[0].ThreadParent != "root" {
+		t.Errorf("parsed thread %q parent %q", got[0].Thread, got[0].ThreadParent)
+	}
+	for _, m := range got {
+		if err := c.ReplyTo(m, "", "re"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type reply struct {
+		To     string
+		Type   string
+		Body   string `xml:"body"`
+		Thread struct {
+			ID     string `xml:",chardata"`
+			Parent string `xml:"parent,attr"`
+		} `xml:"thread"`
+	}
+	want := []reply{
+		{To: "alice@b/phone", Type: "chat", Body: "re"},
+		{To: "ops@conf.b", Type: "groupchat", Body: "re"},
+		// an occupant writing privately is answered privately, and
+		// without an id there is no thread to start
+		{To: "ops@conf.b/carol", Type: "chat", Body: "re"},
+	}
+	want[0].Thread.ID, want[0].Thread.Parent = "t1", "root"
+	want[1].Thread.ID = "m2"
+	var replies []reply
+	for _, s := range received() {
+		if s.Name.Local != "message" {
+			continue
+		}
+		r := reply{To: s.Attr["to"], Type: s.Attr["type"]}
+		if err := xml.Unmarshal([]byte("<m>"+string(s.Inner)+"</m>"), &r); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, r)
+	}
+	if len(replies) != len(want) {
+		t.Fatalf("sent %+v, want %+v", replies, want)
+	}
+	for i := range want {
+		if replies[i] != want[i] {
+			t.Errorf("reply %d is %+v, want %+v", i, replies[i], want[i])
+		}
+	}
+}
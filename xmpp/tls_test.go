@@ -0,0 +1,154 @@
+package xmpp_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+// testCert makes a self-signed certificate for name, returning it along
+// with a pool that trusts it
+func testCert(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+const externalFeatures = "<stream:features><mechanisms xmlns='" + xmpp.NsSASL + "'><mechanism>EXTERNAL</mechanism></mechanisms></stream:features>"
+
+func TestExternalAuth(t *testing.T) {
+	tests := []struct {
+		name, authzid, initial string
+	}{
+		{"certificate identity", "", "="},
+		{"authzid", "bot@b", "Ym90QGI="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverCert, roots := testCert(t, "b")
+			clientCert, _ := testCert(t, "bot@b")
+			c, pipe := xmpptest.Pipe()
+			defer pipe.Close()
+			server := tls.Server(pipe, &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAnyClientCert})
+
+			var peer, mechanism, initial string
+			sasl := saslServer(externalFeatures)
+			received := negotiate(c, server, func(s *xmpp.Stanza) string {
+				if s.Name.Local == "auth" {
+					if certs := server.ConnectionState().PeerCertificates; len(certs) > 0 {
+						peer = certs[0].Subject.CommonName
+					}
+					mechanism, initial = s.Attr["mechanism"], strings.TrimSpace(string(s.Inner))
+				}
+				return sasl(s)
+			})
+			defer received()
+
+			c.UseTLSConfig(&tls.Config{Certificates: []tls.Certificate{clientCert}, RootCAs: roots, ServerName: "b"})
+			c.Stream("bot@b", "b")
+			c.Features()
+			if err := c.ExternalAuth(tt.authzid); err != nil {
+				t.Fatal(err)
+			}
+			if peer != "bot@b" {
+				t.Errorf("server saw client certificate %q", peer)
+			}
+			if mechanism != "EXTERNAL" || initial != tt.initial {
+				t.Errorf("auth %s with %q, want EXTERNAL with %q", mechanism, initial, tt.initial)
+			}
+			if _, err := c.Bind("bot"); err != nil {
+				t.Errorf("Bind after ExternalAuth returned %v", err)
+			}
+		})
+	}
+}
+
+func TestExternalAuthNotOffered(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := negotiate(c, server, saslServer(plainFeatures))
+
+	c.Stream("bot@b", "b")
+	c.Features()
+	if err := c.ExternalAuth(""); !errors.Is(err, xmpp.ErrMechanismUnavailable) {
+		t.Errorf("ExternalAuth returned %v, want ErrMechanismUnavailable", err)
+	}
+	if got := strings.Join(received(), " "); strings.Contains(got, "auth") {
+		t.Errorf("client sent %q", got)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	// the server agrees to tls, then reads the client hello and never answers
+	negotiate(nil, server, func(s *xmpp.Stanza) string {
+		switch s.Name.Local {
+		case "stream":
+			return streamHeader + "<stream:features><starttls xmlns='" + xmpp.NsTLS + "'><required/></starttls></stream:features>"
+		case "starttls":
+			return "<proceed xmlns='" + xmpp.NsTLS + "'/>"
+		}
+		return ""
+	})
+	done := make(chan error, 1)
+	go func() {
+		_, err := xmpp.ConnectOver(client, "b", "bob", "pw", "bot", xmpp.WithTLSHandshakeTimeout(50*time.Millisecond))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var ce *xmpp.ConnectError
+		if !errors.As(err, &ce) || ce.Phase != xmpp.PhaseTLS || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("ConnectOver returned %v, want the handshake timing out", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnectOver hung on a stalled handshake")
+	}
+}
+
+func TestTLSHandshakeTimeoutMet(t *testing.T) {
+	cert, pool := testCert(t, "b")
+	srv := xmpptest.NewServer("b")
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	c, err := xmpp.ConnectOver(srv.Pipe(), "b", "bob", "pw", "bot",
+		xmpp.WithTLSConfig(&tls.Config{RootCAs: pool}), xmpp.WithTLSHandshakeTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -0,0 +1,55 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownGroup is returned when a user jid is needed before the session's
+// own jid, which carries the hipchat group id, is known
+var ErrUnknownGroup = errors.New("hipchat group id unknown")
+
+// groupID returns the hipchat group id and domain from the session's jid,
+// which has the form <group>_<user>@<domain>
+func (c *Conn) groupID() (group, domain string) {
+	c.mu.Lock()
+	jid := bare(c.jid)
+	c.mu.Unlock()
+	at := strings.IndexByte(jid, '@')
+	if at < 0 {
+		return "", ""
+	}
+	group, _, ok := strings.Cut(jid[:at], "_")
+	if !ok {
+		return "", ""
+	}
+	if _, err := strconv.Atoi(group); err != nil {
+		return "", ""
+	}
+	return group, jid[at+1:]
+}
+
+// UserJID returns the jid of the hipchat user with the given id, such as one
+// learned from the REST api, in the session's group. It returns "" until
+// the session's jid is known.
+func (c *Conn) UserJID(userID int) string {
+	group, domain := c.groupID()
+	if group == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s_%d@%s", group, userID, domain)
+}
+
+// SendToUser sends body privately to the hipchat user with the given id
+func (c *Conn) SendToUser(userID int, from, body string) error {
+	to := c.UserJID(userID)
+	if to == "" {
+		return ErrUnknownGroup
+	}
+	if err := c.presentTo(to); err != nil {
+		return err
+	}
+	return c.encode(c.chat(to, from, "chat", body))
+}
@@ -0,0 +1,58 @@
+package xmpp_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestUserJID(t *testing.T) {
+	tests := []struct {
+		user, want string
+	}{
+		{"12345_678", "12345_42@chat.hipchat.com"},
+		{"bob", ""},
+		{"group_678", ""},
+	}
+	for _, tt := range tests {
+		c, err := xmpp.ConnectOver(xmpptest.NewServer("chat.hipchat.com").Pipe(), "chat.hipchat.com", tt.user, "pw", "bot")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.UserJID(42); got != tt.want {
+			t.Errorf("UserJID(42) as %s is %q, want %q", tt.user, got, tt.want)
+		}
+		c.Close()
+	}
+}
+
+func TestSendToUser(t *testing.T) {
+	srv := xmpptest.NewServer("chat.hipchat.com")
+	c, err := xmpp.ConnectOver(srv.Pipe(), "chat.hipchat.com", "12345_678", "pw", "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.SendToUser(42, "", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	// the server answers in order, so once the roster is back it has read
+	// the message too
+	if _, err := c.GetRoster(); err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.ReceivedNamed("message")
+	if len(msgs) != 1 || msgs[0].Attr["to"] != "12345_42@chat.hipchat.com" || msgs[0].Attr["type"] != "chat" {
+		t.Fatalf("server got %v", msgs)
+	}
+}
+
+func TestSendToUserBeforeConnect(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	if err := c.SendToUser(42, "", "hello"); !errors.Is(err, xmpp.ErrUnknownGroup) {
+		t.Errorf("SendToUser returned %v, want ErrUnknownGroup", err)
+	}
+}
@@ -0,0 +1,146 @@
+package xmpp
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+)
+
+const (
+	xmlVCardGet    = "<iq type='get' to='%s' id='%s'><vCard xmlns='%s'/></iq>"
+	xmlVCardSet    = "<iq type='set' id='%s'>%s</iq>"
+	xmlVCardUpdate = "<x xmlns='%s'><photo>%s</photo></x>"
+)
+
+// VCard is the profile of a user
+type VCard struct {
+	FullName  string
+	Nickname  string
+	Email     string
+	PhotoType string
+	Photo     []byte
+}
+
+type vCardResult struct {
+	VCard struct {
+		FN       string `xml:"FN"`
+		Nickname string `xml:"NICKNAME"`
+		Email    struct {
+			UserID string `xml:"USERID"`
+			Text   string `xml:",chardata"`
+		} `xml:"EMAIL"`
+		Photo struct {
+			Type   string `xml:"TYPE"`
+			BinVal string `xml:"BINVAL"`
+		} `xml:"PHOTO"`
+	} `xml:"vcard-temp vCard"`
+}
+
+// GetVCard fetches the vcard of jid
+func (c *Conn) GetVCard(jid string) (*VCard, error) {
+	iqID := id()
+	s, err := c.sendIQ(iqID, xmlVCardGet, html.EscapeString(jid), iqID, NsVCard)
+	if err != nil {
+		return nil, err
+	}
+
+	var r vCardResult
+	if err := s.decode(&r); err != nil {
+		return nil, err
+	}
+	v := &VCard{
+		FullName:  r.VCard.FN,
+		Nickname:  r.VCard.Nickname,
+		Email:     strings.TrimSpace(r.VCard.Email.UserID),
+		PhotoType: r.VCard.Photo.Type,
+	}
+	if v.Email == "" {
+		v.Email = strings.TrimSpace(r.VCard.Email.Text)
+	}
+	if r.VCard.Photo.BinVal != "" {
+		photo := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, r.VCard.Photo.BinVal)
+		if v.Photo, err = base64.StdEncoding.DecodeString(photo); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// vCardSet is the vcard published by SetAvatar
+type vCardSet struct {
+	XMLName  xml.Name `xml:"vcard-temp vCard"`
+	FN       string   `xml:"FN,omitempty"`
+	Nickname string   `xml:"NICKNAME,omitempty"`
+	Email    *struct {
+		UserID string `xml:"USERID"`
+	} `xml:"EMAIL"`
+	Photo struct {
+		Type   string `xml:"TYPE"`
+		BinVal string `xml:"BINVAL"`
+	} `xml:"PHOTO"`
+}
+
+// SetAvatar publishes jpeg as the photo on the connection's vcard, keeping
+// the rest of the vcard as it is, and advertises its hash in presence from
+// then on so that clients fetch the new avatar
+func (c *Conn) SetAvatar(jpeg []byte) error {
+	v, err := c.GetVCard(bare(c.JID()))
+	var se *StanzaError
+	if errors.As(err, &se) {
+		// there is no vcard to keep yet
+		v, err = &VCard{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	vc := vCardSet{FN: v.FullName, Nickname: v.Nickname}
+	if v.Email != "" {
+		vc.Email = &struct {
+			UserID string `xml:"USERID"`
+		}{v.Email}
+	}
+	vc.Photo.Type = "image/jpeg"
+	vc.Photo.BinVal = base64.StdEncoding.EncodeToString(jpeg)
+	b, err := xml.Marshal(vc)
+	if err != nil {
+		return err
+	}
+	iqID := id()
+	if _, err := c.sendIQ(iqID, xmlVCardSet, iqID, b); err != nil {
+		return err
+	}
+
+	sum := sha1.Sum(jpeg)
+	c.mu.Lock()
+	c.avatarHash = hex.EncodeToString(sum[:])
+	show := c.show
+	c.mu.Unlock()
+	if c.directedOnly {
+		return c.directedPresence("", show)
+	}
+	return c.encode(c.ownPresence("", ""))
+}
+
+// presenceExtras renders what the connection adds to its own presence: its
+// capabilities and the hash of the avatar set with SetAvatar
+func (c *Conn) presenceExtras() []byte {
+	c.mu.Lock()
+	hash := c.avatarHash
+	c.mu.Unlock()
+	extras := c.capsElement()
+	if hash != "" {
+		extras += fmt.Sprintf(xmlVCardUpdate, NsVCardUpdate, hash)
+	}
+	return []byte(extras)
+}
@@ -0,0 +1,140 @@
+package xmpp_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestGetVCard(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		return "<iq type='result' id='" + s.Attr["id"] + "'><vCard xmlns='" + xmpp.NsVCard + "'>" +
+			"<FN>Alice Jones</FN><NICKNAME>AliceJ</NICKNAME>" +
+			"<EMAIL><INTERNET/><USERID> alice@example.com </USERID></EMAIL>" +
+			"<PHOTO><TYPE>image/png</TYPE><BINVAL>iVBO\n Rw0K\r\nGgo=</BINVAL></PHOTO>" +
+			"</vCard></iq>"
+	})
+
+	v, err := c.GetVCard("1_2@chat.hipchat.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.FullName != "Alice Jones" || v.Nickname != "AliceJ" || v.Email != "alice@example.com" || v.PhotoType != "image/png" {
+		t.Errorf("got %+v", v)
+	}
+	if want := []byte("\x89PNG\r\n\x1a\n"); !bytes.Equal(v.Photo, want) {
+		t.Errorf("photo %q, want %q", v.Photo, want)
+	}
+
+	sent := received()
+	if len(sent) != 1 || sent[0].Attr["type"] != "get" || sent[0].Attr["to"] != "1_2@chat.hipchat.com" {
+		t.Fatalf("sent %v", sent)
+	}
+}
+
+func TestGetVCardPlainEmail(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	answer(c, server, func(s *xmpp.Stanza) string {
+		return "<iq type='result' id='" + s.Attr["id"] + "'><vCard xmlns='" + xmpp.NsVCard + "'><EMAIL>bob@example.com</EMAIL></vCard></iq>"
+	})
+
+	v, err := c.GetVCard("1_3@chat.hipchat.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Email != "bob@example.com" || v.Photo != nil {
+		t.Errorf("got %+v", v)
+	}
+}
+
+func TestGetVCardBadPhoto(t *testing.T) {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	answer(c, server, func(s *xmpp.Stanza) string {
+		return "<iq type='result' id='" + s.Attr["id"] + "'><vCard xmlns='" + xmpp.NsVCard + "'><PHOTO><BINVAL>not base64!</BINVAL></PHOTO></vCard></iq>"
+	})
+
+	if _, err := c.GetVCard("1_3@chat.hipchat.com"); err == nil {
+		t.Error("bad photo accepted")
+	}
+}
+
+func TestSetAvatar(t *testing.T) {
+	tests := []struct {
+		name, existing, wantFN string
+	}{
+		{"keeps the vcard", "<vCard xmlns='" + xmpp.NsVCard + "'><FN>Deploy Bot</FN><NICKNAME>deploy</NICKNAME></vCard>", "Deploy Bot"},
+		{"no vcard yet", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := xmpptest.Pipe()
+			defer server.Close()
+			received := answer(c, server, func(s *xmpp.Stanza) string {
+				switch {
+				case s.Name.Local != "iq":
+					return ""
+				case s.Attr["type"] == "get" && tt.existing == "":
+					return "<iq type='error' id='" + s.Attr["id"] + "'><error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+				case s.Attr["type"] == "get":
+					return "<iq type='result' id='" + s.Attr["id"] + "'>" + tt.existing + "</iq>"
+				}
+				return result(s)
+			})
+
+			jpeg := []byte("\xff\xd8\xff\xe0 not much of a picture \xff\xd9")
+			if err := c.SetAvatar(jpeg); err != nil {
+				t.Fatal(err)
+			}
+			c.Presence("", "away")
+
+			var published struct {
+				FN    string `xml:"FN"`
+				Photo struct {
+					Type   string `xml:"TYPE"`
+					BinVal string `xml:"BINVAL"`
+				} `xml:"PHOTO"`
+			}
+			var hashes []string
+			for _, s := range received() {
+				switch {
+				case s.Name.Local == "iq" && s.Attr["type"] == "set":
+					if err := xml.Unmarshal(s.Inner, &published); err != nil {
+						t.Fatal(err)
+					}
+				case s.Name.Local == "presence":
+					var p struct {
+						Photo string `xml:"vcard-temp:x:update x>photo"`
+					}
+					if err := xml.Unmarshal([]byte("<presence>"+string(s.Inner)+"</presence>"), &p); err != nil {
+						t.Fatal(err)
+					}
+					hashes = append(hashes, p.Photo)
+				}
+			}
+
+			photo, err := base64.StdEncoding.DecodeString(published.Photo.BinVal)
+			if err != nil || !bytes.Equal(photo, jpeg) || published.Photo.Type != "image/jpeg" {
+				t.Errorf("published photo %q of type %q", photo, published.Photo.Type)
+			}
+			if published.FN != tt.wantFN {
+				t.Errorf("published full name %q, want %q", published.FN, tt.wantFN)
+			}
+			sum := sha1.Sum(photo)
+			want := hex.EncodeToString(sum[:])
+			// the presence SetAvatar sends and every one after it
+			if len(hashes) != 2 || hashes[0] != want || hashes[1] != want {
+				t.Errorf("presence photo hashes %q, want %s", hashes, want)
+			}
+		})
+	}
+}
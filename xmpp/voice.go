@@ -0,0 +1,68 @@
+package xmpp
+
+import (
+	"errors"
+	"html"
+)
+
+const xmlMUCRole = "<iq type='set' to='%s' id='%s'><query xmlns='%s'><item nick='%s' role='%s'/></query></iq>"
+
+// VoiceRequest is an occupant of a moderated room asking for voice, as sent
+// to the room's moderators
+type VoiceRequest struct {
+	Room string
+	Nick string
+	// Jid is the occupant's real jid, when the room shows it to moderators
+	Jid string
+}
+
+// HandleVoiceRequest sets the function the dispatch loop calls with each
+// voice request from a room the connection moderates. Without one, and
+// without WithAutoGrantVoice, requests are passed to the bodyless handler.
+func (c *Conn) HandleVoiceRequest(fn func(VoiceRequest)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.voiceRequestHandler = fn
+}
+
+// GrantVoice makes the occupant nick of the room roomJID a participant, so
+// that they can speak in a moderated room. Only moderators may grant
+// voice, so others get ErrNotPrivileged.
+func (c *Conn) GrantVoice(roomJID, nick string) error {
+	iqID := id()
+	_, err := c.sendIQ(iqID, xmlMUCRole, html.EscapeString(bare(roomJID)), iqID, NsMucAdmin, html.EscapeString(nick), "participant")
+	var se *StanzaError
+	if errors.As(err, &se) && se.Condition == "forbidden" {
+		return ErrNotPrivileged
+	}
+	return err
+}
+
+// parseVoiceRequest returns the voice request a form from a room makes, if
+// it is one
+func parseVoiceRequest(from string, f *DataForm) *VoiceRequest {
+	if f.Type != "form" {
+		return nil
+	}
+	if t := f.Field("FORM_TYPE"); t == nil || t.Value() != NsMucRequest {
+		return nil
+	}
+	if role := f.Field("muc#role"); role != nil && role.Value() != "participant" {
+		return nil
+	}
+	r := &VoiceRequest{Room: bare(from)}
+	if nick := f.Field("muc#roomnick"); nick != nil {
+		r.Nick = nick.Value()
+	}
+	if jid := f.Field("muc#jid"); jid != nil {
+		r.Jid = jid.Value()
+	}
+	return r
+}
+
+// grantRequested grants voice for WithAutoGrantVoice
+func (c *Conn) grantRequested(r VoiceRequest) {
+	if err := c.GrantVoice(r.Room, r.Nick); err != nil {
+		c.reportError(err)
+	}
+}
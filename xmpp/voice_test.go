@@ -0,0 +1,78 @@
+package xmpp_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+const voiceRequest = "<message xmlns='jabber:client' from='room@conf.b'><x xmlns='jabber:x:data' type='form'>" +
+	"<field var='FORM_TYPE'><value>" + xmpp.NsMucRequest + "</value></field>" +
+	"<field var='muc#role'><value>participant</value></field>" +
+	"<field var='muc#roomnick'><value>newbie</value></field></x></message>"
+
+func TestAutoGrantVoice(t *testing.T) {
+	c, server := xmpptest.Pipe(xmpp.WithAutoGrantVoice())
+	defer server.Close()
+	requests := make(chan xmpp.VoiceRequest, 1)
+	c.HandleVoiceRequest(func(r xmpp.VoiceRequest) { requests <- r })
+	granted := make(chan *xmpp.Stanza, 1)
+	go io.WriteString(server, streamHeader+voiceRequest)
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		if s.Name.Local == "iq" {
+			granted <- s
+		}
+		return result(s)
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+
+	select {
+	case r := <-requests:
+		if r.Room != "room@conf.b" || r.Nick != "newbie" {
+			t.Errorf("request %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not handled")
+	}
+	select {
+	case s := <-granted:
+		if s.Attr["to"] != "room@conf.b" || !strings.Contains(string(s.Inner), "nick='newbie' role='participant'") {
+			t.Errorf("grant %s %s", s.Attr["to"], s.Inner)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("voice not granted")
+	}
+	io.WriteString(server, "</stream:stream>")
+	<-done
+	received()
+}
+
+func TestAutoGrantVoiceWithoutRun(t *testing.T) {
+	c, server := xmpptest.Pipe(xmpp.WithAutoGrantVoice())
+	defer server.Close()
+	var requests []xmpp.VoiceRequest
+	c.HandleVoiceRequest(func(r xmpp.VoiceRequest) { requests = append(requests, r) })
+	received := answer(c, server, func(s *xmpp.Stanza) string {
+		return voiceRequest + result(s)
+	})
+
+	// the request arrives while EntityTime reads the stream itself
+	if _, err := c.EntityTime("b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("handled %d requests, want 1", len(requests))
+	}
+	for _, s := range received() {
+		if strings.Contains(string(s.Inner), xmpp.NsMucAdmin) {
+			t.Errorf("voice granted without Run: %s", s.Inner)
+		}
+	}
+}
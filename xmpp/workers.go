@@ -0,0 +1,75 @@
+package xmpp
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// handlerPool runs handlers off the read loop on a fixed number of workers,
+// each sender's stanzas always on the same one so that they are handled in
+// the order they arrived. A worker's queue grows as far as it has to:
+// submit never waits, since a handler may itself be waiting on a reply that
+// only the read loop can deliver.
+type handlerPool struct {
+	mu      sync.Mutex
+	workers []poolWorker
+}
+
+// poolWorker is the queue of one of a pool's workers, along with whether a
+// goroutine is going to run it
+type poolWorker struct {
+	queue   []func()
+	running bool
+}
+
+func newHandlerPool(max int) *handlerPool {
+	return &handlerPool{workers: make([]poolWorker, max)}
+}
+
+// submit queues fn on sender's worker and starts the worker if it isn't
+// going
+func (p *handlerPool) submit(sender string, fn func()) {
+	h := fnv.New32a()
+	h.Write([]byte(sender))
+	i := int(h.Sum32() % uint32(len(p.workers)))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := &p.workers[i]
+	w.queue = append(w.queue, fn)
+	if !w.running {
+		w.running = true
+		go p.work(i)
+	}
+}
+
+// work runs worker i's queue until it is empty
+func (p *handlerPool) work(i int) {
+	for {
+		p.mu.Lock()
+		w := &p.workers[i]
+		if len(w.queue) == 0 {
+			w.running = false
+			p.mu.Unlock()
+			return
+		}
+		fn := w.queue[0]
+		w.queue[0] = nil
+		w.queue = w.queue[1:]
+		p.mu.Unlock()
+		fn()
+	}
+}
+
+// handle passes s to fn, on the handler pool with WithConcurrentHandlers
+// and otherwise there and then
+func (c *Conn) handle(s *Stanza, fn func(*Stanza)) {
+	if c.handlers == nil {
+		fn(s)
+		return
+	}
+	c.handlers.submit(foldBare(s.Attr["from"]), func() {
+		defer c.recoverHandler(s)
+		fn(s)
+	})
+}
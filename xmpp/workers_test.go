@@ -0,0 +1,146 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandlerPoolKeepsSenderOrder(t *testing.T) {
+	p := newHandlerPool(4)
+	var mu sync.Mutex
+	got := make(map[string][]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		sender := fmt.Sprintf("user%d@b", i%7)
+		n := i
+		wg.Add(1)
+		p.submit(sender, func() {
+			defer wg.Done()
+			mu.Lock()
+			got[sender] = append(got[sender], n)
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	for sender, ns := range got {
+		for i := 1; i < len(ns); i++ {
+			if ns[i] < ns[i-1] {
+				t.Fatalf("%s handled out of order: %v", sender, ns)
+			}
+		}
+	}
+}
+
+func TestHandlerPoolBoundsWorkers(t *testing.T) {
+	const max = 3
+	p := newHandlerPool(max)
+	var running, most int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		p.submit(fmt.Sprintf("user%d@b", i), func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+	if most > max {
+		t.Errorf("%d handlers ran at once, want at most %d", most, max)
+	}
+}
+
+func TestHandlerPoolNeverWaits(t *testing.T) {
+	p := newHandlerPool(1)
+	release := make(chan struct{})
+	var handled int32
+	p.submit("a@b", func() { <-release })
+
+	// a blocked handler doesn't hold up submitting however much queues
+	// behind it
+	submitted := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			p.submit("a@b", func() { atomic.AddInt32(&handled, 1) })
+		}
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("submit waited on a blocked handler")
+	}
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&handled) < 1000; {
+		if time.Now().After(deadline) {
+			t.Fatalf("handled %d of 1000 once released", atomic.LoadInt32(&handled))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrentHandlerWaitsOnIQ(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := NewConn(client, WithConcurrentHandlers(1))
+	const messages = 200
+	var handled int32
+	done := make(chan struct{})
+	c.HandleMessage(func(m *Message) {
+		// the reply comes after all the messages, so the read loop must get
+		// through them while this handler waits
+		if atomic.AddInt32(&handled, 1) == 1 {
+			if _, err := c.EntityTime("b"); err != nil {
+				t.Error(err)
+			}
+		}
+		if atomic.LoadInt32(&handled) == messages {
+			close(done)
+		}
+	})
+
+	go func() {
+		d := xml.NewDecoder(server)
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return
+			}
+			if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "iq" {
+				io.WriteString(server, "<iq xmlns='jabber:client' type='result' id='"+ToMap(start.Attr)["id"]+"'/>")
+			}
+		}
+	}()
+	go func() {
+		var b strings.Builder
+		b.WriteString("<stream:stream xmlns='jabber:client' xmlns:stream='" + NsStream + "' version='1.0' id='s1'>")
+		for i := 0; i < messages; i++ {
+			b.WriteString("<message from='a@b/r' type='chat'><body>hi</body></message>")
+		}
+		io.WriteString(server, b.String())
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handled %d of %d messages; the read loop is stuck behind the handler", atomic.LoadInt32(&handled), messages)
+	}
+}
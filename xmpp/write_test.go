@@ -0,0 +1,59 @@
+package xmpp_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+)
+
+// trickleConn accepts at most max bytes a write, or none at all with max 0
+type trickleConn struct {
+	mu  sync.Mutex
+	max int
+	out bytes.Buffer
+}
+
+func (c *trickleConn) Read([]byte) (int, error) { return 0, io.EOF }
+func (c *trickleConn) Close() error             { return nil }
+
+func (c *trickleConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(b) > c.max {
+		b = b[:c.max]
+	}
+	return c.out.Write(b)
+}
+
+func TestPartialWritesStayWhole(t *testing.T) {
+	rwc := &trickleConn{max: 3}
+	c := xmpp.NewConn(rwc)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.SendRaw("<presence><status>" + strings.Repeat("x", 50) + "</status></presence>"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := strings.Repeat("<presence><status>"+strings.Repeat("x", 50)+"</status></presence>", 20)
+	if got := rwc.out.String(); got != want {
+		t.Errorf("stanzas interleaved or cut:\n%s", got)
+	}
+}
+
+func TestZeroWrite(t *testing.T) {
+	c := xmpp.NewConn(&trickleConn{max: 0})
+	if err := c.SendRaw("<presence/>"); !errors.Is(err, xmpp.ErrShortWrite) {
+		t.Errorf("SendRaw returned %v, want ErrShortWrite", err)
+	}
+}
@@ -1,6 +1,9 @@
 package xmpp
 
 import (
+	"bufio"
+	"container/list"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/xml"
@@ -8,7 +11,11 @@ import (
 	"fmt"
 	"html"
 	"io"
+	"log"
 	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -24,25 +31,146 @@ const (
 	NsTLS = "urn:ietf:params:xml:ns:xmpp-tls"
 	// NsDisco is the constanct for nsdisco
 	NsDisco = "http://jabber.org/protocol/disco#items"
+	// NsDiscoInfo is the constant for service discovery info
+	NsDiscoInfo = "http://jabber.org/protocol/disco#info"
+	// NsCaps is the constant for entity capabilities
+	NsCaps = "http://jabber.org/protocol/caps"
 	// NsMuc is the constant for muc
 	NsMuc = "http://jabber.org/protocol/muc"
+	// NsMucAdmin is the constant for muc administration
+	NsMucAdmin = "http://jabber.org/protocol/muc#admin"
+	// NsMucRequest is the constant for muc voice requests
+	NsMucRequest = "http://jabber.org/protocol/muc#request"
+	// NsMucUser is the constant for muc#user
+	NsMucUser = "http://jabber.org/protocol/muc#user"
+	// NsCommands is the constant for ad-hoc commands
+	NsCommands = "http://jabber.org/protocol/commands"
+	// NsDataForms is the constant for data forms
+	NsDataForms = "jabber:x:data"
+	// NsSM is the constant for stream management
+	NsSM = "urn:xmpp:sm:3"
+	// NsVCard is the constant for vcard-temp
+	NsVCard = "vcard-temp"
+	// NsIqLast is the constant for last activity
+	NsIqLast = "jabber:iq:last"
+	// NsSID is the constant for unique and stable stanza ids
+	NsSID = "urn:xmpp:sid:0"
+	// NsCompress is the constant for stream compression
+	NsCompress = "http://jabber.org/protocol/compress"
+	// NsSASL is the constant for sasl
+	NsSASL = "urn:ietf:params:xml:ns:xmpp-sasl"
+	// NsBind is the constant for resource binding
+	NsBind = "urn:ietf:params:xml:ns:xmpp-bind"
+	// NsCorrect is the constant for last message correction
+	NsCorrect = "urn:xmpp:message-correct:0"
+	// NsPing is the constant for xmpp ping
+	NsPing = "urn:xmpp:ping"
+	// NsXHTMLIM is the constant for xhtml-im
+	NsXHTMLIM = "http://jabber.org/protocol/xhtml-im"
+	// NsXHTML is the constant for xhtml
+	NsXHTML = "http://www.w3.org/1999/xhtml"
+	// NsHipChat is the constant for hipchat's own extensions
+	NsHipChat = "http://hipchat.com"
+	// NsDelay is the constant for delayed delivery
+	NsDelay = "urn:xmpp:delay"
+	// NsTime is the constant for entity time
+	NsTime = "urn:xmpp:time"
+	// NsChatMarkers is the constant for chat markers
+	NsChatMarkers = "urn:xmpp:chat-markers:0"
+	// NsNick is the constant for user nicknames
+	NsNick = "http://jabber.org/protocol/nick"
+	// NsReactions is the constant for message reactions
+	NsReactions = "urn:xmpp:reactions:0"
+	// NsComponentAccept is the constant for external components
+	NsComponentAccept = "jabber:component:accept"
+	// NsSI is the constant for stream initiation
+	NsSI = "http://jabber.org/protocol/si"
+	// NsSIFileTransfer is the constant for stream initiation file transfer
+	NsSIFileTransfer = "http://jabber.org/protocol/si/profile/file-transfer"
+	// NsJingle is the constant for jingle
+	NsJingle = "urn:xmpp:jingle:1"
+	// NsJingleFileTransfer is the constant for jingle file transfer
+	NsJingleFileTransfer = "urn:xmpp:jingle:apps:file-transfer:5"
+	// NsReceipts is the constant for message delivery receipts
+	NsReceipts = "urn:xmpp:receipts"
+	// NsRegister is the constant for in-band registration
+	NsRegister = "jabber:iq:register"
+	// NsStreams is the constant for stream error conditions
+	NsStreams = "urn:ietf:params:xml:ns:xmpp-streams"
+	// NsVCardUpdate is the constant for vcard avatar updates
+	NsVCardUpdate = "vcard-temp:x:update"
 
 	xmlStream      = "<stream:stream from='%s' to='%s' version='1.0' xml:lang='en' xmlns='%s' xmlns:stream='%s'>"
 	xmlStartTLS    = "<starttls xmlns='%s'/>"
 	xmlIqSet       = "<iq type='set' id='%s'><query xmlns='%s'><username>%s</username><password>%s</password><resource>%s</resource></query></iq>"
 	xmlIqGet       = "<iq from='%s' to='%s' id='%s' type='get'><query xmlns='%s'/></iq>"
-	xmlPresence    = "<presence from='%s'><show>%s</show></presence>"
-	xmlMUCPart     = "<presence to='%s' type='unavailable'></presence>"
-	xmlMUCPresence = "<presence id='%s' to='%s' from='%s'><x xmlns='%s'/></presence>"
-	xmlMUCMessage  = "<message from='%s' id='%s' to='%s' type='%s'><body>%s</body></message>"
+	xmlIqQueryGet  = "<iq type='get' to='%s' id='%s'><query xmlns='%s'/></iq>"
+	xmlStreamClose = "</stream:stream>"
+	xmlPing        = "<iq type='get' id='%s'><ping xmlns='%s'/></iq>"
+	xmlMUCX        = "<x xmlns='%s'/>"
 )
 
 type required struct{}
 
-type features struct {
-	XMLName    xml.Name  `xml:"features"`
-	StartTLS   *required `xml:"starttls>required"`
-	Mechanisms []string  `xml:"mechanisms>mechanism"`
+// Features are the stream features a server offers, read afresh each time
+// the stream is restarted
+type Features struct {
+	XMLName         xml.Name       `xml:"features"`
+	StartTLS        *required      `xml:"starttls>required"`
+	Mechanisms      []string       `xml:"mechanisms>mechanism"`
+	SASLRequiredTag *required      `xml:"mechanisms>required"`
+	ChannelBindings []channelBind  `xml:"sasl-channel-binding>channel-binding"`
+	Bind            *featureMarker `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	SM              *featureMarker `xml:"urn:xmpp:sm:3 sm"`
+	IqAuth          *struct{}      `xml:"http://jabber.org/features/iq-auth auth"`
+	Compression     []string       `xml:"http://jabber.org/features/compress compression>method"`
+}
+
+// featureMarker is a stream feature that may be marked required or optional
+type featureMarker struct {
+	Required *required `xml:"required"`
+	Optional *required `xml:"optional"`
+}
+
+type channelBind struct {
+	Type string `xml:"type,attr"`
+}
+
+// SASLRequired reports whether the server offered sasl and requires it
+// rather than allowing it to be skipped
+func (f *Features) SASLRequired() bool {
+	return len(f.Mechanisms) > 0 && f.SASLRequiredTag != nil
+}
+
+// ChannelBindingTypes returns the sasl channel binding types the server
+// advertised, such as tls-exporter
+func (f *Features) ChannelBindingTypes() []string {
+	types := make([]string, 0, len(f.ChannelBindings))
+	for _, cb := range f.ChannelBindings {
+		types = append(types, cb.Type)
+	}
+	return types
+}
+
+// BindRequired reports whether the server offered resource binding without
+// marking it optional
+func (f *Features) BindRequired() bool {
+	return f.Bind != nil && f.Bind.Optional == nil
+}
+
+// StreamManagement reports whether the server offered stream management
+func (f *Features) StreamManagement() bool {
+	return f.SM != nil
+}
+
+// offers reports whether the server offered the sasl mechanism
+func (f *Features) offers(mechanism string) bool {
+	for _, m := range f.Mechanisms {
+		if m == mechanism {
+			return true
+		}
+	}
+	return false
 }
 
 type item struct {
@@ -54,10 +182,32 @@ type item struct {
 	NumParticipants string `xml:"x>num_participants"`
 	Owner           string `xml:"x>owner"`
 	Privacy         string `xml:"x>privacy"`
+	Subscription    string `xml:"subscription,attr"`
 	RoomId          string `xml:"x>id"`
 	Topic           string `xml:"x>topic"`
 }
 
+// ErrKeepAlivePayload is returned by KeepAlive when the configured payload
+// isn't whitespace and would corrupt the stream
+var ErrKeepAlivePayload = errors.New("keepalive payload must be whitespace")
+
+// ErrShortWrite is returned when a stanza could not be written in full
+var ErrShortWrite = errors.New("short write")
+
+// ErrInvalidXML is returned for an element the stream can't make sense of
+var ErrInvalidXML = errors.New("invalid xml response")
+
+// Errors returned by Auth for the conditions a legacy auth failure carries.
+// Other failures are returned as a *StanzaError.
+var (
+	// ErrNotAuthorized means the username or password was wrong
+	ErrNotAuthorized = errors.New("auth: not authorized")
+	// ErrConflict means the resource is already in use by another session
+	ErrConflict = errors.New("auth: resource conflict")
+	// ErrNotAcceptable means the server wanted credentials that weren't given
+	ErrNotAcceptable = errors.New("auth: not acceptable")
+)
+
 // Ack is a message ack
 type Ack struct {
 	Ack string `xml:"a"`
@@ -74,9 +224,163 @@ type body struct {
 
 // Conn represents a connection
 type Conn struct {
-	incoming *xml.Decoder
-	outgoing net.Conn
-	errchan  chan error
+	incoming  *xml.Decoder
+	outgoing  io.ReadWriteCloser
+	errchan   chan error
+	clock     Clock
+	tlsConfig *tls.Config
+	// tlsHandshakeTimeout bounds the tls handshake when set
+	tlsHandshakeTimeout time.Duration
+	// inbuf is what incoming reads from, kept so that what it has read
+	// ahead can still be got at once it is unusable
+	inbuf *bufio.Reader
+	// opts are the options the connection was made with, for Clone
+	opts []Option
+	// sni and alpn override the server name and protocols tls offers
+	sni  string
+	alpn []string
+	// serverFrom leaves the from attribute of messages and presence for the
+	// server to stamp
+	serverFrom bool
+
+	ignoreSelfEcho bool
+	// dedup drops messages SeenBefore reports, as set by WithDedupWindow
+	dedup bool
+
+	keepAlivePayload []byte
+	keepAlivePing    bool
+	// nagle leaves Nagle's algorithm on for dialed connections
+	nagle  bool
+	dialer *Dialer
+	// maxRedirects is how many see-other-host redirects Connect follows
+	maxRedirects int
+	// maxBodyBytes limits the escaped size of message bodies, cutting them
+	// short unless strictBodyLimit makes sends fail instead
+	maxBodyBytes    int
+	strictBodyLimit bool
+	escapeEmoticons bool
+	// iqTimeout bounds the wait for each iq reply, which is retried up to
+	// iqRetries times
+	iqTimeout time.Duration
+	iqRetries int
+	// loc is the location timestamps from the server are given in
+	loc *time.Location
+
+	lenient        bool
+	captureRaw     bool
+	probeOnConnect bool
+	directedOnly   bool
+	rejoinDelays   []time.Duration
+	markable       bool
+	charsetReader  func(charset string, input io.Reader) (io.Reader, error)
+	// nick is the friendly name set by WithNick
+	nick string
+	// autoVoice grants voice requests, as set by WithAutoGrantVoice
+	autoVoice bool
+
+	// raw records the stream for WithRawXML, and rawStart is where the
+	// element last returned by Next began
+	raw      *rawReader
+	rawStart int64
+
+	mu       sync.Mutex
+	mentions map[string]string
+	// roster caches the roster by bare jid, kept current by roster pushes
+	roster map[string]RosterEntry
+	// presences holds the last presence of each contact by bare jid
+	presences map[string]ContactPresence
+	// directed holds the bare jids of users sent directed presence under
+	// WithDirectedPresenceOnly, and show and status the availability last
+	// set
+	directed map[string]bool
+	show     string
+	status   string
+	// statusSent is when UpdateStatus last sent presence, and statusPending
+	// is set while a later update waits its turn
+	statusSent    time.Time
+	statusPending bool
+	// avatarHash is the sha1 of the photo set with SetAvatar
+	avatarHash  string
+	mentionName string
+
+	jid      string
+	host     string
+	user     string
+	pass     string
+	resource string
+	rooms    map[string]joinedRoom
+	// occupants holds the last presence of everyone in each muc by nick
+	occupants map[string]map[string]Occupant
+	features  *Features
+	// streamID, streamFrom and streamVersion are from the server's stream
+	// header
+	streamID      string
+	streamFrom    string
+	streamVersion string
+	// allowLegacy lets Connect go on with a server predating xmpp 1.0
+	allowLegacy bool
+	// streamFeatures is the order set by WithStreamFeatures
+	streamFeatures []string
+	// floodRate and floodBurst are the inbound rate limit per sender, and
+	// floodBuckets the senders' token buckets, most recently used first in
+	// floodOrder
+	floodRate    float64
+	floodBurst   int
+	floodBuckets map[string]*floodBucket
+	floodOrder   *list.List
+	floodHandler func(string)
+	// logger and label are set by WithLogger and WithLabel
+	logger *log.Logger
+	label  string
+	// restarted is set once the stream has been restarted after sasl, when
+	// the resource may be bound
+	restarted bool
+
+	// wmu serializes writes. smu guards the stream management state, apart
+	// from wmu so that reading is never held up by a blocked write.
+	wmu sync.Mutex
+	smu sync.Mutex
+	sm  *streamManagement
+
+	qmu   sync.RWMutex
+	queue *sendQueue
+
+	running bool
+	waiters []*waiter
+	// peerClosed is closed once the server ends the current stream, and
+	// closeSent is set once the connection has ended it from its side
+	peerClosed chan struct{}
+	closeSent  bool
+	discoItems []DiscoItem
+	// discoIdentities and discoFeatures are what SetDiscoInfo added to the
+	// connection's disco#info
+	discoIdentities []Identity
+	discoFeatures   []string
+
+	// handlers runs the handlers with WithConcurrentHandlers
+	handlers *handlerPool
+
+	unknownHandler      func(xml.StartElement, []byte)
+	middleware          []func(Stanza) (Stanza, bool)
+	panicHandler        func(interface{}, []byte)
+	messageHandler      func(*Message)
+	roomHandlers        map[string]func(*Message)
+	messageErrorHandler func(*MessageError)
+	bodylessHandler     func(*Message)
+	iqHandler           func(*IQ)
+	roomEventHandler    func(RoomEvent)
+	rosterHandler       func(RosterEntry, ChangeKind)
+	subjectHandler      func(SubjectChange)
+	reactionHandler     func(Reaction)
+	voiceRequestHandler func(VoiceRequest)
+	fileOfferHandler    func(FileOffer) bool
+
+	// outbox persists messages until their delivery is confirmed
+	outbox OutboxStore
+
+	seen    *idCache
+	stamped *idCache
+	stats   connStats
 }
 
 // Message represents a message
@@ -84,44 +388,171 @@ type Message struct {
 	Jid         string
 	MentionName string
 	Body        string
+	// HasBody is false when the message had no body element at all, as
+	// opposed to an empty one
+	HasBody bool
+	// Bodies holds the body in each language by xml:lang when the message
+	// has more than one. Body is then the one without a language of its
+	// own, or failing that the first.
+	Bodies   map[string]string
+	To       string
+	Type     string
+	ID       string
+	OriginID string
+	StanzaID string
+	// ReplaceID is the id of the earlier message this one corrects
+	ReplaceID string
+	// Thread is the id of the conversation thread the message is part of,
+	// and ThreadParent that of the thread it branched off from
+	Thread       string
+	ThreadParent string
+	// Subject is the new subject of a room
+	Subject string
+	// Nick is the friendly name the sender gave for themselves, which for
+	// a room occupant isn't their nick in the room
+	Nick string
+	// Delay is when a delayed message was originally sent, and zero for
+	// messages delivered live
+	Delay time.Time
+	// RawXML is the message exactly as received, with WithRawXML
+	RawXML []byte
+	// Markable is set when the sender wants chat markers for the message
+	Markable bool
+	// Marker is the chat marker the message carries, such as "displayed",
+	// and MarkerID the id of the message it marks
+	Marker   string
+	MarkerID string
+	// ReceiptID is the id of the message a delivery receipt confirms
+	ReceiptID string
+
+	// me is the mention name of the connection that received the message
+	me string
+	// fromRoom is set when the message came from a muc or one of its
+	// occupants
+	fromRoom bool
+	// reaction is the reaction the message carries, if any
+	reaction *Reaction
+	// voiceRequest is the voice request the message makes, if any
+	voiceRequest *VoiceRequest
 }
 
-// Stream is the stream function on a connection
+// Stream opens the stream and reads the server's opening tag in reply, so
+// that the next element read is the stream features
 func (c *Conn) Stream(jid, host string) {
-	if _, err := fmt.Fprintf(c.outgoing, xmlStream, jid, host, NsJabberClient, NsStream); err != nil {
-		c.errchan <- err
+	c.mu.Lock()
+	c.jid, c.host = jid, host
+	c.mu.Unlock()
+	if err := c.send(xmlStream, jid, host, NsJabberClient, NsStream); err != nil {
+		c.reportError(err)
+		return
+	}
+	// Next reports its own errors
+	element, err := c.Next()
+	if err != nil {
+		return
+	}
+	if element.Name.Local != "stream" || element.Name.Space != NsStream {
+		c.reportError(ErrInvalidXML)
+		return
 	}
+	c.streamOpened(ToMap(element.Attr))
+}
+
+// StreamID returns the id the server gave the current stream
+func (c *Conn) StreamID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streamID
+}
+
+// StreamVersion returns the xmpp version the server gave in the current
+// stream's header, which is "" for servers older than 1.0
+func (c *Conn) StreamVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streamVersion
+}
+
+// streamOpened records the attributes of the server's stream header
+func (c *Conn) streamOpened(attr map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.streamID, c.streamFrom, c.streamVersion = attr["id"], attr["from"], attr["version"]
 }
 
 // StartTLS is the tls start function on a connection
 func (c *Conn) StartTLS() {
-	if _, err := fmt.Fprintf(c.outgoing, xmlStartTLS, NsTLS); err != nil {
-		c.errchan <- err
+	if err := c.send(xmlStartTLS, NsTLS); err != nil {
+		c.reportError(err)
 	}
 }
 
-// UseTLS uses TLS with the specified host
+// UseTLS uses TLS with the specified host, applying WithTLSConfig, WithSNI
+// and WithALPN if they were given
 func (c *Conn) UseTLS(host string) {
-	c.outgoing = tls.Client(c.outgoing, &tls.Config{ServerName: host})
-	c.incoming = xml.NewDecoder(c.outgoing)
+	c.UseTLSConfig(c.tlsConfigFor(host))
 }
 
-// Auth authentications with given credentials as a resource
-func (c *Conn) Auth(user, pass, resource string) {
-	if _, err := fmt.Fprintf(c.outgoing, xmlIqSet, id(), NsIqAuth, user, pass, resource); err != nil {
-		c.errchan <- err
+// UseTLSConfig uses TLS with the given config, such as one carrying a
+// client certificate for ExternalAuth
+func (c *Conn) UseTLSConfig(config *tls.Config) {
+	if err := c.startTLS(config); err != nil {
+		c.reportError(err)
+	}
+}
+
+// startTLS switches the connection to tls. With WithTLSHandshakeTimeout the
+// handshake is made at once, within the timeout; otherwise it happens with
+// the first read or write.
+func (c *Conn) startTLS(config *tls.Config) error {
+	conn, ok := c.outgoing.(net.Conn)
+	if !ok {
+		return errors.New("tls requires a net.Conn")
 	}
+	tc := tls.Client(conn, config)
+	c.outgoing = tc
+	c.incoming = c.newDecoder(c.outgoing)
+	if c.tlsHandshakeTimeout <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.tlsHandshakeTimeout)
+	defer cancel()
+	return tc.HandshakeContext(ctx)
+}
+
+// Auth authenticates with given credentials as a resource using legacy
+// jabber:iq:auth, and waits for the server's answer. A rejection is returned
+// as ErrNotAuthorized, ErrConflict or ErrNotAcceptable where the condition
+// is one of those, and as a *StanzaError otherwise.
+func (c *Conn) Auth(user, pass, resource string) error {
+	c.mu.Lock()
+	c.user, c.pass, c.resource = user, pass, resource
+	c.mu.Unlock()
+	return c.legacyAuth(user, pass, resource)
 }
 
 // Features returns features
-func (c *Conn) Features() *features {
-	var f features
+func (c *Conn) Features() *Features {
+	var f Features
 	if err := c.incoming.DecodeElement(&f, nil); err != nil {
-		c.errchan <- err
+		c.reportError(err)
 	}
+	c.mu.Lock()
+	c.features = &f
+	c.mu.Unlock()
 	return &f
 }
 
+// ServerFeatures returns the features the server offered on the current
+// stream, or nil before any have been read. They are replaced each time the
+// stream restarts, after starttls and after sasl, so they reflect what the
+// server offers now rather than what it offered first.
+func (c *Conn) ServerFeatures() *Features {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.features
+}
+
 // Next reads the next message from a stream
 func (c *Conn) Next() (xml.StartElement, error) {
 
@@ -129,27 +560,53 @@ func (c *Conn) Next() (xml.StartElement, error) {
 		var element xml.StartElement
 		var err error
 		var t xml.Token
+		start := c.incoming.InputOffset()
 		t, err = c.incoming.Token()
 		if err != nil {
-			c.errchan <- err
+			err = readError(err)
+			c.reportError(err)
 			return element, err
 		}
 
 		switch t := t.(type) {
 		case xml.StartElement:
 			element = t
+			c.rawStart = start
 			if element.Name.Local == "" {
-				return element, errors.New("invalid xml response")
+				if !c.lenient {
+					return element, ErrInvalidXML
+				}
+				c.reportError(ErrInvalidXML)
+				if err := c.incoming.Skip(); err != nil {
+					return element, err
+				}
+				continue
 			}
 			return element, nil
+		case xml.EndElement:
+			if t.Name.Local == "stream" && t.Name.Space == NsStream {
+				c.streamEnded()
+				return element, ErrStreamClosed
+			}
 		}
 	}
 }
 
+// streamEnded records that the server sent its closing stream tag
+func (c *Conn) streamEnded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.peerClosed:
+	default:
+		close(c.peerClosed)
+	}
+}
+
 // Discover discovers
 func (c *Conn) Discover(from, to string) {
-	if _, err := fmt.Fprintf(c.outgoing, xmlIqGet, from, to, id(), NsDisco); err != nil {
-		c.errchan <- err
+	if err := c.send(xmlIqGet, from, to, id(), NsDisco); err != nil {
+		c.reportError(err)
 	}
 }
 
@@ -157,7 +614,7 @@ func (c *Conn) Discover(from, to string) {
 func (c *Conn) Body() string {
 	b := new(body)
 	if err := c.incoming.DecodeElement(b, nil); err != nil {
-		c.errchan <- err
+		c.reportError(err)
 	}
 	return b.Body
 }
@@ -166,43 +623,202 @@ func (c *Conn) Body() string {
 func (c *Conn) Query() *query {
 	q := new(query)
 	if err := c.incoming.DecodeElement(q, nil); err != nil {
-		c.errchan <- err
+		c.reportError(err)
+	}
+	if q.XMLName.Space == NsIqRoster {
+		c.setRoster(q.Items)
 	}
 	return q
 }
 
-// Presence sets a presence
+// Presence sets a presence, keeping any status set with UpdateStatus
 func (c *Conn) Presence(jid, pres string) {
-	if _, err := fmt.Fprintf(c.outgoing, xmlPresence, jid, pres); err != nil {
-		c.errchan <- err
+	if c.directedOnly {
+		if err := c.directedPresence(jid, pres); err != nil {
+			c.reportError(err)
+		}
+		return
+	}
+	c.mu.Lock()
+	c.show = pres
+	c.mu.Unlock()
+	if err := c.encode(c.ownPresence(jid, "")); err != nil {
+		c.reportError(err)
 	}
 }
 
 // MUCPart leaves a muc
 func (c *Conn) MUCPart(roomId string) {
-	if _, err := fmt.Fprintf(c.outgoing, xmlMUCPart, roomId); err != nil {
-		c.errchan <- err
+	c.mu.Lock()
+	delete(c.rooms, foldBare(roomId))
+	delete(c.occupants, foldBare(roomId))
+	c.mu.Unlock()
+	if err := c.encode(&outPresence{To: roomId, Type: "unavailable"}); err != nil {
+		c.reportError(err)
 	}
 }
 
 // MUCPresence sets a muc presence
 func (c *Conn) MUCPresence(roomId, jid string) {
-	if _, err := fmt.Fprintf(c.outgoing, xmlMUCPresence, id(), roomId, jid, NsMuc); err != nil {
-		c.errchan <- err
+	c.joined(bare(roomId), resource(roomId), JoinOptions{})
+	p := &outPresence{ID: id(), To: roomId, From: c.fromJID(jid), Payload: []byte(fmt.Sprintf(xmlMUCX, NsMuc))}
+	if err := c.encode(p); err != nil {
+		c.reportError(err)
 	}
 }
 
 // MUCSend sends a message to a muc
 func (c *Conn) MUCSend(mtype, to, from, body string) {
-	if _, err := fmt.Fprintf(c.outgoing, xmlMUCMessage, from, id(), to, mtype, html.EscapeString(body)); err != nil {
-		c.errchan <- err
+	if _, err := c.MUCSendWithID(mtype, to, from, body); err != nil {
+		c.reportError(err)
+	}
+}
+
+// MUCSendWithID sends a message like MUCSend, returning the id it was sent
+// with so that receipts, markers and corrections can refer back to it
+func (c *Conn) MUCSendWithID(mtype, to, from, body string) (string, error) {
+	msgID := id()
+	return msgID, c.MUCSendID(msgID, mtype, to, from, body)
+}
+
+// MUCSendID sends a message like MUCSend with an id of the caller's
+// choosing, which should be unique
+func (c *Conn) MUCSendID(msgID, mtype, to, from, body string) error {
+	if mtype == "chat" {
+		if err := c.presentTo(to); err != nil {
+			return err
+		}
+	}
+	return c.encode(c.chatWithID(msgID, to, from, mtype, body))
+}
+
+// SendHeadline sends body as a headline, for announcements that clients
+// neither store nor expect replies to. Headlines received are passed to the
+// message handler with a Type of "headline", which bots should take as a
+// sign not to answer.
+func (c *Conn) SendHeadline(to, from, body string) error {
+	return c.encode(c.chat(to, from, "headline", body))
+}
+
+// Mention sends body to a muc prefixed with an @mention for each user in
+// mentions and flags the message so hipchat notifies them. Mentions are
+// resolved by mention name or jid against the last roster received; anything
+// unresolved (including @all and @here) is sent as given.
+func (c *Conn) Mention(roomJID, from, body string, mentions []string) error {
+	tokens := make([]string, 0, len(mentions)+1)
+	for _, m := range mentions {
+		tokens = append(tokens, "@"+c.resolveMention(m))
+	}
+	tokens = append(tokens, body)
+	text := strings.Join(tokens, " ")
+	msgID := id()
+	payload := fmt.Sprintf(xmlHipChatX, NsHipChat, "<notify>1</notify>", "") + c.stampOrigin(msgID)
+	return c.encode(&outMessage{From: c.fromJID(from), ID: msgID, To: roomJID, Type: "groupchat", Body: &text, Payload: []byte(payload)})
+}
+
+func (c *Conn) resolveMention(m string) string {
+	m = strings.TrimPrefix(m, "@")
+	key := strings.ToLower(m)
+	if strings.Contains(m, "@") {
+		key = foldBare(m)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if name, ok := c.mentions[key]; ok {
+		return name
+	}
+	return m
+}
+
+// GoOffline leaves every room the connection is in and then broadcasts
+// unavailable presence, giving status as the reason. Errors are collected so
+// that one failed write doesn't stop the rest being sent.
+func (c *Conn) GoOffline(status string) error {
+	c.mu.Lock()
+	to := make([]string, 0, len(c.rooms))
+	for jid, r := range c.rooms {
+		to = append(to, jid+"/"+r.nick)
+	}
+	for jid := range c.directed {
+		to = append(to, jid)
+	}
+	c.rooms, c.directed, c.occupants = nil, nil, nil
+	c.mu.Unlock()
+
+	var errs []error
+	for _, jid := range to {
+		if err := c.encode(&outPresence{To: jid, Type: "unavailable", Status: status}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if !c.directedOnly {
+		if err := c.encode(&outPresence{Type: "unavailable", Status: status}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LeaveAll parts every room the connection is in, giving reason as the
+// status each room shows with the departure, and then goes offline. It is
+// GoOffline under the name shutdown code tends to look for.
+func (c *Conn) LeaveAll(reason string) error {
+	return c.GoOffline(reason)
+}
+
+// Close ends the stream and closes the connection. Call GoOffline first to
+// leave with a status.
+func (c *Conn) Close() error {
+	err := c.sendStreamClose()
+	c.flushQueue()
+	if cerr := c.outgoing.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Shutdown ends the stream like Close, but waits for the server to close its
+// side of the stream before closing the connection, so whatever the server
+// still had queued is read and dispatched. If ctx is done first the
+// connection is closed anyway and ctx's error is returned.
+func (c *Conn) Shutdown(ctx context.Context) error {
+	err := c.sendStreamClose()
+	c.flushQueue()
+	if err == nil {
+		c.mu.Lock()
+		running, closed := c.running, c.peerClosed
+		c.mu.Unlock()
+		if !running {
+			go c.drainStream()
+		}
+		select {
+		case <-closed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if cerr := c.outgoing.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// drainStream dispatches stanzas until the stream ends, standing in for Run while
+// Shutdown waits for the server
+func (c *Conn) drainStream() {
+	for {
+		s, err := c.readStanza()
+		if err != nil {
+			return
+		}
+		c.dispatch(s)
 	}
 }
 
 // Roster gets the roster
 func (c *Conn) Roster(from, to string) {
-	if _, err := fmt.Fprintf(c.outgoing, xmlIqGet, from, to, id(), NsIqRoster); err != nil {
-		c.errchan <- err
+	if err := c.send(xmlIqGet, from, to, id(), NsIqRoster); err != nil {
+		c.reportError(err)
 	}
 }
 
@@ -210,32 +826,201 @@ func (c *Conn) Roster(from, to string) {
 // we exit here to allow for handling of cases where we can't write to the xmpp server
 // so the user can decide
 func (c *Conn) KeepAlive() error {
-	if _, err := fmt.Fprintf(c.outgoing, " "); err != nil {
+	if c.keepAlivePing {
+		pingID := id()
+		c.countPing(pingID)
+		return c.send(xmlPing, pingID, NsPing)
+	}
+	if c.keepAlivePayload == nil {
+		return c.write([]byte(" "))
+	}
+	if !isWhitespace(c.keepAlivePayload) {
+		return ErrKeepAlivePayload
+	}
+	return c.write(append([]byte(nil), c.keepAlivePayload...))
+}
+
+// isWhitespace reports whether b holds only the whitespace allowed between
+// stanzas
+func isWhitespace(b []byte) bool {
+	for _, ch := range b {
+		if ch != ' ' && ch != '\t' && ch != '\r' && ch != '\n' {
+			return false
+		}
+	}
+	return true
+}
+
+// KeepAliveEvery calls KeepAlive at every interval until it fails,
+// returning the error
+func (c *Conn) KeepAliveEvery(interval time.Duration) error {
+	t := c.clock.NewTicker(interval)
+	defer t.Stop()
+	for range t.C() {
+		if err := c.KeepAlive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send writes the formatted stanza to the connection, retrying until all of
+// it has been written so that a partial stanza never reaches the server
+// interleaved with another
+func (c *Conn) send(format string, a ...interface{}) error {
+	return c.write([]byte(fmt.Sprintf(format, a...)))
+}
+
+// write sends b as is, or queues it for the writer goroutine when the send
+// queue is enabled. A message the queue turns away is dropped from the
+// outbox again, since the caller is told it wasn't sent.
+func (c *Conn) write(b []byte) error {
+	msgID, err := c.persist(b)
+	if err != nil {
 		return err
 	}
+	err = c.enqueue(b)
+	if err == ErrQueueFull && msgID != "" {
+		c.confirm(msgID)
+	}
+	return err
+}
+
+// enqueue is write without the outbox
+func (c *Conn) enqueue(b []byte) error {
+	c.qmu.RLock()
+	defer c.qmu.RUnlock()
+	if c.queue != nil {
+		select {
+		case c.queue.ch <- b:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+	return c.writeNow(b)
+}
+
+// writeNow writes b to the connection, keeping a copy of it until it is
+// acked when stream management is enabled
+func (c *Conn) writeNow(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.smu.Lock()
+	managed := c.sm != nil
+	if managed && isStanza(b) {
+		c.sm.sent(b)
+	}
+	c.smu.Unlock()
+	c.countSent(b)
+	if c.logger != nil {
+		c.logf("send: %s", b)
+	}
+	for rest := b; len(rest) > 0; {
+		n, err := c.outgoing.Write(rest)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrShortWrite
+		}
+		rest = rest[n:]
+	}
+	if !managed {
+		c.written(b)
+	}
 	return nil
 }
 
+// reportError passes err to the error channel, if one has been set
+func (c *Conn) reportError(err error) {
+	if c.errchan != nil {
+		c.errchan <- err
+	}
+}
+
 // SetErrorChannel sets the channel for handling errors
 func (c *Conn) SetErrorChannel(channel chan error) {
 	c.errchan = channel
 }
 
 // Dial dials an xmpp host
-func Dial(host string) (*Conn, error) {
-	c := new(Conn)
-	outgoing, err := net.Dial("tcp", host+":5222")
+func Dial(host string, opts ...Option) (*Conn, error) {
+	c := newConn(opts)
+	outgoing, err := c.dial(host + ":5222")
 
 	if err != nil {
 		return c, err
 	}
 
 	c.outgoing = outgoing
-	c.incoming = xml.NewDecoder(outgoing)
+	c.incoming = c.newDecoder(outgoing)
+	c.host = host
 
 	return c, nil
 }
 
+// dial connects to addr over tcp, through the connection's Dialer if it has
+// one, setting TCP_NODELAY as WithNoDelay asks
+func (c *Conn) dial(addr string) (net.Conn, error) {
+	d := c.dialer
+	if d == nil {
+		d = &Dialer{}
+	}
+	conn, err := d.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		if err := tcp.SetNoDelay(!c.nagle); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// newDecoder creates the decoder for reading the stream from r
+func (c *Conn) newDecoder(r io.Reader) *xml.Decoder {
+	if c.captureRaw {
+		c.raw = &rawReader{r: r}
+		r = c.raw
+	}
+	// a reader that is an io.ByteReader is used as is, leaving no buffer
+	// inside the decoder
+	c.inbuf = bufio.NewReader(r)
+	d := xml.NewDecoder(c.inbuf)
+	d.CharsetReader = c.charsetReader
+	d.Strict = !c.lenient
+	c.mu.Lock()
+	c.peerClosed = make(chan struct{})
+	c.mu.Unlock()
+	return d
+}
+
+// NewConn creates a connection over an already established stream, such as
+// one end of a net.Pipe in tests
+func NewConn(rwc io.ReadWriteCloser, opts ...Option) *Conn {
+	c := newConn(opts)
+	c.outgoing = rwc
+	c.incoming = c.newDecoder(rwc)
+	return c
+}
+
+func newConn(opts []Option) *Conn {
+	c := &Conn{
+		clock:   realClock{},
+		loc:     time.UTC,
+		seen:    newIDCache(defaultIDCacheSize),
+		stamped: newIDCache(defaultIDCacheSize),
+		opts:    opts,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
 // ToMap converts an xmpp message's xml to a map
 func ToMap(attr []xml.Attr) map[string]string {
 	m := make(map[string]string)
@@ -246,6 +1031,47 @@ func ToMap(attr []xml.Attr) map[string]string {
 	return m
 }
 
+// bare strips the resource from a jid
+func bare(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[:i]
+	}
+	return jid
+}
+
+// resource returns the resource part of a jid
+func resource(jid string) string {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[i+1:]
+	}
+	return ""
+}
+
+// optAttr renders an escaped attribute, or nothing when value is empty
+func optAttr(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	return fmt.Sprintf(" %s='%s'", name, html.EscapeString(value))
+}
+
+// from renders the from attribute for an outgoing message or presence
+func (c *Conn) from(jid string) string {
+	if c.serverFrom {
+		return ""
+	}
+	return optAttr("from", jid)
+}
+
+// optElement renders an element holding escaped text, or nothing when
+// text is empty
+func optElement(name, text string) string {
+	if text == "" {
+		return ""
+	}
+	return fmt.Sprintf("<%s>%s</%s>", name, html.EscapeString(text), name)
+}
+
 func id() string {
 	b := make([]byte, 8)
 	if _, err := io.ReadFull(rand.Reader, b); err != nil {
@@ -0,0 +1,62 @@
+package xmpptest_test
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func ExampleServer() {
+	srv := xmpptest.NewServer("chat.hipchat.com")
+	srv.Users = map[string]string{"1_1": "secret"}
+	c, err := xmpp.ConnectOver(srv.Pipe(), "chat.hipchat.com", "1_1", "secret", "bot")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer c.Close()
+	fmt.Println(c.JID())
+
+	if err := c.JoinRoom("1_ops@conf.hipchat.com", "Deploy Bot", xmpp.JoinOptions{}); err != nil {
+		fmt.Println(err)
+		return
+	}
+	c.MUCSend("groupchat", "1_ops@conf.hipchat.com", "", "deploy done")
+	// the server answers in order, so once the roster is back it has read
+	// the message too
+	if _, err := c.GetRoster(); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, m := range srv.ReceivedNamed("message") {
+		var body struct {
+			Text string `xml:"body"`
+		}
+		xml.Unmarshal(append(append([]byte("<message>"), m.Inner...), "</message>"...), &body)
+		fmt.Println(m.Attr["to"], body.Text)
+	}
+	// Output:
+	// 1_1@chat.hipchat.com/bot
+	// 1_ops@conf.hipchat.com deploy done
+}
+
+func ExamplePipe() {
+	c, server := xmpptest.Pipe()
+	defer server.Close()
+	go io.WriteString(server, "<stream:features xmlns:stream='http://etherx.jabber.org/streams'>"+
+		"<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>SCRAM-SHA-1</mechanism><mechanism>PLAIN</mechanism><required/></mechanisms>"+
+		"<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><optional/></bind>"+
+		"<sm xmlns='urn:xmpp:sm:3'/>"+
+		"</stream:features>")
+
+	f := c.Features()
+	fmt.Println(f.Mechanisms, f.SASLRequired())
+	fmt.Println(f.BindRequired(), f.StreamManagement())
+	// Output:
+	// [SCRAM-SHA-1 PLAIN] true
+	// false true
+}
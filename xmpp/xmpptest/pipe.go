@@ -0,0 +1,25 @@
+package xmpptest
+
+import (
+	"net"
+
+	"github.com/lusis/hipchat/xmpp"
+)
+
+// Pipe returns a Conn over one end of a net.Pipe and the other end, for a
+// test to play the server on by hand: reading what the Conn sends and
+// writing the replies a single method needs, without the handshake Server
+// goes through. The pipe is unbuffered, so replies must be written from
+// another goroutine than the one calling the Conn, and whatever the Conn
+// writes must be read. For example, to check how features are parsed:
+//
+//	c, server := xmpptest.Pipe()
+//	defer server.Close()
+//	go io.WriteString(server, "<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>")
+//	if f := c.Features(); f.Bind == nil {
+//		t.Error("bind not offered")
+//	}
+func Pipe(opts ...xmpp.Option) (client *xmpp.Conn, server net.Conn) {
+	clientSide, server := net.Pipe()
+	return xmpp.NewConn(clientSide, opts...), server
+}
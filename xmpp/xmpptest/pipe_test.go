@@ -0,0 +1,32 @@
+package xmpptest_test
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/lusis/hipchat/xmpp"
+	"github.com/lusis/hipchat/xmpp/xmpptest"
+)
+
+func TestPipeAppliesOptions(t *testing.T) {
+	var buf bytes.Buffer
+	c, server := xmpptest.Pipe(xmpp.WithLogger(log.New(&buf, "", 0)), xmpp.WithLabel("bot1"))
+	sent := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(server)
+		sent <- string(b)
+	}()
+	if err := c.SendRaw("<presence/>"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got := <-sent; !strings.HasPrefix(got, "<presence/>") {
+		t.Errorf("server end read %q", got)
+	}
+	if !strings.Contains(buf.String(), "[bot1] send: <presence/>") {
+		t.Errorf("options not applied, logged:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,441 @@
+// Package xmpptest provides an in-memory xmpp server for testing code built
+// on the xmpp package without a live HipChat. It speaks just enough of the
+// protocol for a Conn to connect: the stream header and features, optional
+// tls and zlib compression, sasl PLAIN or legacy auth, resource binding, an empty roster,
+// stream management with resumption and echoing muc joins and groupchat
+// messages. It is meant for tests only.
+package xmpptest
+
+import (
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/lusis/hipchat/xmpp"
+)
+
+const (
+	xmlStream       = "<stream:stream from='%s' id='%s' version='1.0' xmlns='%s' xmlns:stream='%s'>"
+	xmlFeatures     = "<stream:features>%s</stream:features>"
+	xmlStartTLS     = "<starttls xmlns='%s'><required/></starttls>"
+	xmlMechanisms   = "<mechanisms xmlns='%s'><mechanism>PLAIN</mechanism></mechanisms>"
+	xmlBind         = "<bind xmlns='%s'/>"
+	xmlCompression  = "<compression xmlns='http://jabber.org/features/compress'><method>zlib</method></compression>"
+	xmlProceed      = "<proceed xmlns='%s'/>"
+	xmlCompressed   = "<compressed xmlns='%s'/>"
+	xmlSuccess      = "<success xmlns='%s'/>"
+	xmlFailure      = "<failure xmlns='%s'><not-authorized/></failure>"
+	xmlBindResult   = "<iq type='result' id='%s'><bind xmlns='%s'><jid>%s</jid></bind></iq>"
+	xmlResult       = "<iq type='result' id='%s'/>"
+	xmlRosterResult = "<iq type='result' id='%s'><query xmlns='%s'/></iq>"
+	xmlSelfPresence = "<presence from='%s' to='%s'><x xmlns='%s'><item affiliation='none' role='participant'/><status code='110'/></x></presence>"
+	xmlEcho         = "<message from='%s' to='%s' type='groupchat' id='%s'><body>%s</body></message>"
+	xmlStreamClose  = "</stream:stream>"
+	xmlSMEnabled    = "<enabled xmlns='%s' id='%s' resume='true'/>"
+	xmlSMResumed    = "<resumed xmlns='%s' previd='%s' h='%d'/>"
+	xmlSMFailed     = "<failed xmlns='%s'/>"
+	xmlSMAck        = "<a xmlns='%s' h='%d'/>"
+)
+
+// sendBuffer is how many writes a session holds for the client before the
+// server blocks, standing in for a socket's buffer
+const sendBuffer = 1024
+
+// Server is a scripted xmpp server. Its exported fields must be set before
+// it starts serving.
+type Server struct {
+	// Domain is the domain the server claims to be
+	Domain string
+	// Users holds the passwords of the accounts allowed to log in. When nil
+	// any credentials are accepted.
+	Users map[string]string
+	// TLSConfig, when set, makes the server require starttls
+	TLSConfig *tls.Config
+	// Compression makes the server offer zlib stream compression, once
+	// the stream is under tls if TLSConfig is set
+	Compression bool
+	// NoResume makes the server refuse to resume stream management
+	// sessions, as if they had expired
+	NoResume bool
+
+	mu       sync.Mutex
+	received []*xmpp.Stanza
+	// handled counts the stanzas received in each stream management
+	// session by id
+	handled map[string]*uint32
+}
+
+// NewServer creates a server for domain that accepts any credentials
+func NewServer(domain string) *Server {
+	return &Server{Domain: domain}
+}
+
+// Pipe starts serving one end of a net.Pipe and returns the other for a
+// client to connect over
+func (s *Server) Pipe() net.Conn {
+	client, server := net.Pipe()
+	go s.Serve(server)
+	return client
+}
+
+// Listen accepts connections on l, serving each until l is closed
+func (s *Server) Listen(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.Serve(conn)
+	}
+}
+
+// Received returns every stanza clients have sent so far
+func (s *Server) Received() []*xmpp.Stanza {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*xmpp.Stanza(nil), s.received...)
+}
+
+// ReceivedNamed returns the stanzas clients have sent with the given local
+// name, such as "message"
+func (s *Server) ReceivedNamed(local string) []*xmpp.Stanza {
+	var named []*xmpp.Stanza
+	for _, st := range s.Received() {
+		if st.Name.Local == local {
+			named = append(named, st)
+		}
+	}
+	return named
+}
+
+// session is the state of one client connection
+type session struct {
+	*Server
+	conn     net.Conn
+	incoming *xml.Decoder
+	tls      bool
+	// compressed is set once the stream is compressed
+	compressed bool
+	user       string
+	authed     bool
+	jid        string
+	streams    int
+	// smID is the stream management session the connection is in, if any
+	smID string
+	// out carries what the server writes to the goroutine writing it to
+	// conn, so that the server keeps reading while the client writes
+	out chan outgoing
+	// werr is the first error writing to conn
+	werr error
+}
+
+// outgoing is a write for a session's writer. When done is set the writer
+// reports on it once everything before it has been written.
+type outgoing struct {
+	b    []byte
+	done chan error
+}
+
+// Serve speaks the protocol on conn until the client closes the stream or
+// the connection fails
+func (s *Server) Serve(conn net.Conn) error {
+	ss := &session{Server: s, conn: conn, incoming: xml.NewDecoder(conn), out: make(chan outgoing, sendBuffer)}
+	go ss.writeOut()
+	defer func() {
+		// keep reading while the last writes go out, so that a client
+		// writing as it hangs up, as tls does with close_notify, can't
+		// block them
+		go io.Copy(io.Discard, ss.conn)
+		ss.flush()
+		close(ss.out)
+		ss.conn.Close()
+	}()
+	for {
+		t, err := ss.incoming.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "stream" && t.Name.Space == xmpp.NsStream {
+				if err := ss.openStream(); err != nil {
+					return err
+				}
+				continue
+			}
+			var raw struct {
+				Inner []byte `xml:",innerxml"`
+			}
+			if err := ss.incoming.DecodeElement(&raw, &t); err != nil {
+				return err
+			}
+			st := &xmpp.Stanza{Name: t.Name, Attr: xmpp.ToMap(t.Attr), Inner: raw.Inner}
+			s.mu.Lock()
+			s.received = append(s.received, st)
+			if h := s.handled[ss.smID]; h != nil && t.Name.Space == xmpp.NsJabberClient {
+				*h++
+			}
+			s.mu.Unlock()
+			if err := ss.handle(st); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			if t.Name.Local == "stream" {
+				return ss.write(xmlStreamClose)
+			}
+		}
+	}
+}
+
+// write queues the formatted stanza for the client, returning the error of
+// an earlier write that failed
+func (ss *session) write(format string, a ...interface{}) error {
+	ss.mu.Lock()
+	err := ss.werr
+	ss.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	ss.out <- outgoing{b: []byte(fmt.Sprintf(format, a...))}
+	return nil
+}
+
+// flush waits until everything queued has been written
+func (ss *session) flush() error {
+	done := make(chan error, 1)
+	ss.out <- outgoing{done: done}
+	return <-done
+}
+
+// writeOut writes what the session queues to its conn until out is closed
+func (ss *session) writeOut() {
+	for o := range ss.out {
+		ss.mu.Lock()
+		err := ss.werr
+		ss.mu.Unlock()
+		if o.done != nil {
+			o.done <- err
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, err := ss.conn.Write(o.b); err != nil {
+			ss.mu.Lock()
+			ss.werr = err
+			ss.mu.Unlock()
+		}
+	}
+}
+
+func (ss *session) openStream() error {
+	ss.streams++
+	if err := ss.write(xmlStream, ss.Domain, fmt.Sprintf("s%d", ss.streams), xmpp.NsJabberClient, xmpp.NsStream); err != nil {
+		return err
+	}
+
+	var f string
+	switch {
+	case ss.TLSConfig != nil && !ss.tls:
+		f = fmt.Sprintf(xmlStartTLS, xmpp.NsTLS)
+	case !ss.authed:
+		f = fmt.Sprintf(xmlMechanisms, xmpp.NsSASL)
+	default:
+		f = fmt.Sprintf(xmlBind, xmpp.NsBind)
+	}
+	if ss.Compression && !ss.compressed && (ss.TLSConfig == nil || ss.tls) {
+		f += xmlCompression
+	}
+	return ss.write(xmlFeatures, f)
+}
+
+func (ss *session) handle(st *xmpp.Stanza) error {
+	if st.Name.Space == xmpp.NsSM {
+		return ss.handleSM(st)
+	}
+	switch st.Name.Local {
+	case "starttls":
+		if err := ss.write(xmlProceed, xmpp.NsTLS); err != nil {
+			return err
+		}
+		// the proceed must go out in the clear before the handshake
+		if err := ss.flush(); err != nil {
+			return err
+		}
+		tc := tls.Server(ss.conn, ss.TLSConfig)
+		ss.conn, ss.incoming, ss.tls = tc, xml.NewDecoder(tc), true
+	case "compress":
+		if !ss.Compression {
+			return nil
+		}
+		if err := ss.write(xmlCompressed, xmpp.NsCompress); err != nil {
+			return err
+		}
+		// the answer goes out uncompressed, and everything after it
+		// compressed
+		if err := ss.flush(); err != nil {
+			return err
+		}
+		zc := &zlibConn{Conn: ss.conn, zw: zlib.NewWriter(ss.conn)}
+		ss.conn, ss.incoming, ss.compressed = zc, xml.NewDecoder(zc), true
+	case "auth":
+		var creds string
+		if err := unmarshal(st, &creds); err != nil {
+			return err
+		}
+		b, _ := base64.StdEncoding.DecodeString(creds)
+		parts := strings.Split(string(b), "\x00")
+		if len(parts) != 3 || !ss.allowed(parts[1], parts[2]) {
+			return ss.write(xmlFailure, xmpp.NsSASL)
+		}
+		ss.user, ss.authed = parts[1], true
+		return ss.write(xmlSuccess, xmpp.NsSASL)
+	case "iq":
+		return ss.handleIQ(st)
+	case "presence":
+		to := st.Attr["to"]
+		if !strings.Contains(to, "/") || !strings.Contains(string(st.Inner), xmpp.NsMuc) {
+			return nil
+		}
+		return ss.write(xmlSelfPresence, html.EscapeString(to), html.EscapeString(ss.jid), xmpp.NsMucUser)
+	case "message":
+		if st.Attr["type"] != "groupchat" {
+			return nil
+		}
+		var m struct {
+			Body string `xml:"body"`
+		}
+		if err := unmarshal(st, &m); err != nil {
+			return err
+		}
+		from := st.Attr["to"] + "/" + ss.user
+		return ss.write(xmlEcho, html.EscapeString(from), html.EscapeString(ss.jid), html.EscapeString(st.Attr["id"]), html.EscapeString(m.Body))
+	}
+	return nil
+}
+
+func (ss *session) handleIQ(st *xmpp.Stanza) error {
+	id := html.EscapeString(st.Attr["id"])
+	inner := string(st.Inner)
+	switch {
+	case strings.Contains(inner, xmpp.NsBind):
+		var b struct {
+			Resource string `xml:"bind>resource"`
+		}
+		if err := unmarshal(st, &b); err != nil {
+			return err
+		}
+		if b.Resource == "" {
+			b.Resource = "xmpptest"
+		}
+		ss.jid = ss.user + "@" + ss.Domain + "/" + b.Resource
+		return ss.write(xmlBindResult, id, xmpp.NsBind, html.EscapeString(ss.jid))
+	case strings.Contains(inner, xmpp.NsIqAuth):
+		var a struct {
+			Username string `xml:"query>username"`
+			Password string `xml:"query>password"`
+			Resource string `xml:"query>resource"`
+		}
+		if err := unmarshal(st, &a); err != nil {
+			return err
+		}
+		if !ss.allowed(a.Username, a.Password) {
+			return ss.write("<iq type='error' id='%s'><error type='auth'><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>", id)
+		}
+		ss.user, ss.authed = a.Username, true
+		ss.jid = a.Username + "@" + ss.Domain + "/" + a.Resource
+		return ss.write(xmlResult, id)
+	case strings.Contains(inner, xmpp.NsIqRoster):
+		return ss.write(xmlRosterResult, id, xmpp.NsIqRoster)
+	}
+	if t := st.Attr["type"]; t == "get" || t == "set" {
+		return ss.write(xmlResult, id)
+	}
+	return nil
+}
+
+// handleSM answers stream management requests
+func (ss *session) handleSM(st *xmpp.Stanza) error {
+	ss.mu.Lock()
+	var reply string
+	switch st.Name.Local {
+	case "enable":
+		if ss.handled == nil {
+			ss.handled = make(map[string]*uint32)
+		}
+		ss.smID = fmt.Sprintf("sm%d", len(ss.handled)+1)
+		ss.handled[ss.smID] = new(uint32)
+		reply = fmt.Sprintf(xmlSMEnabled, xmpp.NsSM, ss.smID)
+	case "resume":
+		id := st.Attr["previd"]
+		if h := ss.handled[id]; h != nil && !ss.NoResume {
+			ss.smID = id
+			reply = fmt.Sprintf(xmlSMResumed, xmpp.NsSM, html.EscapeString(id), *h)
+		} else {
+			reply = fmt.Sprintf(xmlSMFailed, xmpp.NsSM)
+		}
+	case "r":
+		if h := ss.handled[ss.smID]; h != nil {
+			reply = fmt.Sprintf(xmlSMAck, xmpp.NsSM, *h)
+		}
+	}
+	ss.mu.Unlock()
+	if reply == "" {
+		return nil
+	}
+	return ss.write("%s", reply)
+}
+
+func (ss *session) allowed(user, pass string) bool {
+	if ss.Users == nil {
+		return true
+	}
+	want, ok := ss.Users[user]
+	return ok && want == pass
+}
+
+// unmarshal decodes the children of st into v
+// zlibConn is a connection compressed with zlib, each write flushed so that
+// nothing is held back in the compressor
+type zlibConn struct {
+	net.Conn
+	zw *zlib.Writer
+	// zr is created with the first read, as the client sends nothing
+	// compressed until it has the answer to its request
+	zr io.ReadCloser
+}
+
+func (z *zlibConn) Read(p []byte) (int, error) {
+	if z.zr == nil {
+		zr, err := zlib.NewReader(z.Conn)
+		if err != nil {
+			return 0, err
+		}
+		z.zr = zr
+	}
+	return z.zr.Read(p)
+}
+
+func (z *zlibConn) Write(p []byte) (int, error) {
+	n, err := z.zw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, z.zw.Flush()
+}
+
+func unmarshal(st *xmpp.Stanza, v interface{}) error {
+	b := "<" + st.Name.Local + ">" + string(st.Inner) + "</" + st.Name.Local + ">"
+	return xml.Unmarshal([]byte(b), v)
+}